@@ -0,0 +1,82 @@
+#ifndef IMAGE_PROCESSOR_FRAME_STREAM_HPP
+#define IMAGE_PROCESSOR_FRAME_STREAM_HPP
+
+#include <cstdint>
+#include <cstdio>
+#include <opencv2/opencv.hpp>
+
+// A frame stream is a sequence of frames, each one is a 12 byte little endian header holding the width,
+// the height and the delay in 100s of a second followed by width * height * 4 bytes of RGBA pixels.
+// The stream ends at EOF, go/internal/rawframe is the implementation used by the worker.
+
+#define FRAME_STREAM_HEADER_SIZE 12
+#define FRAME_STREAM_MAX_FRAME_BYTES (1ULL << 30)
+
+inline void frameStreamPutUint32(uint8_t* buf, uint32_t v)
+{
+    buf[0] = v & 0xff;
+    buf[1] = (v >> 8) & 0xff;
+    buf[2] = (v >> 16) & 0xff;
+    buf[3] = (v >> 24) & 0xff;
+}
+
+inline uint32_t frameStreamUint32(const uint8_t* buf)
+{
+    return uint32_t(buf[0]) | (uint32_t(buf[1]) << 8) | (uint32_t(buf[2]) << 16) | (uint32_t(buf[3]) << 24);
+}
+
+enum FrameStreamResult {
+    FRAME_STREAM_OK = 0,
+    FRAME_STREAM_EOF = 1,
+    FRAME_STREAM_ERROR = 2,
+};
+
+// readFrame reads the next frame into a CV_8UC4 mat, FRAME_STREAM_EOF is returned when the stream ends between frames.
+inline FrameStreamResult readFrame(std::FILE* in, cv::Mat& frame, int& delay)
+{
+    uint8_t header[FRAME_STREAM_HEADER_SIZE];
+
+    auto n = std::fread(header, 1, FRAME_STREAM_HEADER_SIZE, in);
+    if (n == 0 && std::feof(in)) {
+        return FRAME_STREAM_EOF;
+    }
+    if (n != FRAME_STREAM_HEADER_SIZE) {
+        return FRAME_STREAM_ERROR;
+    }
+
+    auto width = frameStreamUint32(header);
+    auto height = frameStreamUint32(header + 4);
+    delay = int(frameStreamUint32(header + 8));
+
+    if (width == 0 || height == 0 || uint64_t(width) * uint64_t(height) * 4 > FRAME_STREAM_MAX_FRAME_BYTES) {
+        return FRAME_STREAM_ERROR;
+    }
+
+    frame.create(int(height), int(width), CV_8UC4);
+    if (std::fread(frame.data, 1, frame.total() * 4, in) != frame.total() * 4) {
+        return FRAME_STREAM_ERROR;
+    }
+
+    return FRAME_STREAM_OK;
+}
+
+// writeFrame writes a CV_8UC4 mat, the mat must be continuous.
+inline bool writeFrame(std::FILE* out, const cv::Mat& frame, int delay)
+{
+    if (frame.type() != CV_8UC4 || !frame.isContinuous()) {
+        return false;
+    }
+
+    uint8_t header[FRAME_STREAM_HEADER_SIZE];
+    frameStreamPutUint32(header, uint32_t(frame.cols));
+    frameStreamPutUint32(header + 4, uint32_t(frame.rows));
+    frameStreamPutUint32(header + 8, uint32_t(delay));
+
+    if (std::fwrite(header, 1, FRAME_STREAM_HEADER_SIZE, out) != FRAME_STREAM_HEADER_SIZE) {
+        return false;
+    }
+
+    return std::fwrite(frame.data, 1, frame.total() * 4, out) == frame.total() * 4;
+}
+
+#endif
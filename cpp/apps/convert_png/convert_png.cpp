@@ -12,12 +12,13 @@
 #include <webp/mux.h>
 
 #include "convert_png.hpp"
+#include "frame_stream.hpp"
 
-#define NEXTARG()                                                     \
-    if (((argIndex + 1) == argc) || (argv[argIndex + 1][0] == '-')) { \
-        std::cerr << arg << " requires an argument." << std::endl;    \
-        return EXIT_FAILURE;                                          \
-    }                                                                 \
+#define NEXTARG()                                                                                      \
+    if (((argIndex + 1) == argc) || (argv[argIndex + 1][0] == '-' && argv[argIndex + 1][1] != '\0')) { \
+        std::cerr << arg << " requires an argument." << std::endl;                                     \
+        return EXIT_FAILURE;                                                                           \
+    }                                                                                                  \
     arg = std::string(argv[++argIndex])
 
 void syntax()
@@ -28,7 +29,7 @@ void syntax()
               << "Options:" << std::endl
               << "  -h,--help                   : Shows syntax help" << std::endl
               << "  -i,--input FILENAME         : Input file location (supported "
-                 "types are png)."
+                 "types are png), - reads a raw frame stream with the delays of every frame from stdin."
               << std::endl
               << "  -t,--threads THREADS        : The number of threads to use." << std::endl
               << "  -o,--output FILENAME        : Output file location "
@@ -37,6 +38,9 @@ void syntax()
               << "  -d,--delay D                : Delay of the next frame in "
                  "100s of a second. (default 4 = 40ms)"
               << std::endl
+              << "  -q,--quality Q              : Encoding quality from 1 to 100, "
+                 "lower values produce smaller files. (default 100)"
+              << std::endl
               << std::endl;
 }
 
@@ -52,9 +56,31 @@ bool equal(const cv::Mat& a, const cv::Mat& b)
     return (s[0] == 0) && (s[1] == 0) && (s[2] == 0) && (s[3] == 0);
 }
 
+// addInput appends the frame to the inputs unless it is the same as the last frame, then the delays are merged
+void addInput(std::vector<File>& inputs, File f, int& width, int& height)
+{
+    // in theory because of how we deduplicate frames here to optimize encoding,
+    // people could upload a 2 frame emote where both frames are the same and it would produce single frame animated emotes.
+    // however this is likely not an issue as not many people do this and also it wouldnt really break anything (i think).
+    if (inputs.size() != 0) {
+        auto lastInput = inputs[inputs.size() - 1];
+        if (equal(lastInput.data, f.data)) {
+            lastInput.delay += f.delay;
+            inputs[inputs.size() - 1] = lastInput;
+            return;
+        }
+    }
+
+    auto size = f.data.size();
+    width = size.width;
+    height = size.height;
+    inputs.push_back(f);
+}
+
 int main(int argc, char* argv[])
 {
     int delay = 4;
+    int quality = 100;
 
     std::vector<File> inputs;
     std::vector<Output> outputs;
@@ -83,6 +109,14 @@ int main(int argc, char* argv[])
                           << std::endl;
                 return EXIT_FAILURE;
             }
+        } else if (arg == "--quality" || arg == "-q") {
+            NEXTARG();
+            quality = std::atoi(arg.c_str());
+            if (quality <= 0 || quality > 100) {
+                std::cerr << "\"" << arg << "\" is not a valid value for quality."
+                          << std::endl;
+                return EXIT_FAILURE;
+            }
         } else if (arg == "--help" || arg == "-h") {
             syntax();
             return EXIT_FAILURE;
@@ -107,6 +141,28 @@ int main(int argc, char* argv[])
             outputs.push_back(output);
         } else if (arg == "--input" || arg == "-i") {
             NEXTARG();
+            if (arg == "-") {
+                // the frames come decoded as rgba so there is no png to read
+                while (true) {
+                    File f;
+                    auto res = readFrame(stdin, f.data, f.delay);
+                    if (res == FRAME_STREAM_EOF) {
+                        break;
+                    } else if (res != FRAME_STREAM_OK) {
+                        std::cerr << "Invalid frame #" << inputs.size() << " in the input stream." << std::endl;
+                        return EXIT_FAILURE;
+                    }
+
+                    if (f.delay <= 0) {
+                        f.delay = delay;
+                    }
+
+                    addInput(inputs, f, width, height);
+                }
+
+                goto loop;
+            }
+
             if (std::filesystem::path(arg).extension() != ".png") {
                 std::cerr << "\"" << arg
                           << "\" is an unsupported file type for an input image."
@@ -123,22 +179,7 @@ int main(int argc, char* argv[])
                 return EXIT_FAILURE;
             }
 
-            // in theory because of how we deduplicate frames here to optimize encoding,
-            // people could upload a 2 frame emote where both frames are the same and it would produce single frame animated emotes.
-            // however this is likely not an issue as not many people do this and also it wouldnt really break anything (i think).
-            if (inputs.size() != 0) {
-                auto lastInput = inputs[inputs.size() - 1];
-                if (equal(lastInput.data, f.data)) {
-                    lastInput.delay += f.delay;
-                    inputs[inputs.size() - 1] = lastInput;
-                    goto loop;
-                }
-            }
-
-            auto size = f.data.size();
-            width = size.width;
-            height = size.height;
-            inputs.push_back(f);
+            addInput(inputs, f, width, height);
         } else {
             std::cerr << "\"" << arg << "\" is an unknown argument." << std::endl;
             return EXIT_FAILURE;
@@ -165,10 +206,12 @@ int main(int argc, char* argv[])
             auto encoder = avifEncoderCreate();
 
             encoder->maxThreads = threads;
-            encoder->minQuantizer = 5;
-            encoder->maxQuantizer = 20;
-            encoder->minQuantizerAlpha = 0;
-            encoder->maxQuantizerAlpha = 10;
+            // quality 100 keeps the default quantizers, anything lower moves them towards AVIF_QUANTIZER_WORST_QUALITY
+            auto loss = 100 - quality;
+            encoder->minQuantizer = std::min(AVIF_QUANTIZER_WORST_QUALITY, 5 + loss * 40 / 100);
+            encoder->maxQuantizer = std::min(AVIF_QUANTIZER_WORST_QUALITY, 20 + loss * 43 / 100);
+            encoder->minQuantizerAlpha = std::min(AVIF_QUANTIZER_WORST_QUALITY, loss * 40 / 100);
+            encoder->maxQuantizerAlpha = std::min(AVIF_QUANTIZER_WORST_QUALITY, 10 + loss * 43 / 100);
             encoder->tileColsLog2 = 2;
             encoder->tileRowsLog2 = 2;
             encoder->speed = 4;
@@ -248,6 +291,12 @@ int main(int argc, char* argv[])
             config.quality = 85;
             config.lossless = 1;
             config.alpha_quality = 85;
+            if (quality < 100) {
+                // lossless webp cannot be made smaller, so we switch to lossy encoding
+                config.lossless = 0;
+                config.quality = quality;
+                config.alpha_quality = quality;
+            }
             config.thread_level = threads > 1 ? 1 : 0;
 
             auto ok = WebPValidateConfig(&config);
@@ -345,7 +394,7 @@ int main(int argc, char* argv[])
             WebPMemoryWriterClear(&memory_writer);
         } else if (output.type == OutputType::GIF) {
             GifskiSettings settings;
-            settings.quality = 95;
+            settings.quality = std::min(95, quality);
             settings.fast = false;
             settings.height = height;
             settings.width = width;
@@ -8,11 +8,13 @@
 #include <vector>
 #include <webp/demux.h>
 
-#define NEXTARG()                                                     \
-    if (((argIndex + 1) == argc) || (argv[argIndex + 1][0] == '-')) { \
-        std::cerr << arg << " requires an argument." << std::endl;    \
-        return EXIT_FAILURE;                                          \
-    }                                                                 \
+#include "frame_stream.hpp"
+
+#define NEXTARG()                                                                                      \
+    if (((argIndex + 1) == argc) || (argv[argIndex + 1][0] == '-' && argv[argIndex + 1][1] != '\0')) { \
+        std::cerr << arg << " requires an argument." << std::endl;                                     \
+        return EXIT_FAILURE;                                                                           \
+    }                                                                                                  \
     arg = std::string(argv[++argIndex])
 
 void syntax()
@@ -24,7 +26,7 @@ void syntax()
               << "  -i,--input FILENAME         : Input file location (supported "
                  "types are webp and avif)."
               << std::endl
-              << "  -o,--output FOLDER          : Output folder"
+              << "  -o,--output FOLDER          : Output folder, - writes a raw frame stream to stdout instead"
               << std::endl
               << "  --info                      : Only output info dont dump the images"
               << std::endl
@@ -77,6 +79,7 @@ int main(int argc, char* argv[])
     std::string output;
 
     bool isAvif, isWebp, onlyInfo;
+    bool stream = false;
 
     int argIndex = 1;
     while (argIndex < argc) {
@@ -89,6 +92,7 @@ int main(int argc, char* argv[])
             NEXTARG();
 
             output = arg;
+            stream = output == "-";
         } else if (arg == "--info") {
             onlyInfo = true;
         } else if (arg == "--input" || arg == "-i") {
@@ -141,9 +145,11 @@ int main(int argc, char* argv[])
         }
 
         cv::Mat frame(animInfo.canvas_height, animInfo.canvas_width, CV_8UC4);
-        std::cout << "width,height,frame_count" << std::endl
-                  << animInfo.canvas_width << "," << animInfo.canvas_height << "," << animInfo.frame_count << std::endl;
-        std::cout << "frame_idx,delay" << std::endl;
+        if (!stream) {
+            std::cout << "width,height,frame_count" << std::endl
+                      << animInfo.canvas_width << "," << animInfo.canvas_height << "," << animInfo.frame_count << std::endl;
+            std::cout << "frame_idx,delay" << std::endl;
+        }
         while (WebPAnimDecoderHasMoreFrames(dec)) {
             int timestamp;
 
@@ -158,9 +164,18 @@ int main(int argc, char* argv[])
             }
 
             auto duration = timestamp - prevFrameTimestamp;
-            std::cout << frameIndex << "," << duration / 10 << std::endl;
 
-            if (!onlyInfo) {
+            if (stream) {
+                // the decoder gives us rgba which is what the stream carries
+                if (!writeFrame(stdout, frame, duration / 10)) {
+                    std::cerr << "\"" << input << "\" failed to write frame #" << frameIndex << std::endl;
+                    return EXIT_FAILURE;
+                }
+            } else {
+                std::cout << frameIndex << "," << duration / 10 << std::endl;
+            }
+
+            if (!onlyInfo && !stream) {
                 sprintf(buffer, "%04d.png", frameIndex);
 
                 auto filename = std::filesystem::path(output) / buffer;
@@ -193,9 +208,11 @@ int main(int argc, char* argv[])
             return EXIT_FAILURE;
         }
 
-        std::cout << "width,height,frame_count" << std::endl
-                  << decoder->image->width << "," << decoder->image->height << "," << decoder->imageCount << std::endl;
-        std::cout << "frame_idx,delay" << std::endl;
+        if (!stream) {
+            std::cout << "width,height,frame_count" << std::endl
+                      << decoder->image->width << "," << decoder->image->height << "," << decoder->imageCount << std::endl;
+            std::cout << "frame_idx,delay" << std::endl;
+        }
 
         cv::Mat frame(decoder->image->height, decoder->image->width, CV_8UC4);
 
@@ -209,9 +226,16 @@ int main(int argc, char* argv[])
                 return EXIT_FAILURE;
             }
 
-            std::cout << frameIndex << "," << decoder->imageTiming.duration * 100 << std::endl;
+            if (stream) {
+                if (!writeFrame(stdout, frame, int(decoder->imageTiming.duration * 100))) {
+                    std::cerr << "\"" << input << "\" failed to write frame #" << frameIndex << std::endl;
+                    return EXIT_FAILURE;
+                }
+            } else {
+                std::cout << frameIndex << "," << decoder->imageTiming.duration * 100 << std::endl;
+            }
 
-            if (!onlyInfo) {
+            if (!onlyInfo && !stream) {
                 sprintf(buffer, "%04d.png", frameIndex);
                 auto filename = std::filesystem::path(output) / buffer;
 
@@ -226,5 +250,10 @@ int main(int argc, char* argv[])
         avifDecoderDestroy(decoder);
     }
 
+    if (stream && std::fflush(stdout) != 0) {
+        std::cerr << "\"" << input << "\" failed to flush the frame stream." << std::endl;
+        return EXIT_FAILURE;
+    }
+
     return EXIT_SUCCESS;
 }
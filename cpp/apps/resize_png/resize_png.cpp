@@ -6,13 +6,14 @@
 #include <thread>
 #include <vector>
 
+#include "frame_stream.hpp"
 #include "resize_png.hpp"
 
-#define NEXTARG()                                                     \
-    if (((argIndex + 1) == argc) || (argv[argIndex + 1][0] == '-')) { \
-        std::cerr << arg << " requires an argument." << std::endl;    \
-        return EXIT_FAILURE;                                          \
-    }                                                                 \
+#define NEXTARG()                                                                                      \
+    if (((argIndex + 1) == argc) || (argv[argIndex + 1][0] == '-' && argv[argIndex + 1][1] != '\0')) { \
+        std::cerr << arg << " requires an argument." << std::endl;                                     \
+        return EXIT_FAILURE;                                                                           \
+    }                                                                                                  \
     arg = std::string(argv[++argIndex])
 
 void syntax()
@@ -36,9 +37,150 @@ void syntax()
               << "  -o,--output FILENAME        : Output filename."
                  " (supported types are png)."
               << std::endl
+              << "  --stream                    : Read a raw frame stream from stdin instead of inputs"
+                 " and write a raw frame stream to every output."
+              << std::endl
               << std::endl;
 }
 
+// fixTransparency corrects the colour of the transparent pixels so that resizing doesnt make weird artifacts
+void fixTransparency(cv::Mat& image)
+{
+    if (image.channels() != 4) {
+        return;
+    }
+
+    std::vector<cv::Mat> channels;
+    cv::split(image, channels); // break image into channels
+
+    auto alpha = channels[3]; // get the alpha channel
+
+    cv::Mat noAlpha;
+
+    channels.pop_back();
+    cv::merge(channels, noAlpha);
+
+    cv::Mat adj;
+    cv::dilate(alpha, adj, cv::Mat(), cv::Point(-1, -1), 3);
+
+    cv::inpaint(noAlpha, alpha == 0 & adj, noAlpha, 1, cv::INPAINT_TELEA); // inpaint the alpha channel
+    adj.release();
+
+    cv::split(noAlpha, channels); // split the image back into channels
+    noAlpha.release();
+
+    channels.push_back(alpha); // add the alpha channel back into the channels
+
+    cv::merge(channels, image); // merge the channels back into an image
+    for (auto& channel : channels) {
+        channel.release();
+    }
+}
+
+// resizeImage pads the image to the new aspect ratio according to the resize ratio and then resizes it
+cv::Mat resizeImage(const cv::Mat& input, int width, int height, int resizeRatio)
+{
+    cv::Mat img = input;
+    auto newSize = cv::Size(width, height);
+
+    if (resizeRatio != 1) {
+        auto currentSize = input.size();
+
+        auto currentRatio = currentSize.aspectRatio();
+        auto newRatio = newSize.aspectRatio();
+        if (currentRatio != newRatio) {
+            cv::Mat padded;
+
+            if (currentRatio < newRatio) { // means that width is too small
+                padded.create(input.rows, int(double(input.rows) * newRatio), input.type());
+            } else { // means that height is too small
+                padded.create(int(double(input.cols) / newRatio), input.cols, input.type());
+            }
+
+            padded.setTo(cv::Scalar::all(0));
+
+            int x;
+            int y;
+
+            if (resizeRatio == 2) {
+                x = 0;
+                y = 0;
+            } else if (resizeRatio == 3) {
+                x = padded.cols - input.cols;
+                y = 0;
+            } else if (resizeRatio == 4) {
+                x = 0;
+                y = padded.rows - input.rows;
+            } else if (resizeRatio == 5) {
+                x = padded.cols - input.cols;
+                y = padded.rows - input.rows;
+            } else if (resizeRatio == 6) {
+                x = (padded.cols - input.cols) / 2;
+                y = (padded.rows - input.rows) / 2;
+            }
+
+            input.copyTo(padded(cv::Rect(x, y, input.cols, input.rows)));
+
+            img = padded;
+        }
+    }
+
+    cv::Mat resized;
+    cv::resize(img, resized, newSize, 0, 0, cv::INTER_AREA);
+
+    return resized;
+}
+
+// streamResize resizes every frame of the stream on stdin into the frame streams of the outputs
+int streamResize(std::vector<Output>& outputs)
+{
+    std::vector<std::FILE*> files;
+    for (auto& output : outputs) {
+        auto file = std::fopen(output.path.c_str(), "wb");
+        if (!file) {
+            std::cerr << "\"" << output.path << "\" failed to open output." << std::endl;
+            return EXIT_FAILURE;
+        }
+
+        files.push_back(file);
+    }
+
+    cv::Mat frame;
+    int delay;
+    int frameIndex = 0;
+
+    while (true) {
+        auto res = readFrame(stdin, frame, delay);
+        if (res == FRAME_STREAM_EOF) {
+            break;
+        } else if (res != FRAME_STREAM_OK) {
+            std::cerr << "Invalid frame #" << frameIndex << " in the input stream." << std::endl;
+            return EXIT_FAILURE;
+        }
+
+        fixTransparency(frame);
+
+        for (size_t i = 0; i < outputs.size(); i++) {
+            auto resized = resizeImage(frame, outputs[i].width, outputs[i].height, outputs[i].resizeRatio);
+            if (!writeFrame(files[i], resized, delay)) {
+                std::cerr << "\"" << outputs[i].path << "\" failed to write frame #" << frameIndex << std::endl;
+                return EXIT_FAILURE;
+            }
+        }
+
+        frameIndex++;
+    }
+
+    for (size_t i = 0; i < files.size(); i++) {
+        if (std::fclose(files[i]) != 0) {
+            std::cerr << "\"" << outputs[i].path << "\" failed to close output." << std::endl;
+            return EXIT_FAILURE;
+        }
+    }
+
+    return EXIT_SUCCESS;
+}
+
 int main(int argc, char* argv[])
 {
     std::vector<Output> outputs;
@@ -46,6 +188,7 @@ int main(int argc, char* argv[])
     File currentInput;
     int currentWidth, currentHeight;
     int resizeRatio = 1;
+    bool stream = false;
 
     int argIndex = 1;
     while (argIndex < argc) {
@@ -62,8 +205,10 @@ int main(int argc, char* argv[])
                 std::cerr << "Invalid resize ratio: " << arg << std::endl;
                 return EXIT_FAILURE;
             }
+        } else if (arg == "--stream") {
+            stream = true;
         } else if (arg == "--output" || arg == "-o") {
-            if (!currentInput.data.data) {
+            if (!stream && !currentInput.data.data) {
                 std::cerr << "\"" << arg
                           << "\" You must provide an input before specifying an output."
                           << std::endl;
@@ -91,6 +236,12 @@ int main(int argc, char* argv[])
             outputs.push_back(output);
         } else if (arg == "--input" || arg == "-i") {
             NEXTARG();
+            if (stream) {
+                std::cerr << "\"" << arg
+                          << "\" Inputs can not be used with --stream."
+                          << std::endl;
+                return EXIT_FAILURE;
+            }
             if (std::filesystem::path(arg).extension() != ".png") {
                 std::cerr << "\"" << arg
                           << "\" is an unsupported file type for an input image."
@@ -111,36 +262,7 @@ int main(int argc, char* argv[])
                 return EXIT_FAILURE;
             }
 
-            if (currentInput.data.channels() == 4) {
-                // we need to correct the transparent pixels on this image so that resizing doesnt make weird artifacts
-                std::vector<cv::Mat> channels;
-                cv::split(currentInput.data, channels); // break image into channels
-
-                cv::Mat adjacent;
-
-                auto alpha = channels[3]; // get the alpha channel
-
-                cv::Mat noAlpha;
-
-                channels.pop_back();
-                cv::merge(channels, noAlpha);
-
-                cv::Mat adj;
-                cv::dilate(alpha, adj, cv::Mat(), cv::Point(-1, -1), 3);
-
-                cv::inpaint(noAlpha, alpha == 0 & adj, noAlpha, 1, cv::INPAINT_TELEA); // inpaint the alpha channel
-                adj.release();
-
-                cv::split(noAlpha, channels); // split the image back into channels
-                noAlpha.release();
-
-                channels.push_back(alpha); // add the alpha channel back into the channels
-
-                cv::merge(channels, currentInput.data); // merge the channels back into an image
-                for (auto& channel : channels) {
-                    channel.release();
-                }
-            }
+            fixTransparency(currentInput.data);
         } else if (arg == "--resize" || arg == "-r") {
             NEXTARG();
             currentWidth = std::stoi(arg);
@@ -175,53 +297,12 @@ int main(int argc, char* argv[])
         return EXIT_FAILURE;
     }
 
-    for (auto output : outputs) {
-        cv::Mat img = output.input.data;
-        auto newSize = cv::Size(output.width, output.height);
-
-        if (output.resizeRatio != 1) {
-            auto currentSize = output.input.data.size();
-
-            auto currentRatio = currentSize.aspectRatio();
-            auto newRatio = newSize.aspectRatio();
-            if (currentRatio != newRatio) {
-                cv::Mat padded;
-
-                if (currentRatio < newRatio) { // means that width is too small
-                    padded.create(img.rows, int(double(img.rows) * newRatio), img.type());
-                } else { // means that height is too small
-                    padded.create(int(double(img.cols) / newRatio), img.cols, img.type());
-                }
-
-                padded.setTo(cv::Scalar::all(0));
-
-                int x;
-                int y;
-
-                if (output.resizeRatio == 2) {
-                    x = 0;
-                    y = 0;
-                } else if (output.resizeRatio == 3) {
-                    x = padded.cols - img.cols;
-                    y = 0;
-                } else if (output.resizeRatio == 4) {
-                    x = 0;
-                    y = padded.rows - img.rows;
-                } else if (output.resizeRatio == 5) {
-                    x = padded.cols - img.cols;
-                    y = padded.rows - img.rows;
-                } else if (output.resizeRatio == 6) {
-                    x = (padded.cols - img.cols) / 2;
-                    y = (padded.rows - img.rows) / 2;
-                }
-
-                img.copyTo(padded(cv::Rect(x, y, img.cols, img.rows)));
-
-                output.input.data = padded;
-            }
-        }
+    if (stream) {
+        return streamResize(outputs);
+    }
 
-        cv::resize(output.input.data, img, newSize, 0, 0, cv::INTER_AREA);
+    for (auto output : outputs) {
+        auto img = resizeImage(output.input.data, output.width, output.height, output.resizeRatio);
         cv::imwrite(output.path, img);
         img.release();
     }
@@ -13,13 +13,14 @@ import (
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/bugsnag/panicwrap"
-	"github.com/seventv/common/svc/s3"
+	commons3 "github.com/seventv/common/svc/s3"
 	"github.com/seventv/image-processor/go/internal/configure"
 	"github.com/seventv/image-processor/go/internal/global"
 	"github.com/seventv/image-processor/go/internal/health"
 	"github.com/seventv/image-processor/go/internal/image_processor"
 	"github.com/seventv/image-processor/go/internal/monitoring"
 	"github.com/seventv/image-processor/go/internal/svc/prometheus"
+	"github.com/seventv/image-processor/go/internal/svc/storage"
 	messagequeue "github.com/seventv/message-queue/go"
 	"go.uber.org/zap"
 )
@@ -99,14 +100,35 @@ func main() {
 	}
 
 	{
-		gCtx.Inst().S3, err = s3.New(gCtx, s3.Options{
-			Region:      config.S3.Region,
-			Endpoint:    config.S3.Endpoint,
-			AccessToken: config.S3.AccessToken,
-			SecretKey:   config.S3.SecretKey,
+		profiles := map[string]storage.Options{}
+		for name, profile := range config.Storage.Profiles {
+			profiles[name] = storage.Options{
+				Backend:   profile.Backend,
+				Buckets:   profile.Buckets,
+				LocalRoot: profile.Local.Root,
+				S3: commons3.Options{
+					Region:      profile.S3.Region,
+					Endpoint:    profile.S3.Endpoint,
+					AccessToken: profile.S3.AccessToken,
+					SecretKey:   profile.S3.SecretKey,
+				},
+			}
+		}
+
+		gCtx.Inst().Storage, err = storage.New(gCtx, storage.Options{
+			Backend:   config.Storage.Backend,
+			Buckets:   config.Storage.Buckets,
+			LocalRoot: config.Storage.Local.Root,
+			S3: commons3.Options{
+				Region:      config.S3.Region,
+				Endpoint:    config.S3.Endpoint,
+				AccessToken: config.S3.AccessToken,
+				SecretKey:   config.S3.SecretKey,
+			},
+			Profiles: profiles,
 		})
 		if err != nil {
-			zap.S().Fatalw("failed to setup s3 handler",
+			zap.S().Fatalw("failed to setup storage handler",
 				"error", err,
 			)
 		}
@@ -138,6 +160,9 @@ func main() {
 		}()
 	}
 
+	processed := image_processor.Run(gCtx)
+	zap.S().Info("running")
+
 	done := make(chan struct{})
 
 	go func() {
@@ -155,13 +180,11 @@ func main() {
 		zap.S().Info("shutting down")
 
 		wg.Wait()
+		<-processed
 
 		close(done)
 	}()
 
-	image_processor.Run(gCtx)
-	zap.S().Info("running")
-
 	<-done
 
 	zap.S().Info("shutdown")
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"reflect"
 	"strings"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/spf13/pflag"
@@ -91,6 +92,15 @@ func bindEnvs(config *viper.Viper, iface interface{}, parts ...string) {
 	}
 }
 
+type WorkerPipeline string
+
+const (
+	// WorkerPipelineAuto uses the native pipeline for static images when the external tools are not installed
+	WorkerPipelineAuto   WorkerPipeline = "auto"
+	WorkerPipelineExec   WorkerPipeline = "exec"
+	WorkerPipelineNative WorkerPipeline = "native"
+)
+
 type MessageQueueMode string
 
 const (
@@ -104,9 +114,45 @@ type Config struct {
 	NoHeader   bool   `mapstructure:"noheader" json:"noheader"`
 
 	Worker struct {
-		Jobs             int    `mapstructure:"jobs" json:"jobs"`
-		ThreadsPerWorker int    `mapstructure:"threads_per_worker" json:"threads_per_worker"`
-		TempDir          string `mapstructure:"temp_dir" json:"temp_dir"`
+		Jobs             int               `mapstructure:"jobs" json:"jobs"`
+		ThreadsPerWorker int               `mapstructure:"threads_per_worker" json:"threads_per_worker"`
+		TempDir          string            `mapstructure:"temp_dir" json:"temp_dir"`
+		MaxInputBytes    int64             `mapstructure:"max_input_bytes" json:"max_input_bytes"`
+		MaxInlineBytes   int64             `mapstructure:"max_inline_bytes" json:"max_inline_bytes"`
+		MaxTotalPixels   int64             `mapstructure:"max_total_pixels" json:"max_total_pixels"`
+		Pipeline         WorkerPipeline    `mapstructure:"pipeline" json:"pipeline"`
+		Decoders         map[string]string `mapstructure:"decoders" json:"decoders"`
+		Resizer          string            `mapstructure:"resizer" json:"resizer"`
+		Encoders         map[string]string `mapstructure:"encoders" json:"encoders"`
+		Optimizers       map[string]string `mapstructure:"optimizers" json:"optimizers"`
+		DisableStreaming bool              `mapstructure:"disable_streaming" json:"disable_streaming"`
+		Cache            struct {
+			Dir      string `mapstructure:"dir" json:"dir"`
+			MaxBytes int64  `mapstructure:"max_bytes" json:"max_bytes"`
+			Bucket   string `mapstructure:"bucket" json:"bucket"`
+			Prefix   string `mapstructure:"prefix" json:"prefix"`
+		} `mapstructure:"cache" json:"cache"`
+		HTTPInput struct {
+			Timeout               time.Duration `mapstructure:"timeout" json:"timeout"`
+			MaxRedirects          int           `mapstructure:"max_redirects" json:"max_redirects"`
+			UserAgent             string        `mapstructure:"user_agent" json:"user_agent"`
+			AllowPrivateAddresses bool          `mapstructure:"allow_private_addresses" json:"allow_private_addresses"`
+			BlockedNetworks       []string      `mapstructure:"blocked_networks" json:"blocked_networks"`
+		} `mapstructure:"http_input" json:"http_input"`
+		Webhook struct {
+			// URL receives the results of tasks without a callback url of their own
+			URL         string        `mapstructure:"url" json:"url"`
+			Secret      string        `mapstructure:"secret" json:"secret"`
+			Timeout     time.Duration `mapstructure:"timeout" json:"timeout"`
+			MaxAttempts int           `mapstructure:"max_attempts" json:"max_attempts"`
+			Backoff     time.Duration `mapstructure:"backoff" json:"backoff"`
+			MaxBackoff  time.Duration `mapstructure:"max_backoff" json:"max_backoff"`
+			// Concurrency is how many results are delivered at once, QueueSize how many wait before tasks wait for room
+			Concurrency int `mapstructure:"concurrency" json:"concurrency"`
+			QueueSize   int `mapstructure:"queue_size" json:"queue_size"`
+			// DrainTimeout is how long a stopping worker waits for its tasks and the queued results
+			DrainTimeout time.Duration `mapstructure:"drain_timeout" json:"drain_timeout"`
+		} `mapstructure:"webhook" json:"webhook"`
 	} `mapstructure:"worker" json:"worker"`
 
 	Health struct {
@@ -117,7 +163,11 @@ type Config struct {
 	MessageQueue struct {
 		Mode      MessageQueueMode `mapstructure:"mode" json:"mode"`
 		JobsQueue string           `mapstructure:"jobs_queue" json:"jobs_queue"`
-		RMQ       struct {
+		// EventsQueue receives the progress events of every task when it is set
+		EventsQueue string `mapstructure:"events_queue" json:"events_queue"`
+		// ControlQueue is where the worker receives control messages such as cancels, every worker needs its own
+		ControlQueue string `mapstructure:"control_queue" json:"control_queue"`
+		RMQ          struct {
 			URI                  string `mapstructure:"uri" json:"uri"`
 			MaxReconnectAttempts int    `mapstructure:"max_reconnect_attempts" json:"max_reconnect_attempts"`
 		} `mapstructure:"rmq" json:"rmq"`
@@ -129,11 +179,33 @@ type Config struct {
 		} `mapstructure:"sqs" json:"sqs"`
 	} `mapstructure:"message_queue" json:"message_queue"`
 
+	Storage struct {
+		// Backend stores the buckets without a mapping in buckets, s3 or local
+		Backend string `mapstructure:"backend" json:"backend"`
+		Local   struct {
+			Root string `mapstructure:"root" json:"root"`
+		} `mapstructure:"local" json:"local"`
+		// Buckets maps bucket names to the backend they are stored in
+		Buckets map[string]string `mapstructure:"buckets" json:"buckets"`
+		// Profiles are other storages the replicas of a task can be written to, e.g. the buckets of another region
+		Profiles map[string]StorageProfile `mapstructure:"profiles" json:"profiles"`
+	} `mapstructure:"storage" json:"storage"`
+
 	S3 struct {
 		Region      string `mapstructure:"region" json:"region"`
 		Endpoint    string `mapstructure:"endpoint" json:"endpoint"`
 		AccessToken string `mapstructure:"access_token" json:"access_token"`
 		SecretKey   string `mapstructure:"secret_key" json:"secret_key"`
+		Upload      struct {
+			Concurrency   int           `mapstructure:"concurrency" json:"concurrency"`
+			MaxAttempts   int           `mapstructure:"max_attempts" json:"max_attempts"`
+			Backoff       time.Duration `mapstructure:"backoff" json:"backoff"`
+			MaxBackoff    time.Duration `mapstructure:"max_backoff" json:"max_backoff"`
+			MultipartSize int64         `mapstructure:"multipart_size" json:"multipart_size"`
+			PartSize      int64         `mapstructure:"part_size" json:"part_size"`
+			// ChecksumSHA256 sends x-amz-checksum-sha256 next to Content-MD5, not every s3 compatible storage supports it
+			ChecksumSHA256 bool `mapstructure:"checksum_sha256" json:"checksum_sha256"`
+		} `mapstructure:"upload" json:"upload"`
 	} `mapstructure:"s3" json:"s3"`
 
 	Monitoring struct {
@@ -143,6 +215,21 @@ type Config struct {
 	} `mapstructure:"monitoring" json:"monitoring"`
 }
 
+// StorageProfile is a storage of its own, with the same options as the default storage.
+type StorageProfile struct {
+	Backend string `mapstructure:"backend" json:"backend"`
+	Local   struct {
+		Root string `mapstructure:"root" json:"root"`
+	} `mapstructure:"local" json:"local"`
+	Buckets map[string]string `mapstructure:"buckets" json:"buckets"`
+	S3      struct {
+		Region      string `mapstructure:"region" json:"region"`
+		Endpoint    string `mapstructure:"endpoint" json:"endpoint"`
+		AccessToken string `mapstructure:"access_token" json:"access_token"`
+		SecretKey   string `mapstructure:"secret_key" json:"secret_key"`
+	} `mapstructure:"s3" json:"s3"`
+}
+
 type Labels []struct {
 	Key   string `mapstructure:"key" json:"key"`
 	Value string `mapstructure:"value" json:"value"`
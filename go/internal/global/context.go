@@ -84,3 +84,13 @@ func WithTimeout(ctx Context, timeout time.Duration) (Context, context.CancelFun
 		inst:    inst,
 	}, cancel
 }
+
+// WithoutCancel keeps the config and instances of ctx without its cancellation and deadline,
+// for work which has to finish after ctx was cancelled.
+func WithoutCancel(ctx Context) Context {
+	return &gCtx{
+		Context: context.Background(),
+		config:  ctx.Config(),
+		inst:    ctx.Inst(),
+	}
+}
@@ -1,13 +1,13 @@
 package global
 
 import (
-	"github.com/seventv/common/svc/s3"
 	"github.com/seventv/image-processor/go/internal/instance"
+	"github.com/seventv/image-processor/go/internal/svc/storage"
 	messagequeue "github.com/seventv/message-queue/go"
 )
 
 type Instances struct {
 	MessageQueue messagequeue.Instance
-	S3           s3.Instance
+	Storage      storage.Instance
 	Prometheus   instance.Prometheus
 }
@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/seventv/image-processor/go/internal/global"
+	"github.com/seventv/image-processor/go/internal/svc/storage"
 	"github.com/valyala/fasthttp"
 	"go.uber.org/zap"
 )
@@ -22,7 +23,7 @@ func New(gCtx global.Context) <-chan struct{} {
 				}
 			}()
 
-			s3Down := false
+			storageDown := false
 
 			lCtx, cancel := context.WithTimeout(context.Background(), time.Second*5)
 			mqDown := gCtx.Inst().MessageQueue != nil && !gCtx.Inst().MessageQueue.Connected(lCtx)
@@ -31,18 +32,34 @@ func New(gCtx global.Context) <-chan struct{} {
 				zap.S().Warnw("mq is not connected")
 			}
 
-			if gCtx.Inst().S3 != nil {
+			if gCtx.Inst().Storage != nil {
 				lCtx, cancel := context.WithTimeout(context.Background(), time.Second*5)
-				if _, err := gCtx.Inst().S3.ListBuckets(lCtx); err != nil {
-					s3Down = true
-					zap.S().Warnw("s3 is not responding",
+				if err := gCtx.Inst().Storage.Ping(lCtx); err != nil {
+					storageDown = true
+					zap.S().Warnw("storage is not responding",
 						"error", err,
 					)
 				}
 				cancel()
+
+				// the profiles are replica destinations, the quorum of a task decides if it needs them
+				if profiler, ok := gCtx.Inst().Storage.(storage.Profiler); ok {
+					for _, name := range profiler.Profiles() {
+						inst, _ := profiler.Profile(name)
+
+						lCtx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+						if err := inst.Ping(lCtx); err != nil {
+							zap.S().Warnw("storage profile is not responding",
+								"profile", name,
+								"error", err,
+							)
+						}
+						cancel()
+					}
+				}
 			}
 
-			if mqDown || s3Down {
+			if mqDown || storageDown {
 				ctx.SetStatusCode(500)
 			}
 		},
@@ -9,6 +9,7 @@ import (
 	"github.com/seventv/common/svc/s3"
 	"github.com/seventv/image-processor/go/internal/configure"
 	"github.com/seventv/image-processor/go/internal/global"
+	"github.com/seventv/image-processor/go/internal/svc/storage"
 	"github.com/seventv/image-processor/go/internal/testutil"
 	messagequeue "github.com/seventv/message-queue/go"
 )
@@ -42,10 +43,11 @@ func TestHealthS3RMQ(t *testing.T) {
 
 	gCtx, cancel := global.WithCancel(global.New(context.Background(), config))
 
-	var err error
-	gCtx.Inst().S3, err = s3.NewMock(gCtx, map[string]map[string][]byte{})
+	s3Inst, err := s3.NewMock(gCtx, map[string]map[string][]byte{})
 	testutil.IsNil(t, err, "s3 init successful")
 
+	gCtx.Inst().Storage = storage.NewS3(s3Inst)
+
 	gCtx.Inst().MessageQueue, err = messagequeue.New(gCtx, messagequeue.ConfigMock{})
 	testutil.IsNil(t, err, "rmq init successful")
 
@@ -68,7 +70,7 @@ func TestHealthS3RMQ(t *testing.T) {
 	_ = resp.Body.Close()
 	testutil.Assert(t, http.StatusInternalServerError, resp.StatusCode, "response code rmq down")
 
-	s3, _ := gCtx.Inst().S3.(*s3.MockInstance)
+	s3, _ := s3Inst.(*s3.MockInstance)
 
 	mock.SetConnected(true)
 	s3.SetConnected(false)
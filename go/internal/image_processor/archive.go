@@ -0,0 +1,216 @@
+package image_processor
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/h2non/filetype"
+	"github.com/klauspost/compress/zstd"
+	"github.com/seventv/image-processor/go/container"
+	"github.com/seventv/image-processor/go/task"
+	"go.uber.org/multierr"
+	"golang.org/x/crypto/sha3"
+)
+
+// archiveEntry describes a file of the archive in its manifest.json.
+type archiveEntry struct {
+	Name        string `json:"name"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type"`
+	SHA3        string `json:"sha3"`
+}
+
+type archiveManifest struct {
+	Entries []archiveEntry `json:"entries"`
+}
+
+// archivePacker writes the entries of an archive in one of the archive formats.
+type archivePacker interface {
+	add(name string, data []byte) error
+	Close() error
+}
+
+type zipPacker struct {
+	w *zip.Writer
+}
+
+func (p zipPacker) add(name string, data []byte) error {
+	f, err := p.w.Create(name)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+
+	return err
+}
+
+func (p zipPacker) Close() error {
+	return p.w.Close()
+}
+
+type tarZstdPacker struct {
+	tw *tar.Writer
+	zw *zstd.Encoder
+}
+
+func (p tarZstdPacker) add(name string, data []byte) error {
+	if err := p.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		Size:     int64(len(data)),
+		ModTime:  time.Now(),
+	}); err != nil {
+		return err
+	}
+
+	_, err := p.tw.Write(data)
+
+	return err
+}
+
+func (p tarZstdPacker) Close() error {
+	return multierr.Append(p.tw.Close(), p.zw.Close())
+}
+
+// archiveFile returns the file name and content type of the archive in a format.
+func archiveFile(format task.ArchiveFormat) (name string, contentType string, err error) {
+	switch format {
+	case task.ArchiveFormatZip:
+		return "archive.zip", "application/zip", nil
+	case task.ArchiveFormatTarZstd:
+		return "archive.tar.zst", "application/zstd", nil
+	}
+
+	return "", "", fmt.Errorf("unknown archive format %d", format)
+}
+
+// archiveDirs returns the directories whose files are put in the archive, none means there is no archive.
+func archiveDirs(contents task.ArchiveContents, resultsDir string, variantsDir string) ([]string, error) {
+	switch contents {
+	case task.ArchiveContentsAll:
+		return []string{resultsDir, variantsDir}, nil
+	case task.ArchiveContentsNone:
+		return nil, nil
+	case task.ArchiveContentsResults:
+		return []string{resultsDir}, nil
+	case task.ArchiveContentsFrames:
+		return []string{variantsDir}, nil
+	}
+
+	return nil, fmt.Errorf("unknown archive contents %d", contents)
+}
+
+// makeArchive packs the files of the directories into tmpDir with a manifest.json of the entries,
+// the entries are named by their path in tmpDir. An empty path means the task has no archive.
+func makeArchive(tmpDir string, resultsDir string, variantsDir string, archive task.TaskOutputArchive) (pth string, contentType string, err error) {
+	dirs, err := archiveDirs(archive.Contents, resultsDir, variantsDir)
+	if err != nil || len(dirs) == 0 {
+		return "", "", err
+	}
+
+	name, contentType, err := archiveFile(archive.Format)
+	if err != nil {
+		return "", "", err
+	}
+
+	pth = path.Join(tmpDir, name)
+
+	file, err := os.Create(pth)
+	if err != nil {
+		return "", "", multierr.Append(fmt.Errorf("failed at create archive file"), err)
+	}
+
+	var packer archivePacker
+
+	switch archive.Format {
+	case task.ArchiveFormatTarZstd:
+		zw, err := zstd.NewWriter(file)
+		if err != nil {
+			return "", "", multierr.Combine(fmt.Errorf("failed at create zstd writer"), err, file.Close())
+		}
+
+		packer = tarZstdPacker{tw: tar.NewWriter(zw), zw: zw}
+	default:
+		packer = zipPacker{w: zip.NewWriter(file)}
+	}
+
+	manifest := archiveManifest{Entries: []archiveEntry{}}
+
+	walker := func(pth string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		data, err := os.ReadFile(pth)
+		if err != nil {
+			return multierr.Append(fmt.Errorf("failed at readfile %s", pth), err)
+		}
+
+		name, err := filepath.Rel(tmpDir, pth)
+		if err != nil {
+			return err
+		}
+
+		name = filepath.ToSlash(name)
+
+		if err := packer.add(name, data); err != nil {
+			return multierr.Append(fmt.Errorf("failed at add archive entry %s", name), err)
+		}
+
+		h := sha3.New512()
+		h.Write(data)
+
+		entry := archiveEntry{
+			Name: name,
+			Size: int64(len(data)),
+			SHA3: hex.EncodeToString(h.Sum(nil)),
+		}
+
+		if t := container.Match(data); t != filetype.Unknown {
+			entry.ContentType = t.MIME.Value
+		}
+
+		manifest.Entries = append(manifest.Entries, entry)
+
+		return nil
+	}
+
+	for _, dir := range dirs {
+		if err := filepath.Walk(dir, walker); err != nil {
+			return "", "", multierr.Combine(fmt.Errorf("failed at walk %s", path.Base(dir)), err, packer.Close(), file.Close())
+		}
+	}
+
+	buf := &bytes.Buffer{}
+
+	enc := json.NewEncoder(buf)
+	enc.SetIndent("", "  ")
+
+	if err := enc.Encode(manifest); err != nil {
+		return "", "", multierr.Combine(fmt.Errorf("failed at marshal archive manifest"), err, packer.Close(), file.Close())
+	}
+
+	if err := packer.add("manifest.json", buf.Bytes()); err != nil {
+		return "", "", multierr.Combine(fmt.Errorf("failed at add archive manifest"), err, packer.Close(), file.Close())
+	}
+
+	if err := multierr.Append(packer.Close(), file.Close()); err != nil {
+		return "", "", multierr.Append(fmt.Errorf("failed at close archive file"), err)
+	}
+
+	return pth, contentType, nil
+}
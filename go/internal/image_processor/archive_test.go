@@ -0,0 +1,165 @@
+package image_processor
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/seventv/image-processor/go/internal/testutil"
+	"github.com/seventv/image-processor/go/task"
+)
+
+func archiveTestDirs(t *testing.T) (tmpDir string, resultsDir string, variantsDir string) {
+	tmpDir = t.TempDir()
+	resultsDir = path.Join(tmpDir, "results")
+	variantsDir = path.Join(tmpDir, "variants")
+
+	testutil.IsNil(t, os.MkdirAll(resultsDir, 0700), "mkdir results")
+	testutil.IsNil(t, os.MkdirAll(variantsDir, 0700), "mkdir variants")
+
+	testutil.IsNil(t, os.WriteFile(path.Join(resultsDir, "1x.txt"), []byte("result"), 0600), "write result")
+	testutil.IsNil(t, os.WriteFile(path.Join(variantsDir, "0000_1x.txt"), []byte("frame"), 0600), "write frame")
+
+	return tmpDir, resultsDir, variantsDir
+}
+
+// readArchive returns the entries of an archive by name.
+func readArchive(t *testing.T, pth string, format task.ArchiveFormat) map[string][]byte {
+	entries := map[string][]byte{}
+
+	switch format {
+	case task.ArchiveFormatZip:
+		r, err := zip.OpenReader(pth)
+		testutil.IsNil(t, err, "open zip")
+
+		defer r.Close()
+
+		for _, f := range r.File {
+			rc, err := f.Open()
+			testutil.IsNil(t, err, "open zip entry")
+
+			data, err := io.ReadAll(rc)
+			testutil.IsNil(t, err, "read zip entry")
+
+			entries[f.Name] = data
+		}
+	case task.ArchiveFormatTarZstd:
+		data, err := os.ReadFile(pth)
+		testutil.IsNil(t, err, "read archive")
+
+		zr, err := zstd.NewReader(bytes.NewReader(data))
+		testutil.IsNil(t, err, "open zstd")
+
+		defer zr.Close()
+
+		tr := tar.NewReader(zr)
+
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+
+			testutil.IsNil(t, err, "read tar header")
+
+			data, err := io.ReadAll(tr)
+			testutil.IsNil(t, err, "read tar entry")
+
+			entries[hdr.Name] = data
+		}
+	}
+
+	return entries
+}
+
+func TestMakeArchive(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		archive task.TaskOutputArchive
+		file    string
+		entries []string
+	}{
+		{task.TaskOutputArchive{}, "archive.zip", []string{"results/1x.txt", "variants/0000_1x.txt"}},
+		{task.TaskOutputArchive{Contents: task.ArchiveContentsResults}, "archive.zip", []string{"results/1x.txt"}},
+		{task.TaskOutputArchive{Contents: task.ArchiveContentsFrames, Format: task.ArchiveFormatTarZstd}, "archive.tar.zst", []string{"variants/0000_1x.txt"}},
+		{task.TaskOutputArchive{Format: task.ArchiveFormatTarZstd}, "archive.tar.zst", []string{"results/1x.txt", "variants/0000_1x.txt"}},
+	}
+
+	for _, test := range tests {
+		tmpDir, resultsDir, variantsDir := archiveTestDirs(t)
+
+		pth, _, err := makeArchive(tmpDir, resultsDir, variantsDir, test.archive)
+		testutil.IsNil(t, err, "make archive")
+		testutil.Assert(t, test.file, path.Base(pth), "archive file")
+
+		entries := readArchive(t, pth, test.archive.Format)
+		testutil.Assert(t, len(test.entries)+1, len(entries), "entries and the manifest")
+
+		manifest := archiveManifest{}
+		testutil.IsNil(t, json.Unmarshal(entries["manifest.json"], &manifest), "manifest is json")
+
+		names := []string{}
+		for _, entry := range manifest.Entries {
+			names = append(names, entry.Name)
+
+			testutil.Assert(t, int64(len(entries[entry.Name])), entry.Size, "manifest has the size of the entry")
+			testutil.Assert(t, 128, len(entry.SHA3), "manifest has the hash of the entry")
+		}
+
+		sort.Strings(names)
+		testutil.Assert(t, len(test.entries), len(names), "manifest lists every entry")
+
+		for i, name := range test.entries {
+			testutil.Assert(t, name, names[i], "manifest entry")
+		}
+	}
+
+	tmpDir, resultsDir, variantsDir := archiveTestDirs(t)
+
+	pth, _, err := makeArchive(tmpDir, resultsDir, variantsDir, task.TaskOutputArchive{Contents: task.ArchiveContentsNone})
+	testutil.IsNil(t, err, "disabled archive")
+	testutil.Assert(t, "", pth, "no archive is made")
+
+	_, _, err = makeArchive(tmpDir, resultsDir, variantsDir, task.TaskOutputArchive{Format: 10})
+	testutil.IsNotNil(t, err, "unknown formats are rejected")
+}
+
+func TestUploadResultsArchive(t *testing.T) {
+	t.Parallel()
+
+	gCtx, _, _ := uploadTestContext(t, 0, 0)
+	tmpDir, resultsDir, variantsDir := archiveTestDirs(t)
+
+	tsk := task.Task{
+		Output: task.TaskOutput{
+			Bucket: "output",
+			Prefix: "prefix",
+			Archive: task.TaskOutputArchive{
+				Format: task.ArchiveFormatTarZstd,
+			},
+		},
+	}
+
+	result := task.Result{}
+	testutil.IsNil(t, Worker{}.uploadResults(tmpDir, resultsDir, variantsDir, "", tsk, &result, map[string]outputInfo{}, gCtx), "uploads succeed")
+	testutil.Assert(t, "prefix/archive.tar.zst", result.ArchiveOutput.Key, "archive key")
+	testutil.Assert(t, "application/zstd", result.ArchiveOutput.ContentType, "archive content type")
+	testutil.Assert(t, result.ArchiveOutput.Size, len(downloaded(t, gCtx, "prefix/archive.tar.zst")), "archive is uploaded")
+
+	tsk.Output.Prefix = "none"
+	tsk.Output.Archive.Contents = task.ArchiveContentsNone
+
+	result = task.Result{}
+	testutil.IsNil(t, Worker{}.uploadResults(tmpDir, resultsDir, variantsDir, "", tsk, &result, map[string]outputInfo{}, gCtx), "uploads succeed")
+	testutil.Assert(t, "", result.ArchiveOutput.Key, "archive is left empty when disabled")
+	testutil.Assert(t, 1, len(result.ImageOutputs), "outputs are uploaded")
+}
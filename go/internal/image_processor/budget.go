@@ -0,0 +1,97 @@
+package image_processor
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/seventv/image-processor/go/internal/global"
+	"go.uber.org/multierr"
+)
+
+// threadBudget is the number of threads the tools of a single task may use at the same time.
+func threadBudget(ctx global.Context) int {
+	budget := ctx.Config().Worker.ThreadsPerWorker
+	if budget <= 0 {
+		budget = 1
+	}
+
+	return budget
+}
+
+// budgetThreads splits the budget evenly between jobs and returns the threads each job gets
+// and how many of them can run at the same time without going over the budget.
+func budgetThreads(budget int, jobs int) (threads int, parallel int) {
+	if budget <= 0 {
+		budget = 1
+	}
+
+	if jobs <= 0 {
+		jobs = 1
+	}
+
+	threads = budget / jobs
+	if threads <= 0 {
+		threads = 1
+	}
+
+	return threads, budget / threads
+}
+
+// runBudgeted runs the jobs concurrently with the budget split between them, the first job to fail cancels the others
+// and its error is returned.
+func runBudgeted(ctx context.Context, budget int, jobs []func(ctx context.Context, threads int) error) error {
+	threads, parallel := budgetThreads(budget, len(jobs))
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg     sync.WaitGroup
+		once   sync.Once
+		jobErr error
+	)
+
+	slots := make(chan struct{}, parallel)
+
+	for _, job := range jobs {
+		wg.Add(1)
+
+		go func(job func(ctx context.Context, threads int) error) {
+			defer wg.Done()
+
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			defer func() { <-slots }()
+
+			err := func() (err error) {
+				defer func() {
+					if pnk := recover(); pnk != nil {
+						err = multierr.Append(fmt.Errorf("panic at runtime: %v", pnk), err)
+					}
+				}()
+
+				return job(ctx, threads)
+			}()
+			if err != nil {
+				once.Do(func() {
+					jobErr = err
+
+					cancel()
+				})
+			}
+		}(job)
+	}
+
+	wg.Wait()
+
+	if jobErr == nil {
+		// jobs that never started because the parent context was cancelled did not report it
+		return ctx.Err()
+	}
+
+	return jobErr
+}
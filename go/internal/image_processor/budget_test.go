@@ -0,0 +1,100 @@
+package image_processor
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/seventv/image-processor/go/internal/testutil"
+)
+
+func TestBudgetThreads(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		budget   int
+		jobs     int
+		threads  int
+		parallel int
+	}{
+		{budget: 8, jobs: 1, threads: 8, parallel: 1},
+		{budget: 8, jobs: 4, threads: 2, parallel: 4},
+		{budget: 8, jobs: 3, threads: 2, parallel: 4},
+		{budget: 4, jobs: 8, threads: 1, parallel: 4},
+		{budget: 0, jobs: 8, threads: 1, parallel: 1},
+	} {
+		threads, parallel := budgetThreads(test.budget, test.jobs)
+		testutil.Assert(t, test.threads, threads, "threads per job")
+		testutil.Assert(t, test.parallel, parallel, "parallel jobs")
+	}
+}
+
+func TestRunBudgeted(t *testing.T) {
+	t.Parallel()
+
+	var (
+		mtx     sync.Mutex
+		running int
+		peak    int
+		ran     int32
+	)
+
+	jobs := make([]func(ctx context.Context, threads int) error, 8)
+	for i := range jobs {
+		jobs[i] = func(ctx context.Context, threads int) error {
+			testutil.Assert(t, 1, threads, "threads per job")
+
+			mtx.Lock()
+			running++
+			if running > peak {
+				peak = running
+			}
+			mtx.Unlock()
+
+			time.Sleep(10 * time.Millisecond)
+
+			mtx.Lock()
+			running--
+			mtx.Unlock()
+
+			atomic.AddInt32(&ran, 1)
+
+			return nil
+		}
+	}
+
+	testutil.IsNil(t, runBudgeted(context.Background(), 3, jobs), "jobs were successful")
+	testutil.Assert(t, int32(8), atomic.LoadInt32(&ran), "every job ran")
+	testutil.Assert(t, 3, peak, "jobs running at the same time")
+}
+
+func TestRunBudgetedError(t *testing.T) {
+	t.Parallel()
+
+	errJob := errors.New("job failed")
+
+	jobs := []func(ctx context.Context, threads int) error{
+		func(ctx context.Context, threads int) error {
+			return errJob
+		},
+		func(ctx context.Context, threads int) error {
+			<-ctx.Done()
+
+			return ctx.Err()
+		},
+	}
+
+	// the second job only returns once the first one cancelled it
+	err := runBudgeted(context.Background(), 2, jobs)
+	testutil.Assert(t, true, errors.Is(err, errJob), "the first error is returned")
+
+	err = runBudgeted(context.Background(), 1, []func(ctx context.Context, threads int) error{
+		func(ctx context.Context, threads int) error {
+			panic("job panicked")
+		},
+	})
+	testutil.IsNotNil(t, err, "panics are recovered")
+}
@@ -0,0 +1,259 @@
+package image_processor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/seventv/image-processor/go/internal/global"
+	"github.com/seventv/image-processor/go/internal/svc/storage"
+	"github.com/seventv/image-processor/go/task"
+	messagequeue "github.com/seventv/message-queue/go"
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+)
+
+// pendingCancelTTL is how long a cancel for a task the worker has not received is kept.
+const pendingCancelTTL = time.Hour
+
+// cancellations tracks the tasks of the worker by id so a cancel message can stop them,
+// cancels of tasks which were not received yet skip them once they are.
+type cancellations struct {
+	mtx     sync.Mutex
+	running map[string][]*cancelHandle
+	pending map[string]time.Time
+}
+
+type cancelHandle struct {
+	cancel    context.CancelFunc
+	cancelled bool
+}
+
+func newCancellations() *cancellations {
+	return &cancellations{
+		running: map[string][]*cancelHandle{},
+		pending: map[string]time.Time{},
+	}
+}
+
+// start tracks a task until finish is called, cancelled is set when a cancel for it arrived before it was received.
+func (c *cancellations) start(id string, cancel context.CancelFunc) (h *cancelHandle, cancelled bool) {
+	h = &cancelHandle{cancel: cancel}
+	if id == "" {
+		return h, false
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if expires, ok := c.pending[id]; ok {
+		delete(c.pending, id)
+
+		if time.Now().Before(expires) {
+			h.cancelled = true
+
+			return h, true
+		}
+	}
+
+	c.running[id] = append(c.running[id], h)
+
+	return h, false
+}
+
+func (c *cancellations) finish(id string, h *cancelHandle) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	handles := c.running[id]
+	for i, other := range handles {
+		if other == h {
+			handles = append(handles[:i], handles[i+1:]...)
+			break
+		}
+	}
+
+	if len(handles) == 0 {
+		delete(c.running, id)
+	} else {
+		c.running[id] = handles
+	}
+}
+
+// cancel stops the running tasks with the id, running is false when there were none and the task is skipped
+// if it is received within pendingCancelTTL.
+func (c *cancellations) cancel(id string) (running bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	now := time.Now()
+	for pending, expires := range c.pending {
+		if now.After(expires) {
+			delete(c.pending, pending)
+		}
+	}
+
+	handles := c.running[id]
+	if len(handles) == 0 {
+		c.pending[id] = now.Add(pendingCancelTTL)
+
+		return false
+	}
+
+	for _, h := range handles {
+		h.cancelled = true
+		h.cancel()
+	}
+
+	return true
+}
+
+// isCancelled reports if the task was stopped by a cancel message rather than by its timeout or the worker shutting down.
+func (c *cancellations) isCancelled(h *cancelHandle) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return h.cancelled
+}
+
+// retryControl receives the control messages of the worker until the subscription ends.
+func retryControl(gCtx global.Context, cancels *cancellations) {
+	defer func() {
+		if err := recover(); err != nil {
+			zap.S().Errorw("panic in control",
+				"panic", err,
+			)
+		}
+	}()
+
+	ch, err := gCtx.Inst().MessageQueue.Subscribe(gCtx, messagequeue.Subscription{
+		Queue: gCtx.Config().MessageQueue.ControlQueue,
+		RMQ:   messagequeue.SubscriptionRMQ{},
+		SQS: messagequeue.SubscriptionSQS{
+			WaitTimeSeconds: 10,
+		},
+	})
+	if err != nil {
+		zap.S().Errorw("failed to subscribe to control queue",
+			"error", err,
+		)
+
+		return
+	}
+
+	for {
+		select {
+		case <-gCtx.Done():
+			return
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+
+			control(gCtx, msg, cancels)
+		}
+	}
+}
+
+func control(gCtx global.Context, msg *messagequeue.IncomingMessage, cancels *cancellations) {
+	c := task.Control{}
+	if err := json.Unmarshal(msg.Body(), &c); err != nil {
+		zap.S().Warnw("bad control payload",
+			"error", multierr.Append(err, msg.Ack(gCtx)),
+		)
+
+		return
+	}
+
+	switch c.Type {
+	case task.ControlTypeCancel:
+		running := cancels.cancel(c.ID)
+
+		zap.S().Infow("cancel task",
+			"id", c.ID,
+			"running", running,
+		)
+	default:
+		zap.S().Warnw("unknown control type",
+			"type", c.Type,
+			"id", c.ID,
+		)
+	}
+
+	if err := msg.Ack(gCtx); err != nil {
+		zap.S().Errorw("failed to ack control",
+			"error", err,
+		)
+	}
+}
+
+// removeOutputs deletes what a cancelled task uploaded before it was stopped and leaves the result without it.
+// Outputs of a manifest belong to an earlier run of the task and are kept, copies of cached outputs are removed.
+func removeOutputs(ctx global.Context, tsk task.Task, result *task.Result) error {
+	if result.ReusedFrom == task.ResultReuseManifest {
+		return nil
+	}
+
+	err := removeFiles(ctx, *result)
+
+	// a reupload over the input itself is not removed
+	reupload := tsk.Input.Reupload
+	if reupload.Enabled && (reupload.Bucket != tsk.Input.Bucket || reupload.Key != tsk.Input.Key) {
+		err = multierr.Append(err, removeFile(ctx, ctx.Inst().Storage, task.ResultFile{Bucket: reupload.Bucket, Key: reupload.Key}))
+	}
+
+	result.ImageOutputs = nil
+	result.ArchiveOutput = task.ResultFile{}
+	result.Replicas = nil
+
+	return err
+}
+
+func removeFile(ctx global.Context, inst storage.Instance, file task.ResultFile) error {
+	if file.Key == "" {
+		return nil
+	}
+
+	if err := inst.DeleteFile(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(file.Bucket),
+		Key:    aws.String(file.Key),
+	}); err != nil {
+		return multierr.Append(fmt.Errorf("failed at delete %s", file.Key), err)
+	}
+
+	return nil
+}
+
+// removeFiles deletes the outputs, archive and replicas of the result.
+func removeFiles(ctx global.Context, result task.Result) error {
+	var err error
+
+	remove := func(inst storage.Instance, file task.ResultFile) {
+		err = multierr.Append(err, removeFile(ctx, inst, file))
+	}
+
+	for _, file := range result.ImageOutputs {
+		remove(ctx.Inst().Storage, file)
+	}
+
+	remove(ctx.Inst().Storage, result.ArchiveOutput)
+
+	// the profile of a replica is all that picks its storage, the result has it so the task is not needed
+	for _, replica := range result.Replicas {
+		inst, e := replicaStorage(ctx, task.TaskOutputReplica{Profile: replica.Profile})
+		if e != nil {
+			err = multierr.Append(err, e)
+			continue
+		}
+
+		for _, file := range replica.Outputs {
+			remove(inst, file)
+		}
+	}
+
+	return err
+}
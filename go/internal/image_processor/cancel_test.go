@@ -0,0 +1,298 @@
+package image_processor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	awss3 "github.com/aws/aws-sdk-go/service/s3"
+
+	"github.com/seventv/image-processor/go/internal/configure"
+	"github.com/seventv/image-processor/go/internal/global"
+	"github.com/seventv/image-processor/go/internal/svc/storage"
+	"github.com/seventv/image-processor/go/internal/testutil"
+	"github.com/seventv/image-processor/go/task"
+	messagequeue "github.com/seventv/message-queue/go"
+)
+
+func cancelTestContext(t *testing.T) global.Context {
+	gCtx, cancel := global.WithCancel(global.New(context.Background(), &configure.Config{}))
+	t.Cleanup(cancel)
+
+	mq, err := messagequeue.New(gCtx, messagequeue.ConfigMock{})
+	testutil.IsNil(t, err, "mq init successful")
+
+	gCtx.Inst().MessageQueue = mq
+
+	return gCtx
+}
+
+func TestCancellations(t *testing.T) {
+	t.Parallel()
+
+	cancels := newCancellations()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	h, skipped := cancels.start("running", cancel)
+	testutil.Assert(t, false, skipped, "task was not cancelled")
+	testutil.Assert(t, true, cancels.cancel("running"), "task is running")
+	testutil.IsNotNil(t, ctx.Err(), "context of the task is cancelled")
+	testutil.Assert(t, true, cancels.isCancelled(h), "task was cancelled by a message")
+
+	cancels.finish("running", h)
+	testutil.Assert(t, 0, len(cancels.running), "finished tasks are not tracked")
+
+	testutil.Assert(t, false, cancels.cancel("later"), "task was not received yet")
+
+	h, skipped = cancels.start("later", func() {})
+	testutil.Assert(t, true, skipped, "task cancelled before it was received is skipped")
+	testutil.Assert(t, true, cancels.isCancelled(h), "skipped task was cancelled")
+
+	_, skipped = cancels.start("later", func() {})
+	testutil.Assert(t, false, skipped, "a cancel only skips the task once")
+
+	h, _ = cancels.start("", func() {})
+	testutil.Assert(t, 1, len(cancels.running), "tasks without an id are not tracked")
+
+	cancels.finish("", h)
+
+	cancels.pending["expired"] = time.Now().Add(-time.Second)
+	_, skipped = cancels.start("expired", func() {})
+	testutil.Assert(t, false, skipped, "expired cancels are ignored")
+}
+
+func TestControl(t *testing.T) {
+	t.Parallel()
+
+	gCtx := cancelTestContext(t)
+	cancels := newCancellations()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	h, _ := cancels.start("task", cancel)
+
+	body, err := json.Marshal(task.Control{Type: task.ControlTypeCancel, ID: "task"})
+	testutil.IsNil(t, err, "control marshals")
+
+	testutil.IsNil(t, gCtx.Inst().MessageQueue.Publish(gCtx, messagequeue.OutgoingMessage{
+		Queue: "control",
+		Body:  body,
+	}), "publish control message")
+
+	ch, err := gCtx.Inst().MessageQueue.Subscribe(gCtx, messagequeue.Subscription{Queue: "control"})
+	testutil.IsNil(t, err, "subscribe to the control queue")
+
+	control(gCtx, <-ch, cancels)
+	testutil.IsNotNil(t, ctx.Err(), "context of the task is cancelled")
+	testutil.Assert(t, true, cancels.isCancelled(h), "task was cancelled by the message")
+}
+
+func TestProcessCancelled(t *testing.T) {
+	t.Parallel()
+
+	gCtx := cancelTestContext(t)
+	cancels := newCancellations()
+	cancels.cancel("task")
+
+	body, err := json.Marshal(task.Task{ID: "task"})
+	testutil.IsNil(t, err, "task marshals")
+
+	headers := messagequeue.MessageHeaders{}
+	headers.SetContentType("application/json")
+	headers.SetReplyTo("results")
+
+	testutil.IsNil(t, gCtx.Inst().MessageQueue.Publish(gCtx, messagequeue.OutgoingMessage{
+		Queue:   "jobs",
+		Body:    body,
+		Headers: headers,
+	}), "publish task")
+
+	jobs, err := gCtx.Inst().MessageQueue.Subscribe(gCtx, messagequeue.Subscription{Queue: "jobs"})
+	testutil.IsNil(t, err, "subscribe to the jobs queue")
+
+	release := make(chan struct{})
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	t.Cleanup(srv.Close)
+	// the callback is released before the server waits for it to return
+	t.Cleanup(func() { close(release) })
+
+	gCtx.Config().Worker.Webhook.URL = srv.URL
+
+	done := make(chan struct{})
+	go func() {
+		// the pool has no worker, a skipped task does not wait for one or for its callback
+		process(gCtx, <-jobs, make(chan Worker), make(chan struct{}), cancels, newWebhookSender(gCtx))
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("skipped task blocked the intake of tasks")
+	}
+
+	results, err := gCtx.Inst().MessageQueue.Subscribe(gCtx, messagequeue.Subscription{Queue: "results"})
+	testutil.IsNil(t, err, "subscribe to the results queue")
+
+	result := task.Result{}
+	testutil.IsNil(t, json.Unmarshal((<-results).Body(), &result), "the response is a result")
+	testutil.Assert(t, "task", result.ID, "result of the task")
+	testutil.Assert(t, task.ResultStateCancelled, result.State, "task was cancelled")
+}
+
+func TestRemoveOutputs(t *testing.T) {
+	t.Parallel()
+
+	gCtx := cancelTestContext(t)
+	root := t.TempDir()
+
+	gCtx.Inst().Storage = storage.NewLocal(root)
+
+	files := []string{"output/prefix/1x.webp", "output/prefix/archive.zip", "private/replica/1x.webp", "input/reupload.gif", "input/input.gif"}
+	for _, file := range files {
+		testutil.IsNil(t, os.MkdirAll(path.Join(root, path.Dir(file)), 0700), "mkdir "+file)
+		testutil.IsNil(t, os.WriteFile(path.Join(root, file), []byte("data"), 0600), "write "+file)
+	}
+
+	tsk := task.Task{
+		Input: task.TaskInput{
+			Bucket: "input",
+			Key:    "input.gif",
+			Reupload: task.TaskInputReupload{
+				Enabled: true,
+				Bucket:  "input",
+				Key:     "reupload.gif",
+			},
+		},
+	}
+
+	result := task.Result{
+		ImageOutputs:  []task.ResultFile{{Bucket: "output", Key: "prefix/1x.webp"}},
+		ArchiveOutput: task.ResultFile{Bucket: "output", Key: "prefix/archive.zip"},
+		Replicas: []task.ResultReplica{{
+			Bucket:  "private",
+			Outputs: []task.ResultFile{{Bucket: "private", Key: "replica/1x.webp"}},
+		}},
+	}
+
+	testutil.IsNil(t, removeOutputs(gCtx, tsk, &result), "outputs are removed")
+	testutil.Assert(t, 0, len(result.ImageOutputs), "result has no outputs")
+	testutil.Assert(t, "", result.ArchiveOutput.Key, "result has no archive")
+	testutil.Assert(t, 0, len(result.Replicas), "result has no replicas")
+
+	for _, file := range files[:4] {
+		_, err := os.Stat(path.Join(root, file))
+		testutil.Assert(t, true, os.IsNotExist(err), "file is removed "+file)
+	}
+
+	_, err := os.Stat(path.Join(root, "input", "input.gif"))
+	testutil.IsNil(t, err, "input is kept")
+
+	// a reupload over the input replaced it, removing it would remove the input
+	tsk.Input.Reupload.Key = "input.gif"
+	testutil.IsNil(t, removeOutputs(gCtx, tsk, &task.Result{}), "nothing to remove")
+
+	_, err = os.Stat(path.Join(root, "input", "input.gif"))
+	testutil.IsNil(t, err, "reupload over the input is kept")
+
+	for _, reuse := range []task.ResultReuse{task.ResultReuseManifest, task.ResultReuseCache} {
+		testutil.IsNil(t, os.WriteFile(path.Join(root, files[0]), []byte("data"), 0600), "write "+files[0])
+
+		testutil.IsNil(t, removeOutputs(gCtx, tsk, &task.Result{
+			ImageOutputs: []task.ResultFile{{Bucket: "output", Key: "prefix/1x.webp"}},
+			Reused:       true,
+			ReusedFrom:   reuse,
+		}), "reused outputs are removed "+string(reuse))
+
+		_, err = os.Stat(path.Join(root, files[0]))
+		testutil.Assert(t, reuse == task.ResultReuseCache, os.IsNotExist(err), "only copies of cached outputs are removed "+string(reuse))
+	}
+}
+
+// cancellingCopyS3 cancels the task once it made a number of copies.
+type cancellingCopyS3 struct {
+	storage.Instance
+
+	mtx    sync.Mutex
+	copies int
+	after  int
+	cancel context.CancelFunc
+}
+
+func (c *cancellingCopyS3) CopyFile(ctx context.Context, opts *awss3.CopyObjectInput) error {
+	c.mtx.Lock()
+	c.copies++
+	cancel := c.copies > c.after
+	c.mtx.Unlock()
+
+	if cancel {
+		c.cancel()
+
+		return ctx.Err()
+	}
+
+	return c.Instance.CopyFile(ctx, opts)
+}
+
+func TestWorkerDedupCancelled(t *testing.T) {
+	t.Parallel()
+
+	gCtx, worker := streamTestWorker(t, &fakeStreamTool{streamFrames: 5}, &fakeStreamTool{})
+
+	root := t.TempDir()
+	input := &bytes.Buffer{}
+	testutil.IsNil(t, gCtx.Inst().Storage.DownloadFile(gCtx, input, &awss3.GetObjectInput{
+		Bucket: aws.String("input"),
+		Key:    aws.String("animated-1.gif"),
+	}), "download input")
+	testutil.IsNil(t, os.MkdirAll(path.Join(root, "input"), 0700), "mkdir input")
+	testutil.IsNil(t, os.WriteFile(path.Join(root, "input", "animated-1.gif"), input.Bytes(), 0600), "write input")
+
+	ctx, cancel := global.WithCancel(gCtx)
+	defer cancel()
+
+	copying := &cancellingCopyS3{Instance: storage.NewLocal(root), after: 1, cancel: cancel}
+	gCtx.Inst().Storage = copying
+	gCtx.Config().Worker.Cache.Dir = t.TempDir()
+
+	tsk := streamTestTask
+	tsk.Output.Prefix = "first"
+
+	first := task.Result{}
+	testutil.IsNil(t, worker.Work(gCtx, tsk, &first), "first convert was successful")
+
+	// the task is cancelled while it copies the cached outputs, after one of them was copied
+	tsk.Output.Prefix = "second"
+
+	second := task.Result{}
+	testutil.IsNotNil(t, worker.Work(ctx, tsk, &second), "second convert was cancelled")
+	testutil.Assert(t, 2, copying.copies, "the reuse was cancelled on its second copy")
+	testutil.IsNil(t, removeOutputs(gCtx, tsk, &second), "outputs are removed")
+
+	copies := 0
+	testutil.IsNil(t, filepath.Walk(path.Join(root, "output"), func(pth string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && strings.Contains(pth, "second") {
+			copies++
+		}
+
+		return err
+	}), "list copies")
+	testutil.Assert(t, 0, copies, "the copy made before the cancel is removed")
+
+	for _, output := range first.ImageOutputs {
+		_, err := os.Stat(path.Join(root, output.Bucket, output.Key))
+		testutil.IsNil(t, err, "outputs of the first task are kept "+output.Key)
+	}
+}
@@ -0,0 +1,465 @@
+package image_processor
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/seventv/image-processor/go/internal/global"
+	"github.com/seventv/image-processor/go/task"
+	"go.uber.org/multierr"
+	"golang.org/x/crypto/sha3"
+)
+
+// removeCopiesTimeout bounds removing the copies of a failed reuse, which outlives the context of the task.
+const removeCopiesTimeout = 30 * time.Second
+
+// dedupParams are the task options that change the contents of the outputs, where the outputs are stored does not.
+type dedupParams struct {
+	Flags             task.TaskFlag          `json:"flags"`
+	SmallestMaxWidth  int                    `json:"smallest_max_width"`
+	SmallestMaxHeight int                    `json:"smallest_max_height"`
+	ResizeRatio       task.ResizeRatio       `json:"resize_ratio"`
+	Scales            []int                  `json:"scales"`
+	Limits            task.TaskLimits        `json:"limits"`
+	SizePolicy        task.OutputSizePolicy  `json:"size_policy"`
+	Archive           task.TaskOutputArchive `json:"archive"`
+}
+
+// dedupKey is the cache key of the outputs of an input processed with the options of a task.
+func dedupKey(tsk task.Task, inputSHA3 string) (string, error) {
+	p := dedupParams{
+		Flags:             tsk.Flags,
+		SmallestMaxWidth:  tsk.SmallestMaxWidth,
+		SmallestMaxHeight: tsk.SmallestMaxHeight,
+		ResizeRatio:       tsk.ResizeRatio,
+		Scales:            tsk.Scales,
+		Limits:            tsk.Limits,
+		SizePolicy:        tsk.Output.SizePolicy,
+		Archive:           tsk.Output.Archive,
+	}
+
+	p.Limits.MaxProcessingTime = 0
+
+	data, err := json.Marshal(p)
+	if err != nil {
+		return "", multierr.Append(fmt.Errorf("failed at marshal params"), err)
+	}
+
+	h := sha3.New256()
+	h.Write([]byte(inputSHA3))
+	h.Write(data)
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// dedupCache maps inputs and task options to outputs that are already stored, in a local directory and optionally in s3.
+type dedupCache struct {
+	local  *dirLRU
+	bucket string
+	prefix string
+}
+
+func newDedupCache(ctx global.Context) dedupCache {
+	config := ctx.Config().Worker.Cache
+
+	c := dedupCache{
+		bucket: config.Bucket,
+		prefix: config.Prefix,
+	}
+
+	if config.Dir != "" {
+		c.local = &dirLRU{dir: config.Dir, maxBytes: config.MaxBytes}
+	}
+
+	return c
+}
+
+func (c dedupCache) enabled() bool {
+	return c.local != nil || c.bucket != ""
+}
+
+// get returns the result of the task the outputs were made by, the local directory is looked at before s3.
+func (c dedupCache) get(ctx global.Context, key string) (result task.Result, ok bool, err error) {
+	var data []byte
+
+	if c.local != nil {
+		data, ok, err = c.local.get(key)
+		if err != nil {
+			return task.Result{}, false, multierr.Append(fmt.Errorf("failed at read local cache"), err)
+		}
+	}
+
+	if !ok && c.bucket != "" {
+		buf := &bytes.Buffer{}
+
+		err = ctx.Inst().Storage.DownloadFile(ctx, buf, &s3.GetObjectInput{
+			Bucket: aws.String(c.bucket),
+			Key:    aws.String(c.s3Key(key)),
+		})
+		if isNoSuchKey(err) {
+			return task.Result{}, false, nil
+		} else if err != nil {
+			return task.Result{}, false, multierr.Append(fmt.Errorf("failed at s3 download"), err)
+		}
+
+		data, ok = buf.Bytes(), true
+
+		if c.local != nil {
+			if err := c.local.put(key, data); err != nil {
+				return task.Result{}, false, multierr.Append(fmt.Errorf("failed at write local cache"), err)
+			}
+		}
+	}
+
+	if !ok {
+		return task.Result{}, false, nil
+	}
+
+	if err := json.Unmarshal(data, &result); err != nil {
+		return task.Result{}, false, multierr.Append(fmt.Errorf("failed at unmarshal cache entry"), err)
+	}
+
+	return result, true, nil
+}
+
+// put stores where the outputs of a task are so later tasks with the same input and options can copy them.
+func (c dedupCache) put(ctx global.Context, key string, result *task.Result) error {
+	data, err := json.Marshal(task.Result{
+		ImageInput:     result.ImageInput,
+		ImageOutputs:   result.ImageOutputs,
+		ArchiveOutput:  result.ArchiveOutput,
+		SkippedOutputs: result.SkippedOutputs,
+	})
+	if err != nil {
+		return multierr.Append(fmt.Errorf("failed at marshal cache entry"), err)
+	}
+
+	if c.local != nil {
+		if err := c.local.put(key, data); err != nil {
+			return multierr.Append(fmt.Errorf("failed at write local cache"), err)
+		}
+	}
+
+	if c.bucket != "" {
+		if err := newUploadPool(ctx).Upload(&s3.PutObjectInput{
+			Bucket:      aws.String(c.bucket),
+			ContentType: aws.String("application/json"),
+			Key:         aws.String(c.s3Key(key)),
+		}, int64(len(data)), func() (io.ReadSeeker, error) {
+			return bytes.NewReader(data), nil
+		}); err != nil {
+			return multierr.Append(fmt.Errorf("failed at s3 upload"), err)
+		}
+	}
+
+	return nil
+}
+
+// remove drops an entry whose outputs are gone.
+func (c dedupCache) remove(key string) error {
+	if c.local == nil {
+		return nil
+	}
+
+	return c.local.remove(key)
+}
+
+func (c dedupCache) s3Key(key string) string {
+	return path.Join(c.prefix, key+".json")
+}
+
+// copyOutputs copies the outputs of an earlier task to where the task stores its outputs and sets them on the result,
+// the ones copied before an error are set as well so they can be removed.
+func copyOutputs(ctx global.Context, tsk task.Task, cached task.Result, result *task.Result) error {
+	copyFile := func(file task.ResultFile) (task.ResultFile, error) {
+		vars := outputKeyVars{
+			Name:       file.Name,
+			Ext:        outputExt(file),
+			FrameCount: file.FrameCount,
+			InputSHA3:  cached.ImageInput.SHA3,
+			SHA3:       file.SHA3,
+		}
+
+		key, err := outputKey(tsk, vars)
+		if err != nil {
+			return task.ResultFile{}, err
+		}
+
+		storage := vars.storage(tsk)
+		acl, disposition, metadata, tagging := objectOptions(storage)
+
+		if err := ctx.Inst().Storage.CopyFile(ctx, &s3.CopyObjectInput{
+			ACL:                acl,
+			Bucket:             aws.String(storage.Bucket),
+			CacheControl:       aws.String(storage.CacheControl),
+			ContentDisposition: disposition,
+			ContentType:        aws.String(file.ContentType),
+			CopySource:         aws.String(url.PathEscape(path.Join(file.Bucket, file.Key))),
+			Key:                aws.String(key),
+			Metadata:           metadata,
+			MetadataDirective:  aws.String(s3.MetadataDirectiveReplace),
+			Tagging:            tagging,
+			TaggingDirective:   aws.String(s3.TaggingDirectiveReplace),
+		}); err != nil {
+			return task.ResultFile{}, multierr.Append(fmt.Errorf("failed at s3 copy %s", file.Key), err)
+		}
+
+		file.Key = key
+		file.Bucket = storage.Bucket
+		file.ACL = storage.ACL
+		file.CacheControl = storage.CacheControl
+
+		return file, nil
+	}
+
+	result.ImageOutputs = make([]task.ResultFile, 0, len(cached.ImageOutputs))
+
+	for _, file := range cached.ImageOutputs {
+		copied, err := copyFile(file)
+		if err != nil {
+			return err
+		}
+
+		result.ImageOutputs = append(result.ImageOutputs, copied)
+	}
+
+	// tasks without an archive leave it empty
+	if cached.ArchiveOutput.Key != "" {
+		copied, err := copyFile(cached.ArchiveOutput)
+		if err != nil {
+			return err
+		}
+
+		result.ArchiveOutput = copied
+	}
+
+	result.SkippedOutputs = cached.SkippedOutputs
+
+	return nil
+}
+
+// reuseCached copies the outputs of an earlier task with the same input and options, ok is false when there are none.
+// The result is only changed when every output, replica and the reupload were written, the copies are removed otherwise.
+func (Worker) reuseCached(ctx global.Context, cache dedupCache, key string, tsk task.Task, inputFile string, inputSums fileSums, inputSize int64, result *task.Result) (ok bool, err error) {
+	cached, ok, err := cache.get(ctx, key)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	reused := task.Result{}
+
+	defer func() {
+		if err != nil {
+			err = multierr.Append(err, removeCopies(ctx, cached, reused))
+		}
+	}()
+
+	// an entry can outlive the outputs it points to, it is dropped so the outputs are made again
+	if err := copyOutputs(ctx, tsk, cached, &reused); err != nil {
+		return false, multierr.Append(err, cache.remove(key))
+	}
+
+	reused.ImageInput = task.ResultFile{
+		SHA3:        inputSums.SHA3,
+		SHA256:      inputSums.SHA256,
+		FrameCount:  cached.ImageInput.FrameCount,
+		ContentType: cached.ImageInput.ContentType,
+		Width:       cached.ImageInput.Width,
+		Height:      cached.ImageInput.Height,
+		Size:        int(inputSize),
+	}
+
+	// a replica which can not be written makes the outputs again, which tries the replicas again
+	if err := copyReplicas(ctx, tsk, &reused); err != nil {
+		return false, err
+	}
+
+	if tsk.Input.Reupload.Enabled {
+		reused.ImageInput.Name = "original"
+		reused.ImageInput.Key = tsk.Input.Reupload.Key
+		reused.ImageInput.Bucket = tsk.Input.Reupload.Bucket
+		reused.ImageInput.CacheControl = tsk.Input.Reupload.CacheControl
+		reused.ImageInput.ACL = tsk.Input.Reupload.ACL
+
+		if err := newUploadPool(ctx).Upload(&s3.PutObjectInput{
+			ACL:          aws.String(tsk.Input.Reupload.ACL),
+			Bucket:       aws.String(tsk.Input.Reupload.Bucket),
+			CacheControl: aws.String(tsk.Input.Reupload.CacheControl),
+			ContentType:  aws.String(reused.ImageInput.ContentType),
+			Key:          aws.String(tsk.Input.Reupload.Key),
+		}, inputSize, func() (io.ReadSeeker, error) {
+			return os.Open(inputFile)
+		}); err != nil {
+			return false, multierr.Append(fmt.Errorf("failed at reupload input"), err)
+		}
+	}
+
+	result.ImageInput = reused.ImageInput
+	result.ImageOutputs = reused.ImageOutputs
+	result.ArchiveOutput = reused.ArchiveOutput
+	result.SkippedOutputs = reused.SkippedOutputs
+	result.Replicas = reused.Replicas
+	result.Reused = true
+	result.ReusedFrom = task.ResultReuseCache
+
+	return true, nil
+}
+
+// removeCopies deletes the outputs and replicas a failed reuse copied, also when the task was cancelled.
+// Copies onto the files of the earlier task itself are kept since they are still its outputs.
+func removeCopies(ctx global.Context, cached task.Result, reused task.Result) error {
+	ctx, cancel := global.WithTimeout(global.WithoutCancel(ctx), removeCopiesTimeout)
+	defer cancel()
+
+	sources := map[string]bool{}
+
+	for _, file := range append(cached.ImageOutputs, cached.ArchiveOutput) {
+		sources[path.Join(file.Bucket, file.Key)] = true
+	}
+
+	for _, replica := range cached.Replicas {
+		for _, file := range replica.Outputs {
+			sources[path.Join(file.Bucket, file.Key)] = true
+		}
+	}
+
+	copies := func(files []task.ResultFile) []task.ResultFile {
+		kept := []task.ResultFile{}
+
+		for _, file := range files {
+			if !sources[path.Join(file.Bucket, file.Key)] {
+				kept = append(kept, file)
+			}
+		}
+
+		return kept
+	}
+
+	reused.ImageOutputs = copies(append(reused.ImageOutputs, reused.ArchiveOutput))
+	reused.ArchiveOutput = task.ResultFile{}
+
+	for i, replica := range reused.Replicas {
+		reused.Replicas[i].Outputs = copies(replica.Outputs)
+	}
+
+	return removeFiles(ctx, reused)
+}
+
+// dirLRU keeps files in a directory up to maxBytes, the files used least recently are removed first.
+// The modification time of a file is when it was used last so the state survives restarts.
+type dirLRU struct {
+	dir      string
+	maxBytes int64
+}
+
+func (l *dirLRU) get(key string) ([]byte, bool, error) {
+	pth := path.Join(l.dir, key)
+
+	data, err := os.ReadFile(pth)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	now := time.Now()
+	if err := os.Chtimes(pth, now, now); err != nil && !os.IsNotExist(err) {
+		return nil, false, err
+	}
+
+	return data, true, nil
+}
+
+func (l *dirLRU) put(key string, data []byte) error {
+	if err := os.MkdirAll(l.dir, 0700); err != nil {
+		return err
+	}
+
+	// the entry is renamed into place so readers never see a partial file
+	tmp, err := os.CreateTemp(l.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		return multierr.Combine(err, tmp.Close(), os.Remove(tmp.Name()))
+	}
+
+	if err := tmp.Close(); err != nil {
+		return multierr.Append(err, os.Remove(tmp.Name()))
+	}
+
+	if err := os.Rename(tmp.Name(), path.Join(l.dir, key)); err != nil {
+		return multierr.Append(err, os.Remove(tmp.Name()))
+	}
+
+	return l.evict()
+}
+
+func (l *dirLRU) remove(key string) error {
+	if err := os.Remove(path.Join(l.dir, key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// evict removes the least recently used files until the directory fits maxBytes, 0 keeps every file.
+func (l *dirLRU) evict() error {
+	if l.maxBytes <= 0 {
+		return nil
+	}
+
+	entries, err := os.ReadDir(l.dir)
+	if err != nil {
+		return err
+	}
+
+	infos := make([]os.FileInfo, 0, len(entries))
+	total := int64(0)
+
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".tmp-") {
+			continue
+		}
+
+		infos = append(infos, info)
+		total += info.Size()
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ModTime().Before(infos[j].ModTime())
+	})
+
+	for _, info := range infos {
+		if total <= l.maxBytes {
+			break
+		}
+
+		if err := l.remove(info.Name()); err != nil {
+			return err
+		}
+
+		total -= info.Size()
+	}
+
+	return nil
+}
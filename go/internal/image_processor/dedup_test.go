@@ -0,0 +1,274 @@
+package image_processor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	awss3 "github.com/aws/aws-sdk-go/service/s3"
+
+	"github.com/seventv/image-processor/go/internal/svc/storage"
+	"github.com/seventv/image-processor/go/internal/testutil"
+	"github.com/seventv/image-processor/go/task"
+)
+
+// copyingS3 implements server side copies on top of the mock, which does not copy anything.
+type copyingS3 struct {
+	storage.Instance
+
+	mtx    sync.Mutex
+	copies int
+	broken bool
+}
+
+func (c *copyingS3) CopyFile(ctx context.Context, opts *awss3.CopyObjectInput) error {
+	c.mtx.Lock()
+	c.copies++
+	broken := c.broken
+	c.mtx.Unlock()
+
+	if broken {
+		return errors.New(awss3.ErrCodeNoSuchKey)
+	}
+
+	source, err := url.PathUnescape(aws.StringValue(opts.CopySource))
+	if err != nil {
+		return err
+	}
+
+	splits := strings.SplitN(source, "/", 2)
+
+	buf := &bytes.Buffer{}
+	if err := c.Instance.DownloadFile(ctx, buf, &awss3.GetObjectInput{
+		Bucket: aws.String(splits[0]),
+		Key:    aws.String(splits[1]),
+	}); err != nil {
+		return err
+	}
+
+	return c.Instance.UploadFile(ctx, &awss3.PutObjectInput{
+		Body:   bytes.NewReader(buf.Bytes()),
+		Bucket: opts.Bucket,
+		Key:    opts.Key,
+	})
+}
+
+func TestWorkerDedup(t *testing.T) {
+	t.Parallel()
+
+	decoder := &fakeStreamTool{streamFrames: 5}
+	gCtx, worker := streamTestWorker(t, decoder, &fakeStreamTool{})
+
+	copying := &copyingS3{Instance: gCtx.Inst().Storage}
+	gCtx.Inst().Storage = copying
+
+	gCtx.Config().Worker.Cache.Dir = t.TempDir()
+	gCtx.Config().Worker.Cache.Bucket = "output"
+	gCtx.Config().Worker.Cache.Prefix = "dedup"
+
+	tsk := streamTestTask
+	tsk.Output.Prefix = "first"
+
+	first := task.Result{}
+	testutil.IsNil(t, worker.Work(gCtx, tsk, &first), "first convert was successful")
+	testutil.Assert(t, false, first.Reused, "first task is processed")
+
+	tsk.Output.Prefix = "second"
+	tsk.Output.CacheControl = "no-cache"
+
+	second := task.Result{}
+	testutil.IsNil(t, worker.Work(gCtx, tsk, &second), "second convert was successful")
+	testutil.Assert(t, true, second.Reused, "second task copies the outputs")
+	testutil.Assert(t, task.ResultReuseCache, second.ReusedFrom, "outputs are copies of the cached ones")
+	testutil.Assert(t, 1, len(decoder.calls), "second task is not decoded")
+	testutil.Assert(t, len(first.ImageOutputs)+1, copying.copies, "every output and the archive are copied")
+	testutil.Assert(t, first.ImageInput.SHA3, second.ImageInput.SHA3, "same input")
+	testutil.Assert(t, len(first.ImageOutputs), len(second.ImageOutputs), "same outputs")
+
+	for i, output := range second.ImageOutputs {
+		testutil.Assert(t, "second/"+path.Base(first.ImageOutputs[i].Key), output.Key, "output is copied to the new prefix")
+		testutil.Assert(t, "no-cache", output.CacheControl, "output has the options of the new task")
+		testutil.Assert(t, first.ImageOutputs[i].SHA3, output.SHA3, "same contents")
+		testutil.Assert(t, true, bytes.Equal(downloaded(t, gCtx, first.ImageOutputs[i].Key), downloaded(t, gCtx, output.Key)), "copied contents")
+	}
+
+	// another worker without the local entry finds it in s3
+	gCtx.Config().Worker.Cache.Dir = t.TempDir()
+	tsk.Output.Prefix = "third"
+
+	third := task.Result{}
+	testutil.IsNil(t, worker.Work(gCtx, tsk, &third), "third convert was successful")
+	testutil.Assert(t, true, third.Reused, "third task copies the outputs")
+	testutil.Assert(t, 1, len(decoder.calls), "third task is not decoded")
+
+	// entries whose outputs are gone are processed again
+	copying.broken = true
+	tsk.Output.Prefix = "fourth"
+
+	fourth := task.Result{}
+	testutil.IsNil(t, worker.Work(gCtx, tsk, &fourth), "fourth convert was successful")
+	testutil.Assert(t, false, fourth.Reused, "fourth task is processed")
+	testutil.Assert(t, 2, len(decoder.calls), "fourth task is decoded")
+
+	tsk.Scales = []int{1}
+	tsk.Output.Prefix = "fifth"
+
+	fifth := task.Result{}
+	testutil.IsNil(t, worker.Work(gCtx, tsk, &fifth), "fifth convert was successful")
+	testutil.Assert(t, false, fifth.Reused, "different options are processed")
+}
+
+// failingUploadS3 fails the first uploads of a key.
+type failingUploadS3 struct {
+	storage.Instance
+
+	mtx      sync.Mutex
+	key      string
+	failures int
+}
+
+func (f *failingUploadS3) UploadFile(ctx context.Context, opts *awss3.PutObjectInput) error {
+	f.mtx.Lock()
+	fail := aws.StringValue(opts.Key) == f.key && f.failures > 0
+	if fail {
+		f.failures--
+	}
+	f.mtx.Unlock()
+
+	if fail {
+		return errors.New("upload failed")
+	}
+
+	return f.Instance.UploadFile(ctx, opts)
+}
+
+func TestWorkerDedupReuploadFails(t *testing.T) {
+	t.Parallel()
+
+	decoder := &fakeStreamTool{streamFrames: 5}
+	gCtx, worker := streamTestWorker(t, decoder, &fakeStreamTool{})
+
+	failing := &failingUploadS3{
+		Instance: &copyingS3{Instance: gCtx.Inst().Storage},
+		key:      "original.gif",
+		failures: 1,
+	}
+	gCtx.Inst().Storage = failing
+
+	gCtx.Config().S3.Upload.MaxAttempts = 1
+	gCtx.Config().Worker.Cache.Dir = t.TempDir()
+
+	tsk := streamTestTask
+	tsk.Output.Prefix = "first"
+
+	first := task.Result{}
+	testutil.IsNil(t, worker.Work(gCtx, tsk, &first), "first convert was successful")
+
+	tsk.Output.Prefix = "second"
+	tsk.Input.Reupload = task.TaskInputReupload{
+		Enabled: true,
+		Bucket:  "output",
+		Key:     "original.gif",
+	}
+
+	// the outputs are copied but the reupload fails, so the task is processed instead
+	second := task.Result{}
+	testutil.IsNil(t, worker.Work(gCtx, tsk, &second), "second convert was successful")
+	testutil.Assert(t, 0, failing.failures, "the reupload of the reuse failed")
+	testutil.Assert(t, false, second.Reused, "second task is processed")
+	testutil.Assert(t, 2, len(decoder.calls), "second task is decoded")
+	testutil.Assert(t, len(first.ImageOutputs), len(second.ImageOutputs), "every output once")
+	testutil.Assert(t, len(first.SkippedOutputs), len(second.SkippedOutputs), "every skipped output once")
+
+	keys := map[string]bool{}
+	for _, output := range second.ImageOutputs {
+		testutil.Assert(t, false, keys[output.Key], "output is reported once "+output.Key)
+		keys[output.Key] = true
+	}
+}
+
+// failingCopyS3 fails the copies to keys under a prefix.
+type failingCopyS3 struct {
+	storage.Instance
+
+	prefix string
+}
+
+func (f *failingCopyS3) CopyFile(ctx context.Context, opts *awss3.CopyObjectInput) error {
+	if strings.HasPrefix(aws.StringValue(opts.Key), f.prefix) {
+		return errors.New("copy failed")
+	}
+
+	return f.Instance.CopyFile(ctx, opts)
+}
+
+func TestWorkerDedupReplicaFails(t *testing.T) {
+	t.Parallel()
+
+	decoder := &fakeStreamTool{streamFrames: 5}
+	gCtx, worker := streamTestWorker(t, decoder, &fakeStreamTool{})
+
+	gCtx.Inst().Storage = &failingCopyS3{
+		Instance: &copyingS3{Instance: gCtx.Inst().Storage},
+		prefix:   "replica/",
+	}
+
+	gCtx.Config().Worker.Cache.Dir = t.TempDir()
+
+	tsk := streamTestTask
+	tsk.Output.Prefix = "first"
+
+	first := task.Result{}
+	testutil.IsNil(t, worker.Work(gCtx, tsk, &first), "first convert was successful")
+
+	tsk.Output.Prefix = "second"
+	tsk.Output.Replicas = []task.TaskOutputReplica{{Prefix: "replica"}}
+
+	// the replica can not be copied so the quorum of the reuse fails, the uploads of the processed task write it
+	second := task.Result{}
+	testutil.IsNil(t, worker.Work(gCtx, tsk, &second), "second convert was successful")
+	testutil.Assert(t, false, second.Reused, "second task is processed")
+	testutil.Assert(t, task.ResultErrorNone, second.Error, "the quorum error of the reuse is not kept")
+	testutil.Assert(t, 1, len(second.Replicas), "status of the replica")
+	testutil.Assert(t, true, second.Replicas[0].Success, "replica was uploaded")
+	testutil.Assert(t, "", second.Replicas[0].Error, "replica has no error of the reuse")
+	testutil.Assert(t, len(second.ImageOutputs)+1, len(second.Replicas[0].Outputs), "every output and the archive are replicated once")
+}
+
+func TestDirLRU(t *testing.T) {
+	t.Parallel()
+
+	lru := &dirLRU{dir: t.TempDir(), maxBytes: 10}
+
+	testutil.IsNil(t, lru.put("a", []byte("aaaa")), "put a")
+	testutil.IsNil(t, lru.put("b", []byte("bbbb")), "put b")
+
+	old := time.Now().Add(-time.Hour)
+	testutil.IsNil(t, os.Chtimes(path.Join(lru.dir, "a"), old, old), "age a")
+	testutil.IsNil(t, os.Chtimes(path.Join(lru.dir, "b"), old.Add(time.Minute), old.Add(time.Minute)), "age b")
+
+	data, ok, err := lru.get("a")
+	testutil.IsNil(t, err, "get a")
+	testutil.Assert(t, true, ok, "a is cached")
+	testutil.Assert(t, "aaaa", string(data), "a contents")
+
+	testutil.IsNil(t, lru.put("c", []byte("cccc")), "put c")
+
+	_, ok, err = lru.get("b")
+	testutil.IsNil(t, err, "get b")
+	testutil.Assert(t, false, ok, "least recently used entry is evicted")
+
+	_, ok, _ = lru.get("a")
+	testutil.Assert(t, true, ok, "recently used entry is kept")
+
+	_, ok, _ = lru.get("c")
+	testutil.Assert(t, true, ok, "new entry is kept")
+}
@@ -0,0 +1,76 @@
+package image_processor
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/seventv/image-processor/go/internal/global"
+	"github.com/seventv/image-processor/go/task"
+	messagequeue "github.com/seventv/message-queue/go"
+	"go.uber.org/zap"
+)
+
+const (
+	// eventMessageType is the type of progress messages, results are published without one
+	eventMessageType = "task.progress"
+
+	eventPublishTimeout = 5 * time.Second
+)
+
+// eventQueues returns the queues the progress events of a task are published to, the reply queue only receives them
+// when the task asks for them so consumers which only expect results are not sent anything else.
+func eventQueues(ctx global.Context, tsk task.Task, replyTo string) []string {
+	queues := []string{}
+
+	if queue := ctx.Config().MessageQueue.EventsQueue; queue != "" {
+		queues = append(queues, queue)
+	}
+
+	if tsk.ProgressEvents && replyTo != "" && replyTo != ctx.Config().MessageQueue.EventsQueue {
+		queues = append(queues, replyTo)
+	}
+
+	return queues
+}
+
+// publishEvent publishes a progress event to the queues, failures are logged since the task goes on without them.
+func publishEvent(ctx global.Context, queues []string, event task.Event) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		zap.S().Errorw("failed to marshal event",
+			"error", err,
+			"task_id", event.ID,
+		)
+
+		return
+	}
+
+	pCtx, cancel := global.WithTimeout(ctx, eventPublishTimeout)
+	defer cancel()
+
+	for _, queue := range queues {
+		if err := ctx.Inst().MessageQueue.Publish(pCtx, messagequeue.OutgoingMessage{
+			Queue: queue,
+			Body:  data,
+			Headers: messagequeue.MessageHeaders{
+				"x-message-type": eventMessageType,
+			},
+			Flags: messagequeue.MessageFlags{
+				ContentType: "application/json",
+				Timestamp:   event.Timestamp,
+				RMQ: messagequeue.MessageFlagsRMQ{
+					DeliveryMode: messagequeue.RMQDeliveryModeTransient,
+					Type:         eventMessageType,
+				},
+				SQS: messagequeue.MessageFlagsSQS{},
+			},
+		}); err != nil {
+			zap.S().Warnw("failed to publish event",
+				"error", err,
+				"queue", queue,
+				"stage", event.Stage,
+				"task_id", event.ID,
+			)
+		}
+	}
+}
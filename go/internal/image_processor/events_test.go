@@ -0,0 +1,69 @@
+package image_processor
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/seventv/image-processor/go/internal/configure"
+	"github.com/seventv/image-processor/go/internal/global"
+	"github.com/seventv/image-processor/go/internal/testutil"
+	"github.com/seventv/image-processor/go/task"
+	messagequeue "github.com/seventv/message-queue/go"
+)
+
+func TestEventQueues(t *testing.T) {
+	t.Parallel()
+
+	config := &configure.Config{}
+
+	gCtx, cancel := global.WithCancel(global.New(context.Background(), config))
+	t.Cleanup(cancel)
+
+	testutil.Assert(t, 0, len(eventQueues(gCtx, task.Task{}, "reply")), "reply queues only get events when the task asks for them")
+	testutil.Assert(t, 1, len(eventQueues(gCtx, task.Task{ProgressEvents: true}, "reply")), "task asks for events")
+	testutil.Assert(t, 0, len(eventQueues(gCtx, task.Task{ProgressEvents: true}, "")), "message has no reply queue")
+
+	config.MessageQueue.EventsQueue = "events"
+
+	queues := eventQueues(gCtx, task.Task{}, "reply")
+	testutil.Assert(t, 1, len(queues), "events queue gets every event")
+	testutil.Assert(t, "events", queues[0], "events queue")
+
+	testutil.Assert(t, 2, len(eventQueues(gCtx, task.Task{ProgressEvents: true}, "reply")), "both queues")
+	testutil.Assert(t, 1, len(eventQueues(gCtx, task.Task{ProgressEvents: true}, "events")), "events are not published twice to the same queue")
+}
+
+func TestPublishEvent(t *testing.T) {
+	t.Parallel()
+
+	gCtx, cancel := global.WithCancel(global.New(context.Background(), &configure.Config{}))
+	t.Cleanup(cancel)
+
+	mq, err := messagequeue.New(gCtx, messagequeue.ConfigMock{})
+	testutil.IsNil(t, err, "mq init successful")
+
+	gCtx.Inst().MessageQueue = mq
+
+	publishEvent(gCtx, []string{"events"}, task.Event{
+		Type:       task.EventTypeProgress,
+		ID:         "task",
+		Stage:      task.EventStageExport,
+		State:      task.EventStateFinished,
+		FrameCount: 5,
+		Timestamp:  time.Now(),
+	})
+
+	ch, err := mq.Subscribe(gCtx, messagequeue.Subscription{Queue: "events"})
+	testutil.IsNil(t, err, "subscribe to the events queue")
+
+	msg := <-ch
+	testutil.Assert(t, eventMessageType, msg.Headers()["x-message-type"], "events have their own message type")
+
+	event := task.Event{}
+	testutil.IsNil(t, json.Unmarshal(msg.Body(), &event), "body is an event")
+	testutil.Assert(t, task.EventTypeProgress, event.Type, "event type")
+	testutil.Assert(t, task.EventStageExport, event.Stage, "event stage")
+	testutil.Assert(t, 5, event.FrameCount, "event frame count")
+}
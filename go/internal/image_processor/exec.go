@@ -0,0 +1,415 @@
+package image_processor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"sync"
+
+	"github.com/seventv/image-processor/go/internal/rawframe"
+	"github.com/seventv/image-processor/go/probe"
+	"go.uber.org/multierr"
+)
+
+func init() {
+	RegisterDecoder("dump_png", DumpPngDecoder{})
+	RegisterDecoder("ffmpeg", FfmpegDecoder{})
+	RegisterResizer("resize_png", ResizePngResizer{})
+	RegisterEncoder("convert_png", ConvertPngEncoder{})
+	RegisterEncoder("copy", CopyEncoder{})
+	RegisterOptimizer("gifsicle", GifsicleOptimizer{})
+	RegisterOptimizer("optipng", OptipngOptimizer{})
+}
+
+// DumpPngDecoder exports the frames of webp and avif files with dump_png.
+type DumpPngDecoder struct{}
+
+func (DumpPngDecoder) Decode(ctx context.Context, input string, outputDir string) error {
+	// Syntax: dump_png -i input.webp -o output
+	// Options:
+	//	 -h,--help                   : Shows syntax help
+	//	 -i,--input FILENAME         : Input file location (supported types are webp and avif).
+	//	 -o,--output FOLDER          : Output folder
+	//	 --info                      : Only output info dont dump the images
+	out, err := exec.CommandContext(ctx,
+		"dump_png",
+		"-i", input,
+		"-o", outputDir,
+	).CombinedOutput()
+	if err != nil {
+		return multierr.Append(fmt.Errorf("failed at dump_png"), multierr.Append(err, fmt.Errorf("dump_png failed: %s", out)))
+	}
+
+	return nil
+}
+
+func (DumpPngDecoder) DecodeStream(ctx context.Context, input string, info probe.Info, w io.Writer) error {
+	cmd := exec.CommandContext(ctx,
+		"dump_png",
+		"-i", input,
+		"-o", "-",
+	)
+	cmd.Stdout = w
+
+	return runStream(cmd)
+}
+
+// FfmpegDecoder exports the frames of images and videos with ffmpeg.
+type FfmpegDecoder struct{}
+
+func (FfmpegDecoder) Decode(ctx context.Context, input string, outputDir string) error {
+	out, err := exec.CommandContext(ctx,
+		"ffmpeg",
+		"-v", "error",
+		"-nostats",
+		"-hide_banner",
+		"-i", input,
+		"-vsync", "0",
+		"-f", "image2",
+		"-start_number", "0",
+		path.Join(outputDir, "%04d.png"),
+	).CombinedOutput()
+	if err != nil {
+		return multierr.Append(fmt.Errorf("failed at ffmpeg"), multierr.Append(err, fmt.Errorf("ffmpeg failed: %s", out)))
+	}
+
+	return nil
+}
+
+func (FfmpegDecoder) DecodeStream(ctx context.Context, input string, info probe.Info, w io.Writer) error {
+	cmd := exec.CommandContext(ctx,
+		"ffmpeg",
+		"-v", "error",
+		"-nostats",
+		"-hide_banner",
+		"-i", input,
+		"-vsync", "0",
+		"-f", "rawvideo",
+		"-pix_fmt", "rgba",
+		"pipe:1",
+	)
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return multierr.Append(fmt.Errorf("failed at ffmpeg"), err)
+	}
+
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+
+	if err := cmd.Start(); err != nil {
+		return multierr.Append(fmt.Errorf("failed at ffmpeg"), err)
+	}
+
+	// rawvideo has no framing so every width * height * 4 bytes is a frame of the size in the headers
+	frames := rawframe.NewWriter(w)
+	frame := rawframe.Frame{
+		Width:  info.Width,
+		Height: info.Height,
+		Pix:    make([]byte, info.Width*info.Height*4),
+	}
+
+	var copyErr error
+
+	for {
+		if _, err := io.ReadFull(stdout, frame.Pix); err == io.EOF {
+			break
+		} else if err != nil {
+			copyErr = multierr.Append(fmt.Errorf("failed at read ffmpeg frame"), err)
+			break
+		}
+
+		if err := frames.Write(frame); err != nil {
+			copyErr = multierr.Append(fmt.Errorf("failed at write frame"), err)
+			break
+		}
+	}
+
+	if copyErr != nil {
+		// ffmpeg has to be stopped as nothing reads the rest of its output
+		_ = cmd.Process.Kill()
+	}
+
+	if err := cmd.Wait(); err != nil && copyErr == nil {
+		return multierr.Append(fmt.Errorf("failed at ffmpeg"), multierr.Append(err, fmt.Errorf("ffmpeg failed: %s", stderr.Bytes())))
+	}
+
+	return copyErr
+}
+
+// ResizePngResizer resizes every frame in a single call to resize_png.
+type ResizePngResizer struct{}
+
+func (ResizePngResizer) Resize(ctx context.Context, frames []ResizeFrame) error {
+	// Syntax: resize_png [options] -i input.png -r 100 100 -o out.png -r 50 50 -o out2.png
+	// Options:
+	//	 -h,--help                   : Shows syntax help
+	//	 -i,--input FILENAME         : Input file location (supported types are png).
+	//	 -r,--resize 100 100         : The width and height
+	//	 -o,--output FILENAME        : Output filename (supported types are png).
+	resizeArgs := []string{}
+
+	for _, frame := range frames {
+		resizeArgs = append(resizeArgs, "-i", frame.Input)
+
+		for _, output := range frame.Outputs {
+			resizeArgs = append(resizeArgs,
+				"-r", strconv.Itoa(output.Width), strconv.Itoa(output.Height),
+				"--resize-ratio", fmt.Sprint(output.Ratio),
+				"-o", output.Output,
+			)
+		}
+	}
+
+	out, err := exec.CommandContext(ctx,
+		"resize_png",
+		resizeArgs...,
+	).CombinedOutput()
+	if err != nil {
+		return multierr.Append(fmt.Errorf("failed at resize_png"), multierr.Append(err, fmt.Errorf("resize_png failed: %s", out)))
+	}
+
+	return nil
+}
+
+func (ResizePngResizer) ResizeStream(ctx context.Context, r io.Reader, outputs []StreamOutput) error {
+	resizeArgs := []string{"--stream"}
+	files := make([]*os.File, 0, len(outputs))
+	readers := make([]*os.File, 0, len(outputs))
+
+	defer func() {
+		for _, f := range append(files, readers...) {
+			f.Close()
+		}
+	}()
+
+	for i, output := range outputs {
+		pr, pw, err := os.Pipe()
+		if err != nil {
+			return multierr.Append(fmt.Errorf("failed at pipe"), err)
+		}
+
+		readers = append(readers, pr)
+		files = append(files, pw)
+
+		// the write ends of the pipes are handed to resize_png as fd 3 and up
+		resizeArgs = append(resizeArgs,
+			"-r", strconv.Itoa(output.Width), strconv.Itoa(output.Height),
+			"--resize-ratio", fmt.Sprint(output.Ratio),
+			"-o", fmt.Sprintf("/dev/fd/%d", 3+i),
+		)
+	}
+
+	cmd := exec.CommandContext(ctx,
+		"resize_png",
+		resizeArgs...,
+	)
+	cmd.Stdin = r
+	cmd.ExtraFiles = files
+
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+
+	if err := cmd.Start(); err != nil {
+		return multierr.Append(fmt.Errorf("failed at resize_png"), err)
+	}
+
+	// only resize_png may hold the write ends now, otherwise the readers never see EOF
+	for _, f := range files {
+		f.Close()
+	}
+
+	files = nil
+
+	var (
+		wg      sync.WaitGroup
+		mtx     sync.Mutex
+		copyErr error
+	)
+
+	for i, output := range outputs {
+		wg.Add(1)
+
+		go func(pr *os.File, w io.Writer) {
+			defer wg.Done()
+
+			if _, err := io.Copy(w, pr); err != nil {
+				mtx.Lock()
+				copyErr = multierr.Append(copyErr, err)
+				mtx.Unlock()
+			}
+
+			// closing the read end makes resize_png fail instead of blocking when this output stopped early
+			pr.Close()
+		}(readers[i], output.W)
+	}
+
+	err := cmd.Wait()
+
+	wg.Wait()
+
+	if err != nil {
+		return multierr.Append(fmt.Errorf("failed at resize_png"), multierr.Append(err, fmt.Errorf("resize_png failed: %s", stderr.Bytes())))
+	}
+
+	if copyErr != nil {
+		return multierr.Append(fmt.Errorf("failed at copy resized frames"), copyErr)
+	}
+
+	return nil
+}
+
+// ConvertPngEncoder encodes avif, webp and gif outputs with convert_png, all outputs share one decode of the frames.
+type ConvertPngEncoder struct{}
+
+func (ConvertPngEncoder) Encode(ctx context.Context, opts EncodeOptions, frames []string, delays []int, outputs ...string) error {
+	// Syntax: convert_png [options] -i input.png -o output.webp -o output.gif -o output.avif
+	// Options:
+	//   -h,--help                   : Shows syntax help
+	//   -i,--input FILENAME         : Input file location (supported types are png).
+	//   -o,--output FILENAME        : Output file location (supported types are webp, avif, gif).
+	//   -d,--delay D                : Delay of the next frame in 100s of a second. (default 4 = 40ms)
+	//   -q,--quality Q              : Encoding quality from 1 to 100. (default 100)
+	// the max fps is 50fps
+	threads := opts.Threads
+	if threads <= 0 {
+		threads = 1
+	}
+
+	quality := opts.Quality
+	if quality <= 0 {
+		quality = 100
+	}
+
+	convertArgs := []string{
+		"-t", strconv.Itoa(threads),
+		"-q", strconv.Itoa(quality),
+	}
+
+	for i, frame := range frames {
+		if delays != nil {
+			convertArgs = append(convertArgs, "-d", strconv.Itoa(delays[i]))
+		}
+
+		convertArgs = append(convertArgs, "-i", frame)
+	}
+
+	for _, output := range outputs {
+		convertArgs = append(convertArgs, "-o", output)
+	}
+
+	out, err := exec.CommandContext(ctx,
+		"convert_png",
+		convertArgs...,
+	).CombinedOutput()
+	if err != nil {
+		return multierr.Append(fmt.Errorf("failed at convert_png"), multierr.Append(err, fmt.Errorf("convert_png failed: %s", out)))
+	}
+
+	return nil
+}
+
+func (ConvertPngEncoder) EncodeStream(ctx context.Context, opts EncodeOptions, r io.Reader, outputs ...string) error {
+	threads := opts.Threads
+	if threads <= 0 {
+		threads = 1
+	}
+
+	quality := opts.Quality
+	if quality <= 0 {
+		quality = 100
+	}
+
+	convertArgs := []string{
+		"-t", strconv.Itoa(threads),
+		"-q", strconv.Itoa(quality),
+		"-i", "-",
+	}
+
+	for _, output := range outputs {
+		convertArgs = append(convertArgs, "-o", output)
+	}
+
+	cmd := exec.CommandContext(ctx,
+		"convert_png",
+		convertArgs...,
+	)
+	cmd.Stdin = r
+
+	return runStream(cmd)
+}
+
+// CopyEncoder copies a single png frame as is, it is meant to be followed by a png optimizer.
+type CopyEncoder struct{}
+
+func (CopyEncoder) Encode(ctx context.Context, opts EncodeOptions, frames []string, delays []int, outputs ...string) error {
+	if len(frames) != 1 {
+		return fmt.Errorf("failed at copy png: expected 1 frame got %d", len(frames))
+	}
+
+	for _, output := range outputs {
+		if _, err := copyFile(frames[0], output); err != nil {
+			return multierr.Append(fmt.Errorf("failed at copy png"), err)
+		}
+	}
+
+	return nil
+}
+
+// GifsicleOptimizer optimizes gifs with gifsicle, limiting the palette to the number of colors.
+type GifsicleOptimizer struct{}
+
+func (GifsicleOptimizer) Optimize(ctx context.Context, output string, opts OptimizeOptions) error {
+	colors := opts.Colors
+	if colors <= 0 {
+		colors = 256
+	}
+
+	out, err := exec.CommandContext(ctx,
+		"gifsicle",
+		"-O3",
+		"--colors", strconv.Itoa(colors),
+		"-b",
+		output,
+	).CombinedOutput()
+	if err != nil {
+		return multierr.Append(fmt.Errorf("failed at gifsicle"), multierr.Append(err, fmt.Errorf("gifsicle failed: %s", out)))
+	}
+
+	return nil
+}
+
+// OptipngOptimizer losslessly optimizes pngs with optipng.
+type OptipngOptimizer struct{}
+
+func (OptipngOptimizer) Optimize(ctx context.Context, output string, opts OptimizeOptions) error {
+	out, err := exec.CommandContext(ctx,
+		"optipng",
+		"-o6",
+		output,
+	).CombinedOutput()
+	if err != nil {
+		return multierr.Append(fmt.Errorf("failed at optipng"), multierr.Append(err, fmt.Errorf("optipng failed: %s", out)))
+	}
+
+	return nil
+}
+
+// runStream runs a tool that reads or writes a frame stream, only stderr is kept for the error.
+func runStream(cmd *exec.Cmd) error {
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+
+	name := path.Base(cmd.Path)
+
+	if err := cmd.Run(); err != nil {
+		return multierr.Append(fmt.Errorf("failed at %s", name), multierr.Append(err, fmt.Errorf("%s failed: %s", name, stderr.Bytes())))
+	}
+
+	return nil
+}
@@ -0,0 +1,233 @@
+package image_processor
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/seventv/image-processor/go/internal/global"
+	"github.com/seventv/image-processor/go/task"
+	"go.uber.org/multierr"
+)
+
+const (
+	defaultHTTPInputTimeout      = 30 * time.Second
+	defaultHTTPInputMaxRedirects = 5
+	defaultHTTPInputUserAgent    = "7TV Image Processor"
+)
+
+// errBlockedAddress means the input url resolves to an address inputs are not fetched from.
+var errBlockedAddress = errors.New("address is blocked")
+
+// privateNetworks are never connected to unless private addresses are allowed, so a task can not make the worker
+// reach services on its own network. The NAT64 and 6to4 prefixes embed ipv4 addresses which would otherwise get around
+// the ipv4 ranges, ipv4-mapped addresses need no range as they are checked as the ipv4 address.
+var privateNetworks = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"64:ff9b::/96",
+	"64:ff9b:1::/48",
+	"2002::/16",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+}
+
+// inputContentTypes are the media types a url input may be served as, the format is still sniffed from the contents.
+var inputContentTypes = []string{"image/", "video/", "application/octet-stream", "binary/octet-stream"}
+
+// blockedNetworks returns the networks url inputs may not resolve to.
+func blockedNetworks(ctx global.Context) ([]*net.IPNet, error) {
+	config := ctx.Config().Worker.HTTPInput
+
+	cidrs := append([]string{}, config.BlockedNetworks...)
+	if !config.AllowPrivateAddresses {
+		cidrs = append(cidrs, privateNetworks...)
+	}
+
+	networks := make([]*net.IPNet, 0, len(cidrs))
+
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, multierr.Append(fmt.Errorf("failed at parse blocked network %s", cidr), err)
+		}
+
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// httpInputClient returns a client which checks every address it connects to, including the ones of redirects.
+func httpInputClient(ctx global.Context) (*http.Client, error) {
+	config := ctx.Config().Worker.HTTPInput
+
+	networks, err := blockedNetworks(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = defaultHTTPInputTimeout
+	}
+
+	maxRedirects := config.MaxRedirects
+	if maxRedirects == 0 {
+		maxRedirects = defaultHTTPInputMaxRedirects
+	}
+
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: blockingTransport(networks, timeout),
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if maxRedirects < 0 || len(via) > maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", len(via))
+			}
+
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return fmt.Errorf("redirect to unsupported scheme %s", req.URL.Scheme)
+			}
+
+			return nil
+		},
+	}, nil
+}
+
+// isBlocked reports if the address is in one of the networks, ipv4-mapped ipv6 addresses are matched as ipv4.
+func isBlocked(networks []*net.IPNet, ip net.IP) bool {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// blockingTransport returns a transport which refuses to connect to the networks, the address is checked after the host
+// is resolved so a name can not resolve to a blocked address between the check and the connection.
+func blockingTransport(networks []*net.IPNet, timeout time.Duration) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+
+			ip := net.ParseIP(host)
+			if ip == nil {
+				return fmt.Errorf("%w: %s is not an ip", errBlockedAddress, host)
+			}
+
+			if isBlocked(networks, ip) {
+				return fmt.Errorf("%w: %s", errBlockedAddress, ip)
+			}
+
+			return nil
+		},
+	}
+
+	return &http.Transport{
+		// a proxy would be connected to instead of the host so it is never used
+		Proxy:                 nil,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   timeout,
+		ResponseHeaderTimeout: timeout,
+		DisableKeepAlives:     true,
+	}
+}
+
+// downloadURL writes the input of the task at its url to output, inputs larger than maxBytes fail with errLimitExceeded.
+func downloadURL(ctx global.Context, tsk task.Task, output io.Writer, maxBytes int64) error {
+	u, err := url.Parse(tsk.Input.URL)
+	if err != nil {
+		return multierr.Append(fmt.Errorf("failed at parse url"), err)
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported url scheme %s", u.Scheme)
+	}
+
+	client, err := httpInputClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return multierr.Append(fmt.Errorf("failed at create request"), err)
+	}
+
+	userAgent := ctx.Config().Worker.HTTPInput.UserAgent
+	if userAgent == "" {
+		userAgent = defaultHTTPInputUserAgent
+	}
+
+	req.Header.Set("User-Agent", userAgent)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	if contentType := resp.Header.Get("Content-Type"); contentType != "" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			return multierr.Append(fmt.Errorf("failed at parse content type %s", contentType), err)
+		}
+
+		if !allowedContentType(mediaType) {
+			return fmt.Errorf("unsupported content type %s", mediaType)
+		}
+	}
+
+	if maxBytes > 0 && resp.ContentLength > maxBytes {
+		return fmt.Errorf("%w: content length is %d bytes", errLimitExceeded, resp.ContentLength)
+	}
+
+	if _, err := io.Copy(output, resp.Body); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func allowedContentType(mediaType string) bool {
+	for _, allowed := range inputContentTypes {
+		if strings.HasSuffix(allowed, "/") && strings.HasPrefix(mediaType, allowed) || mediaType == allowed {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,167 @@
+package image_processor
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/seventv/image-processor/go/internal/configure"
+	"github.com/seventv/image-processor/go/internal/global"
+	"github.com/seventv/image-processor/go/internal/testutil"
+	"github.com/seventv/image-processor/go/task"
+)
+
+func httpInputServer(t *testing.T) *httptest.Server {
+	_, cwd, _, _ := runtime.Caller(0)
+	data := testutil.ReadFile(t, path.Join(path.Dir(cwd), "..", "..", "..", "assets", "animated-1.gif"))
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/animated-1.gif", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/gif")
+		_, _ = w.Write(data)
+	})
+
+	mux.HandleFunc("/untyped", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		_, _ = w.Write(data)
+	})
+
+	mux.HandleFunc("/page.html", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write(data)
+	})
+
+	mux.HandleFunc("/text.gif", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/gif")
+		_, _ = w.Write([]byte("not a gif"))
+	})
+
+	mux.HandleFunc("/missing", func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	})
+
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	})
+
+	mux.HandleFunc("/redirect/", func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(path.Base(r.URL.Path))
+		if n == 0 {
+			http.Redirect(w, r, "/animated-1.gif", http.StatusFound)
+
+			return
+		}
+
+		http.Redirect(w, r, "/redirect/"+strconv.Itoa(n-1), http.StatusFound)
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func httpInputContext(t *testing.T, allowPrivate bool) global.Context {
+	config := &configure.Config{}
+	config.Worker.HTTPInput.AllowPrivateAddresses = allowPrivate
+	config.Worker.HTTPInput.MaxRedirects = 2
+	config.Worker.HTTPInput.Timeout = 200 * time.Millisecond
+
+	gCtx, cancel := global.WithCancel(global.New(context.Background(), config))
+	t.Cleanup(cancel)
+
+	return gCtx
+}
+
+func TestDownloadURL(t *testing.T) {
+	t.Parallel()
+
+	server := httpInputServer(t)
+	gCtx := httpInputContext(t, true)
+
+	for _, pth := range []string{"/animated-1.gif", "/untyped", "/redirect/1"} {
+		result := task.Result{}
+
+		match, inputFile, size, _, err := Worker{}.downloadFile(gCtx, task.Task{
+			Input: task.TaskInput{URL: server.URL + pth},
+		}, t.TempDir(), &result)
+		testutil.IsNil(t, err, pth+" is downloaded")
+		testutil.Assert(t, "gif", match.Extension, pth+" is sniffed")
+		testutil.Assert(t, "input.gif", path.Base(inputFile), pth+" input file")
+		testutil.Assert(t, true, size > 0, pth+" size")
+	}
+
+	for _, pth := range []string{"/page.html", "/text.gif", "/missing", "/slow", "/redirect/5"} {
+		result := task.Result{}
+
+		_, _, _, _, err := Worker{}.downloadFile(gCtx, task.Task{
+			Input: task.TaskInput{URL: server.URL + pth},
+		}, t.TempDir(), &result)
+		testutil.IsNotNil(t, err, pth+" is rejected")
+	}
+
+	_, _, _, _, err := Worker{}.downloadFile(gCtx, task.Task{
+		Input: task.TaskInput{URL: "file:///etc/passwd"},
+	}, t.TempDir(), &task.Result{})
+	testutil.IsNotNil(t, err, "only http urls are downloaded")
+
+	result := task.Result{}
+
+	_, _, _, _, err = Worker{}.downloadFile(gCtx, task.Task{
+		Input:  task.TaskInput{URL: server.URL + "/animated-1.gif"},
+		Limits: task.TaskLimits{MaxInputBytes: 16},
+	}, t.TempDir(), &result)
+	testutil.IsNotNil(t, err, "large inputs are rejected")
+	testutil.Assert(t, task.ResultErrorInputTooLarge, result.Error, "result error")
+}
+
+func TestDownloadURLBlocked(t *testing.T) {
+	t.Parallel()
+
+	server := httpInputServer(t)
+
+	result := task.Result{}
+
+	_, _, _, _, err := Worker{}.downloadFile(httpInputContext(t, false), task.Task{
+		Input: task.TaskInput{URL: server.URL + "/animated-1.gif"},
+	}, t.TempDir(), &result)
+	testutil.IsNotNil(t, err, "private addresses are blocked")
+	testutil.Assert(t, true, errors.Is(err, errBlockedAddress), "blocked error")
+	testutil.Assert(t, task.ResultErrorInputBlocked, result.Error, "result error")
+
+	gCtx := httpInputContext(t, true)
+	gCtx.Config().Worker.HTTPInput.BlockedNetworks = []string{"127.0.0.0/8"}
+
+	result = task.Result{}
+
+	_, _, _, _, err = Worker{}.downloadFile(gCtx, task.Task{
+		Input: task.TaskInput{URL: server.URL + "/animated-1.gif"},
+	}, t.TempDir(), &result)
+	testutil.Assert(t, true, errors.Is(err, errBlockedAddress), "configured networks are blocked")
+}
+
+func TestBlockedNetworks(t *testing.T) {
+	t.Parallel()
+
+	networks, err := blockedNetworks(httpInputContext(t, false))
+	testutil.IsNil(t, err, "private networks parse")
+
+	for _, addr := range []string{"127.0.0.1", "10.1.2.3", "169.254.169.254", "::1", "fd00::1", "::ffff:127.0.0.1", "::ffff:169.254.169.254", "64:ff9b::7f00:1", "64:ff9b::a9fe:a9fe", "2002:7f00:1::1", "2002:a9fe:a9fe::1"} {
+		testutil.Assert(t, true, isBlocked(networks, net.ParseIP(addr)), addr+" is blocked")
+	}
+
+	for _, addr := range []string{"1.1.1.1", "2606:4700:4700::1111", "::ffff:1.1.1.1"} {
+		testutil.Assert(t, false, isBlocked(networks, net.ParseIP(addr)), addr+" is allowed")
+	}
+}
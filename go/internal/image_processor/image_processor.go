@@ -13,12 +13,21 @@ import (
 	"go.uber.org/zap"
 )
 
-func Run(gCtx global.Context) {
+// Run starts processing tasks, the channel is closed once the worker stopped with the context
+// and delivered the results of its last tasks.
+func Run(gCtx global.Context) <-chan struct{} {
 	jobCount := gCtx.Config().Worker.Jobs
 	if jobCount <= 0 {
 		jobCount = runtime.GOMAXPROCS(0)
 	}
 
+	// the configured tools are resolved once up front so a typo fails at startup instead of on every task
+	if _, err := NewPipeline(gCtx.Config()); err != nil {
+		zap.S().Fatalw("invalid worker pipeline",
+			"error", err,
+		)
+	}
+
 	workers := make(chan Worker, jobCount)
 	blockers := make(chan struct{}, jobCount-1)
 
@@ -30,6 +39,9 @@ func Run(gCtx global.Context) {
 		}
 	}
 
+	cancels := newCancellations()
+	webhooks := newWebhookSender(gCtx)
+
 	go func() {
 		first := true
 		for gCtx.Err() == nil {
@@ -39,14 +51,61 @@ func Run(gCtx global.Context) {
 				first = false
 			}
 
-			retryProcess(gCtx, workers, blockers)
+			retryProcess(gCtx, workers, blockers, cancels, webhooks)
+		}
+	}()
+
+	if gCtx.Config().MessageQueue.ControlQueue != "" {
+		go func() {
+			first := true
+			for gCtx.Err() == nil {
+				if !first {
+					time.Sleep(time.Second * 5)
+				} else {
+					first = false
+				}
+
+				retryControl(gCtx, cancels)
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		<-gCtx.Done()
+
+		drainTimeout := gCtx.Config().Worker.Webhook.DrainTimeout
+		if drainTimeout <= 0 {
+			drainTimeout = defaultWebhookDrainTimeout
+		}
+
+		deadline := time.Now().Add(drainTimeout)
+
+		// the tasks still running send their results before the queue is closed
+		for i := 0; i < jobCount; i++ {
+			select {
+			case <-workers:
+			case <-time.After(time.Until(deadline)):
+				zap.S().Errorw("tasks did not stop in time",
+					"running", jobCount-i,
+				)
+
+				i = jobCount
+			}
 		}
+
+		webhooks.close(time.Until(deadline))
 	}()
 
 	zap.S().Infof("Starting job worker with %d jobs", jobCount)
+
+	return done
 }
 
-func retryProcess(gCtx global.Context, workers chan Worker, blockers chan struct{}) {
+func retryProcess(gCtx global.Context, workers chan Worker, blockers chan struct{}, cancels *cancellations, webhooks *webhookSender) {
 	defer func() {
 		if err := recover(); err != nil {
 			zap.S().Errorw("panic in process",
@@ -79,12 +138,12 @@ func retryProcess(gCtx global.Context, workers chan Worker, blockers chan struct
 				return
 			}
 
-			process(gCtx, msg, workers, blockers)
+			process(gCtx, msg, workers, blockers, cancels, webhooks)
 		}
 	}
 }
 
-func process(gCtx global.Context, msg *messagequeue.IncomingMessage, workers chan Worker, blockers chan struct{}) {
+func process(gCtx global.Context, msg *messagequeue.IncomingMessage, workers chan Worker, blockers chan struct{}, cancels *cancellations, webhooks *webhookSender) {
 	defer func() {
 		if err := recover(); err != nil {
 			zap.S().Errorw("panic in process",
@@ -118,7 +177,55 @@ func process(gCtx global.Context, msg *messagequeue.IncomingMessage, workers cha
 		"msg_id", msg.ID(),
 	)
 
-	worker := <-workers
+	result := task.Result{
+		ID:       t.ID,
+		State:    task.ResultStateFailed,
+		Metadata: t.Metadata,
+	}
+
+	// a cancel message cancels base, the processing time only starts counting once there is a worker
+	base, cancelBase := global.WithCancel(gCtx)
+	handle, skipped := cancels.start(t.ID, cancelBase)
+
+	var worker Worker
+
+	if !skipped {
+		select {
+		case worker = <-workers:
+		case <-base.Done():
+			skipped = cancels.isCancelled(handle)
+			if !skipped {
+				// the worker is shutting down, the message is delivered again
+				cancels.finish(t.ID, handle)
+				cancelBase()
+
+				return
+			}
+		}
+	}
+
+	if skipped {
+		cancels.finish(t.ID, handle)
+		cancelBase()
+
+		zap.S().Infow("skipped cancelled task",
+			"id", t.ID,
+			"msg_id", msg.ID(),
+		)
+
+		result.State = task.ResultStateCancelled
+		result.Message = "task was cancelled before it started"
+
+		if err := msg.Ack(gCtx); err != nil {
+			zap.S().Errorw("failed to ack task",
+				"error", err,
+			)
+		}
+
+		publishResult(gCtx, webhooks, t, headers.ReplyTo(), result)
+
+		return
+	}
 
 	var (
 		ctx    global.Context
@@ -126,15 +233,9 @@ func process(gCtx global.Context, msg *messagequeue.IncomingMessage, workers cha
 	)
 
 	if t.Limits.MaxProcessingTime != 0 {
-		ctx, cancel = global.WithTimeout(gCtx, t.Limits.MaxProcessingTime)
+		ctx, cancel = global.WithTimeout(base, t.Limits.MaxProcessingTime)
 	} else {
-		ctx, cancel = global.WithCancel(gCtx)
-	}
-
-	result := task.Result{
-		ID:       t.ID,
-		State:    task.ResultStateFailed,
-		Metadata: t.Metadata,
+		ctx, cancel = global.WithCancel(base)
 	}
 
 	go func() {
@@ -146,6 +247,8 @@ func process(gCtx global.Context, msg *messagequeue.IncomingMessage, workers cha
 			}
 
 			cancel()
+			cancelBase()
+			cancels.finish(t.ID, handle)
 			blockers <- struct{}{}
 			workers <- worker
 
@@ -174,50 +277,83 @@ func process(gCtx global.Context, msg *messagequeue.IncomingMessage, workers cha
 			}
 		}()
 
-		err := worker.Work(ctx, t, &result)
-		if err != nil {
-			err = multierr.Append(err, msg.Nack(gCtx))
-			zap.S().Errorw("task processing failed",
-				"error", err,
-			)
-		} else if err = msg.Ack(gCtx); err != nil {
-			zap.S().Errorw("failed to ack task",
-				"error", err,
-			)
-		} else {
-			result.State = task.ResultStateSuccess
+		// the worker goes back to the pool, only this task reports its progress
+		w := worker
+		if queues := eventQueues(gCtx, t, headers.ReplyTo()); len(queues) != 0 {
+			w.Progress = func(event task.Event) {
+				publishEvent(ctx, queues, event)
+			}
 		}
 
-		if err != nil {
-			result.Message = err.Error()
-		}
+		err := w.Work(ctx, t, &result)
+		if err != nil && cancels.isCancelled(handle) {
+			zap.S().Infow("task was cancelled",
+				"id", t.ID,
+				"msg_id", msg.ID(),
+			)
+
+			result.State = task.ResultStateCancelled
+			result.Message = "task was cancelled"
 
-		if headers.ReplyTo() != "" {
-			resultData, err := json.Marshal(result)
+			// cancelled tasks are not processed again, what was uploaded before the cancel is removed
+			if err := multierr.Append(removeOutputs(gCtx, t, &result), msg.Ack(gCtx)); err != nil {
+				zap.S().Errorw("failed to clean up cancelled task",
+					"error", err,
+				)
+			}
+		} else {
 			if err != nil {
-				zap.S().Errorw("failed to marshal result",
+				err = multierr.Append(err, msg.Nack(gCtx))
+				zap.S().Errorw("task processing failed",
+					"error", err,
+				)
+			} else if err = msg.Ack(gCtx); err != nil {
+				zap.S().Errorw("failed to ack task",
 					"error", err,
 				)
 			} else {
-				if err := gCtx.Inst().MessageQueue.Publish(ctx, messagequeue.OutgoingMessage{
-					Queue: headers.ReplyTo(),
-					Body:  resultData,
-					Flags: messagequeue.MessageFlags{
-						ContentType: "application/json",
-						Timestamp:   time.Now(),
-						RMQ: messagequeue.MessageFlagsRMQ{
-							DeliveryMode: messagequeue.RMQDeliveryModePersistent,
-						},
-						SQS: messagequeue.MessageFlagsSQS{},
-					},
-				}); err != nil {
-					zap.S().Errorw("failed to publish result",
-						"error", err,
-					)
-				}
+				result.State = task.ResultStateSuccess
+			}
+
+			if err != nil {
+				result.Message = err.Error()
 			}
 		}
+
+		publishResult(gCtx, webhooks, t, headers.ReplyTo(), result)
 	}()
 
 	<-blockers
 }
+
+// publishResult sends the result to the reply queue of the message and queues it for the callback url of the task.
+// The context of the worker is used since the one of the task can be cancelled or out of time.
+func publishResult(gCtx global.Context, webhooks *webhookSender, t task.Task, replyTo string, result task.Result) {
+	if replyTo != "" {
+		resultData, err := json.Marshal(result)
+		if err != nil {
+			zap.S().Errorw("failed to marshal result",
+				"error", err,
+			)
+		} else {
+			if err := gCtx.Inst().MessageQueue.Publish(gCtx, messagequeue.OutgoingMessage{
+				Queue: replyTo,
+				Body:  resultData,
+				Flags: messagequeue.MessageFlags{
+					ContentType: "application/json",
+					Timestamp:   time.Now(),
+					RMQ: messagequeue.MessageFlagsRMQ{
+						DeliveryMode: messagequeue.RMQDeliveryModePersistent,
+					},
+					SQS: messagequeue.MessageFlagsSQS{},
+				},
+			}); err != nil {
+				zap.S().Errorw("failed to publish result",
+					"error", err,
+				)
+			}
+		}
+	}
+
+	webhooks.send(t, result)
+}
@@ -8,11 +8,10 @@ import (
 	"testing"
 	"time"
 
-	"github.com/seventv/common/svc/s3"
-
 	"github.com/seventv/image-processor/go/internal/configure"
 	"github.com/seventv/image-processor/go/internal/global"
 	"github.com/seventv/image-processor/go/internal/svc/prometheus"
+	"github.com/seventv/image-processor/go/internal/svc/storage"
 	"github.com/seventv/image-processor/go/internal/testutil"
 	"github.com/seventv/image-processor/go/task"
 
@@ -40,7 +39,7 @@ func TestRun(t *testing.T) {
 	_, cwd, _, _ := runtime.Caller(0)
 	assetDir := path.Join(path.Dir(cwd), "..", "..", "..", "assets")
 
-	gCtx.Inst().S3, err = s3.NewMock(gCtx, map[string]map[string][]byte{
+	gCtx.Inst().Storage, err = storage.NewMock(gCtx, map[string]map[string][]byte{
 		"input": {
 			"animated-2.gif": testutil.ReadFile(t, path.Join(assetDir, "animated-2.gif")),
 		},
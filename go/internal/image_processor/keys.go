@@ -0,0 +1,172 @@
+package image_processor
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/seventv/image-processor/go/task"
+)
+
+// outputKeyVars are the values the placeholders of a key template are replaced with.
+type outputKeyVars struct {
+	Name       string // 2x, 2x_static or archive
+	Ext        string // avif, webp, gif, png, zip or tar.zst
+	FrameCount int
+	InputSHA3  string
+	SHA3       string
+}
+
+// outputExtensions maps the content types of the outputs to their extension, a key can be laid out without one.
+var outputExtensions = map[string]string{
+	"image/avif":       "avif",
+	"image/webp":       "webp",
+	"image/gif":        "gif",
+	"image/png":        "png",
+	"application/zip":  "zip",
+	"application/zstd": "tar.zst",
+}
+
+// outputExt returns the extension of a stored output, by its content type first and its key otherwise.
+func outputExt(file task.ResultFile) string {
+	if ext, ok := outputExtensions[file.ContentType]; ok {
+		return ext
+	}
+
+	return strings.TrimPrefix(path.Ext(file.Key), ".")
+}
+
+func (v outputKeyVars) isArchive() bool {
+	return v.Name == "archive"
+}
+
+// scale returns the scale of the output without the x, the archive has none.
+func (v outputKeyVars) scale() string {
+	if v.isArchive() {
+		return ""
+	}
+
+	return strings.TrimSuffix(strings.TrimSuffix(v.Name, "_static"), "x")
+}
+
+// storage returns where and how the output is stored after applying the overrides of the task.
+func (v outputKeyVars) storage(tsk task.Task) task.TaskOutputStorage {
+	scale, _ := strconv.Atoi(v.scale())
+
+	return tsk.Output.Storage(v.Ext, scale)
+}
+
+// placeholder returns the value of a placeholder of a key template, ok is false for unknown placeholders.
+func (v outputKeyVars) placeholder(tsk task.Task, name string) (value string, ok bool) {
+	isArchive := v.isArchive()
+	isStatic := strings.HasSuffix(v.Name, "_static")
+
+	switch name {
+	case "id":
+		return tsk.ID, true
+	case "prefix":
+		return tsk.Output.Prefix, true
+	case "name":
+		return v.Name, true
+	case "scale":
+		return v.scale(), true
+	case "ext", "format":
+		return v.Ext, true
+	case "static":
+		if isStatic {
+			return "_static", true
+		}
+
+		return "", true
+	case "kind":
+		switch {
+		case isArchive:
+			return "archive", true
+		case isStatic || v.FrameCount <= 1:
+			return "static", true
+		default:
+			return "animated", true
+		}
+	case "input_sha3":
+		return v.InputSHA3, true
+	case "sha3":
+		return v.SHA3, true
+	}
+
+	return "", false
+}
+
+// outputKey returns where an output is stored, without a key template it is stored under the prefix by its file name.
+func outputKey(tsk task.Task, v outputKeyVars) (string, error) {
+	if tsk.Output.KeyTemplate == "" {
+		return path.Join(tsk.Output.Prefix, v.Name+"."+v.Ext), nil
+	}
+
+	key, err := expandKeyTemplate(tsk.Output.KeyTemplate, func(name string) (string, bool) {
+		return v.placeholder(tsk, name)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	// placeholders which are empty can leave duplicate or leading slashes
+	key = strings.TrimPrefix(path.Clean("/"+key), "/")
+	if key == "" {
+		return "", fmt.Errorf("key template %q is empty for %s.%s", tsk.Output.KeyTemplate, v.Name, v.Ext)
+	}
+
+	return key, nil
+}
+
+// validateKeyTemplate checks the placeholders of the template before the task is processed.
+func validateKeyTemplate(tsk task.Task) error {
+	if tsk.Output.KeyTemplate == "" {
+		return nil
+	}
+
+	_, err := expandKeyTemplate(tsk.Output.KeyTemplate, func(name string) (string, bool) {
+		return outputKeyVars{}.placeholder(tsk, name)
+	})
+
+	return err
+}
+
+// expandKeyTemplate replaces every {placeholder} of the template with its value.
+func expandKeyTemplate(tmpl string, lookup func(name string) (string, bool)) (string, error) {
+	sb := strings.Builder{}
+
+	for {
+		start := strings.IndexByte(tmpl, '{')
+		if start == -1 {
+			if strings.IndexByte(tmpl, '}') != -1 {
+				return "", fmt.Errorf("unmatched } in key template")
+			}
+
+			sb.WriteString(tmpl)
+
+			return sb.String(), nil
+		}
+
+		end := strings.IndexByte(tmpl[start:], '}')
+		if end == -1 {
+			return "", fmt.Errorf("unmatched { in key template")
+		}
+
+		if strings.IndexByte(tmpl[:start], '}') != -1 {
+			return "", fmt.Errorf("unmatched } in key template")
+		}
+
+		name := tmpl[start+1 : start+end]
+
+		value, ok := lookup(name)
+		if !ok {
+			return "", fmt.Errorf("unknown placeholder {%s} in key template", name)
+		}
+
+		sb.WriteString(tmpl[:start])
+		sb.WriteString(value)
+
+		tmpl = tmpl[start+end+1:]
+	}
+}
@@ -0,0 +1,133 @@
+package image_processor
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/seventv/image-processor/go/internal/testutil"
+	"github.com/seventv/image-processor/go/task"
+)
+
+func TestOutputKey(t *testing.T) {
+	t.Parallel()
+
+	tsk := task.Task{
+		ID: "id",
+		Output: task.TaskOutput{
+			Prefix: "prefix",
+		},
+	}
+
+	animated := outputKeyVars{Name: "2x", Ext: "webp", FrameCount: 5, InputSHA3: "input", SHA3: "output"}
+	static := outputKeyVars{Name: "2x_static", Ext: "png", FrameCount: 1, InputSHA3: "input", SHA3: "output"}
+	archive := outputKeyVars{Name: "archive", Ext: "zip", InputSHA3: "input", SHA3: "output"}
+
+	tests := []struct {
+		template string
+		vars     outputKeyVars
+		key      string
+	}{
+		{"", animated, "prefix/2x.webp"},
+		{"emote/{id}/{scale}x.{ext}", animated, "emote/id/2x.webp"},
+		{"emote/{id}/{scale}x{static}.{format}", static, "emote/id/2x_static.png"},
+		{"{sha3}.{ext}", animated, "output.webp"},
+		{"{prefix}/{input_sha3}/{kind}/{name}.{ext}", animated, "prefix/input/animated/2x.webp"},
+		{"{kind}/{name}.{ext}", static, "static/2x_static.png"},
+		{"{prefix}/{kind}/{scale}/{name}.{ext}", archive, "prefix/archive/archive.zip"},
+		{"/{id}//{name}.{ext}", animated, "id/2x.webp"},
+	}
+
+	for _, test := range tests {
+		tsk.Output.KeyTemplate = test.template
+
+		key, err := outputKey(tsk, test.vars)
+		testutil.IsNil(t, err, test.template)
+		testutil.Assert(t, test.key, key, test.template)
+	}
+
+	for _, template := range []string{"{nope}.{ext}", "{id", "id}", "{}"} {
+		tsk.Output.KeyTemplate = template
+
+		testutil.IsNotNil(t, validateKeyTemplate(tsk), template)
+	}
+
+	tsk.Output.KeyTemplate = "{static}"
+
+	_, err := outputKey(tsk, animated)
+	testutil.IsNotNil(t, err, "empty keys are rejected")
+}
+
+func TestWorkerKeyTemplate(t *testing.T) {
+	t.Parallel()
+
+	decoder := &fakeStreamTool{streamFrames: 5}
+	gCtx, worker := streamTestWorker(t, decoder, &fakeStreamTool{})
+
+	tsk := streamTestTask
+	tsk.ID = "task"
+	tsk.Output.KeyTemplate = "emote/{id}/{scale}x{static}.{ext}"
+
+	result := task.Result{}
+	testutil.IsNil(t, worker.Work(gCtx, tsk, &result), "convert was successful")
+
+	for _, output := range result.ImageOutputs {
+		testutil.Assert(t, "emote/task/"+output.Name+"."+outputExt(output), output.Key, "output key follows the template")
+		downloaded(t, gCtx, output.Key)
+	}
+
+	testutil.Assert(t, "emote/task/x.zip", result.ArchiveOutput.Key, "archive has no scale")
+
+	tsk.Output.KeyTemplate = "{sha3}.{ext}"
+
+	result = task.Result{}
+	testutil.IsNil(t, worker.Work(gCtx, tsk, &result), "content addressed convert was successful")
+
+	for _, output := range result.ImageOutputs {
+		testutil.Assert(t, output.SHA3+"."+outputExt(output), output.Key, "output is stored by its hash")
+	}
+
+	tsk.Output.KeyTemplate = "{unknown}"
+
+	calls := len(decoder.calls)
+
+	result = task.Result{}
+	testutil.IsNotNil(t, worker.Work(gCtx, tsk, &result), "unknown placeholders fail the task")
+	testutil.Assert(t, calls, len(decoder.calls), "the task fails before it is processed")
+}
+
+func TestUploadResultsDuplicateKeys(t *testing.T) {
+	t.Parallel()
+
+	gCtx, _, _ := uploadTestContext(t, 0, 0)
+
+	tmpDir := t.TempDir()
+	resultsDir := path.Join(tmpDir, "results")
+	variantsDir := path.Join(tmpDir, "variants")
+
+	testutil.IsNil(t, os.MkdirAll(resultsDir, 0700), "mkdir results")
+	testutil.IsNil(t, os.MkdirAll(variantsDir, 0700), "mkdir variants")
+
+	testutil.IsNil(t, os.WriteFile(path.Join(resultsDir, "1x.txt"), []byte("animated"), 0600), "write file")
+	testutil.IsNil(t, os.WriteFile(path.Join(resultsDir, "1x_static.txt"), []byte("static"), 0600), "write file")
+
+	tsk := task.Task{
+		Output: task.TaskOutput{
+			Bucket:      "output",
+			KeyTemplate: "{scale}x.{ext}",
+		},
+	}
+
+	err := Worker{}.uploadResults(tmpDir, resultsDir, variantsDir, "", tsk, &task.Result{}, map[string]outputInfo{}, gCtx)
+	testutil.IsNotNil(t, err, "static and animated outputs of the same scale can not share a key")
+	testutil.Assert(t, true, strings.Contains(err.Error(), "same key"), "duplicate keys are reported")
+
+	tsk.Output.KeyTemplate = "{scale}x{static}.{ext}"
+
+	result := task.Result{}
+	err = Worker{}.uploadResults(tmpDir, resultsDir, variantsDir, "", tsk, &result, map[string]outputInfo{}, gCtx)
+	testutil.IsNil(t, err, "distinct keys are uploaded")
+	testutil.Assert(t, "static", string(downloaded(t, gCtx, "1x_static.txt")), "static output")
+	testutil.Assert(t, "animated", string(downloaded(t, gCtx, "1x.txt")), "animated output")
+}
@@ -0,0 +1,187 @@
+package image_processor
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/seventv/image-processor/go/internal/global"
+	"github.com/seventv/image-processor/go/task"
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/sha3"
+)
+
+// manifestParams are the parts of a task that change its outputs, the id and metadata of a task do not.
+type manifestParams struct {
+	Flags             task.TaskFlag          `json:"flags"`
+	Reupload          task.TaskInputReupload `json:"reupload"`
+	Output            task.TaskOutput        `json:"output"`
+	SmallestMaxWidth  int                    `json:"smallest_max_width"`
+	SmallestMaxHeight int                    `json:"smallest_max_height"`
+	ResizeRatio       task.ResizeRatio       `json:"resize_ratio"`
+	Scales            []int                  `json:"scales"`
+	Limits            task.TaskLimits        `json:"limits"`
+}
+
+// manifest is stored next to the outputs of an idempotent task.
+type manifest struct {
+	InputSHA3 string      `json:"input_sha3"`
+	Params    string      `json:"params"`
+	Result    task.Result `json:"result"`
+}
+
+// manifestKey hashes the parameters of the task and returns them with the key of its manifest.
+func manifestKey(tsk task.Task, inputSHA3 string) (key string, params string, err error) {
+	p := manifestParams{
+		Flags:             tsk.Flags,
+		Reupload:          tsk.Input.Reupload,
+		Output:            tsk.Output,
+		SmallestMaxWidth:  tsk.SmallestMaxWidth,
+		SmallestMaxHeight: tsk.SmallestMaxHeight,
+		ResizeRatio:       tsk.ResizeRatio,
+		Scales:            tsk.Scales,
+		Limits:            tsk.Limits,
+	}
+
+	// how long the task may take has no effect on the outputs
+	p.Limits.MaxProcessingTime = 0
+
+	data, err := json.Marshal(p)
+	if err != nil {
+		return "", "", multierr.Append(fmt.Errorf("failed at marshal params"), err)
+	}
+
+	h := sha3.New256()
+	h.Write(data)
+	params = hex.EncodeToString(h.Sum(nil))
+
+	h = sha3.New256()
+	h.Write([]byte(inputSHA3))
+	h.Write([]byte(params))
+
+	return path.Join(tsk.Output.Prefix, "manifests", hex.EncodeToString(h.Sum(nil))+".json"), params, nil
+}
+
+// loadManifest returns the result stored by an earlier task with the same input and parameters,
+// ok is false when there is none or the outputs it lists are gone.
+func loadManifest(ctx global.Context, tsk task.Task, inputSHA3 string) (result task.Result, ok bool, err error) {
+	key, params, err := manifestKey(tsk, inputSHA3)
+	if err != nil {
+		return task.Result{}, false, err
+	}
+
+	buf := &bytes.Buffer{}
+
+	err = ctx.Inst().Storage.DownloadFile(ctx, buf, &s3.GetObjectInput{
+		Bucket: aws.String(tsk.Output.Bucket),
+		Key:    aws.String(key),
+	})
+	if isNoSuchKey(err) {
+		return task.Result{}, false, nil
+	} else if err != nil {
+		return task.Result{}, false, multierr.Append(fmt.Errorf("failed at s3 download"), err)
+	}
+
+	m := manifest{}
+	if err := json.Unmarshal(buf.Bytes(), &m); err != nil {
+		return task.Result{}, false, multierr.Append(fmt.Errorf("failed at unmarshal manifest"), err)
+	}
+
+	if m.InputSHA3 != inputSHA3 || m.Params != params {
+		return task.Result{}, false, nil
+	}
+
+	files := append([]task.ResultFile{m.Result.ArchiveOutput}, m.Result.ImageOutputs...)
+	for _, file := range files {
+		if file.Key == "" {
+			continue
+		}
+
+		_, err := ctx.Inst().Storage.HeadFile(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(file.Bucket),
+			Key:    aws.String(file.Key),
+		})
+		if isNoSuchKey(err) {
+			zap.S().Debugw("output of manifest is gone",
+				"key", file.Key,
+				"task_id", tsk.ID,
+			)
+
+			return task.Result{}, false, nil
+		} else if err != nil {
+			return task.Result{}, false, multierr.Append(fmt.Errorf("failed at s3 head"), err)
+		}
+	}
+
+	return m.Result, true, nil
+}
+
+// storeManifest stores the result of a task so a later task with the same input and parameters can return it.
+func storeManifest(ctx global.Context, tsk task.Task, result *task.Result) error {
+	key, params, err := manifestKey(tsk, result.ImageInput.SHA3)
+	if err != nil {
+		return err
+	}
+
+	stored := task.Result{
+		ImageInput:     result.ImageInput,
+		ImageOutputs:   result.ImageOutputs,
+		ArchiveOutput:  result.ArchiveOutput,
+		SkippedOutputs: result.SkippedOutputs,
+		Replicas:       result.Replicas,
+	}
+
+	data, err := json.Marshal(manifest{
+		InputSHA3: result.ImageInput.SHA3,
+		Params:    params,
+		Result:    stored,
+	})
+	if err != nil {
+		return multierr.Append(fmt.Errorf("failed at marshal manifest"), err)
+	}
+
+	return newUploadPool(ctx).Upload(&s3.PutObjectInput{
+		Bucket:      aws.String(tsk.Output.Bucket),
+		ContentType: aws.String("application/json"),
+		Key:         aws.String(key),
+	}, int64(len(data)), func() (io.ReadSeeker, error) {
+		return bytes.NewReader(data), nil
+	})
+}
+
+// saveManifest stores the manifest of idempotent tasks, the outputs are already uploaded
+// so failing to store it only means the next task processes them again.
+func saveManifest(ctx global.Context, tsk task.Task, result *task.Result) {
+	if !tsk.Output.Idempotent {
+		return
+	}
+
+	if err := storeManifest(ctx, tsk, result); err != nil {
+		zap.S().Warnw("failed to store manifest",
+			"error", err,
+			"task_id", tsk.ID,
+		)
+	}
+}
+
+// isNoSuchKey reports if s3 did not find the object, the mock instance returns the bare error code.
+func isNoSuchKey(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		return awsErr.Code() == s3.ErrCodeNoSuchKey || awsErr.Code() == "NotFound"
+	}
+
+	return err.Error() == s3.ErrCodeNoSuchKey
+}
@@ -0,0 +1,121 @@
+package image_processor
+
+import (
+	"os"
+	"path"
+	"runtime"
+	"testing"
+
+	"github.com/seventv/image-processor/go/internal/svc/storage"
+	"github.com/seventv/image-processor/go/internal/testutil"
+	"github.com/seventv/image-processor/go/task"
+)
+
+func TestWorkerManifest(t *testing.T) {
+	t.Parallel()
+
+	decoder := &fakeStreamTool{streamFrames: 5}
+	gCtx, worker := streamTestWorker(t, decoder, &fakeStreamTool{})
+
+	tsk := streamTestTask
+	tsk.Output.Idempotent = true
+
+	first := task.Result{}
+	testutil.IsNil(t, worker.Work(gCtx, tsk, &first), "first convert was successful")
+	testutil.Assert(t, false, first.Reused, "first task is processed")
+
+	second := task.Result{}
+	testutil.IsNil(t, worker.Work(gCtx, tsk, &second), "second convert was successful")
+	testutil.Assert(t, true, second.Reused, "second task reuses the outputs")
+	testutil.Assert(t, task.ResultReuseManifest, second.ReusedFrom, "outputs are the ones of the manifest")
+	testutil.Assert(t, 1, len(decoder.calls), "second task is not decoded")
+	testutil.Assert(t, first.ImageInput.SHA3, second.ImageInput.SHA3, "same input")
+	testutil.Assert(t, len(first.ImageOutputs), len(second.ImageOutputs), "same outputs")
+	testutil.Assert(t, first.ArchiveOutput.Key, second.ArchiveOutput.Key, "same archive")
+
+	tsk.ID = "another-id"
+	tsk.Limits.MaxProcessingTime = 1
+
+	third := task.Result{}
+	testutil.IsNil(t, worker.Work(gCtx, tsk, &third), "third convert was successful")
+	testutil.Assert(t, true, third.Reused, "the id and processing time do not change the outputs")
+
+	tsk.Scales = []int{1}
+
+	fourth := task.Result{}
+	testutil.IsNil(t, worker.Work(gCtx, tsk, &fourth), "fourth convert was successful")
+	testutil.Assert(t, false, fourth.Reused, "different scales are processed again")
+	testutil.Assert(t, 2, len(decoder.calls), "fourth task is decoded")
+
+	tsk.Output.Idempotent = false
+
+	fifth := task.Result{}
+	testutil.IsNil(t, worker.Work(gCtx, tsk, &fifth), "fifth convert was successful")
+	testutil.Assert(t, false, fifth.Reused, "manifests are only used by idempotent tasks")
+}
+
+func TestWorkerManifestReplicas(t *testing.T) {
+	t.Parallel()
+
+	decoder := &fakeStreamTool{streamFrames: 5}
+	gCtx, worker := streamTestWorker(t, decoder, &fakeStreamTool{})
+
+	_, cwd, _, _ := runtime.Caller(0)
+
+	input, err := os.ReadFile(path.Join(path.Dir(cwd), "..", "..", "..", "assets", "animated-1.gif"))
+	testutil.IsNil(t, err, "read input")
+
+	root := t.TempDir()
+	testutil.IsNil(t, os.MkdirAll(path.Join(root, "input"), 0700), "mkdir input bucket")
+	testutil.IsNil(t, os.WriteFile(path.Join(root, "input", "animated-1.gif"), input, 0600), "write input")
+
+	gCtx.Inst().Storage = storage.NewLocal(root)
+
+	tsk := streamTestTask
+	tsk.Output.Idempotent = true
+	tsk.Output.Replicas = []task.TaskOutputReplica{{Bucket: "replica"}}
+
+	first := task.Result{}
+	testutil.IsNil(t, worker.Work(gCtx, tsk, &first), "first convert was successful")
+	testutil.Assert(t, 1, len(first.Replicas), "first task has the replica")
+
+	second := task.Result{}
+	testutil.IsNil(t, worker.Work(gCtx, tsk, &second), "second convert was successful")
+	testutil.Assert(t, true, second.Reused, "second task reuses the outputs")
+	testutil.Assert(t, 1, len(second.Replicas), "the manifest has the replicas")
+	testutil.Assert(t, true, second.Replicas[0].Success, "replica of the manifest was written")
+	testutil.Assert(t, len(first.Replicas[0].Outputs), len(second.Replicas[0].Outputs), "same replica outputs")
+
+	gone := second.Replicas[0].Outputs[0]
+	testutil.IsNil(t, os.Remove(path.Join(root, gone.Bucket, gone.Key)), "remove a replica output")
+
+	third := task.Result{}
+	testutil.IsNil(t, worker.Work(gCtx, tsk, &third), "third convert was successful")
+	testutil.Assert(t, true, third.Reused, "third task reuses the outputs")
+	testutil.Assert(t, true, third.Replicas[0].Success, "replica is written again")
+	testutil.Assert(t, 1, len(decoder.calls), "reused tasks are not decoded")
+
+	_, err = os.Stat(path.Join(root, gone.Bucket, gone.Key))
+	testutil.IsNil(t, err, "missing replica output is copied again")
+}
+
+func TestManifestKey(t *testing.T) {
+	t.Parallel()
+
+	tsk := streamTestTask
+
+	key, params, err := manifestKey(tsk, "input")
+	testutil.IsNil(t, err, "manifest key")
+	testutil.Assert(t, "animated-1.gif/manifests", key[:len("animated-1.gif/manifests")], "manifest is stored under the prefix")
+
+	tsk.Metadata = []byte(`{"foo":"bar"}`)
+
+	sameKey, sameParams, err := manifestKey(tsk, "input")
+	testutil.IsNil(t, err, "manifest key")
+	testutil.Assert(t, key, sameKey, "metadata does not change the key")
+	testutil.Assert(t, params, sameParams, "metadata does not change the params")
+
+	otherKey, _, err := manifestKey(tsk, "other input")
+	testutil.IsNil(t, err, "manifest key")
+	testutil.Assert(t, true, key != otherKey, "the input changes the key")
+}
@@ -0,0 +1,220 @@
+package image_processor
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+
+	"github.com/h2non/filetype/matchers"
+	"github.com/h2non/filetype/types"
+	"github.com/seventv/image-processor/go/container"
+	"github.com/seventv/image-processor/go/internal/configure"
+	"github.com/seventv/image-processor/go/internal/global"
+	"github.com/seventv/image-processor/go/internal/native"
+	"github.com/seventv/image-processor/go/internal/rawframe"
+	"github.com/seventv/image-processor/go/probe"
+	"go.uber.org/multierr"
+)
+
+func init() {
+	RegisterDecoder("native", NativeDecoder{})
+	RegisterResizer("native", NativeResizer{})
+	RegisterEncoder("native", NativeEncoder{})
+}
+
+// externalTools are the binaries the exec pipeline needs for static images.
+var externalTools = []string{"ffmpeg", "resize_png", "convert_png", "optipng"}
+
+// nativePipeline only has the pure Go tools, it has no avif, webp or gif encoders so those outputs are skipped.
+var nativePipeline = Pipeline{
+	Decoders: map[string]Decoder{
+		"png": NativeDecoder{},
+		"jpg": NativeDecoder{},
+		"gif": NativeDecoder{},
+	},
+	Resizer: NativeResizer{},
+	Encoders: map[string]Encoder{
+		"png": NativeEncoder{},
+	},
+}
+
+// useNative decides if a static input is processed by the pure Go pipeline instead of the external tools.
+func useNative(ctx global.Context, match types.Type, info probe.Info) bool {
+	if info.FrameCount != 1 {
+		return false
+	}
+
+	switch match {
+	case matchers.TypePng, matchers.TypeJpeg, matchers.TypeGif:
+	default:
+		return false
+	}
+
+	switch ctx.Config().Worker.Pipeline {
+	case configure.WorkerPipelineNative:
+		return true
+	case configure.WorkerPipelineExec:
+		return false
+	}
+
+	for _, tool := range externalTools {
+		if _, err := exec.LookPath(tool); err != nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// NativeDecoder decodes the first frame of static png, jpeg and gif images in pure Go.
+type NativeDecoder struct{}
+
+func (NativeDecoder) Decode(ctx context.Context, input string, outputDir string) error {
+	file, err := os.Open(input)
+	if err != nil {
+		return multierr.Append(fmt.Errorf("failed at open input"), err)
+	}
+	defer file.Close()
+
+	img, err := native.Decode(file, container.MatchPath(input).Extension)
+	if err != nil {
+		return multierr.Append(fmt.Errorf("failed at decode"), err)
+	}
+
+	// the frame is only read back by the resizer so compression is not worth the time
+	return writePNG(path.Join(outputDir, "0000.png"), img, png.NoCompression)
+}
+
+func (NativeDecoder) DecodeStream(ctx context.Context, input string, info probe.Info, w io.Writer) error {
+	file, err := os.Open(input)
+	if err != nil {
+		return multierr.Append(fmt.Errorf("failed at open input"), err)
+	}
+	defer file.Close()
+
+	img, err := native.Decode(file, container.MatchPath(input).Extension)
+	if err != nil {
+		return multierr.Append(fmt.Errorf("failed at decode"), err)
+	}
+
+	return rawframe.NewWriter(w).Write(rawframe.FromImage(img, 0))
+}
+
+// NativeResizer resizes frames in pure Go the same way resize_png does.
+type NativeResizer struct{}
+
+func (NativeResizer) Resize(ctx context.Context, frames []ResizeFrame) error {
+	for _, frame := range frames {
+		img, err := readPNG(frame.Input)
+		if err != nil {
+			return err
+		}
+
+		for _, output := range frame.Outputs {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			variant := native.Resize(img, output.Width, output.Height, output.Ratio)
+
+			if err := writePNG(output.Output, variant, png.BestSpeed); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (NativeResizer) ResizeStream(ctx context.Context, r io.Reader, outputs []StreamOutput) error {
+	frames := rawframe.NewReader(r)
+
+	writers := make([]*rawframe.Writer, len(outputs))
+	for i, output := range outputs {
+		writers[i] = rawframe.NewWriter(output.W)
+	}
+
+	for {
+		frame, err := frames.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return multierr.Append(fmt.Errorf("failed at read frame"), err)
+		}
+
+		for i, output := range outputs {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			variant := native.Resize(frame.Image(), output.Width, output.Height, output.Ratio)
+
+			if err := writers[i].Write(rawframe.FromImage(variant, frame.Delay)); err != nil {
+				return multierr.Append(fmt.Errorf("failed at write frame"), err)
+			}
+		}
+	}
+}
+
+// NativeEncoder writes a single frame as a png with the best compression the Go encoder has.
+type NativeEncoder struct{}
+
+func (NativeEncoder) Encode(ctx context.Context, opts EncodeOptions, frames []string, delays []int, outputs ...string) error {
+	if len(frames) != 1 {
+		return fmt.Errorf("failed at native encode: expected 1 frame got %d", len(frames))
+	}
+
+	img, err := readPNG(frames[0])
+	if err != nil {
+		return err
+	}
+
+	for _, output := range outputs {
+		if path.Ext(output) != ".png" {
+			return fmt.Errorf("failed at native encode: unsupported output %s", output)
+		}
+
+		if err := writePNG(output, img, png.BestCompression); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func readPNG(pth string) (image.Image, error) {
+	file, err := os.Open(pth)
+	if err != nil {
+		return nil, multierr.Append(fmt.Errorf("failed at open %s", pth), err)
+	}
+	defer file.Close()
+
+	img, err := png.Decode(file)
+	if err != nil {
+		return nil, multierr.Append(fmt.Errorf("failed at decode %s", pth), err)
+	}
+
+	return img, nil
+}
+
+func writePNG(pth string, img image.Image, compression png.CompressionLevel) error {
+	file, err := os.Create(pth)
+	if err != nil {
+		return multierr.Append(fmt.Errorf("failed at create %s", pth), err)
+	}
+
+	if err := native.EncodePNG(file, img, compression); err != nil {
+		return multierr.Append(fmt.Errorf("failed at encode %s", pth), multierr.Append(err, file.Close()))
+	}
+
+	if err := file.Close(); err != nil {
+		return multierr.Append(fmt.Errorf("failed at close %s", pth), err)
+	}
+
+	return nil
+}
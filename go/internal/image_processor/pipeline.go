@@ -0,0 +1,307 @@
+package image_processor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/seventv/image-processor/go/internal/configure"
+	"github.com/seventv/image-processor/go/probe"
+	"github.com/seventv/image-processor/go/task"
+)
+
+// Decoder exports every frame of the input file into outputDir as 0000.png, 0001.png, ...
+type Decoder interface {
+	Decode(ctx context.Context, input string, outputDir string) error
+}
+
+// ResizeFrame is a frame and every size it has to be resized to.
+type ResizeFrame struct {
+	Input   string
+	Outputs []ResizeOutput
+}
+
+// ResizeOutput is a png written by a Resizer.
+type ResizeOutput struct {
+	Width  int
+	Height int
+	Ratio  task.ResizeRatio
+	Output string
+}
+
+// Resizer writes the resized variants of png frames.
+type Resizer interface {
+	Resize(ctx context.Context, frames []ResizeFrame) error
+}
+
+// EncodeOptions are the settings an Encoder is asked to use.
+type EncodeOptions struct {
+	Threads int
+	// Quality is from 1 to 100 where 100 is the best the encoder can do
+	Quality int
+}
+
+// Encoder encodes png frames into each of the outputs, delays are in 100s of a second and nil for static images.
+// Outputs are only ever of the formats the encoder is registered for.
+type Encoder interface {
+	Encode(ctx context.Context, opts EncodeOptions, frames []string, delays []int, outputs ...string) error
+}
+
+// OptimizeOptions are the settings an Optimizer is asked to use.
+type OptimizeOptions struct {
+	// Colors limits the palette of formats that have one, 0 keeps the encoder default
+	Colors int
+}
+
+// Optimizer makes an encoded output smaller in place.
+type Optimizer interface {
+	Optimize(ctx context.Context, output string, opts OptimizeOptions) error
+}
+
+// StreamDecoder is a Decoder that can also write the frames as a raw frame stream, see the rawframe package.
+// The delays of the frames in the stream are ignored, the worker sets them from the probed headers.
+type StreamDecoder interface {
+	Decoder
+	DecodeStream(ctx context.Context, input string, info probe.Info, w io.Writer) error
+}
+
+// StreamOutput is a raw frame stream written by a StreamResizer, it is closed by the caller.
+type StreamOutput struct {
+	Width  int
+	Height int
+	Ratio  task.ResizeRatio
+	W      io.Writer
+}
+
+// StreamResizer is a Resizer that can also resize every frame of a raw frame stream into each of the outputs.
+type StreamResizer interface {
+	Resizer
+	ResizeStream(ctx context.Context, r io.Reader, outputs []StreamOutput) error
+}
+
+// StreamEncoder is an Encoder that can also read the frames and their delays from a raw frame stream.
+type StreamEncoder interface {
+	Encoder
+	EncodeStream(ctx context.Context, opts EncodeOptions, r io.Reader, outputs ...string) error
+}
+
+// Pipeline is the set of tools used to process a task, decoders are keyed by the input extension
+// and encoders and optimizers by the output extension.
+type Pipeline struct {
+	Decoders   map[string]Decoder
+	Resizer    Resizer
+	Encoders   map[string]Encoder
+	Optimizers map[string]Optimizer
+}
+
+var (
+	registryMtx sync.RWMutex
+
+	decoders   = map[string]Decoder{}
+	resizers   = map[string]Resizer{}
+	encoders   = map[string]Encoder{}
+	optimizers = map[string]Optimizer{}
+)
+
+// RegisterDecoder makes a decoder selectable by name in the worker config.
+func RegisterDecoder(name string, decoder Decoder) {
+	registryMtx.Lock()
+	defer registryMtx.Unlock()
+
+	decoders[name] = decoder
+}
+
+// RegisterResizer makes a resizer selectable by name in the worker config.
+func RegisterResizer(name string, resizer Resizer) {
+	registryMtx.Lock()
+	defer registryMtx.Unlock()
+
+	resizers[name] = resizer
+}
+
+// RegisterEncoder makes an encoder selectable by name in the worker config.
+func RegisterEncoder(name string, encoder Encoder) {
+	registryMtx.Lock()
+	defer registryMtx.Unlock()
+
+	encoders[name] = encoder
+}
+
+// RegisterOptimizer makes an optimizer selectable by name in the worker config.
+func RegisterOptimizer(name string, optimizer Optimizer) {
+	registryMtx.Lock()
+	defer registryMtx.Unlock()
+
+	optimizers[name] = optimizer
+}
+
+// NoneTool can be configured for a format to disable the encoder or optimizer of that format.
+const NoneTool = "none"
+
+var (
+	// defaultDecoders are the decoder names used for each input extension unless the config overrides them
+	defaultDecoders = map[string]string{
+		"webp": "dump_png",
+		"avif": "dump_png",
+		"gif":  "ffmpeg",
+		"png":  "ffmpeg",
+		"jpg":  "ffmpeg",
+		"tif":  "ffmpeg",
+		"mp4":  "ffmpeg",
+		"flv":  "ffmpeg",
+		"avi":  "ffmpeg",
+		"mov":  "ffmpeg",
+		"webm": "ffmpeg",
+	}
+	// defaultResizer is the resizer name used unless the config overrides it
+	defaultResizer = "resize_png"
+	// defaultEncoders are the encoder names used for each output extension unless the config overrides them
+	defaultEncoders = map[string]string{
+		"avif": "convert_png",
+		"webp": "convert_png",
+		"gif":  "convert_png",
+		"png":  "copy",
+	}
+	// defaultOptimizers are the optimizer names used for each output extension unless the config overrides them
+	defaultOptimizers = map[string]string{
+		"gif": "gifsicle",
+		"png": "optipng",
+	}
+)
+
+// NewPipeline resolves the tools named in the config on top of the defaults.
+func NewPipeline(config *configure.Config) (Pipeline, error) {
+	registryMtx.RLock()
+	defer registryMtx.RUnlock()
+
+	pipeline := Pipeline{
+		Decoders:   map[string]Decoder{},
+		Encoders:   map[string]Encoder{},
+		Optimizers: map[string]Optimizer{},
+	}
+
+	for format, name := range mergeNames(defaultDecoders, config.Worker.Decoders) {
+		decoder, ok := decoders[name]
+		if !ok {
+			return Pipeline{}, fmt.Errorf("unknown decoder %s for %s", name, format)
+		}
+
+		pipeline.Decoders[format] = decoder
+	}
+
+	name := defaultResizer
+	if config.Worker.Resizer != "" {
+		name = config.Worker.Resizer
+	}
+
+	resizer, ok := resizers[name]
+	if !ok {
+		return Pipeline{}, fmt.Errorf("unknown resizer %s", name)
+	}
+
+	pipeline.Resizer = resizer
+
+	for format, name := range mergeNames(defaultEncoders, config.Worker.Encoders) {
+		encoder, ok := encoders[name]
+		if !ok {
+			return Pipeline{}, fmt.Errorf("unknown encoder %s for %s", name, format)
+		}
+
+		pipeline.Encoders[format] = encoder
+	}
+
+	for format, name := range mergeNames(defaultOptimizers, config.Worker.Optimizers) {
+		optimizer, ok := optimizers[name]
+		if !ok {
+			return Pipeline{}, fmt.Errorf("unknown optimizer %s for %s", name, format)
+		}
+
+		pipeline.Optimizers[format] = optimizer
+	}
+
+	return pipeline, nil
+}
+
+// mergeNames overrides the defaults with the configured names, formats configured as NoneTool are left out.
+func mergeNames(defaults map[string]string, configured map[string]string) map[string]string {
+	names := map[string]string{}
+
+	for format, name := range defaults {
+		names[format] = name
+	}
+
+	for format, name := range configured {
+		format = strings.ToLower(strings.TrimPrefix(format, "."))
+		if name == NoneTool {
+			delete(names, format)
+		} else {
+			names[format] = name
+		}
+	}
+
+	return names
+}
+
+// encodeGroup is a set of outputs encoded by one call to an encoder.
+type encodeGroup struct {
+	Encoder Encoder
+	Outputs []string
+}
+
+// groupOutputs groups the outputs by encoder so an encoder used for several formats only reads the frames once.
+// Outputs with no encoder for their format are returned as missing.
+func (p Pipeline) groupOutputs(outputs []string) (groups []encodeGroup, missing []string) {
+outer:
+	for _, output := range outputs {
+		encoder, ok := p.Encoders[outputFormat(output)]
+		if !ok {
+			missing = append(missing, output)
+			continue
+		}
+
+		// encoders that can not be compared are never grouped, comparing them would panic
+		if reflect.TypeOf(encoder).Comparable() {
+			for i := range groups {
+				if groups[i].Encoder == encoder {
+					groups[i].Outputs = append(groups[i].Outputs, output)
+					continue outer
+				}
+			}
+		}
+
+		groups = append(groups, encodeGroup{Encoder: encoder, Outputs: []string{output}})
+	}
+
+	return groups, missing
+}
+
+// encode encodes the frames into every output that has an encoder and returns the outputs that do not.
+func (p Pipeline) encode(ctx context.Context, opts EncodeOptions, frames []string, delays []int, outputs ...string) (missing []string, err error) {
+	groups, missing := p.groupOutputs(outputs)
+
+	for _, group := range groups {
+		if err := group.Encoder.Encode(ctx, opts, frames, delays, group.Outputs...); err != nil {
+			return nil, err
+		}
+	}
+
+	return missing, nil
+}
+
+// optimize runs the optimizer of the output format if there is one.
+func (p Pipeline) optimize(ctx context.Context, output string, opts OptimizeOptions) error {
+	optimizer, ok := p.Optimizers[outputFormat(output)]
+	if !ok {
+		return nil
+	}
+
+	return optimizer.Optimize(ctx, output, opts)
+}
+
+func outputFormat(output string) string {
+	return strings.TrimPrefix(path.Ext(output), ".")
+}
@@ -0,0 +1,226 @@
+package image_processor
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"path"
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/seventv/image-processor/go/internal/configure"
+	"github.com/seventv/image-processor/go/internal/global"
+	"github.com/seventv/image-processor/go/internal/svc/prometheus"
+	"github.com/seventv/image-processor/go/internal/svc/storage"
+	"github.com/seventv/image-processor/go/internal/testutil"
+	"github.com/seventv/image-processor/go/task"
+
+	messagequeue "github.com/seventv/message-queue/go"
+)
+
+// fakeTool records its calls and writes placeholder files instead of running anything.
+type fakeTool struct {
+	mtx     sync.Mutex
+	calls   [][]string
+	options []interface{}
+}
+
+func (f *fakeTool) record(opts interface{}, files ...string) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	f.calls = append(f.calls, files)
+	f.options = append(f.options, opts)
+}
+
+func (f *fakeTool) Decode(ctx context.Context, input string, outputDir string) error {
+	f.record(nil, input)
+
+	file, err := os.Create(path.Join(outputDir, "0000.png"))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return png.Encode(file, image.NewNRGBA(image.Rect(0, 0, 64, 32)))
+}
+
+func (f *fakeTool) Resize(ctx context.Context, frames []ResizeFrame) error {
+	for _, frame := range frames {
+		for _, output := range frame.Outputs {
+			f.record(output, output.Output)
+
+			if err := os.WriteFile(output.Output, []byte("variant"), 0600); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (f *fakeTool) Encode(ctx context.Context, opts EncodeOptions, frames []string, delays []int, outputs ...string) error {
+	f.record(opts, outputs...)
+
+	for _, output := range outputs {
+		if err := os.WriteFile(output, []byte("encoded"), 0600); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (f *fakeTool) Optimize(ctx context.Context, output string, opts OptimizeOptions) error {
+	f.record(opts, output)
+
+	return nil
+}
+
+func TestWorkerPipeline(t *testing.T) {
+	t.Parallel()
+
+	var err error
+
+	config := &configure.Config{}
+	config.Worker.TempDir = t.TempDir()
+
+	gCtx, cancel := global.WithCancel(global.New(context.Background(), config))
+	defer cancel()
+
+	gCtx.Inst().MessageQueue, err = messagequeue.New(gCtx, messagequeue.ConfigMock{})
+	testutil.IsNil(t, err, "mq init successful")
+
+	gCtx.Inst().Prometheus = prometheus.New(prometheus.Options{})
+
+	_, cwd, _, _ := runtime.Caller(0)
+	assetDir := path.Join(path.Dir(cwd), "..", "..", "..", "assets")
+
+	gCtx.Inst().Storage, err = storage.NewMock(gCtx, map[string]map[string][]byte{
+		"input": {
+			"static-1.png": testutil.ReadFile(t, path.Join(assetDir, "static-1.png")),
+		},
+		"output": {},
+	})
+	testutil.IsNil(t, err, "s3 init successful")
+
+	decoder := &fakeTool{}
+	resizer := &fakeTool{}
+	encoder := &fakeTool{}
+	pngEncoder := &fakeTool{}
+	optimizer := &fakeTool{}
+
+	worker := Worker{
+		Pipeline: &Pipeline{
+			Decoders: map[string]Decoder{"png": decoder},
+			Resizer:  resizer,
+			Encoders: map[string]Encoder{
+				"avif": encoder,
+				"webp": encoder,
+				"png":  pngEncoder,
+			},
+			Optimizers: map[string]Optimizer{"png": optimizer},
+		},
+	}
+
+	result := task.Result{}
+	err = worker.Work(gCtx, task.Task{
+		Flags: task.TaskFlagALL,
+		Input: task.TaskInput{
+			Bucket: "input",
+			Key:    "static-1.png",
+		},
+		Output: task.TaskOutput{
+			Bucket: "output",
+			Prefix: "static-1.png",
+		},
+		SmallestMaxWidth:  96,
+		SmallestMaxHeight: 32,
+		Scales:            []int{1, 2},
+	}, &result)
+	testutil.IsNil(t, err, "convert with fakes was successful")
+
+	testutil.Assert(t, 1, len(decoder.calls), "decoder calls")
+	testutil.Assert(t, 2, len(resizer.calls), "one resize per scale")
+	testutil.Assert(t, ResizeOutput{
+		Width:  128,
+		Height: 64,
+		Ratio:  task.ResizeRatioStretch,
+		Output: resizer.calls[1][0],
+	}, resizer.options[1].(ResizeOutput), "second scale is doubled")
+
+	testutil.Assert(t, 2, len(encoder.calls), "avif and webp share a call per scale")
+	testutil.Assert(t, 2, len(encoder.calls[0]), "outputs of the first call")
+	testutil.Assert(t, EncodeOptions{Threads: 1, Quality: 100}, encoder.options[0].(EncodeOptions), "full quality")
+	testutil.Assert(t, 2, len(pngEncoder.calls), "png encoder calls")
+	testutil.Assert(t, 2, len(optimizer.calls), "only pngs are optimized")
+	testutil.Assert(t, 6, len(result.ImageOutputs), "uploaded outputs")
+}
+
+func TestPipelineSkipsMissingEncoders(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	encoder := &fakeTool{}
+	pipeline := Pipeline{Encoders: map[string]Encoder{"png": encoder}}
+	result := task.Result{}
+
+	outputs, err := encodeOutputs(context.Background(), pipeline, 1, []string{"frame.png"}, nil, &result, []string{
+		path.Join(dir, "1x.avif"),
+		path.Join(dir, "1x.png"),
+	})
+	testutil.IsNil(t, err, "encode outputs")
+	testutil.Assert(t, 1, len(outputs), "encoded outputs")
+	testutil.Assert(t, path.Join(dir, "1x.png"), outputs[0], "png is encoded")
+	testutil.Assert(t, 1, len(result.SkippedOutputs), "skipped outputs")
+	testutil.Assert(t, "1x.avif", result.SkippedOutputs[0].Name, "avif is skipped")
+}
+
+func TestNewPipeline(t *testing.T) {
+	t.Parallel()
+
+	pipeline, err := NewPipeline(&configure.Config{})
+	testutil.IsNil(t, err, "default pipeline")
+	testutil.Assert(t, true, pipeline.Decoders["avif"] == DumpPngDecoder{}, "default avif decoder")
+	testutil.Assert(t, true, pipeline.Resizer == ResizePngResizer{}, "default resizer")
+	testutil.Assert(t, true, pipeline.Encoders["webp"] == ConvertPngEncoder{}, "default webp encoder")
+
+	config := &configure.Config{}
+	config.Worker.Decoders = map[string]string{"png": "native"}
+	config.Worker.Resizer = "native"
+	config.Worker.Encoders = map[string]string{".PNG": "native", "avif": NoneTool}
+	config.Worker.Optimizers = map[string]string{"png": NoneTool}
+
+	pipeline, err = NewPipeline(config)
+	testutil.IsNil(t, err, "configured pipeline")
+	testutil.Assert(t, true, pipeline.Decoders["png"] == NativeDecoder{}, "configured png decoder")
+	testutil.Assert(t, true, pipeline.Resizer == NativeResizer{}, "configured resizer")
+	testutil.Assert(t, true, pipeline.Encoders["png"] == NativeEncoder{}, "configured png encoder")
+
+	_, ok := pipeline.Encoders["avif"]
+	testutil.Assert(t, false, ok, "avif encoder is disabled")
+
+	_, ok = pipeline.Optimizers["png"]
+	testutil.Assert(t, false, ok, "png optimizer is disabled")
+
+	for _, name := range []string{"decoders", "resizer", "encoders", "optimizers"} {
+		config := &configure.Config{}
+
+		switch name {
+		case "decoders":
+			config.Worker.Decoders = map[string]string{"gif": "missing"}
+		case "resizer":
+			config.Worker.Resizer = "missing"
+		case "encoders":
+			config.Worker.Encoders = map[string]string{"gif": "missing"}
+		case "optimizers":
+			config.Worker.Optimizers = map[string]string{"gif": "missing"}
+		}
+
+		_, err := NewPipeline(config)
+		testutil.IsNotNil(t, err, fmt.Sprintf("unknown tool in %s", name))
+	}
+}
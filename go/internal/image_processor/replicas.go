@@ -0,0 +1,280 @@
+package image_processor
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/seventv/image-processor/go/internal/global"
+	"github.com/seventv/image-processor/go/internal/svc/storage"
+	"github.com/seventv/image-processor/go/task"
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+)
+
+// replicaStorage returns the storage a replica is written to, the profile of the replica picks it.
+func replicaStorage(ctx global.Context, replica task.TaskOutputReplica) (storage.Instance, error) {
+	if replica.Profile == "" {
+		return ctx.Inst().Storage, nil
+	}
+
+	profiler, ok := ctx.Inst().Storage.(storage.Profiler)
+	if !ok {
+		return nil, fmt.Errorf("storage has no profiles, replica needs %s", replica.Profile)
+	}
+
+	inst, ok := profiler.Profile(replica.Profile)
+	if !ok {
+		return nil, fmt.Errorf("unknown storage profile %s", replica.Profile)
+	}
+
+	return inst, nil
+}
+
+// validateReplicas checks the storage profiles and the quorum of the replicas before the task is processed.
+func validateReplicas(ctx global.Context, tsk task.Task) error {
+	if tsk.Output.Quorum < 0 || tsk.Output.Quorum > len(tsk.Output.Replicas)+1 {
+		return fmt.Errorf("quorum %d is not between 0 and the %d destinations", tsk.Output.Quorum, len(tsk.Output.Replicas)+1)
+	}
+
+	for _, replica := range tsk.Output.Replicas {
+		if _, err := replicaStorage(ctx, replica); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// newResultReplicas returns the statuses of the replicas of the task before any output was written.
+func newResultReplicas(tsk task.Task) []task.ResultReplica {
+	if len(tsk.Output.Replicas) == 0 {
+		return nil
+	}
+
+	replicas := make([]task.ResultReplica, len(tsk.Output.Replicas))
+
+	for i, replica := range tsk.Output.Replicas {
+		replicas[i] = task.ResultReplica{
+			Bucket:  replica.Bucket,
+			Prefix:  replica.Prefix,
+			Profile: replica.Profile,
+			Outputs: []task.ResultFile{},
+		}
+
+		if replicas[i].Bucket == "" {
+			replicas[i].Bucket = tsk.Output.Bucket
+		}
+
+		if replicas[i].Prefix == "" {
+			replicas[i].Prefix = tsk.Output.Prefix
+		}
+	}
+
+	return replicas
+}
+
+// replicaOutput returns the key and storage options of the replica of an output, the key template of the task
+// lays out the key under the prefix of the replica.
+func replicaOutput(tsk task.Task, replica task.TaskOutputReplica, vars outputKeyVars) (key string, dest task.TaskOutputStorage, err error) {
+	if replica.Prefix != "" {
+		tsk.Output.Prefix = replica.Prefix
+	}
+
+	key, err = outputKey(tsk, vars)
+	if err != nil {
+		return "", task.TaskOutputStorage{}, err
+	}
+
+	dest = vars.storage(tsk)
+
+	if replica.Bucket != "" {
+		dest.Bucket = replica.Bucket
+	}
+
+	if replica.ACL != "" {
+		dest.ACL = replica.ACL
+	}
+
+	if replica.CacheControl != "" {
+		dest.CacheControl = replica.CacheControl
+	}
+
+	return key, dest, nil
+}
+
+// checkQuorum sets the status of every replica and fails the task when fewer destinations were written than its quorum,
+// the outputs themselves are already written when it is called.
+func checkQuorum(tsk task.Task, result *task.Result, errs []error) error {
+	written := 1
+
+	for i := range result.Replicas {
+		result.Replicas[i].Success = errs[i] == nil
+		if errs[i] != nil {
+			result.Replicas[i].Error = errs[i].Error()
+			continue
+		}
+
+		written++
+	}
+
+	quorum := tsk.Output.Quorum
+	if quorum == 0 {
+		quorum = len(tsk.Output.Replicas) + 1
+	}
+
+	if written < quorum {
+		result.Error = task.ResultErrorReplicaQuorum
+
+		return multierr.Append(fmt.Errorf("wrote %d of %d destinations, the quorum is %d", written, len(tsk.Output.Replicas)+1, quorum), multierr.Combine(errs...))
+	}
+
+	for i, err := range errs {
+		if err != nil {
+			zap.S().Warnw("failed to write replica",
+				"bucket", result.Replicas[i].Bucket,
+				"prefix", result.Replicas[i].Prefix,
+				"error", err,
+				"task_id", tsk.ID,
+			)
+		}
+	}
+
+	return nil
+}
+
+// replicasPresent reports if every replica of the task was written and its outputs are still there,
+// replicas of a reused result which are not are written again.
+func replicasPresent(ctx global.Context, tsk task.Task, replicas []task.ResultReplica) (bool, error) {
+	if len(replicas) != len(tsk.Output.Replicas) {
+		return false, nil
+	}
+
+	for i, replica := range replicas {
+		if !replica.Success {
+			return false, nil
+		}
+
+		inst, err := replicaStorage(ctx, tsk.Output.Replicas[i])
+		if err != nil {
+			return false, err
+		}
+
+		for _, file := range replica.Outputs {
+			_, err := inst.HeadFile(ctx, &s3.HeadObjectInput{
+				Bucket: aws.String(file.Bucket),
+				Key:    aws.String(file.Key),
+			})
+			if isNoSuchKey(err) {
+				zap.S().Debugw("replica of manifest is gone",
+					"key", file.Key,
+					"task_id", tsk.ID,
+				)
+
+				return false, nil
+			} else if err != nil {
+				return false, multierr.Append(fmt.Errorf("failed at s3 head"), err)
+			}
+		}
+	}
+
+	return true, nil
+}
+
+// copyReplicas writes the replicas of outputs which were copied instead of made. Replicas in the storage of the worker
+// are copied, the ones of other profiles are downloaded from the outputs and uploaded again.
+func copyReplicas(ctx global.Context, tsk task.Task, result *task.Result) error {
+	if len(tsk.Output.Replicas) == 0 {
+		return nil
+	}
+
+	files := result.ImageOutputs
+	if result.ArchiveOutput.Key != "" {
+		files = append(append([]task.ResultFile{}, files...), result.ArchiveOutput)
+	}
+
+	result.Replicas = newResultReplicas(tsk)
+	errs := make([]error, len(tsk.Output.Replicas))
+	pool := newUploadPool(ctx)
+
+	for i, replica := range tsk.Output.Replicas {
+		inst, err := replicaStorage(ctx, replica)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+
+		for _, file := range files {
+			vars := outputKeyVars{
+				Name:       file.Name,
+				Ext:        outputExt(file),
+				FrameCount: file.FrameCount,
+				InputSHA3:  result.ImageInput.SHA3,
+				SHA3:       file.SHA3,
+			}
+
+			key, dest, err := replicaOutput(tsk, replica, vars)
+			if err != nil {
+				errs[i] = multierr.Append(errs[i], err)
+				continue
+			}
+
+			acl, disposition, metadata, tagging := objectOptions(dest)
+
+			if replica.Profile == "" {
+				err = inst.CopyFile(ctx, &s3.CopyObjectInput{
+					ACL:                acl,
+					Bucket:             aws.String(dest.Bucket),
+					CacheControl:       aws.String(dest.CacheControl),
+					ContentDisposition: disposition,
+					ContentType:        aws.String(file.ContentType),
+					CopySource:         aws.String(url.PathEscape(path.Join(file.Bucket, file.Key))),
+					Key:                aws.String(key),
+					Metadata:           metadata,
+					MetadataDirective:  aws.String(s3.MetadataDirectiveReplace),
+					Tagging:            tagging,
+					TaggingDirective:   aws.String(s3.TaggingDirectiveReplace),
+				})
+			} else {
+				buf := &bytes.Buffer{}
+
+				err = ctx.Inst().Storage.DownloadFile(ctx, buf, &s3.GetObjectInput{
+					Bucket: aws.String(file.Bucket),
+					Key:    aws.String(file.Key),
+				})
+				if err == nil {
+					err = pool.UploadTo(inst, &s3.PutObjectInput{
+						ACL:                acl,
+						Bucket:             aws.String(dest.Bucket),
+						CacheControl:       aws.String(dest.CacheControl),
+						ContentDisposition: disposition,
+						ContentType:        aws.String(file.ContentType),
+						Key:                aws.String(key),
+						Metadata:           metadata,
+						Tagging:            tagging,
+					}, int64(buf.Len()), func() (io.ReadSeeker, error) {
+						return bytes.NewReader(buf.Bytes()), nil
+					})
+				}
+			}
+
+			if err != nil {
+				errs[i] = multierr.Append(errs[i], multierr.Append(fmt.Errorf("failed at replicate %s", file.Key), err))
+				continue
+			}
+
+			file.Key = key
+			file.Bucket = dest.Bucket
+			file.ACL = dest.ACL
+			file.CacheControl = dest.CacheControl
+
+			result.Replicas[i].Outputs = append(result.Replicas[i].Outputs, file)
+		}
+	}
+
+	return checkQuorum(tsk, result, errs)
+}
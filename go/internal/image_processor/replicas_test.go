@@ -0,0 +1,125 @@
+package image_processor
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/seventv/image-processor/go/internal/configure"
+	"github.com/seventv/image-processor/go/internal/global"
+	"github.com/seventv/image-processor/go/internal/svc/prometheus"
+	"github.com/seventv/image-processor/go/internal/svc/storage"
+	"github.com/seventv/image-processor/go/internal/testutil"
+	"github.com/seventv/image-processor/go/task"
+)
+
+func TestUploadResultsReplicas(t *testing.T) {
+	t.Parallel()
+
+	gCtx, _, _ := uploadTestContext(t, 0, 0)
+	tmpDir, resultsDir, variantsDir := archiveTestDirs(t)
+
+	tsk := task.Task{
+		Output: task.TaskOutput{
+			Bucket: "output",
+			Prefix: "prefix",
+			Replicas: []task.TaskOutputReplica{
+				{Bucket: "private", Prefix: "replica", ACL: "private"},
+				{Bucket: "missing"},
+			},
+			Quorum: 2,
+		},
+	}
+
+	result := task.Result{}
+	testutil.IsNil(t, Worker{}.uploadResults(tmpDir, resultsDir, variantsDir, "", tsk, &result, map[string]outputInfo{}, gCtx), "the quorum is met")
+	testutil.Assert(t, 2, len(result.Replicas), "status of every replica")
+	testutil.Assert(t, task.ResultErrorNone, result.Error, "no error")
+
+	replica := result.Replicas[0]
+	testutil.Assert(t, true, replica.Success, "replica was written")
+	testutil.Assert(t, "private", replica.Bucket, "replica bucket")
+	testutil.Assert(t, "replica", replica.Prefix, "replica prefix")
+	testutil.Assert(t, 2, len(replica.Outputs), "output and archive are replicated")
+
+	for _, file := range replica.Outputs {
+		testutil.Assert(t, "private", file.Bucket, "replica output bucket")
+		testutil.Assert(t, "private", file.ACL, "replica output acl")
+		testutil.Assert(t, "replica", path.Dir(file.Key), "replica output key")
+	}
+
+	testutil.Assert(t, false, result.Replicas[1].Success, "missing bucket is not written")
+	testutil.Assert(t, true, result.Replicas[1].Error != "", "replica has the error")
+	testutil.Assert(t, "prefix", result.Replicas[1].Prefix, "replica keeps the prefix of the outputs")
+	testutil.Assert(t, 1, len(result.ImageOutputs), "outputs are uploaded")
+
+	tsk.Output.Quorum = 0
+
+	result = task.Result{}
+	testutil.IsNotNil(t, Worker{}.uploadResults(tmpDir, resultsDir, variantsDir, "", tsk, &result, map[string]outputInfo{}, gCtx), "every destination is needed")
+	testutil.Assert(t, task.ResultErrorReplicaQuorum, result.Error, "quorum error")
+}
+
+func TestReplicaProfiles(t *testing.T) {
+	t.Parallel()
+
+	primary := t.TempDir()
+	eu := t.TempDir()
+
+	gCtx, cancel := global.WithCancel(global.New(context.Background(), &configure.Config{}))
+	t.Cleanup(cancel)
+
+	inst, err := storage.New(gCtx, storage.Options{
+		Backend:   storage.BackendLocal,
+		LocalRoot: primary,
+		Profiles: map[string]storage.Options{
+			"eu": {Backend: storage.BackendLocal, LocalRoot: eu},
+		},
+	})
+	testutil.IsNil(t, err, "storage init successful")
+
+	gCtx.Inst().Storage = inst
+	gCtx.Inst().Prometheus = prometheus.New(prometheus.Options{})
+
+	tsk := task.Task{
+		Output: task.TaskOutput{
+			Bucket: "output",
+			Prefix: "prefix",
+			Replicas: []task.TaskOutputReplica{
+				{Profile: "eu"},
+			},
+		},
+	}
+
+	testutil.IsNil(t, validateReplicas(gCtx, tsk), "known profile")
+
+	tmpDir, resultsDir, variantsDir := archiveTestDirs(t)
+
+	result := task.Result{}
+	testutil.IsNil(t, Worker{}.uploadResults(tmpDir, resultsDir, variantsDir, "", tsk, &result, map[string]outputInfo{}, gCtx), "uploads succeed")
+
+	for _, root := range []string{primary, eu} {
+		_, err := os.Stat(path.Join(root, "output", "prefix", "1x.txt"))
+		testutil.IsNil(t, err, "the same bucket is written in both profiles")
+	}
+
+	// outputs copied from the cache are replicated from where they were copied to
+	copied := task.Result{ImageOutputs: result.ImageOutputs, ArchiveOutput: result.ArchiveOutput}
+	tsk.Output.Replicas = []task.TaskOutputReplica{{Profile: "eu", Prefix: "copied"}, {Bucket: "other"}}
+
+	testutil.IsNil(t, copyReplicas(gCtx, tsk, &copied), "replicas are copied")
+	testutil.Assert(t, 2, len(copied.Replicas), "status of every replica")
+
+	for _, pth := range []string{path.Join(eu, "output", "copied", "archive.zip"), path.Join(primary, "other", "prefix", "1x.txt")} {
+		_, err := os.Stat(pth)
+		testutil.IsNil(t, err, "replica was copied "+pth)
+	}
+
+	tsk.Output.Replicas = []task.TaskOutputReplica{{Profile: "us"}}
+	testutil.IsNotNil(t, validateReplicas(gCtx, tsk), "unknown profile")
+
+	tsk.Output.Replicas = nil
+	tsk.Output.Quorum = 2
+	testutil.IsNotNil(t, validateReplicas(gCtx, tsk), "quorum larger than the destinations")
+}
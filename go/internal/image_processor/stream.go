@@ -0,0 +1,323 @@
+package image_processor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image/png"
+	"io"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/h2non/filetype/matchers"
+	"github.com/h2non/filetype/types"
+	"github.com/seventv/image-processor/go/internal/global"
+	"github.com/seventv/image-processor/go/internal/rawframe"
+	"github.com/seventv/image-processor/go/probe"
+	"github.com/seventv/image-processor/go/task"
+	"go.uber.org/multierr"
+)
+
+// errStreamMismatch is returned when the decoded frames do not match the probed headers.
+var errStreamMismatch = errors.New("the decoded frames do not match the headers")
+
+// streamable reports if the frames of a task can be streamed between the tools instead of written as png files.
+func streamable(pipeline Pipeline, match types.Type, info probe.Info, tsk task.Task) bool {
+	if _, ok := pipeline.Decoders[match.Extension].(StreamDecoder); !ok {
+		return false
+	}
+
+	if _, ok := pipeline.Resizer.(StreamResizer); !ok {
+		return false
+	}
+
+	// the delay of every frame has to be known before it is decoded, videos only have a frame rate
+	if info.FrameCount != 1 && len(info.Delays) != info.FrameCount {
+		return false
+	}
+
+	// fitting an output into its budget encodes it again from the frames
+	if len(tsk.Limits.MaxOutputSizes) != 0 {
+		return false
+	}
+
+	if info.FrameCount > 1 {
+		groups, _ := pipeline.groupOutputs(animatedOutputs(tsk, "", 1))
+		for _, group := range groups {
+			if _, ok := group.Encoder.(StreamEncoder); !ok {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// streamFrames decodes, resizes and encodes the animated outputs with the frames passed between the tools as raw frame streams.
+// Only the first frame of every scale is written to the variants dir, it is what the static outputs are made from,
+// unless the archive of the task has the resized frames.
+func (Worker) streamFrames(ctx global.Context, pipeline Pipeline, tmpDir string, inputFile string, match types.Type, info probe.Info, tsk task.Task) (delays []int, inputDir string, variantsDir string, err error) {
+	defer func() {
+		if pnk := recover(); pnk != nil {
+			err = multierr.Append(fmt.Errorf("panic at runtime: %v", pnk), err)
+		}
+	}()
+
+	// nothing is decoded into the input dir, it is returned so it is cleaned up like in the file pipeline
+	inputDir = path.Join(tmpDir, "input")
+	variantsDir = path.Join(tmpDir, "variants")
+	resultsDir := path.Join(tmpDir, "results")
+
+	if err := os.MkdirAll(variantsDir, 0700); err != nil {
+		return nil, "", "", multierr.Append(fmt.Errorf("failed at mkdir variantsDir"), err)
+	}
+
+	if err := os.MkdirAll(resultsDir, 0700); err != nil {
+		return nil, "", "", multierr.Append(fmt.Errorf("failed at mkdir resultsDir"), err)
+	}
+
+	decoder := pipeline.Decoders[match.Extension].(StreamDecoder)
+	resizer := pipeline.Resizer.(StreamResizer)
+
+	// the encoders of every scale run at the same time so they share the threads
+	threads, _ := budgetThreads(threadBudget(ctx), len(tsk.Scales))
+
+	width, height, ratio := resizeTarget(tsk, info.Width, info.Height)
+
+	allFrames := archivesFrames(tsk.Output.Archive.Contents)
+
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg        sync.WaitGroup
+		mtx       sync.Mutex
+		streamErr error
+	)
+
+	// every stage closes the pipes it reads and writes with its error, so the stages around it stop as well
+	run := func(stage string, fn func() error) {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			err := func() (err error) {
+				defer func() {
+					if pnk := recover(); pnk != nil {
+						err = fmt.Errorf("panic at runtime: %v", pnk)
+					}
+				}()
+
+				return fn()
+			}()
+			if err != nil {
+				mtx.Lock()
+				streamErr = multierr.Append(streamErr, multierr.Append(fmt.Errorf("failed at %s", stage), err))
+				mtx.Unlock()
+
+				cancel()
+			}
+		}()
+	}
+
+	decodedR, decodedW := io.Pipe()
+	resizeR, resizeW := io.Pipe()
+
+	run("decode", func() error {
+		err := decoder.DecodeStream(streamCtx, inputFile, info, decodedW)
+		decodedW.CloseWithError(err)
+
+		return err
+	})
+
+	run("frame timings", func() error {
+		var err error
+
+		delays, err = forwardFrames(decodedR, resizeW, match, info)
+		decodedR.CloseWithError(err)
+		resizeW.CloseWithError(err)
+
+		return err
+	})
+
+	outputs := make([]StreamOutput, len(tsk.Scales))
+	writers := make([]*io.PipeWriter, len(tsk.Scales))
+
+	for i, scale := range tsk.Scales {
+		pr, pw := io.Pipe()
+
+		writers[i] = pw
+		outputs[i] = StreamOutput{
+			Width:  width * scale,
+			Height: height * scale,
+			Ratio:  ratio,
+			W:      pw,
+		}
+
+		var animated []string
+		if info.FrameCount > 1 {
+			animated = animatedOutputs(tsk, resultsDir, scale)
+		}
+
+		scale := scale
+		framePath := func(i int) string {
+			if i != 0 && !allFrames {
+				return ""
+			}
+
+			return path.Join(variantsDir, fmt.Sprintf("%04d_%dx.png", i, scale))
+		}
+
+		run(fmt.Sprintf("encode %dx", scale), func() error {
+			err := encodeScale(streamCtx, pipeline, pr, threads, framePath, animated)
+			pr.CloseWithError(err)
+
+			return err
+		})
+	}
+
+	run("resize", func() error {
+		err := resizer.ResizeStream(streamCtx, resizeR, outputs)
+		resizeR.CloseWithError(err)
+
+		for _, pw := range writers {
+			pw.CloseWithError(err)
+		}
+
+		return err
+	})
+
+	wg.Wait()
+
+	if streamErr != nil {
+		return nil, inputDir, variantsDir, streamErr
+	}
+
+	return delays, inputDir, variantsDir, nil
+}
+
+// forwardFrames sets the delays from the headers on the decoded frames, frames that do not match the headers fail with errStreamMismatch.
+func forwardFrames(r io.Reader, w io.Writer, match types.Type, info probe.Info) ([]int, error) {
+	frames := rawframe.NewReader(r)
+	writer := rawframe.NewWriter(w)
+	delays := make([]int, 0, info.FrameCount)
+
+	for {
+		frame, err := frames.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, multierr.Append(fmt.Errorf("failed at read frame"), err)
+		}
+
+		if len(delays) == info.FrameCount {
+			return nil, fmt.Errorf("%w: more than %d frames", errStreamMismatch, info.FrameCount)
+		}
+
+		if frame.Width != info.Width || frame.Height != info.Height {
+			return nil, fmt.Errorf("%w: frame %d is %dx%d instead of %dx%d", errStreamMismatch, len(delays), frame.Width, frame.Height, info.Width, info.Height)
+		}
+
+		frame.Delay = 0
+
+		if info.FrameCount > 1 {
+			frame.Delay = info.Delays[len(delays)]
+			if match == matchers.TypeGif {
+				frame.Delay = gifDelay(frame.Delay)
+			}
+
+			if frame.Delay <= 1 {
+				frame.Delay = 10 // browsers treat 100fps gifs as 10fps
+			}
+		}
+
+		if err := writer.Write(frame); err != nil {
+			return nil, multierr.Append(fmt.Errorf("failed at write frame"), err)
+		}
+
+		delays = append(delays, frame.Delay)
+	}
+
+	if len(delays) != info.FrameCount {
+		return nil, fmt.Errorf("%w: %d frames instead of %d", errStreamMismatch, len(delays), info.FrameCount)
+	}
+
+	return delays, nil
+}
+
+// archivesFrames reports if the archive has the resized frames, streamed tasks then write every frame to the variants dir.
+func archivesFrames(contents task.ArchiveContents) bool {
+	return contents == task.ArchiveContentsAll || contents == task.ArchiveContentsFrames
+}
+
+// encodeScale streams every frame of a scale into the encoders of the animated outputs and writes the frames framePath
+// has a path for as png files, the first one is what the static outputs are made from.
+func encodeScale(ctx context.Context, pipeline Pipeline, r io.Reader, threads int, framePath func(i int) string, outputs []string) (err error) {
+	groups, _ := pipeline.groupOutputs(outputs)
+
+	var (
+		wg        sync.WaitGroup
+		mtx       sync.Mutex
+		encodeErr error
+	)
+
+	pipes := make([]*io.PipeWriter, len(groups))
+	writers := make([]*rawframe.Writer, len(groups))
+
+	for i, group := range groups {
+		pr, pw := io.Pipe()
+
+		pipes[i] = pw
+		writers[i] = rawframe.NewWriter(pw)
+
+		wg.Add(1)
+
+		go func(encoder StreamEncoder, outputs []string) {
+			defer wg.Done()
+
+			err := encoder.EncodeStream(ctx, EncodeOptions{Threads: threads, Quality: 100}, pr, outputs...)
+			pr.CloseWithError(err)
+
+			if err != nil {
+				mtx.Lock()
+				encodeErr = multierr.Append(encodeErr, err)
+				mtx.Unlock()
+			}
+		}(group.Encoder.(StreamEncoder), group.Outputs)
+	}
+
+	defer func() {
+		for _, pw := range pipes {
+			pw.CloseWithError(err)
+		}
+
+		wg.Wait()
+
+		err = multierr.Append(err, encodeErr)
+	}()
+
+	frames := rawframe.NewReader(r)
+
+	for i := 0; ; i++ {
+		frame, err := frames.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return multierr.Append(fmt.Errorf("failed at read frame"), err)
+		}
+
+		if pth := framePath(i); pth != "" {
+			if err := writePNG(pth, frame.Image(), png.BestSpeed); err != nil {
+				return err
+			}
+		}
+
+		for _, writer := range writers {
+			if err := writer.Write(frame); err != nil {
+				return multierr.Append(fmt.Errorf("failed at write frame"), err)
+			}
+		}
+	}
+}
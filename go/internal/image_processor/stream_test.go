@@ -0,0 +1,413 @@
+package image_processor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"runtime"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	awss3 "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/h2non/filetype/matchers"
+	prom "github.com/prometheus/client_golang/prometheus"
+
+	"github.com/seventv/image-processor/go/internal/configure"
+	"github.com/seventv/image-processor/go/internal/global"
+	"github.com/seventv/image-processor/go/internal/rawframe"
+	"github.com/seventv/image-processor/go/internal/svc/prometheus"
+	"github.com/seventv/image-processor/go/internal/svc/storage"
+	"github.com/seventv/image-processor/go/internal/testutil"
+	"github.com/seventv/image-processor/go/probe"
+	"github.com/seventv/image-processor/go/task"
+
+	messagequeue "github.com/seventv/message-queue/go"
+)
+
+// fakeStreamTool is a fakeTool that also supports raw frame streams, the decoder emits streamFrames frames.
+type fakeStreamTool struct {
+	fakeTool
+	streamFrames int
+	streamDelays [][]int
+}
+
+func (f *fakeStreamTool) Decode(ctx context.Context, input string, outputDir string) error {
+	info, err := probeFile(input)
+	if err != nil {
+		return err
+	}
+
+	f.record(nil, input)
+
+	for i := 0; i < info.FrameCount; i++ {
+		if err := writePNG(path.Join(outputDir, fmt.Sprintf("%04d.png", i)), image.NewNRGBA(image.Rect(0, 0, info.Width, info.Height)), 0); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (f *fakeStreamTool) DecodeStream(ctx context.Context, input string, info probe.Info, w io.Writer) error {
+	f.record(info, input)
+
+	frames := rawframe.NewWriter(w)
+	for i := 0; i < f.streamFrames; i++ {
+		if err := frames.Write(rawframe.FromImage(image.NewNRGBA(image.Rect(0, 0, info.Width, info.Height)), 0)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (f *fakeStreamTool) EncodeStream(ctx context.Context, opts EncodeOptions, r io.Reader, outputs ...string) error {
+	frames := rawframe.NewReader(r)
+	delays := []int{}
+
+	for {
+		frame, err := frames.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		delays = append(delays, frame.Delay)
+	}
+
+	f.record(opts, outputs...)
+
+	f.mtx.Lock()
+	f.streamDelays = append(f.streamDelays, delays)
+	f.mtx.Unlock()
+
+	for _, output := range outputs {
+		if err := os.WriteFile(output, []byte("encoded"), 0600); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func probeFile(pth string) (probe.Info, error) {
+	file, err := os.Open(pth)
+	if err != nil {
+		return probe.Info{}, err
+	}
+	defer file.Close()
+
+	return probe.Probe(file)
+}
+
+func streamTestWorker(tb testing.TB, decoder *fakeStreamTool, encoder *fakeStreamTool) (global.Context, Worker) {
+	config := &configure.Config{}
+	config.Worker.TempDir = tb.TempDir()
+	config.Worker.ThreadsPerWorker = 4
+
+	gCtx, cancel := global.WithCancel(global.New(context.Background(), config))
+	tb.Cleanup(cancel)
+
+	mq, err := messagequeue.New(gCtx, messagequeue.ConfigMock{})
+	if err != nil {
+		tb.Fatal("mq init failed: ", err)
+	}
+
+	gCtx.Inst().MessageQueue = mq
+	gCtx.Inst().Prometheus = prometheus.New(prometheus.Options{})
+
+	_, cwd, _, _ := runtime.Caller(0)
+
+	input, err := os.ReadFile(path.Join(path.Dir(cwd), "..", "..", "..", "assets", "animated-1.gif"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	gCtx.Inst().Storage, err = storage.NewMock(gCtx, map[string]map[string][]byte{
+		"input": {
+			"animated-1.gif": input,
+		},
+		"output": {},
+	})
+	if err != nil {
+		tb.Fatal("s3 init failed: ", err)
+	}
+
+	return gCtx, Worker{
+		Pipeline: &Pipeline{
+			Decoders: map[string]Decoder{"gif": decoder},
+			Resizer:  NativeResizer{},
+			Encoders: map[string]Encoder{
+				"avif": encoder,
+				"webp": encoder,
+				"gif":  encoder,
+				"png":  NativeEncoder{},
+			},
+		},
+	}
+}
+
+var streamTestTask = task.Task{
+	Flags: task.TaskFlagALL,
+	Input: task.TaskInput{
+		Bucket: "input",
+		Key:    "animated-1.gif",
+	},
+	Output: task.TaskOutput{
+		Bucket: "output",
+		Prefix: "animated-1.gif",
+	},
+	SmallestMaxWidth:  96,
+	SmallestMaxHeight: 32,
+	Scales:            []int{1, 2},
+}
+
+func TestWorkerStream(t *testing.T) {
+	t.Parallel()
+
+	decoder := &fakeStreamTool{streamFrames: 5}
+	encoder := &fakeStreamTool{}
+	gCtx, worker := streamTestWorker(t, decoder, encoder)
+
+	tsk := streamTestTask
+	tsk.Input.Reupload = task.TaskInputReupload{
+		Enabled: true,
+		Bucket:  "output",
+		Key:     "original.gif",
+	}
+
+	result := task.Result{}
+	err := worker.Work(gCtx, tsk, &result)
+	testutil.IsNil(t, err, "streamed convert was successful")
+
+	original := &bytes.Buffer{}
+	testutil.IsNil(t, gCtx.Inst().Storage.DownloadFile(gCtx, original, &awss3.GetObjectInput{
+		Bucket: aws.String("output"),
+		Key:    aws.String("original.gif"),
+	}), "input was reuploaded")
+	testutil.Assert(t, result.ImageInput.Size, original.Len(), "reuploaded from disk")
+
+	testutil.Assert(t, 1, len(decoder.calls), "decoder calls")
+	testutil.Assert(t, true, decoder.options[0] != nil, "the frames were streamed")
+	testutil.Assert(t, 2, len(encoder.streamDelays), "one streamed encode per scale")
+
+	for _, delays := range encoder.streamDelays {
+		testutil.Assert(t, 5, len(delays), "streamed frames")
+		testutil.Assert(t, 6, delays[0], "delay from the gif headers")
+	}
+
+	testutil.Assert(t, 5, result.ImageInput.FrameCount, "input frame count")
+	testutil.Assert(t, 12, len(result.ImageOutputs), "animated and static outputs of both scales")
+}
+
+func TestWorkerStreamArchive(t *testing.T) {
+	t.Parallel()
+
+	_, cwd, _, _ := runtime.Caller(0)
+
+	input, err := os.ReadFile(path.Join(path.Dir(cwd), "..", "..", "..", "assets", "animated-1.gif"))
+	testutil.IsNil(t, err, "read input")
+
+	archiveFrames := func(disable bool, contents task.ArchiveContents) []string {
+		gCtx, worker := streamTestWorker(t, &fakeStreamTool{streamFrames: 5}, &fakeStreamTool{})
+		gCtx.Config().Worker.DisableStreaming = disable
+
+		root := t.TempDir()
+		testutil.IsNil(t, os.MkdirAll(path.Join(root, "input"), 0700), "mkdir input bucket")
+		testutil.IsNil(t, os.WriteFile(path.Join(root, "input", "animated-1.gif"), input, 0600), "write input")
+
+		gCtx.Inst().Storage = storage.NewLocal(root)
+
+		tsk := streamTestTask
+		tsk.Output.Archive.Contents = contents
+
+		result := task.Result{}
+		testutil.IsNil(t, worker.Work(gCtx, tsk, &result), "convert was successful")
+
+		frames := []string{}
+		for name := range readArchive(t, path.Join(root, result.ArchiveOutput.Bucket, result.ArchiveOutput.Key), task.ArchiveFormatZip) {
+			if path.Dir(name) == "variants" {
+				frames = append(frames, name)
+			}
+		}
+
+		return frames
+	}
+
+	for _, contents := range []task.ArchiveContents{task.ArchiveContentsAll, task.ArchiveContentsFrames} {
+		testutil.Assert(t, 10, len(archiveFrames(false, contents)), "every streamed frame of both scales is archived")
+		testutil.Assert(t, 10, len(archiveFrames(true, contents)), "every exported frame of both scales is archived")
+	}
+
+	testutil.Assert(t, 0, len(archiveFrames(false, task.ArchiveContentsResults)), "archive without frames")
+}
+
+func TestWorkerProgress(t *testing.T) {
+	t.Parallel()
+
+	for _, disable := range []bool{false, true} {
+		gCtx, worker := streamTestWorker(t, &fakeStreamTool{streamFrames: 5}, &fakeStreamTool{})
+		gCtx.Config().Worker.DisableStreaming = disable
+
+		events := []task.Event{}
+		worker.Progress = func(event task.Event) {
+			events = append(events, event)
+		}
+
+		testutil.IsNil(t, worker.Work(gCtx, streamTestTask, &task.Result{}), "convert was successful")
+
+		stages := []task.EventStage{task.EventStageDownload, task.EventStageStream, task.EventStageMakeResults, task.EventStageUpload}
+		if disable {
+			stages = []task.EventStage{task.EventStageDownload, task.EventStageExport, task.EventStageResize, task.EventStageMakeResults, task.EventStageUpload}
+		}
+
+		testutil.Assert(t, len(stages)*2, len(events), "every stage starts and finishes")
+
+		for i, stage := range stages {
+			started, finished := events[i*2], events[i*2+1]
+
+			testutil.Assert(t, stage, started.Stage, "stage started in order")
+			testutil.Assert(t, task.EventStateStarted, started.State, "started")
+			testutil.Assert(t, stage, finished.Stage, "stage finished in order")
+			testutil.Assert(t, task.EventStateFinished, finished.State, "finished")
+			testutil.Assert(t, task.EventTypeProgress, finished.Type, "progress event")
+		}
+
+		testutil.Assert(t, 5, events[len(events)-1].FrameCount, "frame count of the input")
+	}
+}
+
+func TestWorkerLocalStorage(t *testing.T) {
+	t.Parallel()
+
+	gCtx, worker := streamTestWorker(t, &fakeStreamTool{streamFrames: 5}, &fakeStreamTool{})
+
+	_, cwd, _, _ := runtime.Caller(0)
+
+	input, err := os.ReadFile(path.Join(path.Dir(cwd), "..", "..", "..", "assets", "animated-1.gif"))
+	testutil.IsNil(t, err, "read input")
+
+	root := t.TempDir()
+	testutil.IsNil(t, os.MkdirAll(path.Join(root, "input"), 0700), "mkdir input bucket")
+	testutil.IsNil(t, os.WriteFile(path.Join(root, "input", "animated-1.gif"), input, 0600), "write input")
+
+	gCtx.Inst().Storage = storage.NewLocal(root)
+
+	result := task.Result{}
+	testutil.IsNil(t, worker.Work(gCtx, streamTestTask, &result), "convert from and to a directory tree")
+	testutil.Assert(t, 12, len(result.ImageOutputs), "animated and static outputs of both scales")
+
+	for _, output := range append(result.ImageOutputs, result.ArchiveOutput) {
+		info, err := os.Stat(path.Join(root, output.Bucket, output.Key))
+		testutil.IsNil(t, err, "output is a file under the root "+output.Key)
+		testutil.Assert(t, int64(output.Size), info.Size(), "output size "+output.Key)
+	}
+}
+
+func TestWorkerStreamMismatch(t *testing.T) {
+	t.Parallel()
+
+	decoder := &fakeStreamTool{streamFrames: 4}
+	encoder := &fakeStreamTool{}
+	gCtx, worker := streamTestWorker(t, decoder, encoder)
+
+	result := task.Result{}
+	err := worker.Work(gCtx, streamTestTask, &result)
+	testutil.IsNil(t, err, "convert fell back to files")
+
+	testutil.Assert(t, 2, len(decoder.calls), "streamed and then decoded to files")
+	testutil.Assert(t, true, decoder.options[1] == nil, "the second decode wrote files")
+	testutil.Assert(t, 5, result.ImageInput.FrameCount, "input frame count")
+	testutil.Assert(t, 12, len(result.ImageOutputs), "animated and static outputs of both scales")
+}
+
+func TestForwardFrames(t *testing.T) {
+	t.Parallel()
+
+	frame := rawframe.FromImage(image.NewNRGBA(image.Rect(0, 0, 2, 2)), 0)
+	info := probe.Info{Width: 2, Height: 2, FrameCount: 3, Delays: []int{1, 2, 7}}
+
+	input := &bytes.Buffer{}
+	for i := 0; i < 3; i++ {
+		testutil.IsNil(t, rawframe.NewWriter(input).Write(frame), "write frame")
+	}
+
+	delays, err := forwardFrames(bytes.NewReader(input.Bytes()), io.Discard, matchers.TypeGif, info)
+	testutil.IsNil(t, err, "forward gif frames")
+	testutil.Assert(t, 10, delays[0], "10ms gif frames play at 100ms")
+	testutil.Assert(t, 2, delays[1], "20ms gif frames")
+	testutil.Assert(t, 7, delays[2], "delay from the headers")
+
+	_, err = forwardFrames(bytes.NewReader(input.Bytes()), io.Discard, matchers.TypeWebp, probe.Info{Width: 2, Height: 2, FrameCount: 2, Delays: []int{4, 4}})
+	testutil.IsNotNil(t, err, "too many frames")
+
+	_, err = forwardFrames(bytes.NewReader(input.Bytes()), io.Discard, matchers.TypeWebp, probe.Info{Width: 3, Height: 2, FrameCount: 3, Delays: []int{4, 4, 4}})
+	testutil.IsNotNil(t, err, "frame size does not match the headers")
+}
+
+// BenchmarkWorkerStages reports the seconds per task every action of task_duration_seconds took with the external tools,
+// once with the frames written to the temp dir between the stages and once with them streamed.
+func BenchmarkWorkerStages(b *testing.B) {
+	for _, tool := range []string{"ffmpeg", "resize_png", "convert_png", "gifsicle", "optipng"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			b.Skipf("%s is not installed", tool)
+		}
+	}
+
+	for _, mode := range []struct {
+		name    string
+		disable bool
+	}{{"files", true}, {"stream", false}} {
+		mode := mode
+
+		b.Run(mode.name, func(b *testing.B) {
+			gCtx, _ := streamTestWorker(b, &fakeStreamTool{}, &fakeStreamTool{})
+			gCtx.Config().Worker.DisableStreaming = mode.disable
+
+			pipeline, err := NewPipeline(gCtx.Config())
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			worker := Worker{Pipeline: &pipeline}
+
+			registry := prom.NewRegistry()
+			gCtx.Inst().Prometheus.Register(registry)
+
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if err := worker.Work(gCtx, streamTestTask, &task.Result{}); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.StopTimer()
+
+			families, err := registry.Gather()
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			for _, family := range families {
+				if family.GetName() != "image_processor_task_duration_seconds" {
+					continue
+				}
+
+				for _, metric := range family.GetMetric() {
+					for _, label := range metric.GetLabel() {
+						if label.GetName() == "action" {
+							b.ReportMetric(metric.GetHistogram().GetSampleSum()/float64(b.N), label.GetValue()+"_s/op")
+						}
+					}
+				}
+			}
+		})
+	}
+}
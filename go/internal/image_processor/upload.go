@@ -0,0 +1,335 @@
+package image_processor
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/seventv/image-processor/go/internal/global"
+	"github.com/seventv/image-processor/go/internal/svc/storage"
+	"github.com/seventv/image-processor/go/task"
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultUploadConcurrency   = 8
+	defaultUploadMaxAttempts   = 3
+	defaultUploadBackoff       = 250 * time.Millisecond
+	defaultUploadMaxBackoff    = 5 * time.Second
+	defaultUploadMultipartSize = 64 << 20
+	defaultUploadPartSize      = 16 << 20
+)
+
+// errChecksumMismatch means the object s3 stored is not the body that was sent.
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// uploadChecksums are the hashes of a body sent with its upload so s3 rejects corrupted bodies.
+type uploadChecksums struct {
+	md5    []byte
+	sha256 []byte
+}
+
+// uploadPool runs uploads with a bounded concurrency and retries every upload with exponential backoff.
+type uploadPool struct {
+	ctx global.Context
+
+	maxAttempts    int
+	backoff        time.Duration
+	maxBackoff     time.Duration
+	multipartSize  int64
+	partSize       int64
+	checksumSHA256 bool
+
+	slots chan struct{}
+	wg    sync.WaitGroup
+	mtx   sync.Mutex
+	err   error
+}
+
+func newUploadPool(ctx global.Context) *uploadPool {
+	config := ctx.Config().S3.Upload
+
+	p := &uploadPool{
+		ctx:            ctx,
+		maxAttempts:    config.MaxAttempts,
+		backoff:        config.Backoff,
+		maxBackoff:     config.MaxBackoff,
+		multipartSize:  config.MultipartSize,
+		partSize:       config.PartSize,
+		checksumSHA256: config.ChecksumSHA256,
+	}
+
+	concurrency := config.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultUploadConcurrency
+	}
+
+	if p.maxAttempts <= 0 {
+		p.maxAttempts = defaultUploadMaxAttempts
+	}
+
+	if p.backoff <= 0 {
+		p.backoff = defaultUploadBackoff
+	}
+
+	if p.maxBackoff <= 0 {
+		p.maxBackoff = defaultUploadMaxBackoff
+	}
+
+	if p.multipartSize == 0 {
+		p.multipartSize = defaultUploadMultipartSize
+	}
+
+	if p.partSize <= 0 {
+		p.partSize = defaultUploadPartSize
+	}
+
+	p.slots = make(chan struct{}, concurrency)
+
+	return p
+}
+
+// Go runs fn once one of the slots of the pool is free, its error is returned by Wait.
+func (p *uploadPool) Go(fn func() error) {
+	p.wg.Add(1)
+
+	go func() {
+		defer p.wg.Done()
+
+		err := func() (err error) {
+			defer func() {
+				if pnk := recover(); pnk != nil {
+					err = fmt.Errorf("panic at runtime: %v", pnk)
+				}
+			}()
+
+			select {
+			case p.slots <- struct{}{}:
+			case <-p.ctx.Done():
+				return p.ctx.Err()
+			}
+			defer func() { <-p.slots }()
+
+			return fn()
+		}()
+		if err != nil {
+			p.mtx.Lock()
+			p.err = multierr.Append(p.err, err)
+			p.mtx.Unlock()
+		}
+	}()
+}
+
+// Wait waits for every upload to finish and returns their errors.
+func (p *uploadPool) Wait() error {
+	p.wg.Wait()
+
+	return p.err
+}
+
+// Upload puts an object in the storage of the worker, see UploadTo.
+func (p *uploadPool) Upload(opts *s3.PutObjectInput, size int64, body func() (io.ReadSeeker, error)) error {
+	return p.UploadTo(p.ctx.Inst().Storage, opts, size, body)
+}
+
+// UploadTo puts an object in inst, body is called for every attempt so each one starts from the beginning of the file.
+// Files of at least multipartSize bytes are uploaded in parts when the storage supports it.
+// The body is hashed before the first attempt, its checksums are sent with every attempt.
+func (p *uploadPool) UploadTo(inst storage.Instance, opts *s3.PutObjectInput, size int64, body func() (io.ReadSeeker, error)) error {
+	multipart, ok := inst.(storage.MultipartUploader)
+	if p.multipartSize < 0 || size < p.multipartSize {
+		ok = false
+	}
+
+	sums, err := bodyChecksums(body)
+	if err != nil {
+		return multierr.Append(fmt.Errorf("failed at checksum body"), err)
+	}
+
+	opts = p.withChecksums(opts, sums, ok)
+
+	for attempt := 1; ; attempt++ {
+		err = p.upload(inst, opts, body, multipart, ok, sums)
+		if err == nil {
+			return nil
+		}
+
+		if attempt >= p.maxAttempts || !retryable(err) {
+			break
+		}
+
+		p.ctx.Inst().Prometheus.UploadRetried()
+
+		backoff := p.backoff << (attempt - 1)
+		if backoff > p.maxBackoff || backoff <= 0 {
+			backoff = p.maxBackoff
+		}
+
+		zap.S().Debugw("retrying upload",
+			"key", opts.Key,
+			"attempt", attempt,
+			"backoff", backoff,
+			"error", err,
+		)
+
+		select {
+		case <-time.After(backoff):
+		case <-p.ctx.Done():
+			return multierr.Append(err, p.ctx.Err())
+		}
+	}
+
+	p.ctx.Inst().Prometheus.UploadFailed()
+
+	return err
+}
+
+func (p *uploadPool) upload(inst storage.Instance, opts *s3.PutObjectInput, body func() (io.ReadSeeker, error), multipart storage.MultipartUploader, useMultipart bool, sums uploadChecksums) error {
+	r, err := body()
+	if err != nil {
+		return err
+	}
+
+	if closer, ok := r.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	input := *opts
+	input.Body = r
+
+	if useMultipart {
+		return multipart.UploadFileMultipart(p.ctx, &input, p.partSize)
+	}
+
+	if putter, ok := inst.(storage.Putter); ok {
+		out, err := putter.PutFile(p.ctx, &input)
+		if err != nil {
+			return err
+		}
+
+		return verifyETag(out, sums.md5)
+	}
+
+	return inst.UploadFile(p.ctx, &input)
+}
+
+func bodyChecksums(body func() (io.ReadSeeker, error)) (uploadChecksums, error) {
+	r, err := body()
+	if err != nil {
+		return uploadChecksums{}, err
+	}
+
+	if closer, ok := r.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	md5Hash := md5.New()
+	sha256Hash := sha256.New()
+
+	if _, err := io.Copy(io.MultiWriter(md5Hash, sha256Hash), r); err != nil {
+		return uploadChecksums{}, err
+	}
+
+	return uploadChecksums{md5: md5Hash.Sum(nil), sha256: sha256Hash.Sum(nil)}, nil
+}
+
+// withChecksums returns the options with the checksums of the body, a multipart upload has no Content-MD5 for
+// the whole body so its parts are only checked with SHA256 when it is enabled.
+func (p *uploadPool) withChecksums(opts *s3.PutObjectInput, sums uploadChecksums, useMultipart bool) *s3.PutObjectInput {
+	input := *opts
+
+	if !useMultipart && input.ContentMD5 == nil {
+		input.ContentMD5 = aws.String(base64.StdEncoding.EncodeToString(sums.md5))
+	}
+
+	if p.checksumSHA256 {
+		if useMultipart {
+			input.ChecksumAlgorithm = aws.String(s3.ChecksumAlgorithmSha256)
+		} else {
+			input.ChecksumSHA256 = aws.String(base64.StdEncoding.EncodeToString(sums.sha256))
+		}
+	}
+
+	return &input
+}
+
+// verifyETag compares the ETag of an object put in one request with the MD5 of the body, the ETag of
+// objects encrypted with KMS or a customer key is not the MD5 so they are not compared.
+func verifyETag(out *s3.PutObjectOutput, md5Sum []byte) error {
+	if out == nil {
+		return nil
+	}
+
+	etag := strings.Trim(aws.StringValue(out.ETag), `"`)
+	if etag == "" || strings.Contains(etag, "-") || aws.StringValue(out.ServerSideEncryption) == s3.ServerSideEncryptionAwsKms || out.SSECustomerAlgorithm != nil {
+		return nil
+	}
+
+	if expected := hex.EncodeToString(md5Sum); !strings.EqualFold(etag, expected) {
+		return fmt.Errorf("%w: etag %s is not the md5 %s of the body", errChecksumMismatch, etag, expected)
+	}
+
+	return nil
+}
+
+// retryable reports if an upload error could go away by trying again, requests rejected by s3 will not.
+func retryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	// the body was corrupted on the way to s3
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) && awsErr.Code() == "BadDigest" {
+		return true
+	}
+
+	var reqErr awserr.RequestFailure
+	if errors.As(err, &reqErr) {
+		code := reqErr.StatusCode()
+
+		return code >= http.StatusInternalServerError || code == http.StatusTooManyRequests || code == http.StatusRequestTimeout
+	}
+
+	return true
+}
+
+// objectOptions converts the storage options of an output to the fields s3 takes them in, empty options are left unset.
+func objectOptions(storage task.TaskOutputStorage) (acl *string, disposition *string, metadata map[string]*string, tagging *string) {
+	if storage.ACL != "" {
+		acl = aws.String(storage.ACL)
+	}
+
+	if storage.ContentDisposition != "" {
+		disposition = aws.String(storage.ContentDisposition)
+	}
+
+	if len(storage.Metadata) != 0 {
+		metadata = aws.StringMap(storage.Metadata)
+	}
+
+	if len(storage.Tags) != 0 {
+		tags := url.Values{}
+		for k, v := range storage.Tags {
+			tags.Set(k, v)
+		}
+
+		tagging = aws.String(tags.Encode())
+	}
+
+	return acl, disposition, metadata, tagging
+}
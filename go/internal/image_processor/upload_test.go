@@ -0,0 +1,488 @@
+package image_processor
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	awss3 "github.com/aws/aws-sdk-go/service/s3"
+	prom "github.com/prometheus/client_golang/prometheus"
+
+	"github.com/seventv/image-processor/go/internal/configure"
+	"github.com/seventv/image-processor/go/internal/global"
+	"github.com/seventv/image-processor/go/internal/svc/prometheus"
+	"github.com/seventv/image-processor/go/internal/svc/storage"
+	"github.com/seventv/image-processor/go/internal/testutil"
+	"github.com/seventv/image-processor/go/task"
+)
+
+// flakyS3 fails the first attempts of every key with an injected status code and records how the uploads were made.
+type flakyS3 struct {
+	storage.Instance
+
+	mtx       sync.Mutex
+	failures  int
+	status    int
+	attempts  map[string]int
+	multipart map[string]int64
+	inputs    map[string]*awss3.PutObjectInput
+	delay     time.Duration
+	running   int
+	peak      int
+}
+
+func (f *flakyS3) attempt(key string) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	f.attempts[key]++
+	if f.attempts[key] <= f.failures {
+		return awserr.NewRequestFailure(awserr.New("InternalError", "injected failure", nil), f.status, "request")
+	}
+
+	return nil
+}
+
+func (f *flakyS3) UploadFile(ctx context.Context, opts *awss3.PutObjectInput) error {
+	f.mtx.Lock()
+	f.running++
+	if f.running > f.peak {
+		f.peak = f.running
+	}
+	f.mtx.Unlock()
+
+	defer func() {
+		f.mtx.Lock()
+		f.running--
+		f.mtx.Unlock()
+	}()
+
+	time.Sleep(f.delay)
+
+	f.mtx.Lock()
+	f.inputs[aws.StringValue(opts.Key)] = opts
+	f.mtx.Unlock()
+
+	// part of the body is read before failing so a retry has to start over
+	if err := f.attempt(aws.StringValue(opts.Key)); err != nil {
+		_, _ = io.CopyN(io.Discard, opts.Body, 2)
+
+		return err
+	}
+
+	return f.Instance.UploadFile(ctx, opts)
+}
+
+func (f *flakyS3) UploadFileMultipart(ctx context.Context, opts *awss3.PutObjectInput, partSize int64) error {
+	if err := f.attempt(aws.StringValue(opts.Key)); err != nil {
+		return err
+	}
+
+	f.mtx.Lock()
+	f.multipart[aws.StringValue(opts.Key)] = partSize
+	f.inputs[aws.StringValue(opts.Key)] = opts
+	f.mtx.Unlock()
+
+	return f.Instance.UploadFile(ctx, opts)
+}
+
+func uploadTestContext(t *testing.T, failures int, status int) (global.Context, *flakyS3, *prom.Registry) {
+	config := &configure.Config{}
+	config.S3.Upload.Concurrency = 2
+	config.S3.Upload.MaxAttempts = 3
+	config.S3.Upload.Backoff = time.Millisecond
+	config.S3.Upload.MultipartSize = 64
+	config.S3.Upload.PartSize = 32
+
+	gCtx, cancel := global.WithCancel(global.New(context.Background(), config))
+	t.Cleanup(cancel)
+
+	mock, err := storage.NewMock(gCtx, map[string]map[string][]byte{
+		"output":  {},
+		"private": {},
+	})
+	testutil.IsNil(t, err, "s3 init successful")
+
+	flaky := &flakyS3{
+		Instance:  mock,
+		failures:  failures,
+		status:    status,
+		attempts:  map[string]int{},
+		multipart: map[string]int64{},
+		inputs:    map[string]*awss3.PutObjectInput{},
+	}
+
+	gCtx.Inst().Storage = flaky
+	gCtx.Inst().Prometheus = prometheus.New(prometheus.Options{})
+
+	registry := prom.NewRegistry()
+	gCtx.Inst().Prometheus.Register(registry)
+
+	return gCtx, flaky, registry
+}
+
+func uploadBytes(pool *uploadPool, key string, data []byte) error {
+	return pool.Upload(&awss3.PutObjectInput{
+		Bucket: aws.String("output"),
+		Key:    aws.String(key),
+	}, int64(len(data)), func() (io.ReadSeeker, error) {
+		return bytes.NewReader(data), nil
+	})
+}
+
+func uploadRetries(t *testing.T, registry *prom.Registry, result string) float64 {
+	families, err := registry.Gather()
+	testutil.IsNil(t, err, "gather metrics")
+
+	for _, family := range families {
+		if family.GetName() != "image_processor_total_upload_retries" {
+			continue
+		}
+
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "result" && label.GetValue() == result {
+					return metric.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+
+	return 0
+}
+
+func downloaded(t *testing.T, gCtx global.Context, key string) []byte {
+	buf := &bytes.Buffer{}
+	testutil.IsNil(t, gCtx.Inst().Storage.DownloadFile(gCtx, buf, &awss3.GetObjectInput{
+		Bucket: aws.String("output"),
+		Key:    aws.String(key),
+	}), fmt.Sprintf("%s was uploaded", key))
+
+	return buf.Bytes()
+}
+
+func TestUploadRetries(t *testing.T) {
+	t.Parallel()
+
+	gCtx, flaky, registry := uploadTestContext(t, 2, http.StatusServiceUnavailable)
+	data := []byte("0123456789")
+
+	testutil.IsNil(t, uploadBytes(newUploadPool(gCtx), "file", data), "upload succeeds on the third attempt")
+	testutil.Assert(t, 3, flaky.attempts["file"], "attempts")
+	testutil.Assert(t, true, bytes.Equal(data, downloaded(t, gCtx, "file")), "retries upload the whole body")
+	testutil.Assert(t, 2.0, uploadRetries(t, registry, "retried"), "retries are counted")
+	testutil.Assert(t, 0.0, uploadRetries(t, registry, "failed"), "nothing failed")
+}
+
+func TestUploadGivesUp(t *testing.T) {
+	t.Parallel()
+
+	gCtx, flaky, registry := uploadTestContext(t, 5, http.StatusInternalServerError)
+
+	testutil.IsNotNil(t, uploadBytes(newUploadPool(gCtx), "file", []byte("data")), "upload fails")
+	testutil.Assert(t, 3, flaky.attempts["file"], "attempts are limited")
+	testutil.Assert(t, 2.0, uploadRetries(t, registry, "retried"), "retries are counted")
+	testutil.Assert(t, 1.0, uploadRetries(t, registry, "failed"), "failure is counted")
+}
+
+func TestUploadDoesNotRetryRejected(t *testing.T) {
+	t.Parallel()
+
+	gCtx, flaky, registry := uploadTestContext(t, 1, http.StatusForbidden)
+
+	testutil.IsNotNil(t, uploadBytes(newUploadPool(gCtx), "file", []byte("data")), "upload fails")
+	testutil.Assert(t, 1, flaky.attempts["file"], "rejected uploads are not retried")
+	testutil.Assert(t, 0.0, uploadRetries(t, registry, "retried"), "no retries")
+	testutil.Assert(t, 1.0, uploadRetries(t, registry, "failed"), "failure is counted")
+}
+
+func TestUploadPoolConcurrency(t *testing.T) {
+	t.Parallel()
+
+	gCtx, flaky, _ := uploadTestContext(t, 0, 0)
+	flaky.delay = 10 * time.Millisecond
+
+	pool := newUploadPool(gCtx)
+
+	for i := 0; i < 6; i++ {
+		key := fmt.Sprintf("file-%d", i)
+
+		pool.Go(func() error {
+			return uploadBytes(pool, key, []byte(key))
+		})
+	}
+
+	testutil.IsNil(t, pool.Wait(), "uploads succeed")
+	testutil.Assert(t, 2, flaky.peak, "uploads running at the same time")
+
+	for i := 0; i < 6; i++ {
+		key := fmt.Sprintf("file-%d", i)
+		testutil.Assert(t, key, string(downloaded(t, gCtx, key)), "uploaded contents")
+	}
+}
+
+func TestUploadMultipart(t *testing.T) {
+	t.Parallel()
+
+	gCtx, flaky, _ := uploadTestContext(t, 1, http.StatusBadGateway)
+	pool := newUploadPool(gCtx)
+
+	large := bytes.Repeat([]byte("a"), 100)
+
+	testutil.IsNil(t, uploadBytes(pool, "large", large), "large upload succeeds")
+	testutil.IsNil(t, uploadBytes(pool, "small", []byte("small")), "small upload succeeds")
+
+	testutil.Assert(t, int64(32), flaky.multipart["large"], "large files are uploaded in parts")
+	testutil.Assert(t, 2, flaky.attempts["large"], "multipart uploads are retried")
+
+	_, ok := flaky.multipart["small"]
+	testutil.Assert(t, false, ok, "small files are uploaded in one request")
+	testutil.Assert(t, true, bytes.Equal(large, downloaded(t, gCtx, "large")), "large contents")
+}
+
+func TestUploadResultsRetries(t *testing.T) {
+	t.Parallel()
+
+	gCtx, flaky, registry := uploadTestContext(t, 1, http.StatusServiceUnavailable)
+
+	tmpDir := t.TempDir()
+	resultsDir := path.Join(tmpDir, "results")
+	variantsDir := path.Join(tmpDir, "variants")
+	inputFile := path.Join(tmpDir, "input.gif")
+
+	testutil.IsNil(t, os.MkdirAll(resultsDir, 0700), "mkdir results")
+	testutil.IsNil(t, os.MkdirAll(variantsDir, 0700), "mkdir variants")
+
+	for name, data := range map[string]string{
+		path.Join(resultsDir, "1x.txt"):    "first",
+		path.Join(resultsDir, "2x.txt"):    "second",
+		path.Join(resultsDir, "3x.txt"):    "third",
+		path.Join(variantsDir, "0000.txt"): "variant",
+		inputFile:                          "input",
+	} {
+		testutil.IsNil(t, os.WriteFile(name, []byte(data), 0600), "write file")
+	}
+
+	tsk := task.Task{
+		Input: task.TaskInput{
+			Reupload: task.TaskInputReupload{
+				Enabled: true,
+				Bucket:  "output",
+				Key:     "original",
+			},
+		},
+		Output: task.TaskOutput{
+			Bucket: "output",
+			Prefix: "prefix",
+		},
+	}
+
+	result := task.Result{}
+	err := Worker{}.uploadResults(tmpDir, resultsDir, variantsDir, inputFile, tsk, &result, map[string]outputInfo{}, gCtx)
+	testutil.IsNil(t, err, "uploads succeed after a retry")
+
+	testutil.Assert(t, 3, len(result.ImageOutputs), "every output is uploaded")
+	testutil.Assert(t, "archive", result.ArchiveOutput.Name, "archive is uploaded")
+	testutil.Assert(t, "second", string(downloaded(t, gCtx, "prefix/2x.txt")), "output contents")
+
+	for _, output := range result.ImageOutputs {
+		sum := sha256.Sum256(downloaded(t, gCtx, output.Key))
+		testutil.Assert(t, hex.EncodeToString(sum[:]), output.SHA256, "result has the sha256 of the output")
+	}
+	testutil.Assert(t, "input", string(downloaded(t, gCtx, "original")), "input is reuploaded")
+	testutil.Assert(t, 2, flaky.attempts["original"], "reupload is retried")
+	testutil.Assert(t, 5.0, uploadRetries(t, registry, "retried"), "every upload was retried once")
+}
+
+func TestUploadResultsStorage(t *testing.T) {
+	t.Parallel()
+
+	gCtx, flaky, _ := uploadTestContext(t, 0, 0)
+
+	tmpDir := t.TempDir()
+	resultsDir := path.Join(tmpDir, "results")
+	variantsDir := path.Join(tmpDir, "variants")
+
+	testutil.IsNil(t, os.MkdirAll(resultsDir, 0700), "mkdir results")
+	testutil.IsNil(t, os.MkdirAll(variantsDir, 0700), "mkdir variants")
+
+	for _, name := range []string{"1x.txt", "2x.txt"} {
+		testutil.IsNil(t, os.WriteFile(path.Join(resultsDir, name), []byte(name), 0600), "write file")
+	}
+
+	tsk := task.Task{
+		Output: task.TaskOutput{
+			Bucket:             "output",
+			Prefix:             "prefix",
+			ACL:                "public-read",
+			CacheControl:       "max-age=60",
+			ContentDisposition: "inline",
+			Metadata:           map[string]string{"emote": "id"},
+			Tags:               map[string]string{"kind": "emote"},
+			Overrides: []task.TaskOutputOverride{
+				{Format: "zip", CacheControl: "no-store", ContentDisposition: "attachment"},
+				{Scale: 2, Bucket: "private", ACL: "private", Metadata: map[string]string{"scale": "2"}, Tags: map[string]string{"kind": "large emote"}},
+			},
+		},
+	}
+
+	result := task.Result{}
+	err := Worker{}.uploadResults(tmpDir, resultsDir, variantsDir, "", tsk, &result, map[string]outputInfo{}, gCtx)
+	testutil.IsNil(t, err, "uploads succeed")
+
+	small := flaky.inputs["prefix/1x.txt"]
+	testutil.Assert(t, "output", aws.StringValue(small.Bucket), "default bucket")
+	testutil.Assert(t, "public-read", aws.StringValue(small.ACL), "default acl")
+	testutil.Assert(t, "max-age=60", aws.StringValue(small.CacheControl), "default cache control")
+	testutil.Assert(t, "inline", aws.StringValue(small.ContentDisposition), "default content disposition")
+	testutil.Assert(t, "id", aws.StringValue(small.Metadata["emote"]), "metadata")
+	testutil.Assert(t, "kind=emote", aws.StringValue(small.Tagging), "tags")
+
+	large := flaky.inputs["prefix/2x.txt"]
+	testutil.Assert(t, "private", aws.StringValue(large.Bucket), "scale override bucket")
+	testutil.Assert(t, "private", aws.StringValue(large.ACL), "scale override acl")
+	testutil.Assert(t, "max-age=60", aws.StringValue(large.CacheControl), "options without override are kept")
+	testutil.Assert(t, "id", aws.StringValue(large.Metadata["emote"]), "metadata is merged")
+	testutil.Assert(t, "2", aws.StringValue(large.Metadata["scale"]), "override metadata")
+	testutil.Assert(t, "kind=large+emote", aws.StringValue(large.Tagging), "override tags")
+
+	archive := flaky.inputs["prefix/archive.zip"]
+	testutil.Assert(t, "no-store", aws.StringValue(archive.CacheControl), "archive cache control")
+	testutil.Assert(t, "attachment", aws.StringValue(archive.ContentDisposition), "archive content disposition")
+	testutil.Assert(t, "output", aws.StringValue(archive.Bucket), "archive does not match the scale override")
+
+	for _, output := range result.ImageOutputs {
+		if output.Name == "2x" {
+			testutil.Assert(t, "private", output.Bucket, "result has the bucket of the override")
+			testutil.Assert(t, "private", output.ACL, "result has the acl of the override")
+		}
+	}
+
+	testutil.Assert(t, "no-store", result.ArchiveOutput.CacheControl, "archive result has the override")
+}
+
+// etagS3 returns the ETag of every put, the first corrupt puts of every key store a different body than was sent.
+type etagS3 struct {
+	storage.Instance
+
+	mtx      sync.Mutex
+	corrupt  int
+	attempts map[string]int
+	inputs   map[string]*awss3.PutObjectInput
+}
+
+func (e *etagS3) PutFile(ctx context.Context, opts *awss3.PutObjectInput) (*awss3.PutObjectOutput, error) {
+	data, err := io.ReadAll(opts.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	key := aws.StringValue(opts.Key)
+
+	e.mtx.Lock()
+	e.attempts[key]++
+	e.inputs[key] = opts
+	corrupted := e.attempts[key] <= e.corrupt
+	e.mtx.Unlock()
+
+	if corrupted {
+		data = append([]byte("corrupted"), data...)
+	}
+
+	input := *opts
+	input.Body = bytes.NewReader(data)
+
+	if err := e.Instance.UploadFile(ctx, &input); err != nil {
+		return nil, err
+	}
+
+	sum := md5.Sum(data)
+
+	return &awss3.PutObjectOutput{ETag: aws.String(`"` + hex.EncodeToString(sum[:]) + `"`)}, nil
+}
+
+func TestUploadChecksums(t *testing.T) {
+	t.Parallel()
+
+	gCtx, _, registry := uploadTestContext(t, 0, 0)
+	gCtx.Config().S3.Upload.ChecksumSHA256 = true
+
+	etag := &etagS3{
+		Instance: gCtx.Inst().Storage,
+		corrupt:  1,
+		attempts: map[string]int{},
+		inputs:   map[string]*awss3.PutObjectInput{},
+	}
+	gCtx.Inst().Storage = etag
+
+	data := []byte("0123456789")
+
+	testutil.IsNil(t, uploadBytes(newUploadPool(gCtx), "file", data), "upload succeeds after the etag mismatch")
+	testutil.Assert(t, 2, etag.attempts["file"], "corrupted uploads are retried")
+	testutil.Assert(t, 1.0, uploadRetries(t, registry, "retried"), "retry is counted")
+	testutil.Assert(t, true, bytes.Equal(data, downloaded(t, gCtx, "file")), "uploaded contents")
+
+	md5Sum := md5.Sum(data)
+	sha256Sum := sha256.Sum256(data)
+
+	input := etag.inputs["file"]
+	testutil.Assert(t, base64.StdEncoding.EncodeToString(md5Sum[:]), aws.StringValue(input.ContentMD5), "content md5 is sent")
+	testutil.Assert(t, base64.StdEncoding.EncodeToString(sha256Sum[:]), aws.StringValue(input.ChecksumSHA256), "sha256 checksum is sent")
+
+	etag.corrupt = 5
+
+	err := uploadBytes(newUploadPool(gCtx), "corrupted", data)
+	testutil.IsNotNil(t, err, "upload fails when every attempt is corrupted")
+	testutil.Assert(t, true, errors.Is(err, errChecksumMismatch), "mismatch is reported")
+	testutil.Assert(t, 3, etag.attempts["corrupted"], "attempts are limited")
+}
+
+func TestUploadMultipartChecksums(t *testing.T) {
+	t.Parallel()
+
+	gCtx, flaky, _ := uploadTestContext(t, 0, 0)
+	gCtx.Config().S3.Upload.ChecksumSHA256 = true
+
+	testutil.IsNil(t, uploadBytes(newUploadPool(gCtx), "large", bytes.Repeat([]byte("a"), 100)), "large upload succeeds")
+
+	input := flaky.inputs["large"]
+	testutil.Assert(t, awss3.ChecksumAlgorithmSha256, aws.StringValue(input.ChecksumAlgorithm), "parts are checked with sha256")
+	testutil.Assert(t, true, input.ContentMD5 == nil, "multipart uploads have no md5 of the whole body")
+}
+
+func TestVerifyETag(t *testing.T) {
+	t.Parallel()
+
+	sum := md5.Sum([]byte("data"))
+	valid := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		out   *awss3.PutObjectOutput
+		valid bool
+	}{
+		{&awss3.PutObjectOutput{ETag: aws.String(`"` + valid + `"`)}, true},
+		{&awss3.PutObjectOutput{ETag: aws.String(`"0123"`)}, false},
+		{&awss3.PutObjectOutput{ETag: aws.String(`"0123-2"`)}, true},
+		{&awss3.PutObjectOutput{ETag: aws.String(`"0123"`), ServerSideEncryption: aws.String(awss3.ServerSideEncryptionAwsKms)}, true},
+		{&awss3.PutObjectOutput{}, true},
+		{nil, true},
+	}
+
+	for i, test := range tests {
+		testutil.Assert(t, test.valid, verifyETag(test.out, sum[:]) == nil, fmt.Sprintf("etag %d", i))
+	}
+}
@@ -0,0 +1,302 @@
+package image_processor
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/seventv/image-processor/go/internal/global"
+	"github.com/seventv/image-processor/go/task"
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultWebhookTimeout      = 10 * time.Second
+	defaultWebhookMaxAttempts  = 5
+	defaultWebhookBackoff      = 500 * time.Millisecond
+	defaultWebhookMaxBackoff   = 30 * time.Second
+	defaultWebhookConcurrency  = 4
+	defaultWebhookQueueSize    = 1000
+	defaultWebhookDrainTimeout = 30 * time.Second
+
+	webhookSignatureHeader = "X-Signature-256"
+)
+
+// errWebhookRejected means the callback answered with a status that will not change by posting again.
+var errWebhookRejected = errors.New("webhook rejected")
+
+// callbackURL returns where the result of the task is posted, empty means it is not posted.
+func callbackURL(ctx global.Context, tsk task.Task) string {
+	if tsk.CallbackURL != "" {
+		return tsk.CallbackURL
+	}
+
+	return ctx.Config().Worker.Webhook.URL
+}
+
+// signWebhook returns the signature header of a body, the hex HMAC-SHA256 of the body with the secret.
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookClient returns the client results are posted with, redirects are never followed. Callback urls of tasks
+// are restricted like url inputs so a task can not make the worker post to services next to it.
+func webhookClient(ctx global.Context, restricted bool, timeout time.Duration) (*http.Client, error) {
+	client := &http.Client{
+		Timeout: timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	if restricted {
+		networks, err := blockedNetworks(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		client.Transport = blockingTransport(networks, timeout)
+	}
+
+	return client, nil
+}
+
+// deliverResult posts the result to the callback url, failed posts are retried with exponential backoff
+// unless the callback rejects the result. Restricted callbacks may not be on the blocked networks of url inputs.
+func deliverResult(ctx global.Context, callback string, restricted bool, result task.Result) error {
+	config := ctx.Config().Worker.Webhook
+
+	u, err := url.Parse(callback)
+	if err != nil {
+		return multierr.Append(fmt.Errorf("failed at parse callback url"), err)
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported callback url scheme %s", u.Scheme)
+	}
+
+	body, err := json.Marshal(result)
+	if err != nil {
+		return multierr.Append(fmt.Errorf("failed at marshal result"), err)
+	}
+
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = defaultWebhookTimeout
+	}
+
+	maxAttempts := config.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = defaultWebhookMaxAttempts
+	}
+
+	backoff := config.Backoff
+	if backoff <= 0 {
+		backoff = defaultWebhookBackoff
+	}
+
+	maxBackoff := config.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = defaultWebhookMaxBackoff
+	}
+
+	client, err := webhookClient(ctx, restricted, timeout)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 1; ; attempt++ {
+		err = postWebhook(ctx, client, u.String(), config.Secret, result.ID, body)
+		if err == nil {
+			return nil
+		}
+
+		if attempt >= maxAttempts || errors.Is(err, errWebhookRejected) || errors.Is(err, errBlockedAddress) {
+			return err
+		}
+
+		wait := backoff << (attempt - 1)
+		if wait > maxBackoff || wait <= 0 {
+			wait = maxBackoff
+		}
+
+		zap.S().Debugw("retrying webhook",
+			"attempt", attempt,
+			"backoff", wait,
+			"error", err,
+			"task_id", result.ID,
+		)
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return multierr.Append(err, ctx.Err())
+		}
+	}
+}
+
+// webhookDelivery is a result waiting to be posted.
+type webhookDelivery struct {
+	callback   string
+	restricted bool
+	result     task.Result
+}
+
+// webhookSender posts results in the background so a slow callback holds neither a worker nor the intake of tasks
+// while there is room in the queue, once it is full the results wait for room instead of being dropped.
+type webhookSender struct {
+	// ctx is not cancelled with the worker so the queue can be drained when it stops
+	ctx    global.Context
+	cancel context.CancelFunc
+	queue  chan webhookDelivery
+
+	wg      sync.WaitGroup
+	mtx     sync.RWMutex
+	closed  bool
+	closing chan struct{}
+	once    sync.Once
+}
+
+func newWebhookSender(ctx global.Context) *webhookSender {
+	config := ctx.Config().Worker.Webhook
+
+	concurrency := config.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultWebhookConcurrency
+	}
+
+	queueSize := config.QueueSize
+	if queueSize <= 0 {
+		queueSize = defaultWebhookQueueSize
+	}
+
+	dCtx, cancel := global.WithCancel(global.New(context.Background(), ctx.Config()))
+
+	s := &webhookSender{
+		ctx:     dCtx,
+		cancel:  cancel,
+		queue:   make(chan webhookDelivery, queueSize),
+		closing: make(chan struct{}),
+	}
+
+	for i := 0; i < concurrency; i++ {
+		s.wg.Add(1)
+
+		go s.run()
+	}
+
+	return s
+}
+
+func (s *webhookSender) run() {
+	defer s.wg.Done()
+
+	for d := range s.queue {
+		if err := deliverResult(s.ctx, d.callback, d.restricted, d.result); err != nil {
+			zap.S().Errorw("failed to deliver result",
+				"error", err,
+				"task_id", d.result.ID,
+			)
+		}
+	}
+}
+
+// send queues the result of the task for its callback url and waits for room in the queue when it is full,
+// only results sent after the sender started closing are not delivered.
+func (s *webhookSender) send(tsk task.Task, result task.Result) {
+	callback := callbackURL(s.ctx, tsk)
+	if callback == "" {
+		return
+	}
+
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if !s.closed {
+		select {
+		case s.queue <- webhookDelivery{callback: callback, restricted: tsk.CallbackURL != "", result: result}:
+			return
+		case <-s.closing:
+		}
+	}
+
+	zap.S().Errorw("worker is stopping, result is not delivered",
+		"task_id", result.ID,
+	)
+}
+
+// close stops taking results and waits up to timeout for the queued ones to be delivered,
+// the deliveries left after it are cancelled.
+func (s *webhookSender) close(timeout time.Duration) {
+	s.once.Do(func() {
+		close(s.closing)
+
+		s.mtx.Lock()
+		s.closed = true
+		close(s.queue)
+		s.mtx.Unlock()
+	})
+
+	done := make(chan struct{})
+
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		zap.S().Errorw("webhook queue was not drained in time",
+			"pending", len(s.queue),
+		)
+	}
+
+	s.cancel()
+}
+
+func postWebhook(ctx global.Context, client *http.Client, callback string, secret string, taskID string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, callback, bytes.NewReader(body))
+	if err != nil {
+		return multierr.Append(fmt.Errorf("failed at create request"), err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", defaultHTTPInputUserAgent)
+	req.Header.Set("X-Task-ID", taskID)
+
+	if secret != "" {
+		req.Header.Set(webhookSignatureHeader, signWebhook(secret, body))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusRequestTimeout:
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return fmt.Errorf("%w: unexpected status %s", errWebhookRejected, resp.Status)
+}
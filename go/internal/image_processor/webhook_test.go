@@ -0,0 +1,254 @@
+package image_processor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/seventv/image-processor/go/internal/configure"
+	"github.com/seventv/image-processor/go/internal/global"
+	"github.com/seventv/image-processor/go/internal/testutil"
+	"github.com/seventv/image-processor/go/task"
+)
+
+func webhookTestContext(t *testing.T) global.Context {
+	config := &configure.Config{}
+	config.Worker.Webhook.Secret = "secret"
+	config.Worker.Webhook.MaxAttempts = 3
+	config.Worker.Webhook.Backoff = time.Millisecond
+
+	gCtx, cancel := global.WithCancel(global.New(context.Background(), config))
+	t.Cleanup(cancel)
+
+	return gCtx
+}
+
+func TestDeliverResult(t *testing.T) {
+	t.Parallel()
+
+	gCtx := webhookTestContext(t)
+
+	var (
+		mtx      sync.Mutex
+		attempts int
+		bodies   [][]byte
+	)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		mtx.Lock()
+		defer mtx.Unlock()
+
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		if r.Header.Get(webhookSignatureHeader) != signWebhook("secret", body) || r.Header.Get("X-Task-ID") != "task" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		bodies = append(bodies, body)
+	}))
+	t.Cleanup(srv.Close)
+
+	result := task.Result{ID: "task", State: task.ResultStateSuccess}
+	testutil.IsNil(t, deliverResult(gCtx, srv.URL, false, result), "result is delivered after a retry")
+	testutil.Assert(t, 2, attempts, "failed posts are retried")
+	testutil.Assert(t, 1, len(bodies), "signed result was received")
+
+	received := task.Result{}
+	testutil.IsNil(t, json.Unmarshal(bodies[0], &received), "body is the result")
+	testutil.Assert(t, "task", received.ID, "result id")
+	testutil.Assert(t, task.ResultStateSuccess, received.State, "result state")
+
+	testutil.IsNotNil(t, deliverResult(gCtx, "ftp://example.com", false, result), "unsupported scheme")
+}
+
+func TestDeliverResultRejected(t *testing.T) {
+	t.Parallel()
+
+	gCtx := webhookTestContext(t)
+
+	var (
+		mtx      sync.Mutex
+		attempts int
+	)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		attempts++
+		mtx.Unlock()
+
+		if r.URL.Path == "/bad" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	t.Cleanup(srv.Close)
+
+	testutil.IsNotNil(t, deliverResult(gCtx, srv.URL+"/bad", false, task.Result{}), "rejected result")
+	testutil.Assert(t, 1, attempts, "rejected results are not posted again")
+
+	testutil.IsNotNil(t, deliverResult(gCtx, srv.URL, false, task.Result{}), "callback is down")
+	testutil.Assert(t, 4, attempts, "posts are retried up to the max attempts")
+}
+
+func TestDeliverResultRestricted(t *testing.T) {
+	t.Parallel()
+
+	gCtx := webhookTestContext(t)
+
+	var (
+		mtx   sync.Mutex
+		posts []string
+	)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		posts = append(posts, r.URL.Path)
+		mtx.Unlock()
+
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "/internal", http.StatusTemporaryRedirect)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	err := deliverResult(gCtx, srv.URL, true, task.Result{})
+	testutil.Assert(t, true, errors.Is(err, errBlockedAddress), "callbacks of tasks can not be on private networks")
+	testutil.Assert(t, 0, len(posts), "blocked callbacks are not posted to")
+
+	testutil.IsNotNil(t, deliverResult(gCtx, srv.URL+"/redirect", false, task.Result{}), "redirects are rejected")
+	testutil.Assert(t, 1, len(posts), "redirects are not followed or retried")
+}
+
+func TestWebhookSender(t *testing.T) {
+	t.Parallel()
+
+	gCtx := webhookTestContext(t)
+
+	received := make(chan task.Result, 3)
+	release := make(chan struct{})
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+
+		result := task.Result{}
+		_ = json.NewDecoder(r.Body).Decode(&result)
+		received <- result
+	}))
+	t.Cleanup(srv.Close)
+
+	gCtx.Config().Worker.Webhook.URL = srv.URL
+	gCtx.Config().Worker.Webhook.Concurrency = 1
+	gCtx.Config().Worker.Webhook.QueueSize = 1
+
+	sender := newWebhookSender(gCtx)
+
+	sent := make(chan string, 3)
+	go func() {
+		for _, id := range []string{"posting", "queued", "waiting"} {
+			sender.send(task.Task{ID: id}, task.Result{ID: id})
+			sent <- id
+
+			// the first result has to be taken off the queue before the second fills it
+			if id == "posting" {
+				time.Sleep(100 * time.Millisecond)
+			}
+		}
+	}()
+
+	testutil.Assert(t, "posting", <-sent, "first result is taken")
+	testutil.Assert(t, "queued", <-sent, "second result is queued")
+
+	select {
+	case id := <-sent:
+		t.Fatalf("result %s did not wait for room in a full queue", id)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+
+	testutil.Assert(t, "waiting", <-sent, "result is queued once there is room")
+
+	for _, id := range []string{"posting", "queued", "waiting"} {
+		testutil.Assert(t, id, (<-received).ID, "result is delivered "+id)
+	}
+
+	sender.close(5 * time.Second)
+}
+
+func TestWebhookSenderClose(t *testing.T) {
+	t.Parallel()
+
+	gCtx := webhookTestContext(t)
+
+	var delivered int32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		atomic.AddInt32(&delivered, 1)
+	}))
+	t.Cleanup(srv.Close)
+
+	gCtx.Config().Worker.Webhook.URL = srv.URL
+	gCtx.Config().Worker.Webhook.Concurrency = 1
+
+	sender := newWebhookSender(gCtx)
+
+	for _, id := range []string{"a", "b", "c"} {
+		sender.send(task.Task{ID: id}, task.Result{ID: id})
+	}
+
+	sender.close(5 * time.Second)
+	testutil.Assert(t, int32(3), atomic.LoadInt32(&delivered), "queued results are delivered before the sender is closed")
+
+	// results of tasks which finish after the sender was closed are not queued
+	sender.send(task.Task{ID: "late"}, task.Result{ID: "late"})
+
+	release := make(chan struct{})
+
+	stuck := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(stuck.Close)
+	t.Cleanup(func() { close(release) })
+
+	gCtx.Config().Worker.Webhook.URL = stuck.URL
+
+	sender = newWebhookSender(gCtx)
+	sender.send(task.Task{ID: "stuck"}, task.Result{ID: "stuck"})
+
+	start := time.Now()
+	sender.close(100 * time.Millisecond)
+	testutil.Assert(t, true, time.Since(start) < 5*time.Second, "close gives up on the queue after the timeout")
+	testutil.IsNotNil(t, sender.ctx.Err(), "deliveries left are cancelled")
+}
+
+func TestCallbackURL(t *testing.T) {
+	t.Parallel()
+
+	gCtx := webhookTestContext(t)
+
+	testutil.Assert(t, "", callbackURL(gCtx, task.Task{}), "no callback")
+
+	gCtx.Config().Worker.Webhook.URL = "http://config"
+	testutil.Assert(t, "http://config", callbackURL(gCtx, task.Task{}), "callback of the config")
+	testutil.Assert(t, "http://task", callbackURL(gCtx, task.Task{CallbackURL: "http://task"}), "callback of the task wins")
+}
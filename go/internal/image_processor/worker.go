@@ -1,12 +1,12 @@
 package image_processor
 
 import (
-	"archive/zip"
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"image/gif"
 	"io"
 	"io/fs"
 	"math"
@@ -27,13 +27,37 @@ import (
 	"github.com/seventv/common/utils"
 	"github.com/seventv/image-processor/go/container"
 	"github.com/seventv/image-processor/go/internal/global"
+	"github.com/seventv/image-processor/go/internal/svc/storage"
+	"github.com/seventv/image-processor/go/probe"
 	"github.com/seventv/image-processor/go/task"
 	"go.uber.org/multierr"
 	"go.uber.org/zap"
 	"golang.org/x/crypto/sha3"
 )
 
-type Worker struct{}
+type Worker struct {
+	// Pipeline replaces the tools resolved from the config when set
+	Pipeline *Pipeline
+	// Progress is called when a stage of a task starts or finishes, nothing is reported when it is nil
+	Progress func(event task.Event)
+}
+
+// progress reports a stage of the task, a frame count of 0 means the frames are not known yet.
+func (w Worker) progress(tsk task.Task, stage task.EventStage, state task.EventState, frameCount int) {
+	if w.Progress == nil {
+		return
+	}
+
+	w.Progress(task.Event{
+		Type:       task.EventTypeProgress,
+		ID:         tsk.ID,
+		Stage:      stage,
+		State:      state,
+		FrameCount: frameCount,
+		Timestamp:  time.Now(),
+		Metadata:   tsk.Metadata,
+	})
+}
 
 func (w Worker) Work(ctx global.Context, tsk task.Task, result *task.Result) (err error) {
 	if result == nil {
@@ -57,6 +81,14 @@ func (w Worker) Work(ctx global.Context, tsk task.Task, result *task.Result) (er
 		finish(err == nil)
 	}()
 
+	if err := validateKeyTemplate(tsk); err != nil {
+		return err
+	}
+
+	if err := validateReplicas(ctx, tsk); err != nil {
+		return err
+	}
+
 	id := uuid.New().String()
 	tmpDir := path.Join(ctx.Config().Worker.TempDir, id)
 
@@ -72,8 +104,9 @@ func (w Worker) Work(ctx global.Context, tsk task.Task, result *task.Result) (er
 	defer os.RemoveAll(tmpDir)
 
 	done := ctx.Inst().Prometheus.DownloadFile()
+	w.progress(tsk, task.EventStageDownload, task.EventStateStarted, 0)
 
-	raw, match, inputFile, err := w.downloadFile(ctx, tsk, tmpDir, result)
+	match, inputFile, inputSize, inputSums, err := w.downloadFile(ctx, tsk, tmpDir, result)
 	if err != nil {
 		return multierr.Append(fmt.Errorf("failed at download file"), err)
 	}
@@ -83,60 +116,192 @@ func (w Worker) Work(ctx global.Context, tsk task.Task, result *task.Result) (er
 	)
 
 	done()
+	w.progress(tsk, task.EventStageDownload, task.EventStateFinished, 0)
 
 	ctx.Inst().Prometheus.InputFileType(match.MIME.Value)
 
-	ctx.Inst().Prometheus.TotalBytesDownloaded(len(raw))
+	ctx.Inst().Prometheus.TotalBytesDownloaded(int(inputSize))
+
+	if tsk.Output.Idempotent {
+		stored, ok, err := loadManifest(ctx, tsk, inputSums.SHA3)
+		if err != nil {
+			// the task is processed again when the manifest can not be read
+			zap.S().Warnw("failed to load manifest",
+				"error", err,
+				"task_id", tsk.ID,
+			)
+		} else if ok {
+			result.ImageInput = stored.ImageInput
+			result.ImageOutputs = stored.ImageOutputs
+			result.ArchiveOutput = stored.ArchiveOutput
+			result.SkippedOutputs = stored.SkippedOutputs
+			result.Replicas = stored.Replicas
+			result.Reused = true
+			result.ReusedFrom = task.ResultReuseManifest
+
+			zap.S().Debugw("reused outputs of manifest",
+				"task_id", tsk.ID,
+			)
+
+			ok, err := replicasPresent(ctx, tsk, stored.Replicas)
+			if err != nil {
+				zap.S().Warnw("failed to check replicas of manifest",
+					"error", err,
+					"task_id", tsk.ID,
+				)
+			}
+
+			if !ok {
+				// the outputs are there so the replicas are written again from them
+				if err := copyReplicas(ctx, tsk, result); err != nil {
+					return multierr.Append(fmt.Errorf("failed at copy replicas"), err)
+				}
+
+				saveManifest(ctx, tsk, result)
+			}
+
+			return nil
+		}
+	}
+
+	cache := newDedupCache(ctx)
+
+	var cacheKey string
+
+	if cache.enabled() {
+		cacheKey, err = dedupKey(tsk, inputSums.SHA3)
+		if err != nil {
+			return multierr.Append(fmt.Errorf("failed at dedup key"), err)
+		}
+
+		ok, err := w.reuseCached(ctx, cache, cacheKey, tsk, inputFile, inputSums, inputSize, result)
+		if err != nil {
+			// the outputs are made again when they can not be copied
+			zap.S().Warnw("failed to reuse cached outputs",
+				"error", err,
+				"task_id", tsk.ID,
+			)
+		} else if ok {
+			zap.S().Debugw("copied cached outputs",
+				"task_id", tsk.ID,
+			)
+
+			saveManifest(ctx, tsk, result)
 
-	done = ctx.Inst().Prometheus.ExportFrames()
+			return nil
+		}
+	}
 
-	delays, inputDir, err := w.exportFrames(ctx, tmpDir, inputFile, match, raw)
+	info, err := w.probeInput(ctx, inputFile)
 	if err != nil {
-		return multierr.Append(fmt.Errorf("failed at export frames"), err)
+		return multierr.Append(fmt.Errorf("failed at probe input"), err)
 	}
 
-	zap.S().Debugw("exported frames",
-		"frame_count", len(delays),
+	zap.S().Debugw("probed input",
+		"width", info.Width,
+		"height", info.Height,
+		"frame_count", info.FrameCount,
 		"task_id", tsk.ID,
 	)
 
-	done()
-
-	if tsk.Limits.MaxFrameCount != 0 && len(delays) > tsk.Limits.MaxFrameCount {
-		return fmt.Errorf("file has too many frames (%d where the limit is %d)", len(delays), tsk.Limits.MaxFrameCount)
+	// the headers are checked before any frames are decoded so a decompression bomb never reaches ffmpeg or dump_png
+	if err := checkLimits(ctx, tsk, result, info.Width, info.Height, info.FrameCount); err != nil {
+		return err
 	}
 
-	ctx.Inst().Prometheus.TotalFramesProcessed(len(delays))
-
-	width, height, err := w.getWidthHeight(ctx, path.Join(inputDir, "0000.png"))
+	pipeline, native, err := w.pipeline(ctx, match, info)
 	if err != nil {
-		return multierr.Append(fmt.Errorf("failed at get width height"), err)
+		return multierr.Append(fmt.Errorf("failed at pipeline"), err)
 	}
 
-	zap.S().Debugw("calculated width and height",
-		"width", width,
-		"height", height,
-		"task_id", tsk.ID,
+	var (
+		delays      []int
+		inputDir    string
+		variantsDir string
+		width       int
+		height      int
+		streamed    bool
 	)
 
-	if (tsk.Limits.MaxWidth != 0 && tsk.Limits.MaxWidth < width) || (tsk.Limits.MaxHeight != 0 && tsk.Limits.MaxHeight < height) {
-		return fmt.Errorf("file dimensions are too big (%dx%d where the limit is %dx%d)", width, height, tsk.Limits.MaxWidth, tsk.Limits.MaxHeight)
+	if !ctx.Config().Worker.DisableStreaming && streamable(pipeline, match, info, tsk) {
+		done = ctx.Inst().Prometheus.StreamFrames()
+		w.progress(tsk, task.EventStageStream, task.EventStateStarted, info.FrameCount)
+
+		delays, inputDir, variantsDir, err = w.streamFrames(ctx, pipeline, tmpDir, inputFile, match, info, tsk)
+
+		switch {
+		case err == nil:
+			streamed = true
+			width, height = info.Width, info.Height
+
+			zap.S().Debugw("streamed frames",
+				"frame_count", len(delays),
+				"native", native,
+				"task_id", tsk.ID,
+			)
+
+			done()
+			w.progress(tsk, task.EventStageStream, task.EventStateFinished, len(delays))
+		case errors.Is(err, errStreamMismatch):
+			// the decoded frames did not match the headers, the file pipeline works out the real timings
+			zap.S().Debugw("falling back to the file pipeline",
+				"error", err,
+				"task_id", tsk.ID,
+			)
+
+			if err := multierr.Combine(os.RemoveAll(variantsDir), os.RemoveAll(path.Join(tmpDir, "results"))); err != nil {
+				return multierr.Append(fmt.Errorf("failed at clean up streamed frames"), err)
+			}
+		default:
+			return multierr.Append(fmt.Errorf("failed at stream frames"), err)
+		}
 	}
 
-	h := sha3.New512()
+	if !streamed {
+		done = ctx.Inst().Prometheus.ExportFrames()
+		w.progress(tsk, task.EventStageExport, task.EventStateStarted, info.FrameCount)
 
-	_, err = h.Write(raw)
-	if err != nil {
-		return multierr.Append(fmt.Errorf("failed at hash input file"), err)
+		delays, inputDir, err = w.exportFrames(ctx, pipeline, tmpDir, inputFile, match, info)
+		if err != nil {
+			return multierr.Append(fmt.Errorf("failed at export frames"), err)
+		}
+
+		zap.S().Debugw("exported frames",
+			"frame_count", len(delays),
+			"native", native,
+			"task_id", tsk.ID,
+		)
+
+		done()
+		w.progress(tsk, task.EventStageExport, task.EventStateFinished, len(delays))
+
+		width, height, err = w.getWidthHeight(path.Join(inputDir, "0000.png"))
+		if err != nil {
+			return multierr.Append(fmt.Errorf("failed at get width height"), err)
+		}
+
+		zap.S().Debugw("calculated width and height",
+			"width", width,
+			"height", height,
+			"task_id", tsk.ID,
+		)
+	}
+
+	ctx.Inst().Prometheus.TotalFramesProcessed(len(delays))
+
+	// headers can lie about the contents so the limits are checked again against the decoded frames
+	if err := checkLimits(ctx, tsk, result, width, height, len(delays)); err != nil {
+		return err
 	}
 
 	result.ImageInput = task.ResultFile{
-		SHA3:        hex.EncodeToString(h.Sum(nil)),
+		SHA3:        inputSums.SHA3,
+		SHA256:      inputSums.SHA256,
 		FrameCount:  len(delays),
 		ContentType: match.MIME.Value,
 		Width:       width,
 		Height:      height,
-		Size:        len(raw),
+		Size:        int(inputSize),
 	}
 
 	if tsk.Input.Reupload.Enabled {
@@ -147,37 +312,50 @@ func (w Worker) Work(ctx global.Context, tsk task.Task, result *task.Result) (er
 		result.ImageInput.ACL = tsk.Input.Reupload.ACL
 	}
 
-	done = ctx.Inst().Prometheus.ResizeFrames()
+	if !streamed {
+		done = ctx.Inst().Prometheus.ResizeFrames()
+		w.progress(tsk, task.EventStageResize, task.EventStateStarted, len(delays))
 
-	variantsDir, err := w.resizeFrames(ctx, inputDir, tmpDir, tsk, width, height, delays)
-	if err != nil {
-		return multierr.Append(fmt.Errorf("failed at resize file"), err)
-	}
+		variantsDir, err = w.resizeFrames(ctx, pipeline, inputDir, tmpDir, tsk, width, height, delays)
+		if err != nil {
+			return multierr.Append(fmt.Errorf("failed at resize file"), err)
+		}
 
-	zap.S().Debugw("resized frames",
-		"variants_dir", variantsDir,
-		"task_id", tsk.ID,
-	)
+		zap.S().Debugw("resized frames",
+			"variants_dir", variantsDir,
+			"task_id", tsk.ID,
+		)
 
-	done()
+		done()
+		w.progress(tsk, task.EventStageResize, task.EventStateFinished, len(delays))
+	}
 
 	done = ctx.Inst().Prometheus.MakeResults()
+	w.progress(tsk, task.EventStageMakeResults, task.EventStateStarted, len(delays))
 
-	resultsDir, err := w.makeResults(tmpDir, delays, tsk, variantsDir, ctx, inputDir, inputFile)
+	resultsDir, infos, err := w.makeResults(tmpDir, delays, tsk, variantsDir, ctx, pipeline, streamed, inputDir, inputFile, result)
 	if err != nil {
 		return multierr.Append(fmt.Errorf("failed at make results"), err)
 	}
 
+	if tsk.Output.SizePolicy != task.OutputSizePolicyKeep {
+		if err := applySizePolicy(resultsDir, tsk.Output.SizePolicy, result, infos); err != nil {
+			return multierr.Append(fmt.Errorf("failed at apply size policy"), err)
+		}
+	}
+
 	zap.S().Debugw("made results",
 		"results_dir", resultsDir,
 		"task_id", tsk.ID,
 	)
 
 	done()
+	w.progress(tsk, task.EventStageMakeResults, task.EventStateFinished, len(delays))
 
 	done = ctx.Inst().Prometheus.UploadResults()
+	w.progress(tsk, task.EventStageUpload, task.EventStateStarted, len(delays))
 
-	err = w.uploadResults(tmpDir, resultsDir, variantsDir, raw, tsk, result, ctx)
+	err = w.uploadResults(tmpDir, resultsDir, variantsDir, inputFile, tsk, result, infos, ctx)
 	if err != nil {
 		return multierr.Append(fmt.Errorf("failed at upload results"), err)
 	}
@@ -187,609 +365,1111 @@ func (w Worker) Work(ctx global.Context, tsk task.Task, result *task.Result) (er
 	)
 
 	done()
+	w.progress(tsk, task.EventStageUpload, task.EventStateFinished, len(delays))
 
-	return nil
-}
+	saveManifest(ctx, tsk, result)
 
-func (Worker) downloadFile(ctx global.Context, tsk task.Task, tmpDir string, result *task.Result) (raw []byte, match types.Type, inputFile string, err error) {
-	defer func() {
-		if pnk := recover(); pnk != nil {
-			err = multierr.Append(fmt.Errorf("panic at runtime: %v", pnk), err)
+	if cache.enabled() {
+		if err := cache.put(ctx, cacheKey, result); err != nil {
+			zap.S().Warnw("failed to cache outputs",
+				"error", err,
+				"task_id", tsk.ID,
+			)
 		}
-	}()
+	}
 
-	buf := &bytes.Buffer{}
+	return nil
+}
 
-	err = ctx.Inst().S3.DownloadFile(ctx, buf, &s3.GetObjectInput{
-		Bucket: aws.String(tsk.Input.Bucket),
-		Key:    aws.String(tsk.Input.Key),
-	})
-	if err != nil {
-		return nil, types.Type{}, "", multierr.Append(fmt.Errorf("failed at s3 download"), err)
+// pipeline returns the tools used for a task, static images are handled in pure Go when the external tools
+// are not installed or not wanted.
+func (w Worker) pipeline(ctx global.Context, match types.Type, info probe.Info) (pipeline Pipeline, native bool, err error) {
+	if w.Pipeline != nil {
+		return *w.Pipeline, false, nil
 	}
 
-	match = container.Match(buf.Bytes())
-	switch match {
-	case matchers.TypeWebp,
-		matchers.TypeGif,
-		matchers.TypePng,
-		matchers.TypeMp4,
-		matchers.TypeFlv,
-		matchers.TypeAvi,
-		matchers.TypeMov,
-		matchers.TypeJpeg,
-		matchers.TypeTiff,
-		matchers.TypeWebm,
-		container.TypeAvif:
-	default:
-		return nil, types.Type{}, "", fmt.Errorf("failed at match: unsupported image format: %v", match.Extension)
+	if useNative(ctx, match, info) {
+		return nativePipeline, true, nil
 	}
 
-	inputFile = path.Join(tmpDir, fmt.Sprintf("input.%s", match.Extension))
+	pipeline, err = NewPipeline(ctx.Config())
 
-	file, err := os.Create(inputFile)
-	if err != nil {
-		return nil, types.Type{}, "", multierr.Append(fmt.Errorf("failed at create dir"), err)
-	}
+	return pipeline, false, err
+}
 
-	_, err = file.Write(buf.Bytes())
-	if err != nil {
-		return nil, types.Type{}, "", multierr.Append(fmt.Errorf("failed at write file"), multierr.Append(err, file.Close()))
-	}
+// checkLimits validates the dimensions and frame count of the input against the limits of the task.
+func checkLimits(ctx global.Context, tsk task.Task, result *task.Result, width int, height int, frameCount int) error {
+	if tsk.Limits.MaxFrameCount != 0 && frameCount > tsk.Limits.MaxFrameCount {
+		result.Error = task.ResultErrorTooManyFrames
 
-	err = file.Close()
-	if err != nil {
-		return nil, types.Type{}, "", multierr.Append(fmt.Errorf("failed at close file"), err)
+		return fmt.Errorf("file has too many frames (%d where the limit is %d)", frameCount, tsk.Limits.MaxFrameCount)
 	}
 
-	return buf.Bytes(), match, inputFile, nil
-}
+	if (tsk.Limits.MaxWidth != 0 && tsk.Limits.MaxWidth < width) || (tsk.Limits.MaxHeight != 0 && tsk.Limits.MaxHeight < height) {
+		result.Error = task.ResultErrorDimensionsTooLarge
 
-func (Worker) uploadResults(tmpDir string, resultsDir string, variantsDir string, inputFile []byte, tsk task.Task, result *task.Result, ctx global.Context) (err error) {
-	defer func() {
-		if pnk := recover(); pnk != nil {
-			err = multierr.Append(fmt.Errorf("panic at runtime: %v", pnk), err)
-		}
-	}()
+		return fmt.Errorf("file dimensions are too big (%dx%d where the limit is %dx%d)", width, height, tsk.Limits.MaxWidth, tsk.Limits.MaxHeight)
+	}
 
-	zipFilePath := path.Join(tmpDir, "archive.zip")
+	if (tsk.Limits.MinWidth != 0 && tsk.Limits.MinWidth > width) || (tsk.Limits.MinHeight != 0 && tsk.Limits.MinHeight > height) {
+		result.Error = task.ResultErrorDimensionsTooSmall
 
-	zipFile, err := os.Create(zipFilePath)
-	if err != nil {
-		return multierr.Append(fmt.Errorf("failed at create zip file"), err)
+		return fmt.Errorf("file dimensions are too small (%dx%d where the minimum is %dx%d)", width, height, tsk.Limits.MinWidth, tsk.Limits.MinHeight)
 	}
 
-	zipWriter := zip.NewWriter(zipFile)
-	walker := func(pth string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
+	if height != 0 {
+		ratio := float64(width) / float64(height)
 
-		if info.IsDir() {
-			return nil
-		}
+		if (tsk.Limits.MinAspectRatio != 0 && ratio < tsk.Limits.MinAspectRatio) || (tsk.Limits.MaxAspectRatio != 0 && ratio > tsk.Limits.MaxAspectRatio) {
+			result.Error = task.ResultErrorAspectRatio
 
-		file, err := os.Open(pth)
-		if err != nil {
-			return multierr.Append(fmt.Errorf("failed at open file %s", pth), err)
+			return fmt.Errorf("file aspect ratio is out of range (%dx%d is %.3f where the range is %.3f to %.3f)", width, height, ratio, tsk.Limits.MinAspectRatio, tsk.Limits.MaxAspectRatio)
 		}
-		defer file.Close()
+	}
 
-		f, err := zipWriter.Create(strings.TrimLeft(pth, tmpDir))
-		if err != nil {
-			return multierr.Append(fmt.Errorf("failed at create zip file"), err)
-		}
+	maxPixels := tsk.Limits.MaxTotalPixels
+	if maxPixels == 0 {
+		maxPixels = ctx.Config().Worker.MaxTotalPixels
+	}
 
-		_, err = io.Copy(f, file)
-		if err != nil {
-			return multierr.Append(fmt.Errorf("failed at io copy"), err)
-		}
+	if pixels := int64(width) * int64(height) * int64(frameCount); maxPixels > 0 && pixels > maxPixels {
+		result.Error = task.ResultErrorTooManyPixels
 
-		return nil
+		return fmt.Errorf("file has too many pixels (%dx%dx%d frames is %d where the limit is %d)", width, height, frameCount, pixels, maxPixels)
 	}
 
-	err = filepath.Walk(resultsDir, walker)
+	return nil
+}
+
+// probeInput reads the dimensions and frame count from the headers of the input without decoding it,
+// formats that the probe package does not understand fall back to the stream headers reported by ffprobe.
+func (Worker) probeInput(ctx global.Context, inputFile string) (probe.Info, error) {
+	file, err := os.Open(inputFile)
 	if err != nil {
-		return multierr.Append(fmt.Errorf("failed at walk resultsDir"), multierr.Append(err, multierr.Append(zipWriter.Close(), zipFile.Close())))
+		return probe.Info{}, multierr.Append(fmt.Errorf("failed at open input"), err)
 	}
 
-	err = filepath.Walk(variantsDir, walker)
-	if err != nil {
-		return multierr.Append(fmt.Errorf("failed at walk variantsDir"), multierr.Append(err, multierr.Append(zipWriter.Close(), zipFile.Close())))
+	info, err := probe.Probe(file)
+	file.Close()
+
+	if err == nil {
+		return info, nil
+	} else if !errors.Is(err, probe.ErrUnsupported) {
+		return probe.Info{}, err
 	}
 
-	err = multierr.Append(zipWriter.Close(), zipFile.Close())
+	out, err := exec.CommandContext(ctx,
+		"ffprobe",
+		"-v", "error",
+		"-select_streams", "v:0",
+		"-show_entries", "stream=width,height,nb_frames,r_frame_rate:format=duration",
+		"-of", "default=noprint_wrappers=1",
+		inputFile,
+	).CombinedOutput()
 	if err != nil {
-		return multierr.Append(fmt.Errorf("failed at close zip file"), err)
+		return probe.Info{}, multierr.Append(fmt.Errorf("failed at ffprobe"), multierr.Append(err, fmt.Errorf("ffprobe failed: %s", out)))
 	}
 
-	wg := sync.WaitGroup{}
-
-	var (
-		uploadErr error
-		mtx       sync.Mutex
-	)
+	entries := map[string]string{}
 
-	if tsk.Input.Reupload.Enabled {
-		if err := ctx.Inst().S3.UploadFile(ctx, &s3.PutObjectInput{
-			Body:         bytes.NewReader(inputFile),
-			ACL:          aws.String(tsk.Input.Reupload.ACL),
-			Bucket:       aws.String(tsk.Input.Reupload.Bucket),
-			CacheControl: aws.String(tsk.Input.Reupload.CacheControl),
-			ContentType:  aws.String(result.ImageInput.ContentType),
-			Key:          aws.String(tsk.Input.Reupload.Key),
-		}); err != nil {
-			return multierr.Append(fmt.Errorf("failed at reupload input"), err)
+	for _, line := range strings.Split(strings.TrimSpace(utils.B2S(out)), "\n") {
+		if splits := strings.SplitN(strings.TrimSpace(line), "=", 2); len(splits) == 2 {
+			entries[splits[0]] = splits[1]
 		}
 	}
 
-	uploadPath := func(pth string) {
-		defer wg.Done()
-		defer func() {
-			if pnk := recover(); pnk != nil {
-				mtx.Lock()
-				defer mtx.Unlock()
-
-				uploadErr = multierr.Append(fmt.Errorf("panic at runtime: %v", pnk), err)
-			}
-		}()
-
-		h := sha3.New512()
-
-		data, err := os.ReadFile(pth)
-		if err != nil {
-			mtx.Lock()
-			defer mtx.Unlock()
-
-			uploadErr = multierr.Append(fmt.Errorf("failed at readfile %s", pth), multierr.Append(err, uploadErr))
+	info.Width, err = strconv.Atoi(entries["width"])
+	if err != nil {
+		return probe.Info{}, multierr.Append(fmt.Errorf("failed at parse width"), multierr.Append(err, fmt.Errorf("ffprobe failed: %s", out)))
+	}
 
-			return
-		}
+	info.Height, err = strconv.Atoi(entries["height"])
+	if err != nil {
+		return probe.Info{}, multierr.Append(fmt.Errorf("failed at parse height"), multierr.Append(err, fmt.Errorf("ffprobe failed: %s", out)))
+	}
 
-		_, err = h.Write(data)
-		if err != nil {
-			mtx.Lock()
-			defer mtx.Unlock()
+	// containers like webm and flv do not store a frame count so it is estimated from the duration and frame rate
+	info.FrameCount, err = strconv.Atoi(entries["nb_frames"])
+	if err != nil {
+		duration, _ := strconv.ParseFloat(entries["duration"], 64)
 
-			uploadErr = multierr.Append(fmt.Errorf("failed at hash data"), multierr.Append(err, uploadErr))
+		fps := 0.0
+		if fpsArr := strings.SplitN(entries["r_frame_rate"], "/", 2); len(fpsArr) == 2 {
+			numerator, _ := strconv.ParseFloat(fpsArr[0], 64)
+			denominator, _ := strconv.ParseFloat(fpsArr[1], 64)
 
-			return
+			if denominator != 0 {
+				fps = numerator / denominator
+			}
 		}
 
-		ctx.Inst().Prometheus.TotalBytesUploaded(len(data))
-
-		sha3 := hex.EncodeToString(h.Sum(nil))
-
-		t := container.Match(data)
-
-		key := path.Join(tsk.Output.Prefix, path.Base(pth))
+		info.FrameCount = int(math.Ceil(duration * fps))
+	}
 
-		name := strings.TrimSuffix(path.Base(pth), path.Ext(pth))
+	if info.FrameCount <= 0 {
+		info.FrameCount = 1
+	}
 
-		if t == matchers.TypeZip {
-			result.ArchiveOutput = task.ResultFile{
-				Name:         name,
-				Size:         len(data),
-				Key:          key,
-				Bucket:       tsk.Output.Bucket,
-				ACL:          tsk.Output.ACL,
-				CacheControl: tsk.Output.CacheControl,
-				SHA3:         sha3,
-			}
-		} else {
-			var (
-				width      int
-				height     int
-				frameCount int
-			)
+	return info, nil
+}
 
-			switch t {
-			case matchers.TypeGif, matchers.TypePng:
-				output, err := exec.CommandContext(ctx,
-					"ffprobe",
-					"-v", "error",
-					"-select_streams", "v:0",
-					"-count_packets",
-					"-show_entries", "stream=width,height,nb_read_packets",
-					"-of", "csv=p=0",
-					pth,
-				).CombinedOutput()
-				if err != nil {
-					mtx.Lock()
-					defer mtx.Unlock()
-					uploadErr = multierr.Append(fmt.Errorf("failed at ffprobe png/gif"), multierr.Append(multierr.Append(err, fmt.Errorf("ffprobe failed: %s", output)), uploadErr))
-					return
-				}
+// downloadFile streams the input into the temp dir while hashing it and keeping the first bytes to sniff the format from,
+// so the input is never held in memory.
+func (Worker) downloadFile(ctx global.Context, tsk task.Task, tmpDir string, result *task.Result) (match types.Type, inputFile string, size int64, sums fileSums, err error) {
+	defer func() {
+		if pnk := recover(); pnk != nil {
+			err = multierr.Append(fmt.Errorf("panic at runtime: %v", pnk), err)
+		}
+	}()
 
-				splits := strings.SplitN(strings.TrimSpace(utils.B2S(output)), ",", 3)
-				width, err = strconv.Atoi(splits[0])
-				if err != nil {
-					mtx.Lock()
-					defer mtx.Unlock()
-					uploadErr = multierr.Append(fmt.Errorf("failed at parse width"), multierr.Append(multierr.Append(err, fmt.Errorf("ffprobe failed: %s", output)), uploadErr))
-					return
-				}
-				height, err = strconv.Atoi(splits[1])
-				if err != nil {
-					mtx.Lock()
-					defer mtx.Unlock()
-					uploadErr = multierr.Append(fmt.Errorf("failed at parse height"), multierr.Append(multierr.Append(err, fmt.Errorf("ffprobe failed: %s", output)), uploadErr))
-					return
-				}
-				frameCount, err = strconv.Atoi(splits[2])
-				if err != nil {
-					mtx.Lock()
-					defer mtx.Unlock()
-					uploadErr = multierr.Append(fmt.Errorf("failed at parse frame count"), multierr.Append(multierr.Append(err, fmt.Errorf("ffprobe failed: %s", output)), uploadErr))
-					return
-				}
-			case matchers.TypeWebp, container.TypeAvif:
-				output, err := exec.CommandContext(ctx,
-					"dump_png",
-					"--info",
-					"-i", pth,
-				).CombinedOutput()
-				if err != nil {
-					mtx.Lock()
-					defer mtx.Unlock()
-					uploadErr = multierr.Append(fmt.Errorf("failed at dump_png"), multierr.Append(multierr.Append(err, fmt.Errorf("dump_png failed: %s", output)), uploadErr))
-					return
-				}
+	maxBytes := tsk.Limits.MaxInputBytes
+	if maxBytes == 0 {
+		maxBytes = ctx.Config().Worker.MaxInputBytes
+	}
 
-				lines := strings.Split(strings.TrimSpace(utils.B2S(output)), "\n")
-				splits := strings.SplitN(lines[1], ",", 3)
-				width, err = strconv.Atoi(splits[0])
-				if err != nil {
-					mtx.Lock()
-					defer mtx.Unlock()
-					uploadErr = multierr.Append(fmt.Errorf("failed at parse width"), multierr.Append(multierr.Append(err, fmt.Errorf("dump_png failed: %s", output)), uploadErr))
-					return
-				}
-				height, err = strconv.Atoi(splits[1])
-				if err != nil {
-					mtx.Lock()
-					defer mtx.Unlock()
-					uploadErr = multierr.Append(fmt.Errorf("failed at parse height"), multierr.Append(multierr.Append(err, fmt.Errorf("dump_png failed: %s", output)), uploadErr))
-					return
-				}
-				frameCount, err = strconv.Atoi(splits[2])
-				if err != nil {
-					mtx.Lock()
-					defer mtx.Unlock()
-					uploadErr = multierr.Append(fmt.Errorf("failed at parse frameCount"), multierr.Append(multierr.Append(err, fmt.Errorf("dump_png failed: %s", output)), uploadErr))
-					return
-				}
-			}
+	inline := len(tsk.Input.Data) != 0
 
-			mtx.Lock()
-			result.ImageOutputs = append(result.ImageOutputs, task.ResultFile{
-				Name:         name,
-				FrameCount:   frameCount,
-				Width:        width,
-				Height:       height,
-				Key:          key,
-				Bucket:       tsk.Output.Bucket,
-				Size:         len(data),
-				ContentType:  t.MIME.Value,
-				ACL:          tsk.Output.ACL,
-				CacheControl: tsk.Output.CacheControl,
-				SHA3:         sha3,
-			})
-			mtx.Unlock()
+	if inline {
+		maxInline := ctx.Config().Worker.MaxInlineBytes
+		if maxInline == 0 {
+			maxInline = defaultMaxInlineBytes
 		}
 
-		var acl *string
-		if tsk.Output.ACL != "" {
-			acl = &tsk.Output.ACL
-		}
+		if size := int64(len(tsk.Input.Data)); size > maxInline {
+			result.Error = task.ResultErrorInputTooLarge
 
-		if err := ctx.Inst().S3.UploadFile(ctx, &s3.PutObjectInput{
-			Body:         bytes.NewReader(data),
-			ACL:          acl,
-			Bucket:       aws.String(tsk.Output.Bucket),
-			CacheControl: aws.String(tsk.Output.CacheControl),
-			ContentType:  aws.String(t.MIME.Value),
-			Key:          aws.String(key),
-		}); err != nil {
-			mtx.Lock()
-			uploadErr = multierr.Append(fmt.Errorf("failed at s3 upload"), multierr.Append(err, uploadErr))
-			mtx.Unlock()
+			return types.Type{}, "", 0, fileSums{}, fmt.Errorf("inline input is too large (%d bytes where the limit is %d)", size, maxInline)
 		}
 	}
 
-	err = filepath.Walk(resultsDir, func(pth string, info fs.FileInfo, err error) error {
+	if maxBytes > 0 && tsk.Input.URL == "" && !inline {
+		head, err := ctx.Inst().Storage.HeadFile(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(tsk.Input.Bucket),
+			Key:    aws.String(tsk.Input.Key),
+		})
 		if err != nil {
-			return err
+			return types.Type{}, "", 0, fileSums{}, multierr.Append(fmt.Errorf("failed at s3 head"), err)
 		}
 
-		if info.IsDir() {
-			return nil
+		if size := aws.Int64Value(head.ContentLength); size > maxBytes {
+			result.Error = task.ResultErrorInputTooLarge
+
+			return types.Type{}, "", 0, fileSums{}, fmt.Errorf("input file is too large (%d bytes where the limit is %d)", size, maxBytes)
 		}
+	}
 
-		wg.Add(1)
-		go uploadPath(pth)
+	// the extension is only known once the file is sniffed so it is renamed after the download
+	downloadFile := path.Join(tmpDir, "input")
 
-		return nil
-	})
+	file, err := os.Create(downloadFile)
 	if err != nil {
-		return multierr.Append(fmt.Errorf("failed at walk resultsDir"), err)
+		return types.Type{}, "", 0, fileSums{}, multierr.Append(fmt.Errorf("failed at create file"), err)
 	}
 
-	wg.Add(1)
-	uploadPath(zipFilePath)
+	h := sha3.New512()
+	h256 := sha256.New()
+	head := &headWriter{n: sniffBytes}
+	counter := &countWriter{}
 
-	wg.Wait()
+	var output io.Writer = io.MultiWriter(file, h, h256, head, counter)
+	if maxBytes > 0 {
+		output = &limitedWriter{w: output, n: maxBytes}
+	}
 
-	return uploadErr
-}
+	source := "s3"
 
-func (Worker) makeResults(tmpDir string, delays []int, tsk task.Task, variantsDir string, ctx global.Context, inputDir string, inputFile string) (resultsDir string, err error) {
-	// Syntax: convert_png [options] -i input.png -o output.webp -o output.gif -o output.avif
-	// Options:
-	//   -h,--help                   : Shows syntax help
-	//   -i,--input FILENAME         : Input file location (supported types are png).
-	//   -o,--output FILENAME        : Output file location (supported types are webp, avif, gif).
-	//   -d,--delay D                : Delay of the next frame in 100s of a second. (default 4 = 40ms)
-	// the max fps is 50fps
-	defer func() {
-		if pnk := recover(); pnk != nil {
-			err = multierr.Append(fmt.Errorf("panic at runtime: %v", pnk), err)
-		}
-	}()
+	switch {
+	case inline:
+		// inline inputs go through the same writers so they are hashed and limited like downloads
+		source = "inline"
+		_, err = output.Write(tsk.Input.Data)
+	case tsk.Input.URL != "":
+		source = "http"
+		err = downloadURL(ctx, tsk, output, maxBytes)
+	default:
+		err = ctx.Inst().Storage.DownloadFile(ctx, output, &s3.GetObjectInput{
+			Bucket: aws.String(tsk.Input.Bucket),
+			Key:    aws.String(tsk.Input.Key),
+		})
+	}
 
-	resultsDir = path.Join(tmpDir, "results")
+	if errors.Is(err, errLimitExceeded) {
+		result.Error = task.ResultErrorInputTooLarge
 
-	err = os.MkdirAll(resultsDir, 0700)
-	if err != nil {
-		return "", multierr.Append(fmt.Errorf("failed at mkdir resultsDir"), err)
-	}
+		return types.Type{}, "", 0, fileSums{}, multierr.Append(fmt.Errorf("input file is too large (exceeded the limit of %d bytes)", maxBytes), file.Close())
+	} else if errors.Is(err, errBlockedAddress) {
+		result.Error = task.ResultErrorInputBlocked
 
-	threads := ctx.Config().Worker.ThreadsPerWorker
-	if threads <= 0 {
-		threads = 1
+		return types.Type{}, "", 0, fileSums{}, multierr.Append(err, file.Close())
+	} else if err != nil {
+		return types.Type{}, "", 0, fileSums{}, multierr.Append(fmt.Errorf("failed at %s download", source), multierr.Append(err, file.Close()))
 	}
 
-	if len(delays) > 1 {
-		for _, scale := range tsk.Scales {
-			convertArgs := []string{
-				"-t", strconv.Itoa(threads),
-			}
-
-			for i := 0; i < len(delays); i++ {
-				if delays[i] <= 1 {
-					delays[i] = 10 // browsers treat 100fps gifs as 10fps
-				}
+	err = file.Close()
+	if err != nil {
+		return types.Type{}, "", 0, fileSums{}, multierr.Append(fmt.Errorf("failed at close file"), err)
+	}
 
-				convertArgs = append(convertArgs,
-					"-d", strconv.Itoa(delays[i]),
-					"-i", path.Join(variantsDir, fmt.Sprintf("%04d_%dx.png", i, scale)),
-				)
-			}
+	match = container.Match(head.buf)
+	switch match {
+	case matchers.TypeWebp,
+		matchers.TypeGif,
+		matchers.TypePng,
+		matchers.TypeMp4,
+		matchers.TypeFlv,
+		matchers.TypeAvi,
+		matchers.TypeMov,
+		matchers.TypeJpeg,
+		matchers.TypeTiff,
+		matchers.TypeWebm,
+		container.TypeAvif:
+	default:
+		return types.Type{}, "", 0, fileSums{}, fmt.Errorf("failed at match: unsupported image format: %v", match.Extension)
+	}
 
-			outputs := 0
+	inputFile = path.Join(tmpDir, fmt.Sprintf("input.%s", match.Extension))
 
-			if tsk.Flags&task.TaskFlagAVIF != 0 {
-				convertArgs = append(convertArgs,
-					"-o", path.Join(resultsDir, fmt.Sprintf("%dx.avif", scale)),
-				)
-				outputs++
+	err = os.Rename(downloadFile, inputFile)
+	if err != nil {
+		return types.Type{}, "", 0, fileSums{}, multierr.Append(fmt.Errorf("failed at rename file"), err)
+	}
+
+	return match, inputFile, counter.n, fileSums{
+		SHA3:   hex.EncodeToString(h.Sum(nil)),
+		SHA256: hex.EncodeToString(h256.Sum(nil)),
+	}, nil
+}
+
+// fileSums are the hashes of a file, SHA3 identifies files in the worker and SHA256 is what CDN tooling checks.
+type fileSums struct {
+	SHA3   string
+	SHA256 string
+}
+
+// defaultMaxInlineBytes is the largest input a task can carry in its json when it is not configured.
+const defaultMaxInlineBytes = 256 << 10
+
+// sniffBytes is how much of the start of a file is kept to match its format, it is what filetype reads from files.
+const sniffBytes = 8192
+
+// headWriter keeps the first n bytes written to it.
+type headWriter struct {
+	buf []byte
+	n   int
+}
+
+func (w *headWriter) Write(p []byte) (int, error) {
+	if rem := w.n - len(w.buf); rem > 0 {
+		if len(p) < rem {
+			rem = len(p)
+		}
+
+		w.buf = append(w.buf, p[:rem]...)
+	}
+
+	return len(p), nil
+}
+
+// countWriter counts the bytes written to it.
+type countWriter struct {
+	n int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+
+	return len(p), nil
+}
+
+var errLimitExceeded = errors.New("limit exceeded")
+
+// limitedWriter fails with errLimitExceeded once more than n bytes are written to it.
+type limitedWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > l.n {
+		return 0, errLimitExceeded
+	}
+
+	l.n -= int64(len(p))
+
+	return l.w.Write(p)
+}
+
+func (Worker) uploadResults(tmpDir string, resultsDir string, variantsDir string, inputFile string, tsk task.Task, result *task.Result, infos map[string]outputInfo, ctx global.Context) (err error) {
+	defer func() {
+		if pnk := recover(); pnk != nil {
+			err = multierr.Append(fmt.Errorf("panic at runtime: %v", pnk), err)
+		}
+	}()
+
+	archivePath, archiveType, err := makeArchive(tmpDir, resultsDir, variantsDir, tsk.Output.Archive)
+	if err != nil {
+		return multierr.Append(fmt.Errorf("failed at make archive"), err)
+	}
+
+	pool := newUploadPool(ctx)
+
+	var mtx sync.Mutex
+
+	if tsk.Input.Reupload.Enabled {
+		pool.Go(func() error {
+			stat, err := os.Stat(inputFile)
+			if err != nil {
+				return multierr.Append(fmt.Errorf("failed at stat input"), err)
 			}
 
-			if tsk.Flags&task.TaskFlagWEBP != 0 {
-				convertArgs = append(convertArgs,
-					"-o", path.Join(resultsDir, fmt.Sprintf("%dx.webp", scale)),
-				)
-				outputs++
+			if err := pool.Upload(&s3.PutObjectInput{
+				ACL:          aws.String(tsk.Input.Reupload.ACL),
+				Bucket:       aws.String(tsk.Input.Reupload.Bucket),
+				CacheControl: aws.String(tsk.Input.Reupload.CacheControl),
+				ContentType:  aws.String(result.ImageInput.ContentType),
+				Key:          aws.String(tsk.Input.Reupload.Key),
+			}, stat.Size(), func() (io.ReadSeeker, error) {
+				return os.Open(inputFile)
+			}); err != nil {
+				return multierr.Append(fmt.Errorf("failed at reupload input"), err)
 			}
 
-			madeGif := false
+			return nil
+		})
+	}
 
-			if tsk.Flags&task.TaskFlagGIF != 0 {
-				convertArgs = append(convertArgs,
-					"-o", path.Join(resultsDir, fmt.Sprintf("%dx.gif", scale)),
-				)
-				madeGif = true
-				outputs++
-			}
+	// two outputs with the same key would overwrite each other, a template has to tell apart every output with different contents
+	type claim struct {
+		name string
+		sha3 string
+	}
+
+	keys := map[string]claim{}
+
+	// location is the profile and bucket the key is stored in
+	claimKey := func(vars outputKeyVars, location string, key string) error {
+		mtx.Lock()
+		defer mtx.Unlock()
+
+		if other, ok := keys[path.Join(location, key)]; ok && other.sha3 != vars.SHA3 {
+			return fmt.Errorf("outputs %s and %s.%s have the same key %s", other.name, vars.Name, vars.Ext, key)
+		}
+
+		keys[path.Join(location, key)] = claim{name: vars.Name + "." + vars.Ext, sha3: vars.SHA3}
+
+		return nil
+	}
+
+	// failed replicas do not fail the uploads, the quorum decides if the task fails
+	result.Replicas = newResultReplicas(tsk)
+	replicaErrs := make([]error, len(tsk.Output.Replicas))
+
+	put := func(inst storage.Instance, dest task.TaskOutputStorage, key string, contentType string, data []byte) error {
+		acl, disposition, metadata, tagging := objectOptions(dest)
+
+		if err := pool.UploadTo(inst, &s3.PutObjectInput{
+			ACL:                acl,
+			Bucket:             aws.String(dest.Bucket),
+			CacheControl:       aws.String(dest.CacheControl),
+			ContentDisposition: disposition,
+			ContentType:        aws.String(contentType),
+			Key:                aws.String(key),
+			Metadata:           metadata,
+			Tagging:            tagging,
+		}, int64(len(data)), func() (io.ReadSeeker, error) {
+			return bytes.NewReader(data), nil
+		}); err != nil {
+			return multierr.Append(fmt.Errorf("failed at s3 upload"), err)
+		}
+
+		ctx.Inst().Prometheus.TotalBytesUploaded(len(data))
+
+		return nil
+	}
+
+	replicate := func(i int, vars outputKeyVars, file task.ResultFile, data []byte) error {
+		replica := tsk.Output.Replicas[i]
+
+		inst, err := replicaStorage(ctx, replica)
+		if err != nil {
+			return err
+		}
+
+		key, dest, err := replicaOutput(tsk, replica, vars)
+		if err != nil {
+			return err
+		}
+
+		if err := claimKey(vars, path.Join(replica.Profile, dest.Bucket), key); err != nil {
+			return err
+		}
+
+		if err := put(inst, dest, key, file.ContentType, data); err != nil {
+			return err
+		}
 
-			if outputs > 0 {
-				out, err := exec.CommandContext(ctx,
-					"convert_png",
-					convertArgs...,
-				).CombinedOutput()
+		file.Key = key
+		file.Bucket = dest.Bucket
+		file.ACL = dest.ACL
+		file.CacheControl = dest.CacheControl
+
+		mtx.Lock()
+		result.Replicas[i].Outputs = append(result.Replicas[i].Outputs, file)
+		mtx.Unlock()
+
+		return nil
+	}
+
+	uploadPath := func(pth string) error {
+		h := sha3.New512()
+
+		data, err := os.ReadFile(pth)
+		if err != nil {
+			return multierr.Append(fmt.Errorf("failed at readfile %s", pth), err)
+		}
+
+		_, err = h.Write(data)
+		if err != nil {
+			return multierr.Append(fmt.Errorf("failed at hash data"), err)
+		}
+
+		sha3 := hex.EncodeToString(h.Sum(nil))
+		sha256Sum := sha256.Sum256(data)
+
+		t := container.Match(data)
+		contentType := t.MIME.Value
+
+		name := strings.TrimSuffix(path.Base(pth), path.Ext(pth))
+
+		vars := outputKeyVars{
+			Name:      name,
+			Ext:       strings.TrimPrefix(path.Ext(pth), "."),
+			InputSHA3: result.ImageInput.SHA3,
+			SHA3:      sha3,
+		}
+
+		if pth == archivePath {
+			contentType = archiveType
+			vars.Name = "archive"
+			vars.Ext = strings.TrimPrefix(path.Base(pth), "archive.")
+		}
+
+		dest := vars.storage(tsk)
+
+		file := task.ResultFile{
+			Name:         vars.Name,
+			Bucket:       dest.Bucket,
+			Size:         len(data),
+			ContentType:  contentType,
+			ACL:          dest.ACL,
+			CacheControl: dest.CacheControl,
+			SHA3:         sha3,
+			SHA256:       hex.EncodeToString(sha256Sum[:]),
+		}
+
+		if pth != archivePath {
+			switch t {
+			case matchers.TypeGif, matchers.TypePng, matchers.TypeWebp, container.TypeAvif:
+				probed, err := probe.Probe(bytes.NewReader(data))
 				if err != nil {
-					return "", multierr.Append(fmt.Errorf("failed at convert_png"), multierr.Append(err, fmt.Errorf("convert_png failed: %s", out)))
+					return multierr.Append(fmt.Errorf("failed at probe %s", pth), err)
 				}
+
+				file.Width = probed.Width
+				file.Height = probed.Height
+				file.FrameCount = probed.FrameCount
 			}
 
-			if madeGif {
-				out, err := exec.CommandContext(ctx,
-					"gifsicle",
-					"-O3",
-					"--colors", "256",
-					"-b",
-					path.Join(resultsDir, fmt.Sprintf("%dx.gif", scale)),
-				).CombinedOutput()
-				if err != nil {
-					return "", multierr.Append(fmt.Errorf("failed at gifsicle"), multierr.Append(err, fmt.Errorf("gifsicle failed: %s", out)))
+			info := infos[path.Base(pth)]
+			file.Encoding = info.Encoding
+			file.NonPreferred = info.NonPreferred
+			vars.FrameCount = file.FrameCount
+		}
+
+		key, err := outputKey(tsk, vars)
+		if err != nil {
+			return err
+		}
+
+		if err := claimKey(vars, dest.Bucket, key); err != nil {
+			return err
+		}
+
+		file.Key = key
+
+		mtx.Lock()
+		if pth == archivePath {
+			result.ArchiveOutput = file
+		} else {
+			result.ImageOutputs = append(result.ImageOutputs, file)
+		}
+		mtx.Unlock()
+
+		for i := range tsk.Output.Replicas {
+			i := i
+
+			pool.Go(func() error {
+				if err := replicate(i, vars, file, data); err != nil {
+					mtx.Lock()
+					replicaErrs[i] = multierr.Append(replicaErrs[i], err)
+					mtx.Unlock()
 				}
+
+				return nil
+			})
+		}
+
+		return put(ctx.Inst().Storage, dest, key, contentType, data)
+	}
+
+	err = filepath.Walk(resultsDir, func(pth string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		pool.Go(func() error {
+			return uploadPath(pth)
+		})
+
+		return nil
+	})
+	if err != nil {
+		return multierr.Append(fmt.Errorf("failed at walk resultsDir"), multierr.Append(err, pool.Wait()))
+	}
+
+	if archivePath != "" {
+		pool.Go(func() error {
+			return uploadPath(archivePath)
+		})
+	}
+
+	if err := pool.Wait(); err != nil {
+		return err
+	}
+
+	return checkQuorum(tsk, result, replicaErrs)
+}
+
+// makeResults encodes the variants into the outputs of the task, when the frames were streamed the animated outputs
+// are already encoded and only have to be optimized. The scales and encoders are run at the same time within the thread budget.
+func (Worker) makeResults(tmpDir string, delays []int, tsk task.Task, variantsDir string, ctx global.Context, pipeline Pipeline, streamed bool, inputDir string, inputFile string, result *task.Result) (resultsDir string, infos map[string]outputInfo, err error) {
+	defer func() {
+		if pnk := recover(); pnk != nil {
+			err = multierr.Append(fmt.Errorf("panic at runtime: %v", pnk), err)
+		}
+	}()
+
+	resultsDir = path.Join(tmpDir, "results")
+
+	err = os.MkdirAll(resultsDir, 0700)
+	if err != nil {
+		return "", nil, multierr.Append(fmt.Errorf("failed at mkdir resultsDir"), err)
+	}
+
+	for i := range delays {
+		if len(delays) > 1 && delays[i] <= 1 {
+			delays[i] = 10 // browsers treat 100fps gifs as 10fps
+		}
+	}
+
+	jobs := []*encodeJob{}
+
+	if len(delays) > 1 {
+		for _, scale := range tsk.Scales {
+			frames := make([]string, len(delays))
+			for i := range frames {
+				frames[i] = path.Join(variantsDir, fmt.Sprintf("%04d_%dx.png", i, scale))
 			}
+
+			// when the frames were streamed the animated outputs are already encoded
+			jobs = append(jobs, newEncodeJobs(pipeline, frames, delays, scale, streamed, animatedOutputs(tsk, resultsDir, scale))...)
 		}
 	}
 
 	for _, scale := range tsk.Scales {
-		convertArgs := []string{
-			"-t", strconv.Itoa(threads),
-			"-i", path.Join(variantsDir, fmt.Sprintf("0000_%dx.png", scale)),
-		}
+		frames := []string{path.Join(variantsDir, fmt.Sprintf("0000_%dx.png", scale))}
 
 		static := "_static"
 		if len(delays) == 1 {
 			static = ""
 		}
 
-		outputs := 0
+		outputs := []string{}
 
 		if (tsk.Flags&task.TaskFlagAVIF_STATIC != 0 && len(delays) > 1) || (tsk.Flags&task.TaskFlagAVIF != 0 && len(delays) == 1) {
-			convertArgs = append(convertArgs,
-				"-o", path.Join(resultsDir, fmt.Sprintf("%dx%s.avif", scale, static)),
-			)
-			outputs++
+			outputs = append(outputs, path.Join(resultsDir, fmt.Sprintf("%dx%s.avif", scale, static)))
 		}
 
 		if (tsk.Flags&task.TaskFlagWEBP_STATIC != 0 && len(delays) > 1) || (tsk.Flags&task.TaskFlagWEBP != 0 && len(delays) == 1) {
-			convertArgs = append(convertArgs,
-				"-o", path.Join(resultsDir, fmt.Sprintf("%dx%s.webp", scale, static)),
-			)
-			outputs++
+			outputs = append(outputs, path.Join(resultsDir, fmt.Sprintf("%dx%s.webp", scale, static)))
 		}
 
 		if (tsk.Flags&task.TaskFlagPNG_STATIC != 0 && len(delays) > 1) || (tsk.Flags&task.TaskFlagPNG != 0 && len(delays) == 1) {
-			if _, err := copyFile(path.Join(variantsDir, fmt.Sprintf("0000_%dx.png", scale)), path.Join(resultsDir, fmt.Sprintf("%dx%s.png", scale, static))); err != nil {
-				return "", multierr.Append(fmt.Errorf("failed at copy png"), err)
-			}
+			outputs = append(outputs, path.Join(resultsDir, fmt.Sprintf("%dx%s.png", scale, static)))
+		}
 
-			out, err := exec.CommandContext(ctx,
-				"optipng",
-				"-o6",
-				path.Join(resultsDir, fmt.Sprintf("%dx%s.png", scale, static)),
-			).CombinedOutput()
-			if err != nil {
-				return "", multierr.Append(fmt.Errorf("failed at optipng"), multierr.Append(err, fmt.Errorf("optipng failed: %s", out)))
-			}
+		jobs = append(jobs, newEncodeJobs(pipeline, frames, nil, scale, false, outputs)...)
+	}
+
+	runs := make([]func(ctx context.Context, threads int) error, len(jobs))
+	for i, job := range jobs {
+		job := job
+
+		runs[i] = func(jobCtx context.Context, threads int) error {
+			return job.run(jobCtx, pipeline, tsk, threads)
 		}
+	}
 
-		if outputs > 0 {
-			out, err := exec.CommandContext(ctx,
-				"convert_png",
-				convertArgs...,
-			).CombinedOutput()
-			if err != nil {
-				return "", multierr.Append(fmt.Errorf("failed at convert_png"), multierr.Append(err, fmt.Errorf("convert_png failed: %s", out)))
-			}
+	if err := runBudgeted(ctx, threadBudget(ctx), runs); err != nil {
+		return "", nil, err
+	}
+
+	// the jobs are merged in the order they were made in so the result does not depend on which finished first
+	infos = map[string]outputInfo{}
+
+	for _, job := range jobs {
+		result.SkippedOutputs = append(result.SkippedOutputs, job.result.SkippedOutputs...)
+
+		for name, info := range job.infos {
+			infos[name] = info
 		}
 	}
 
 	if err = os.RemoveAll(inputDir); err != nil {
-		return "", multierr.Append(fmt.Errorf("failed at rmdir inputDir"), err)
+		return "", nil, multierr.Append(fmt.Errorf("failed at rmdir inputDir"), err)
 	}
 
-	if err = os.RemoveAll(inputFile); err != nil {
-		return "", multierr.Append(fmt.Errorf("failed at rmdir inputFile"), err)
+	// the input is streamed from disk when it is reuploaded
+	if !tsk.Input.Reupload.Enabled {
+		if err = os.RemoveAll(inputFile); err != nil {
+			return "", nil, multierr.Append(fmt.Errorf("failed at rmdir inputFile"), err)
+		}
 	}
 
-	return resultsDir, nil
+	return resultsDir, infos, nil
 }
 
-func (Worker) getWidthHeight(ctx context.Context, image string) (int, int, error) {
-	out, err := exec.CommandContext(ctx,
-		"ffprobe",
-		"-v", "error",
-		"-select_streams", "v",
-		"-of", "default=noprint_wrappers=1:nokey=1",
-		"-show_entries", "stream=width,height",
-		image,
-	).CombinedOutput()
+// encodeJob encodes and optimizes outputs of a scale that share an encoder, the jobs of a task run at the same time.
+// Skipped outputs and infos are kept on the job so the jobs do not share the task result.
+type encodeJob struct {
+	frames   []string
+	delays   []int
+	scale    int
+	streamed bool
+	outputs  []string
+
+	result task.Result
+	infos  map[string]outputInfo
+}
+
+// newEncodeJobs makes a job for every encoder the outputs use and one for the outputs there is no encoder for.
+func newEncodeJobs(pipeline Pipeline, frames []string, delays []int, scale int, streamed bool, outputs []string) []*encodeJob {
+	groups, missing := pipeline.groupOutputs(outputs)
+
+	jobs := make([]*encodeJob, 0, len(groups)+1)
+	for _, group := range groups {
+		jobs = append(jobs, &encodeJob{frames: frames, delays: delays, scale: scale, streamed: streamed, outputs: group.Outputs})
+	}
+
+	if len(missing) != 0 {
+		jobs = append(jobs, &encodeJob{frames: frames, delays: delays, scale: scale, streamed: streamed, outputs: missing})
+	}
+
+	return jobs
+}
+
+func (j *encodeJob) run(ctx context.Context, pipeline Pipeline, tsk task.Task, threads int) error {
+	var (
+		outputs []string
+		err     error
+	)
+
+	j.infos = map[string]outputInfo{}
+
+	if j.streamed {
+		_, missing := pipeline.groupOutputs(j.outputs)
+		outputs, err = finishOutputs(ctx, pipeline, &j.result, j.outputs, missing)
+	} else {
+		outputs, err = encodeOutputs(ctx, pipeline, threads, j.frames, j.delays, &j.result, j.outputs)
+	}
+
 	if err != nil {
-		return 0, 0, multierr.Append(fmt.Errorf("failed at ffprobe"), multierr.Append(err, fmt.Errorf("ffprobe failed: %s", out)))
+		return err
 	}
 
-	widthHeight := strings.SplitN(strings.TrimSpace(utils.B2S(out)), "\n", 2)
+	for _, output := range outputs {
+		if err := fitOutputBudget(ctx, pipeline, tsk, &j.result, j.infos, threads, j.frames, j.delays, j.scale, output); err != nil {
+			return multierr.Append(fmt.Errorf("failed at fit output budget"), err)
+		}
+	}
 
-	width, err := strconv.Atoi(widthHeight[0])
+	return nil
+}
+
+// encodeOutputs encodes and optimizes the outputs at full quality, outputs of formats the pipeline has no encoder for
+// are reported in the result as skipped and left out of the returned outputs.
+func encodeOutputs(ctx context.Context, pipeline Pipeline, threads int, frames []string, delays []int, result *task.Result, outputs []string) ([]string, error) {
+	if len(outputs) == 0 {
+		return outputs, nil
+	}
+
+	missing, err := pipeline.encode(ctx, EncodeOptions{Threads: threads, Quality: 100}, frames, delays, outputs...)
 	if err != nil {
-		return 0, 0, multierr.Append(fmt.Errorf("failed at parse width"), multierr.Append(err, fmt.Errorf("ffprobe failed: %s", out)))
+		return nil, err
+	}
+
+	return finishOutputs(ctx, pipeline, result, outputs, missing)
+}
+
+// finishOutputs optimizes the encoded outputs and reports the missing ones as skipped.
+func finishOutputs(ctx context.Context, pipeline Pipeline, result *task.Result, outputs []string, missing []string) ([]string, error) {
+	encoded := make([]string, 0, len(outputs))
+
+outer:
+	for _, output := range outputs {
+		for _, m := range missing {
+			if m == output {
+				result.SkippedOutputs = append(result.SkippedOutputs, task.ResultSkippedFile{
+					Name:   path.Base(output),
+					Reason: fmt.Sprintf("there is no %s encoder in the pipeline", outputFormat(output)),
+				})
+
+				continue outer
+			}
+		}
+
+		if err := pipeline.optimize(ctx, output, OptimizeOptions{}); err != nil {
+			return nil, err
+		}
+
+		encoded = append(encoded, output)
+	}
+
+	return encoded, nil
+}
+
+// animatedOutputs are the animated outputs the task asks for at a scale.
+func animatedOutputs(tsk task.Task, resultsDir string, scale int) []string {
+	outputs := []string{}
+
+	if tsk.Flags&task.TaskFlagAVIF != 0 {
+		outputs = append(outputs, path.Join(resultsDir, fmt.Sprintf("%dx.avif", scale)))
+	}
+
+	if tsk.Flags&task.TaskFlagWEBP != 0 {
+		outputs = append(outputs, path.Join(resultsDir, fmt.Sprintf("%dx.webp", scale)))
 	}
 
-	height, err := strconv.Atoi(widthHeight[1])
+	if tsk.Flags&task.TaskFlagGIF != 0 {
+		outputs = append(outputs, path.Join(resultsDir, fmt.Sprintf("%dx.gif", scale)))
+	}
+
+	return outputs
+}
+
+// outputInfo carries details about an output gathered while making results that are reported once it is uploaded.
+type outputInfo struct {
+	Encoding     *task.ResultEncoding
+	NonPreferred bool
+}
+
+// outputCompatibility ranks formats by client support, a lower rank is supported by more clients.
+var outputCompatibility = map[string]int{
+	".gif":  0,
+	".png":  0,
+	".webp": 1,
+	".avif": 2,
+}
+
+// applySizePolicy finds outputs that are strictly larger than a more widely supported output of the same scale and kind,
+// and either marks them as non preferred or removes them depending on the policy.
+func applySizePolicy(resultsDir string, policy task.OutputSizePolicy, result *task.Result, infos map[string]outputInfo) error {
+	entries, err := os.ReadDir(resultsDir)
 	if err != nil {
-		return 0, 0, multierr.Append(fmt.Errorf("failed at parse height"), multierr.Append(err, fmt.Errorf("ffprobe failed: %s", out)))
+		return multierr.Append(fmt.Errorf("failed at read resultsDir"), err)
+	}
+
+	sizes := map[string]int64{}
+	groups := map[string][]string{}
+	order := []string{}
+	dropped := []string{}
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return multierr.Append(fmt.Errorf("failed at stat output"), err)
+		}
+
+		name := entry.Name()
+		group := strings.TrimSuffix(name, path.Ext(name)) // 1x, 1x_static, ...
+
+		if _, ok := groups[group]; !ok {
+			order = append(order, group)
+		}
+
+		sizes[name] = info.Size()
+		groups[group] = append(groups[group], name)
+	}
+
+	for _, group := range order {
+		names := groups[group]
+		for _, name := range names {
+			rank, ok := outputCompatibility[path.Ext(name)]
+			if !ok {
+				continue
+			}
+
+			alternative := ""
+
+			for _, other := range names {
+				otherRank, ok := outputCompatibility[path.Ext(other)]
+				if ok && otherRank < rank && sizes[other] < sizes[name] {
+					alternative = other
+					break
+				}
+			}
+
+			if alternative == "" {
+				continue
+			}
+
+			switch policy {
+			case task.OutputSizePolicyMark:
+				info := infos[name]
+				info.NonPreferred = true
+				infos[name] = info
+			case task.OutputSizePolicyDrop:
+				result.SkippedOutputs = append(result.SkippedOutputs, task.ResultSkippedFile{
+					Name:   name,
+					Reason: fmt.Sprintf("output is %d bytes which is larger than %s at %d bytes", sizes[name], alternative, sizes[alternative]),
+				})
+				delete(infos, name)
+
+				dropped = append(dropped, name)
+			}
+		}
+	}
+
+	for _, name := range dropped {
+		if err := os.Remove(path.Join(resultsDir, name)); err != nil {
+			return multierr.Append(fmt.Errorf("failed at remove output"), err)
+		}
 	}
 
-	return width, height, nil
+	return nil
 }
 
-func (Worker) resizeFrames(ctx global.Context, inputDir string, tmpDir string, tsk task.Task, width int, height int, delays []int) (variantsDir string, err error) {
-	// Syntax: resize_png [options] -i input.png -r 100 100 -o out.png -r 50 50 -o out2.png
-	// Options:
-	//	 -h,--help                   : Shows syntax help
-	//	 -i,--input FILENAME         : Input file location (supported types are png).
-	//	 -r,--resize 100 100         : The width and height
-	//	 -o,--output FILENAME        : Output filename (supported types are png).
-	defer func() {
-		if pnk := recover(); pnk != nil {
-			err = multierr.Append(fmt.Errorf("panic at runtime: %v", pnk), err)
+var (
+	// budgetQualities are the convert_png qualities tried in order when an avif or webp output is over budget
+	budgetQualities = []int{90, 80, 70, 60, 50, 40, 30, 20}
+	// budgetColors are the gifsicle palette sizes tried in order when a gif output is over budget
+	budgetColors = []int{128, 64, 32, 16}
+	// budgetFrameSteps are tried after the lowest quality, keeping only every n-th frame of an animation
+	budgetFrameSteps = []int{2, 3, 4}
+)
+
+// budgetSteps returns the encoder settings to try in order to make an output of this format smaller.
+func budgetSteps(format string, frameCount int) []task.ResultEncoding {
+	steps := []task.ResultEncoding{}
+
+	var last task.ResultEncoding
+
+	switch format {
+	case "avif", "webp":
+		for _, quality := range budgetQualities {
+			last = task.ResultEncoding{Quality: quality, FrameStep: 1}
+			steps = append(steps, last)
 		}
-	}()
+	case "gif":
+		for _, colors := range budgetColors {
+			last = task.ResultEncoding{Quality: 100, Colors: colors, FrameStep: 1}
+			steps = append(steps, last)
+		}
+	default:
+		// png outputs are already optimized losslessly by optipng so there is nothing left to try
+		return nil
+	}
 
-	variantsDir = path.Join(tmpDir, "variants")
+	if frameCount > 1 {
+		for _, step := range budgetFrameSteps {
+			last.FrameStep = step
+			steps = append(steps, last)
+		}
+	}
 
-	err = os.MkdirAll(variantsDir, 0700)
+	return steps
+}
+
+// fitOutputBudget re-encodes an output with progressively lower settings until it fits the byte budget of the task.
+// Outputs that do not fit even at the lowest settings are removed and reported in the result as skipped.
+func fitOutputBudget(ctx context.Context, pipeline Pipeline, tsk task.Task, result *task.Result, infos map[string]outputInfo, threads int, frames []string, delays []int, scale int, output string) error {
+	format := strings.TrimPrefix(path.Ext(output), ".")
+
+	max := tsk.Limits.MaxOutputBytes(format, scale)
+	if max == 0 {
+		return nil
+	}
+
+	info, err := os.Stat(output)
 	if err != nil {
-		return "", multierr.Append(fmt.Errorf("failed at mkdir variantsDir"), err)
+		return multierr.Append(fmt.Errorf("failed at stat output"), err)
 	}
 
-	if tsk.ResizeRatio == task.ResizeRatioNothing {
-		smwf := float64(tsk.SmallestMaxWidth)
-		wf := float64(width)
-		smhf := float64(tsk.SmallestMaxHeight)
-		hf := float64(height)
+	encoding := &task.ResultEncoding{Quality: 100, FrameStep: 1}
+	if format == "gif" {
+		encoding.Colors = 256
+	}
+
+	size := info.Size()
+
+	for _, step := range budgetSteps(format, len(frames)) {
+		if size <= int64(max) {
+			break
+		}
+
+		stepFrames, stepDelays := decimateFrames(frames, delays, step.FrameStep)
 
-		if smwf < wf {
-			hf *= smwf / wf
-			wf = smwf
+		if _, err := pipeline.encode(ctx, EncodeOptions{Threads: threads, Quality: step.Quality}, stepFrames, stepDelays, output); err != nil {
+			return err
 		}
 
-		if smhf < hf {
-			wf *= smhf / hf
-			hf = smhf
+		if err := pipeline.optimize(ctx, output, OptimizeOptions{Colors: step.Colors}); err != nil {
+			return err
 		}
 
-		width = int(math.Round(wf))
-		height = int(math.Round(hf))
+		info, err := os.Stat(output)
+		if err != nil {
+			return multierr.Append(fmt.Errorf("failed at stat output"), err)
+		}
 
-		tsk.ResizeRatio = task.ResizeRatioStretch
-	} else {
-		width = tsk.SmallestMaxHeight
-		height = tsk.SmallestMaxHeight
+		size = info.Size()
+		*encoding = step
 	}
 
-	resizeArgs := []string{}
-	for i := 0; i < len(delays); i++ {
-		resizeArgs = append(resizeArgs,
-			"-i", path.Join(inputDir, fmt.Sprintf("%04d.png", i)),
-		)
+	if size > int64(max) {
+		if err := os.Remove(output); err != nil {
+			return multierr.Append(fmt.Errorf("failed at remove output"), err)
+		}
 
-		for _, scale := range tsk.Scales {
-			height := height * scale
-			width := width * scale
+		result.SkippedOutputs = append(result.SkippedOutputs, task.ResultSkippedFile{
+			Name:   path.Base(output),
+			Reason: fmt.Sprintf("output is %d bytes at the lowest quality where the limit is %d bytes", size, max),
+		})
 
-			resizeArgs = append(resizeArgs,
-				"-r", strconv.Itoa(width), strconv.Itoa(height),
-				"--resize-ratio", fmt.Sprint(tsk.ResizeRatio),
-				"-o", path.Join(variantsDir, fmt.Sprintf("%04d_%dx.png", i, scale)),
-			)
+		return nil
+	}
+
+	infos[path.Base(output)] = outputInfo{Encoding: encoding}
+
+	return nil
+}
+
+// decimateFrames keeps every step-th frame and adds the delays of the dropped frames to the kept frame before them.
+func decimateFrames(frames []string, delays []int, step int) ([]string, []int) {
+	if step <= 1 || len(frames) <= 1 {
+		return frames, delays
+	}
+
+	keptFrames := make([]string, 0, len(frames)/step+1)
+	keptDelays := make([]int, 0, len(frames)/step+1)
+
+	for i, frame := range frames {
+		if i%step == 0 {
+			keptFrames = append(keptFrames, frame)
+			keptDelays = append(keptDelays, delays[i])
+		} else {
+			keptDelays[len(keptDelays)-1] += delays[i]
 		}
 	}
 
-	out, err := exec.CommandContext(ctx,
-		"resize_png",
-		resizeArgs...,
-	).CombinedOutput()
+	return keptFrames, keptDelays
+}
+
+func (Worker) getWidthHeight(image string) (int, int, error) {
+	file, err := os.Open(image)
+	if err != nil {
+		return 0, 0, multierr.Append(fmt.Errorf("failed at open image"), err)
+	}
+	defer file.Close()
+
+	info, err := probe.Probe(file)
+	if err != nil {
+		return 0, 0, multierr.Append(fmt.Errorf("failed at probe"), err)
+	}
+
+	return info.Width, info.Height, nil
+}
+
+// resizeTarget returns the 1x size of the variants and the resize ratio to reach it.
+func resizeTarget(tsk task.Task, width int, height int) (int, int, task.ResizeRatio) {
+	if tsk.ResizeRatio != task.ResizeRatioNothing {
+		return tsk.SmallestMaxHeight, tsk.SmallestMaxHeight, tsk.ResizeRatio
+	}
+
+	smwf := float64(tsk.SmallestMaxWidth)
+	wf := float64(width)
+	smhf := float64(tsk.SmallestMaxHeight)
+	hf := float64(height)
+
+	if smwf < wf {
+		hf *= smwf / wf
+		wf = smwf
+	}
+
+	if smhf < hf {
+		wf *= smhf / hf
+		hf = smhf
+	}
+
+	return int(math.Round(wf)), int(math.Round(hf)), task.ResizeRatioStretch
+}
+
+func (Worker) resizeFrames(ctx global.Context, pipeline Pipeline, inputDir string, tmpDir string, tsk task.Task, width int, height int, delays []int) (variantsDir string, err error) {
+	defer func() {
+		if pnk := recover(); pnk != nil {
+			err = multierr.Append(fmt.Errorf("panic at runtime: %v", pnk), err)
+		}
+	}()
+
+	variantsDir = path.Join(tmpDir, "variants")
+
+	err = os.MkdirAll(variantsDir, 0700)
 	if err != nil {
-		return "", multierr.Append(fmt.Errorf("failed at resize_png"), multierr.Append(err, fmt.Errorf("resize_png failed: %s", out)))
+		return "", multierr.Append(fmt.Errorf("failed at mkdir variantsDir"), err)
+	}
+
+	width, height, tsk.ResizeRatio = resizeTarget(tsk, width, height)
+
+	frames := make([]ResizeFrame, len(delays))
+	for i := range frames {
+		frames[i].Input = path.Join(inputDir, fmt.Sprintf("%04d.png", i))
+
+		for _, scale := range tsk.Scales {
+			frames[i].Outputs = append(frames[i].Outputs, ResizeOutput{
+				Width:  width * scale,
+				Height: height * scale,
+				Ratio:  tsk.ResizeRatio,
+				Output: path.Join(variantsDir, fmt.Sprintf("%04d_%dx.png", i, scale)),
+			})
+		}
+	}
+
+	if err := pipeline.Resizer.Resize(ctx, frames); err != nil {
+		return "", err
 	}
 
 	return variantsDir, nil
 }
 
-func (Worker) exportFrames(ctx global.Context, tmpDir string, inputFile string, match types.Type, raw []byte) (delays []int, inputDir string, err error) {
-	// Syntax: dump_png -i input.webp -o output
-	// Options:
-	//	 -h,--help                   : Shows syntax help
-	//	 -i,--input FILENAME         : Input file location (supported types are webp and avif).
-	//	 -o,--output FOLDER          : Output folder
-	//	 --info                      : Only output info dont dump the images
+func (Worker) exportFrames(ctx global.Context, pipeline Pipeline, tmpDir string, inputFile string, match types.Type, info probe.Info) (delays []int, inputDir string, err error) {
 	defer func() {
 		if pnk := recover(); pnk != nil {
 			err = multierr.Append(fmt.Errorf("panic at runtime: %v", pnk), err)
@@ -803,126 +1483,89 @@ func (Worker) exportFrames(ctx global.Context, tmpDir string, inputFile string,
 		return nil, "", multierr.Append(fmt.Errorf("failed at mkdir inputDir"), err)
 	}
 
-	switch match {
-	case matchers.TypeWebp, container.TypeAvif:
-		// we use dump_png
-		out, err := exec.CommandContext(ctx,
-			"dump_png",
-			"-i", inputFile,
-			"-o", inputDir,
-		).CombinedOutput()
-		if err != nil {
-			return nil, "", multierr.Append(fmt.Errorf("failed at dump_png"), multierr.Append(err, fmt.Errorf("dump_png failed: %s", out)))
-		}
+	decoder, ok := pipeline.Decoders[match.Extension]
+	if !ok {
+		return nil, "", fmt.Errorf("failed at decode: there is no %s decoder in the pipeline", match.Extension)
+	}
 
-		lines := strings.Split(utils.B2S(out), "\n")
-		for _, line := range lines[3:] {
-			line = strings.TrimSpace(line)
-			if line != "" {
-				splits := strings.SplitN(line, ",", 2)
+	if err := decoder.Decode(ctx, inputFile, inputDir); err != nil {
+		return nil, "", err
+	}
 
-				delay, err := strconv.Atoi(splits[1])
-				if err != nil {
-					return nil, "", multierr.Append(fmt.Errorf("failed at parse delay"), multierr.Append(err, fmt.Errorf("dump_png failed: %s", out)))
-				}
+	files, err := os.ReadDir(inputDir)
+	if err != nil {
+		return nil, "", multierr.Append(fmt.Errorf("failed at ReadDir inputDir"), err)
+	}
 
-				delays = append(delays, delay)
-			}
-		}
-	case matchers.TypeGif, // animated
-		matchers.TypePng,  // can be animated
-		matchers.TypeMp4,  // animated
-		matchers.TypeFlv,  // animated
-		matchers.TypeAvi,  // animated
-		matchers.TypeMov,  // animated
-		matchers.TypeJpeg, // static
-		matchers.TypeTiff, // static
-		matchers.TypeWebm: // animated
-		// we use ffmpeg to get the frames
-		if match == matchers.TypeGif {
-			// if this is a gif we need to know the per frame timings, we can use the builtin gif decoder to get this
-			img, err := gif.DecodeAll(bytes.NewReader(raw))
-			if err != nil {
-				return nil, "", multierr.Append(fmt.Errorf("failed at gif decode"), err)
-			}
+	// make the array with the total number of files
+	delays = make([]int, len(files))
 
-			delays = img.Delay
+	switch {
+	case len(files) <= 1:
+		// a still image has no delay
+	case len(info.Delays) == len(files):
+		// the probe read the per frame timings from the headers of gif, apng, webp and avif files
+		copy(delays, info.Delays)
 
-			// gifs have a hard frame timing min of 20ms (2 timescales) if its 10ms (1 timescale) browsers treat this as 100ms (10 timescales)
+		if match == matchers.TypeGif {
 			for i, d := range delays {
-				if d <= 1 { // 10ms
-					d = 10 // 100ms
-				} else if d <= 2 { // 20ms
-					d = 2 // 20ms
-				}
-
-				delays[i] = d
+				delays[i] = gifDelay(d)
 			}
 		}
-
-		// now we must use ffmpeg to extract all the frames of the image
+	case match == matchers.TypeWebp || match == container.TypeAvif:
+		return nil, "", fmt.Errorf("failed at decode: exported %d frames where the headers have %d", len(files), len(info.Delays))
+	default:
+		// videos have a constant frame rate instead of per frame timings
+		// ffprobe -v error -select_streams v -of default=noprint_wrappers=1:nokey=1 -show_entries stream=r_frame_rate
 		out, err := exec.CommandContext(ctx,
-			"ffmpeg",
+			"ffprobe",
 			"-v", "error",
-			"-nostats",
-			"-hide_banner",
-			"-i", inputFile,
-			"-vsync", "0",
-			"-f", "image2",
-			"-start_number", "0",
-			path.Join(inputDir, "%04d.png"),
+			"-select_streams", "v",
+			"-of", "default=noprint_wrappers=1:nokey=1",
+			"-show_entries", "stream=r_frame_rate",
+			inputFile,
 		).CombinedOutput()
 		if err != nil {
-			return nil, "", multierr.Append(fmt.Errorf("failed at ffmpeg"), multierr.Append(err, fmt.Errorf("ffmpeg failed: %s", out)))
+			return nil, "", multierr.Append(fmt.Errorf("failed at ffprobe"), multierr.Append(err, fmt.Errorf("ffprobe failed: %s", out)))
 		}
 
-		if len(delays) == 0 {
-			files, err := os.ReadDir(inputDir)
-			if err != nil {
-				return nil, "", multierr.Append(fmt.Errorf("failed at ReadDir inputDir"), err)
-			}
-
-			// make the array with the total number of files
-			delays = make([]int, len(files))
-			// we then need to get the framerate of the input if there is more than 1 file
-			if len(files) > 1 {
-				// ffprobe -v error -select_streams v -of default=noprint_wrappers=1:nokey=1 -show_entries stream=r_frame_rate
-				out, err := exec.CommandContext(ctx,
-					"ffprobe",
-					"-v", "error",
-					"-select_streams", "v",
-					"-of", "default=noprint_wrappers=1:nokey=1",
-					"-show_entries", "stream=r_frame_rate",
-					inputFile,
-				).CombinedOutput()
-				if err != nil {
-					return nil, "", multierr.Append(fmt.Errorf("failed at ffprobe"), multierr.Append(err, fmt.Errorf("ffprobe failed: %s", out)))
-				}
-
-				fpsArr := strings.SplitN(strings.TrimSpace(utils.B2S(out)), "/", 2)
+		fpsArr := strings.SplitN(strings.TrimSpace(utils.B2S(out)), "/", 2)
+		if len(fpsArr) != 2 {
+			return nil, "", fmt.Errorf("failed at parse fps: ffprobe returned %s", out)
+		}
 
-				numerator, err := strconv.Atoi(fpsArr[0])
-				if err != nil {
-					return nil, "", multierr.Append(fmt.Errorf("failed at parse numerator fps"), multierr.Append(err, fmt.Errorf("ffprobe failed: %s", out)))
-				}
+		numerator, err := strconv.Atoi(fpsArr[0])
+		if err != nil {
+			return nil, "", multierr.Append(fmt.Errorf("failed at parse numerator fps"), multierr.Append(err, fmt.Errorf("ffprobe failed: %s", out)))
+		}
 
-				denominator, err := strconv.Atoi(fpsArr[1])
-				if err != nil {
-					return nil, "", multierr.Append(fmt.Errorf("failed at parse denominator fps"), multierr.Append(err, fmt.Errorf("ffprobe failed: %s", out)))
-				}
+		denominator, err := strconv.Atoi(fpsArr[1])
+		if err != nil {
+			return nil, "", multierr.Append(fmt.Errorf("failed at parse denominator fps"), multierr.Append(err, fmt.Errorf("ffprobe failed: %s", out)))
+		}
 
-				// this is because GIF images can only be a max of 50fps, meaning each frame can only be 2 timescales (0.02s)
-				delay := int(math.Max(math.Round(100/(float64(numerator)/float64(denominator))), 2))
-				for i := range delays {
-					delays[i] = delay
-				}
-			}
+		// this is because GIF images can only be a max of 50fps, meaning each frame can only be 2 timescales (0.02s)
+		delay := int(math.Max(math.Round(100/(float64(numerator)/float64(denominator))), 2))
+		for i := range delays {
+			delays[i] = delay
 		}
 	}
 
 	return delays, inputDir, nil
 }
 
+// gifDelay clamps the delay of a gif frame the way browsers play it back.
+func gifDelay(d int) int {
+	// gifs have a hard frame timing min of 20ms (2 timescales) if its 10ms (1 timescale) browsers treat this as 100ms (10 timescales)
+	if d <= 1 { // 10ms
+		return 10 // 100ms
+	} else if d <= 2 { // 20ms
+		return 2 // 20ms
+	}
+
+	return d
+}
+
 func copyFile(src, dst string) (int64, error) {
 	sourceFileStat, err := os.Stat(src)
 	if err != nil {
@@ -1,20 +1,26 @@
 package image_processor
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"os"
 	"path"
 	"runtime"
 	"sync"
 	"testing"
 
-	"github.com/seventv/common/svc/s3"
-
 	"github.com/seventv/image-processor/go/internal/configure"
 	"github.com/seventv/image-processor/go/internal/global"
 	"github.com/seventv/image-processor/go/internal/svc/prometheus"
+	"github.com/seventv/image-processor/go/internal/svc/storage"
 	"github.com/seventv/image-processor/go/internal/testutil"
 	"github.com/seventv/image-processor/go/task"
+	"golang.org/x/crypto/sha3"
 
 	messagequeue "github.com/seventv/message-queue/go"
 )
@@ -70,7 +76,7 @@ func TestWorker(t *testing.T) {
 		f["input"][file] = testutil.ReadFile(t, path.Join(assetDir, file))
 	}
 
-	gCtx.Inst().S3, err = s3.NewMock(gCtx, f)
+	gCtx.Inst().Storage, err = storage.NewMock(gCtx, f)
 	testutil.IsNil(t, err, "s3 init successful")
 
 	wg := sync.WaitGroup{}
@@ -126,7 +132,7 @@ func TestWorkerFailed(t *testing.T) {
 		"output": {},
 	}
 
-	gCtx.Inst().S3, err = s3.NewMock(gCtx, f)
+	gCtx.Inst().Storage, err = storage.NewMock(gCtx, f)
 	testutil.IsNil(t, err, "s3 init successful")
 
 	wg := sync.WaitGroup{}
@@ -164,3 +170,338 @@ func TestWorkerFailed(t *testing.T) {
 		cancel()
 	}()
 }
+
+func TestWorkerNative(t *testing.T) {
+	t.Parallel()
+
+	var err error
+
+	config := &configure.Config{}
+	config.Worker.TempDir = t.TempDir()
+	config.Worker.Pipeline = configure.WorkerPipelineNative
+
+	gCtx, cancel := global.WithCancel(global.New(context.Background(), config))
+	defer cancel()
+
+	gCtx.Inst().MessageQueue, err = messagequeue.New(gCtx, messagequeue.ConfigMock{})
+	testutil.IsNil(t, err, "mq init successful")
+
+	gCtx.Inst().Prometheus = prometheus.New(prometheus.Options{})
+
+	_, cwd, _, _ := runtime.Caller(0)
+	assetDir := path.Join(path.Dir(cwd), "..", "..", "..", "assets")
+
+	files := []string{"static-1.png", "static-2.png", "static-1.jpeg"}
+
+	f := map[string]map[string][]byte{
+		"input":  {},
+		"output": {},
+	}
+
+	for _, file := range files {
+		f["input"][file] = testutil.ReadFile(t, path.Join(assetDir, file))
+	}
+
+	gCtx.Inst().Storage, err = storage.NewMock(gCtx, f)
+	testutil.IsNil(t, err, "s3 init successful")
+
+	for _, file := range files {
+		worker := Worker{}
+		result := task.Result{}
+		err := worker.Work(gCtx, task.Task{
+			Flags: task.TaskFlagPNG | task.TaskFlagWEBP,
+			Input: task.TaskInput{
+				Bucket: "input",
+				Key:    file,
+			},
+			Output: task.TaskOutput{
+				Bucket: "output",
+				Prefix: file,
+			},
+			SmallestMaxWidth:  96,
+			SmallestMaxHeight: 32,
+			Scales:            []int{1, 2},
+		}, &result)
+		testutil.IsNil(t, err, fmt.Sprintf("native convert of %s was successful", file))
+		testutil.Assert(t, 2, len(result.ImageOutputs), fmt.Sprintf("png outputs of %s", file))
+		testutil.Assert(t, 2, len(result.SkippedOutputs), fmt.Sprintf("webp outputs of %s are skipped", file))
+	}
+}
+
+func TestDecimateFrames(t *testing.T) {
+	t.Parallel()
+
+	frames, delays := decimateFrames([]string{"0", "1", "2", "3", "4"}, []int{2, 3, 4, 5, 6}, 2)
+
+	testutil.Assert(t, 3, len(frames), "frame count")
+	testutil.Assert(t, "2", frames[1], "second frame")
+	testutil.Assert(t, 5, delays[0], "first delay includes the dropped frame")
+	testutil.Assert(t, 9, delays[1], "second delay includes the dropped frame")
+	testutil.Assert(t, 6, delays[2], "last delay")
+
+	frames, delays = decimateFrames([]string{"0"}, nil, 3)
+	testutil.Assert(t, 1, len(frames), "static frame count")
+	testutil.Assert(t, 0, len(delays), "static delays")
+}
+
+func TestOutputBudget(t *testing.T) {
+	t.Parallel()
+
+	limits := task.TaskLimits{
+		MaxOutputSizes: []task.TaskOutputSizeLimit{
+			{MaxBytes: 7_000_000},
+			{Format: "webp", MaxBytes: 2_000_000},
+			{Format: "webp", Scale: 1, MaxBytes: 1_000_000},
+		},
+	}
+
+	testutil.Assert(t, 7_000_000, limits.MaxOutputBytes("gif", 1), "global budget")
+	testutil.Assert(t, 2_000_000, limits.MaxOutputBytes("webp", 4), "format budget")
+	testutil.Assert(t, 1_000_000, limits.MaxOutputBytes("webp", 1), "format and scale budget")
+	testutil.Assert(t, 0, task.TaskLimits{}.MaxOutputBytes("webp", 1), "no budget")
+
+	testutil.Assert(t, len(budgetQualities), len(budgetSteps("avif", 1)), "static avif steps")
+	testutil.Assert(t, len(budgetColors)+len(budgetFrameSteps), len(budgetSteps("gif", 10)), "animated gif steps")
+	testutil.Assert(t, 0, len(budgetSteps("png", 1)), "png steps")
+}
+
+func TestApplySizePolicy(t *testing.T) {
+	t.Parallel()
+
+	for _, policy := range []task.OutputSizePolicy{task.OutputSizePolicyMark, task.OutputSizePolicyDrop} {
+		dir := t.TempDir()
+
+		for name, size := range map[string]int{
+			"1x.gif":         100,
+			"1x.webp":        150,
+			"1x.avif":        120,
+			"1x_static.png":  50,
+			"1x_static.webp": 40,
+			"1x_static.avif": 45,
+		} {
+			testutil.IsNil(t, os.WriteFile(path.Join(dir, name), make([]byte, size), 0600), "write output")
+		}
+
+		result := task.Result{}
+		infos := map[string]outputInfo{}
+
+		testutil.IsNil(t, applySizePolicy(dir, policy, &result, infos), "apply size policy")
+
+		_, webpErr := os.Stat(path.Join(dir, "1x.webp"))
+		_, avifErr := os.Stat(path.Join(dir, "1x.avif"))
+		_, staticErr := os.Stat(path.Join(dir, "1x_static.avif"))
+
+		switch policy {
+		case task.OutputSizePolicyMark:
+			testutil.Assert(t, true, infos["1x.webp"].NonPreferred, "webp larger than gif is marked")
+			testutil.Assert(t, true, infos["1x.avif"].NonPreferred, "avif larger than gif is marked")
+			testutil.Assert(t, true, infos["1x_static.avif"].NonPreferred, "avif larger than webp is marked")
+			testutil.Assert(t, false, infos["1x_static.webp"].NonPreferred, "smallest webp is not marked")
+			testutil.Assert(t, 0, len(result.SkippedOutputs), "nothing skipped")
+			testutil.IsNil(t, webpErr, "webp kept")
+		case task.OutputSizePolicyDrop:
+			testutil.Assert(t, 3, len(result.SkippedOutputs), "outputs skipped")
+			testutil.Assert(t, true, os.IsNotExist(webpErr), "webp removed")
+			testutil.Assert(t, true, os.IsNotExist(avifErr), "avif removed")
+			testutil.Assert(t, true, os.IsNotExist(staticErr), "static avif removed")
+		}
+	}
+}
+
+func TestDownloadFileLimit(t *testing.T) {
+	t.Parallel()
+
+	var err error
+
+	config := &configure.Config{}
+	config.Worker.MaxInputBytes = 1024
+
+	gCtx, cancel := global.WithCancel(global.New(context.Background(), config))
+	defer cancel()
+
+	gCtx.Inst().Storage, err = storage.NewMock(gCtx, map[string]map[string][]byte{
+		"input": {
+			"large": make([]byte, 4096),
+			"small": make([]byte, 512),
+		},
+	})
+	testutil.IsNil(t, err, "s3 init successful")
+
+	worker := Worker{}
+
+	result := task.Result{}
+	_, _, _, _, err = worker.downloadFile(gCtx, task.Task{
+		Input: task.TaskInput{Bucket: "input", Key: "large"},
+	}, t.TempDir(), &result)
+	testutil.IsNotNil(t, err, "download of a large file fails")
+	testutil.Assert(t, task.ResultErrorInputTooLarge, result.Error, "result error is set")
+
+	result = task.Result{}
+	_, _, _, _, err = worker.downloadFile(gCtx, task.Task{
+		Input:  task.TaskInput{Bucket: "input", Key: "large"},
+		Limits: task.TaskLimits{MaxInputBytes: 8192},
+	}, t.TempDir(), &result)
+	testutil.IsNotNil(t, err, "download of a large file with a higher task limit fails at match")
+	testutil.Assert(t, task.ResultErrorNone, result.Error, "task limit overrides the config default")
+
+	result = task.Result{}
+	_, _, _, _, err = worker.downloadFile(gCtx, task.Task{
+		Input: task.TaskInput{Bucket: "input", Key: "small"},
+	}, t.TempDir(), &result)
+	testutil.IsNotNil(t, err, "download of a small file fails at match")
+	testutil.Assert(t, task.ResultErrorNone, result.Error, "small file is not too large")
+}
+
+func TestDownloadFile(t *testing.T) {
+	t.Parallel()
+
+	_, cwd, _, _ := runtime.Caller(0)
+	data := testutil.ReadFile(t, path.Join(path.Dir(cwd), "..", "..", "..", "assets", "animated-1.gif"))
+
+	gCtx, cancel := global.WithCancel(global.New(context.Background(), &configure.Config{}))
+	defer cancel()
+
+	var err error
+
+	gCtx.Inst().Storage, err = storage.NewMock(gCtx, map[string]map[string][]byte{
+		"input": {
+			"animated-1.gif": data,
+		},
+	})
+	testutil.IsNil(t, err, "s3 init successful")
+
+	dir := t.TempDir()
+	result := task.Result{}
+
+	match, inputFile, size, sums, err := Worker{}.downloadFile(gCtx, task.Task{
+		Input: task.TaskInput{Bucket: "input", Key: "animated-1.gif"},
+	}, dir, &result)
+	testutil.IsNil(t, err, "download was successful")
+	testutil.Assert(t, "gif", match.Extension, "format sniffed from the first bytes")
+	testutil.Assert(t, path.Join(dir, "input.gif"), inputFile, "input file is named after the format")
+	testutil.Assert(t, int64(len(data)), size, "downloaded size")
+
+	h := sha3.New512()
+	h.Write(data)
+	testutil.Assert(t, hex.EncodeToString(h.Sum(nil)), sums.SHA3, "hashed while downloading")
+
+	sha256Sum := sha256.Sum256(data)
+	testutil.Assert(t, hex.EncodeToString(sha256Sum[:]), sums.SHA256, "sha256 hashed while downloading")
+
+	written, err := os.ReadFile(inputFile)
+	testutil.IsNil(t, err, "input file was written")
+	testutil.Assert(t, true, bytes.Equal(data, written), "input file contents")
+
+	_, err = os.Stat(path.Join(dir, "input"))
+	testutil.Assert(t, true, os.IsNotExist(err), "download file was renamed")
+}
+
+func TestDownloadInline(t *testing.T) {
+	t.Parallel()
+
+	_, cwd, _, _ := runtime.Caller(0)
+	data := testutil.ReadFile(t, path.Join(path.Dir(cwd), "..", "..", "..", "assets", "animated-1.gif"))
+
+	config := &configure.Config{}
+	config.Worker.MaxInlineBytes = int64(len(data))
+
+	gCtx, cancel := global.WithCancel(global.New(context.Background(), config))
+	defer cancel()
+
+	tsk := task.Task{}
+	testutil.IsNil(t, json.Unmarshal([]byte(`{"input":{"data":"`+base64.StdEncoding.EncodeToString(data)+`"}}`), &tsk), "inline input is base64 in json")
+
+	result := task.Result{}
+
+	match, inputFile, size, sums, err := Worker{}.downloadFile(gCtx, tsk, t.TempDir(), &result)
+	testutil.IsNil(t, err, "inline input was written")
+	testutil.Assert(t, "gif", match.Extension, "format sniffed from the inline input")
+	testutil.Assert(t, int64(len(data)), size, "inline size")
+
+	h := sha3.New512()
+	h.Write(data)
+	testutil.Assert(t, hex.EncodeToString(h.Sum(nil)), sums.SHA3, "inline input is hashed")
+
+	written, err := os.ReadFile(inputFile)
+	testutil.IsNil(t, err, "input file was written")
+	testutil.Assert(t, true, bytes.Equal(data, written), "input file contents")
+
+	_, _, _, _, err = Worker{}.downloadFile(gCtx, task.Task{
+		Input: task.TaskInput{Data: []byte("not an image")},
+	}, t.TempDir(), &task.Result{})
+	testutil.IsNotNil(t, err, "inline inputs are validated")
+
+	_, _, _, _, err = Worker{}.downloadFile(gCtx, task.Task{
+		Input:  task.TaskInput{Data: data},
+		Limits: task.TaskLimits{MaxInputBytes: 16},
+	}, t.TempDir(), &result)
+	testutil.IsNotNil(t, err, "inline inputs are limited like downloads")
+	testutil.Assert(t, task.ResultErrorInputTooLarge, result.Error, "result error")
+
+	gCtx.Config().Worker.MaxInlineBytes = 16
+	result = task.Result{}
+
+	_, _, _, _, err = Worker{}.downloadFile(gCtx, task.Task{
+		Input: task.TaskInput{Data: data},
+	}, t.TempDir(), &result)
+	testutil.IsNotNil(t, err, "inline inputs larger than the inline limit are rejected")
+	testutil.Assert(t, task.ResultErrorInputTooLarge, result.Error, "result error")
+}
+
+func TestCheckLimits(t *testing.T) {
+	t.Parallel()
+
+	config := &configure.Config{}
+	config.Worker.MaxTotalPixels = 100 * 100 * 10
+
+	gCtx, cancel := global.WithCancel(global.New(context.Background(), config))
+	defer cancel()
+
+	tsk := task.Task{
+		Limits: task.TaskLimits{
+			MaxFrameCount: 20,
+			MaxWidth:      200,
+			MaxHeight:     200,
+		},
+	}
+
+	result := task.Result{}
+	testutil.IsNil(t, checkLimits(gCtx, tsk, &result, 100, 100, 10), "within limits")
+
+	result = task.Result{}
+	testutil.IsNotNil(t, checkLimits(gCtx, tsk, &result, 100, 100, 30), "too many frames")
+	testutil.Assert(t, task.ResultErrorTooManyFrames, result.Error, "too many frames error")
+
+	result = task.Result{}
+	testutil.IsNotNil(t, checkLimits(gCtx, tsk, &result, 300, 100, 1), "too wide")
+	testutil.Assert(t, task.ResultErrorDimensionsTooLarge, result.Error, "too wide error")
+
+	result = task.Result{}
+	testutil.IsNotNil(t, checkLimits(gCtx, tsk, &result, 200, 200, 20), "too many pixels")
+	testutil.Assert(t, task.ResultErrorTooManyPixels, result.Error, "too many pixels error")
+
+	tsk.Limits.MinWidth = 16
+	tsk.Limits.MinHeight = 16
+	tsk.Limits.MinAspectRatio = 0.25
+	tsk.Limits.MaxAspectRatio = 4
+
+	result = task.Result{}
+	testutil.IsNotNil(t, checkLimits(gCtx, tsk, &result, 1, 1, 1), "too small")
+	testutil.Assert(t, task.ResultErrorDimensionsTooSmall, result.Error, "too small error")
+
+	result = task.Result{}
+	testutil.IsNotNil(t, checkLimits(gCtx, tsk, &result, 200, 20, 1), "too wide aspect ratio")
+	testutil.Assert(t, task.ResultErrorAspectRatio, result.Error, "too wide aspect ratio error")
+
+	result = task.Result{}
+	testutil.IsNotNil(t, checkLimits(gCtx, tsk, &result, 20, 200, 1), "too tall aspect ratio")
+	testutil.Assert(t, task.ResultErrorAspectRatio, result.Error, "too tall aspect ratio error")
+
+	result = task.Result{}
+	testutil.IsNil(t, checkLimits(gCtx, tsk, &result, 160, 40, 1), "aspect ratio at the limit")
+
+	tsk.Limits.MaxTotalPixels = 200 * 200 * 20
+
+	result = task.Result{}
+	testutil.IsNil(t, checkLimits(gCtx, tsk, &result, 200, 200, 20), "task pixel limit overrides config")
+}
@@ -8,6 +8,7 @@ type Prometheus interface {
 	DownloadFile() func()
 	ExportFrames() func()
 	ResizeFrames() func()
+	StreamFrames() func()
 	MakeResults() func()
 	UploadResults() func()
 
@@ -15,6 +16,9 @@ type Prometheus interface {
 	TotalBytesDownloaded(int)
 	TotalBytesUploaded(int)
 
+	UploadRetried()
+	UploadFailed()
+
 	InputFileType(string)
 
 	Register(prometheus.Registerer)
@@ -0,0 +1,93 @@
+// Package native implements the static image pipeline in pure Go, it lets the worker process png, jpeg and gif
+// images without the cpp tools, ffmpeg or optipng being installed.
+package native
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+
+	"github.com/seventv/image-processor/go/task"
+	xdraw "golang.org/x/image/draw"
+)
+
+// Decode decodes the first frame of a png, jpeg or gif image.
+func Decode(r io.Reader, format string) (image.Image, error) {
+	switch format {
+	case "png":
+		return png.Decode(r)
+	case "jpg", "jpeg":
+		return jpeg.Decode(r)
+	case "gif":
+		return gif.Decode(r)
+	}
+
+	return nil, fmt.Errorf("unsupported format: %s", format)
+}
+
+// Resize pads the image to the aspect ratio of the new size according to the resize ratio
+// and then scales it with a Catmull-Rom filter, like resize_png does.
+func Resize(img image.Image, width int, height int, ratio task.ResizeRatio) *image.NRGBA {
+	src := img
+
+	if ratio != task.ResizeRatioNothing && ratio != task.ResizeRatioStretch {
+		src = pad(img, float64(width)/float64(height), ratio)
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+
+	// scaling into an NRGBA image interpolates in premultiplied space, so transparent pixels do not bleed their colour
+	xdraw.CatmullRom.Scale(dst, dst.Bounds(), src, src.Bounds(), xdraw.Src, nil)
+
+	return dst
+}
+
+// pad places the image on a transparent canvas with the target aspect ratio.
+func pad(img image.Image, targetRatio float64, ratio task.ResizeRatio) image.Image {
+	bounds := img.Bounds()
+	cols, rows := bounds.Dx(), bounds.Dy()
+
+	currentRatio := float64(cols) / float64(rows)
+	if currentRatio == targetRatio {
+		return img
+	}
+
+	paddedCols, paddedRows := cols, rows
+	if currentRatio < targetRatio { // means that width is too small
+		paddedCols = int(float64(rows) * targetRatio)
+	} else { // means that height is too small
+		paddedRows = int(float64(cols) / targetRatio)
+	}
+
+	x, y := 0, 0
+
+	switch ratio {
+	case task.ResizeRatioPaddingRightBottom:
+	case task.ResizeRatioPaddingLeftBottom:
+		x = paddedCols - cols
+	case task.ResizeRatioPaddingRightTop:
+		y = paddedRows - rows
+	case task.ResizeRatioPaddingLeftTop:
+		x = paddedCols - cols
+		y = paddedRows - rows
+	case task.ResizeRatioPaddingCenter:
+		x = (paddedCols - cols) / 2
+		y = (paddedRows - rows) / 2
+	}
+
+	padded := image.NewNRGBA(image.Rect(0, 0, paddedCols, paddedRows))
+	draw.Draw(padded, image.Rect(x, y, x+cols, y+rows), img, bounds.Min, draw.Src)
+
+	return padded
+}
+
+// EncodePNG writes the image as a png, best compression stands in for optipng.
+func EncodePNG(w io.Writer, img image.Image, compression png.CompressionLevel) error {
+	encoder := png.Encoder{CompressionLevel: compression}
+
+	return encoder.Encode(w, img)
+}
@@ -0,0 +1,76 @@
+package native
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"path"
+	"runtime"
+	"testing"
+
+	"github.com/seventv/image-processor/go/internal/testutil"
+	"github.com/seventv/image-processor/go/task"
+)
+
+func readAsset(t *testing.T, filename string) []byte {
+	_, cwd, _, _ := runtime.Caller(0)
+
+	return testutil.ReadFile(t, path.Join(path.Dir(cwd), "..", "..", "..", "assets", filename))
+}
+
+func TestDecode(t *testing.T) {
+	t.Parallel()
+
+	for filename, format := range map[string]string{
+		"static-1.png":   "png",
+		"static-1.jpeg":  "jpeg",
+		"animated-1.gif": "gif",
+	} {
+		img, err := Decode(bytes.NewReader(readAsset(t, filename)), format)
+		testutil.IsNil(t, err, filename)
+		testutil.Assert(t, true, img.Bounds().Dx() > 0, filename)
+	}
+
+	_, err := Decode(bytes.NewReader(readAsset(t, "static-1.webp")), "webp")
+	testutil.IsNotNil(t, err, "webp is not supported")
+}
+
+func TestResize(t *testing.T) {
+	t.Parallel()
+
+	// a 2:1 opaque red image
+	src := image.NewNRGBA(image.Rect(0, 0, 200, 100))
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 200; x++ {
+			src.SetNRGBA(x, y, color.NRGBA{R: 255, A: 255})
+		}
+	}
+
+	img := Resize(src, 50, 50, task.ResizeRatioStretch)
+	testutil.Assert(t, image.Rect(0, 0, 50, 50), img.Bounds(), "stretch size")
+	testutil.Assert(t, uint8(255), img.NRGBAAt(25, 45).A, "stretch fills the image")
+
+	img = Resize(src, 50, 50, task.ResizeRatioPaddingRightBottom)
+	testutil.Assert(t, uint8(255), img.NRGBAAt(25, 5).A, "image is at the top")
+	testutil.Assert(t, uint8(0), img.NRGBAAt(25, 45).A, "padding is at the bottom")
+
+	img = Resize(src, 50, 50, task.ResizeRatioPaddingCenter)
+	testutil.Assert(t, uint8(0), img.NRGBAAt(25, 2).A, "padding is at the top")
+	testutil.Assert(t, uint8(255), img.NRGBAAt(25, 25).A, "image is in the center")
+	testutil.Assert(t, uint8(0), img.NRGBAAt(25, 47).A, "padding is at the bottom")
+}
+
+func TestEncodePNG(t *testing.T) {
+	t.Parallel()
+
+	img, err := Decode(bytes.NewReader(readAsset(t, "static-1.png")), "png")
+	testutil.IsNil(t, err, "decode")
+
+	buf := &bytes.Buffer{}
+	testutil.IsNil(t, EncodePNG(buf, Resize(img, 32, 32, task.ResizeRatioStretch), png.BestCompression), "encode")
+
+	cfg, err := png.DecodeConfig(buf)
+	testutil.IsNil(t, err, "encoded png decodes")
+	testutil.Assert(t, 32, cfg.Width, "encoded width")
+}
@@ -0,0 +1,125 @@
+// Package rawframe implements the stream used to pass decoded frames between the stages of the pipeline
+// without encoding every frame as a png file.
+//
+// A stream is a sequence of frames, each one is a 12 byte little endian header holding the width, the height
+// and the delay in 100s of a second followed by width * height * 4 bytes of non premultiplied RGBA pixels.
+// The stream ends at EOF, cpp/apps/common/frame_stream.hpp is the implementation used by the cpp tools.
+package rawframe
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+)
+
+// HeaderSize is the number of bytes before the pixels of every frame.
+const HeaderSize = 12
+
+// MaxFrameBytes is the largest frame a Reader accepts, it is far above any frame the limits of a task allow.
+const MaxFrameBytes = 1 << 30
+
+var ErrFrameTooLarge = errors.New("frame too large")
+
+type Frame struct {
+	Width  int
+	Height int
+	// Delay is in 100s of a second
+	Delay int
+	// Pix holds the RGBA pixels of the frame row by row without any padding
+	Pix []byte
+}
+
+// FromImage copies an image into a frame.
+func FromImage(img image.Image, delay int) Frame {
+	nrgba, ok := img.(*image.NRGBA)
+	if !ok || nrgba.Stride != 4*nrgba.Rect.Dx() || nrgba.Rect.Min != (image.Point{}) {
+		bounds := img.Bounds()
+		nrgba = image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+		draw.Draw(nrgba, nrgba.Rect, img, bounds.Min, draw.Src)
+	}
+
+	return Frame{
+		Width:  nrgba.Rect.Dx(),
+		Height: nrgba.Rect.Dy(),
+		Delay:  delay,
+		Pix:    nrgba.Pix,
+	}
+}
+
+// Image returns the frame as an image sharing the pixels of the frame.
+func (f Frame) Image() *image.NRGBA {
+	return &image.NRGBA{
+		Pix:    f.Pix,
+		Stride: 4 * f.Width,
+		Rect:   image.Rect(0, 0, f.Width, f.Height),
+	}
+}
+
+type Reader struct {
+	r      io.Reader
+	header [HeaderSize]byte
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r}
+}
+
+// Next reads the next frame, io.EOF is returned when the stream ends between two frames.
+func (r *Reader) Next() (Frame, error) {
+	if _, err := io.ReadFull(r.r, r.header[:]); err != nil {
+		return Frame{}, err
+	}
+
+	frame := Frame{
+		Width:  int(binary.LittleEndian.Uint32(r.header[0:])),
+		Height: int(binary.LittleEndian.Uint32(r.header[4:])),
+		Delay:  int(binary.LittleEndian.Uint32(r.header[8:])),
+	}
+
+	size := uint64(frame.Width) * uint64(frame.Height) * 4
+	if size > MaxFrameBytes {
+		return Frame{}, fmt.Errorf("%w: %dx%d", ErrFrameTooLarge, frame.Width, frame.Height)
+	}
+
+	frame.Pix = make([]byte, size)
+
+	if _, err := io.ReadFull(r.r, frame.Pix); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+
+		return Frame{}, err
+	}
+
+	return frame, nil
+}
+
+type Writer struct {
+	w      io.Writer
+	header [HeaderSize]byte
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+func (w *Writer) Write(frame Frame) error {
+	if len(frame.Pix) != frame.Width*frame.Height*4 {
+		return fmt.Errorf("frame has %d bytes of pixels for %dx%d", len(frame.Pix), frame.Width, frame.Height)
+	}
+
+	binary.LittleEndian.PutUint32(w.header[0:], uint32(frame.Width))
+	binary.LittleEndian.PutUint32(w.header[4:], uint32(frame.Height))
+	binary.LittleEndian.PutUint32(w.header[8:], uint32(frame.Delay))
+
+	if _, err := w.w.Write(w.header[:]); err != nil {
+		return err
+	}
+
+	_, err := w.w.Write(frame.Pix)
+
+	return err
+}
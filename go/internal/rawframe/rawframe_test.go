@@ -0,0 +1,163 @@
+package rawframe
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/seventv/image-processor/go/internal/testutil"
+)
+
+func testFrame(width int, height int, delay int) Frame {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{R: uint8(x), G: uint8(y), B: uint8(x ^ y), A: uint8(x + y)})
+		}
+	}
+
+	return FromImage(img, delay)
+}
+
+func TestStream(t *testing.T) {
+	t.Parallel()
+
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+
+	frames := []Frame{testFrame(3, 2, 4), testFrame(3, 2, 10), testFrame(1, 1, 0)}
+	for _, frame := range frames {
+		testutil.IsNil(t, w.Write(frame), "write frame")
+	}
+
+	testutil.Assert(t, 3*HeaderSize+(6+6+1)*4, buf.Len(), "stream size")
+
+	r := NewReader(buf)
+
+	for i, frame := range frames {
+		read, err := r.Next()
+		testutil.IsNil(t, err, "read frame")
+		testutil.Assert(t, frame.Width, read.Width, "width")
+		testutil.Assert(t, frame.Height, read.Height, "height")
+		testutil.Assert(t, frame.Delay, read.Delay, "delay")
+		testutil.Assert(t, true, bytes.Equal(frame.Pix, read.Pix), "pixels")
+		testutil.Assert(t, frame.Image().NRGBAAt(i%frame.Width, 0), read.Image().NRGBAAt(i%frame.Width, 0), "image")
+	}
+
+	_, err := r.Next()
+	testutil.Assert(t, true, err == io.EOF, "end of stream")
+}
+
+func TestStreamErrors(t *testing.T) {
+	t.Parallel()
+
+	buf := &bytes.Buffer{}
+	testutil.IsNil(t, NewWriter(buf).Write(testFrame(4, 4, 1)), "write frame")
+
+	_, err := NewReader(bytes.NewReader(buf.Bytes()[:buf.Len()-1])).Next()
+	testutil.Assert(t, true, err == io.ErrUnexpectedEOF, "truncated pixels")
+
+	_, err = NewReader(bytes.NewReader(buf.Bytes()[:HeaderSize-1])).Next()
+	testutil.Assert(t, true, err == io.ErrUnexpectedEOF, "truncated header")
+
+	huge := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0}
+	_, err = NewReader(bytes.NewReader(huge)).Next()
+	testutil.Assert(t, true, errors.Is(err, ErrFrameTooLarge), "frame too large")
+
+	testutil.IsNotNil(t, NewWriter(io.Discard).Write(Frame{Width: 2, Height: 2}), "missing pixels")
+}
+
+func TestFromImage(t *testing.T) {
+	t.Parallel()
+
+	img := image.NewRGBA(image.Rect(2, 2, 4, 5))
+	img.Set(2, 2, color.RGBA{R: 255, A: 255})
+
+	frame := FromImage(img, 3)
+	testutil.Assert(t, 2, frame.Width, "width")
+	testutil.Assert(t, 3, frame.Height, "height")
+	testutil.Assert(t, color.NRGBA{R: 255, A: 255}, frame.Image().NRGBAAt(0, 0), "pixel moved to the origin")
+}
+
+// The benchmarks compare handing frames from one stage to the next as png files in the temp dir,
+// which is what the file pipeline does between export, resize and encode, with writing them into a raw frame stream.
+
+const (
+	benchFrames = 50
+	benchWidth  = 384
+	benchHeight = 384
+)
+
+func BenchmarkHandoffPNG(b *testing.B) {
+	frame := testFrame(benchWidth, benchHeight, 4)
+	dir := b.TempDir()
+
+	b.SetBytes(int64(benchFrames * len(frame.Pix)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < benchFrames; j++ {
+			pth := path.Join(dir, "frame.png")
+
+			file, err := os.Create(pth)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			if err := png.Encode(file, frame.Image()); err != nil {
+				b.Fatal(err)
+			}
+
+			file.Close()
+
+			file, err = os.Open(pth)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			if _, err := png.Decode(file); err != nil {
+				b.Fatal(err)
+			}
+
+			file.Close()
+		}
+	}
+}
+
+func BenchmarkHandoffStream(b *testing.B) {
+	frame := testFrame(benchWidth, benchHeight, 4)
+
+	b.SetBytes(int64(benchFrames * len(frame.Pix)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		pr, pw := io.Pipe()
+
+		go func() {
+			w := NewWriter(pw)
+			for j := 0; j < benchFrames; j++ {
+				if err := w.Write(frame); err != nil {
+					pw.CloseWithError(err)
+					return
+				}
+			}
+
+			pw.Close()
+		}()
+
+		r := NewReader(pr)
+		for {
+			if _, err := r.Next(); err == io.EOF {
+				break
+			} else if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
@@ -49,6 +49,12 @@ func New(o Options) instance.Prometheus {
 			Help:        "Total files moved from s3",
 			ConstLabels: o.Labels,
 		}, []string{"direction"}),
+		totalUploadRetries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   "image_processor",
+			Name:        "total_upload_retries",
+			Help:        "Uploads to s3 that failed, by whether they were retried or gave up",
+			ConstLabels: o.Labels,
+		}, []string{"result"}),
 		taskInputType: prometheus.NewCounterVec(prometheus.CounterOpts{
 			Namespace:   "image_processor",
 			Name:        "input_type",
@@ -66,6 +72,7 @@ type Instance struct {
 	totalBytes           *prometheus.CounterVec
 	totalFiles           *prometheus.CounterVec
 	totalFramesProcessed prometheus.Counter
+	totalUploadRetries   *prometheus.CounterVec
 
 	taskInputType *prometheus.CounterVec
 }
@@ -81,6 +88,7 @@ func (m *Instance) Register(r prometheus.Registerer) {
 		m.totalFiles,
 
 		m.totalFramesProcessed,
+		m.totalUploadRetries,
 	)
 }
 
@@ -111,6 +119,16 @@ func (m *Instance) TotalBytesUploaded(bytes int) {
 	m.totalBytes.With(prometheus.Labels{"direction": "uploaded"}).Add(float64(bytes))
 }
 
+// UploadRetried counts a failed upload attempt that is tried again.
+func (m *Instance) UploadRetried() {
+	m.totalUploadRetries.With(prometheus.Labels{"result": "retried"}).Inc()
+}
+
+// UploadFailed counts an upload that failed on its last attempt.
+func (m *Instance) UploadFailed() {
+	m.totalUploadRetries.With(prometheus.Labels{"result": "failed"}).Inc()
+}
+
 func (m *Instance) TotalFramesProcessed(frames int) {
 	m.totalFramesProcessed.Add(float64(frames))
 }
@@ -131,6 +149,15 @@ func (m *Instance) ResizeFrames() func() {
 	}
 }
 
+// StreamFrames times exporting, resizing and encoding the animated outputs when the frames are streamed between them.
+func (m *Instance) StreamFrames() func() {
+	start := time.Now()
+
+	return func() {
+		m.taskDurationSeconds.With(prometheus.Labels{"action": "stream_frames"}).Observe(float64(time.Since(start)/time.Millisecond) / 1000)
+	}
+}
+
 func (m *Instance) ExportFrames() func() {
 	start := time.Now()
 
@@ -0,0 +1,77 @@
+package s3
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awsutil"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	commons3 "github.com/seventv/common/svc/s3"
+)
+
+// Instance extends the common s3 instance with calls it does not expose.
+type Instance interface {
+	commons3.Instance
+	HeadFile(ctx context.Context, opts *s3.HeadObjectInput) (*s3.HeadObjectOutput, error)
+	PutFile(ctx context.Context, opts *s3.PutObjectInput) (*s3.PutObjectOutput, error)
+	UploadFileMultipart(ctx context.Context, opts *s3.PutObjectInput, partSize int64) error
+	DeleteFile(ctx context.Context, opts *s3.DeleteObjectInput) error
+}
+
+type s3Inst struct {
+	commons3.Instance
+	s3 *s3.S3
+}
+
+func New(ctx context.Context, o commons3.Options) (Instance, error) {
+	inst, err := commons3.New(ctx, o)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := session.NewSession(&aws.Config{
+		Credentials:      credentials.NewStaticCredentials(o.AccessToken, o.SecretKey, ""),
+		Region:           aws.String(o.Region),
+		S3ForcePathStyle: aws.Bool(true),
+		Endpoint:         aws.String(o.Endpoint),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3Inst{
+		Instance: inst,
+		s3:       s3.New(s),
+	}, nil
+}
+
+func (a *s3Inst) HeadFile(ctx context.Context, opts *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	return a.s3.HeadObjectWithContext(ctx, opts)
+}
+
+// PutFile uploads the body in one request and returns the response, which has the ETag of the object.
+func (a *s3Inst) PutFile(ctx context.Context, opts *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	return a.s3.PutObjectWithContext(ctx, opts)
+}
+
+func (a *s3Inst) DeleteFile(ctx context.Context, opts *s3.DeleteObjectInput) error {
+	_, err := a.s3.DeleteObjectWithContext(ctx, opts)
+
+	return err
+}
+
+// UploadFileMultipart uploads the body in parts of partSize bytes, parts that fail are retried on their own.
+func (a *s3Inst) UploadFileMultipart(ctx context.Context, opts *s3.PutObjectInput, partSize int64) error {
+	input := &s3manager.UploadInput{}
+	awsutil.Copy(input, opts)
+	input.Body = opts.Body
+
+	_, err := s3manager.NewUploaderWithClient(a.s3, func(u *s3manager.Uploader) {
+		u.PartSize = partSize
+	}).UploadWithContext(ctx, input)
+
+	return err
+}
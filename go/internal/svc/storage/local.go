@@ -0,0 +1,197 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"go.uber.org/multierr"
+)
+
+type localStorage struct {
+	root string
+}
+
+// NewLocal stores every bucket as a directory in root and every key as a file in it. The options of uploads
+// which a filesystem has no place for, such as the acl, content type and metadata, are not kept.
+func NewLocal(root string) Instance {
+	return &localStorage{root: root}
+}
+
+// path returns the file of a key, keys which would leave the directory of the bucket are rejected.
+func (l *localStorage) path(bucket string, key string) (string, error) {
+	if bucket == "" || bucket == "." || bucket == ".." || strings.ContainsAny(bucket, `/\`) {
+		return "", fmt.Errorf("invalid bucket %q", bucket)
+	}
+
+	if key == "" || strings.HasSuffix(key, "/") {
+		return "", fmt.Errorf("invalid key %q", key)
+	}
+
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "." || segment == ".." || strings.Contains(segment, `\`) {
+			return "", fmt.Errorf("invalid key %q", key)
+		}
+	}
+
+	return filepath.Join(l.root, bucket, filepath.FromSlash(key)), nil
+}
+
+func notFound(bucket string, key string) error {
+	return awserr.New(s3.ErrCodeNoSuchKey, fmt.Sprintf("%s/%s does not exist", bucket, key), nil)
+}
+
+func (l *localStorage) UploadFile(ctx context.Context, opts *s3.PutObjectInput) error {
+	pth, err := l.path(aws.StringValue(opts.Bucket), aws.StringValue(opts.Key))
+	if err != nil {
+		return err
+	}
+
+	var body io.Reader = strings.NewReader("")
+	if opts.Body != nil {
+		body = opts.Body
+	}
+
+	return writeFile(ctx, pth, body)
+}
+
+// writeFile renames the file into place once it is complete so readers never see a partial file.
+func writeFile(ctx context.Context, pth string, body io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(pth), 0700); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(pth), ".tmp-")
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(tmp, &contextReader{ctx: ctx, r: body}); err != nil {
+		return multierr.Combine(err, tmp.Close(), os.Remove(tmp.Name()))
+	}
+
+	if err := tmp.Close(); err != nil {
+		return multierr.Append(err, os.Remove(tmp.Name()))
+	}
+
+	if err := os.Rename(tmp.Name(), pth); err != nil {
+		return multierr.Append(err, os.Remove(tmp.Name()))
+	}
+
+	return nil
+}
+
+func (l *localStorage) DownloadFile(ctx context.Context, output io.Writer, opts *s3.GetObjectInput) error {
+	bucket, key := aws.StringValue(opts.Bucket), aws.StringValue(opts.Key)
+
+	pth, err := l.path(bucket, key)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(pth)
+	if os.IsNotExist(err) {
+		return notFound(bucket, key)
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(output, &contextReader{ctx: ctx, r: file})
+
+	return err
+}
+
+func (l *localStorage) CopyFile(ctx context.Context, opts *s3.CopyObjectInput) error {
+	bucket, key, err := copySource(opts)
+	if err != nil {
+		return err
+	}
+
+	source, err := l.path(bucket, key)
+	if err != nil {
+		return err
+	}
+
+	pth, err := l.path(aws.StringValue(opts.Bucket), aws.StringValue(opts.Key))
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(source)
+	if os.IsNotExist(err) {
+		return notFound(bucket, key)
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return writeFile(ctx, pth, file)
+}
+
+func (l *localStorage) HeadFile(ctx context.Context, opts *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	bucket, key := aws.StringValue(opts.Bucket), aws.StringValue(opts.Key)
+
+	pth, err := l.path(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := os.Stat(pth)
+	if os.IsNotExist(err) {
+		return nil, notFound(bucket, key)
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &s3.HeadObjectOutput{
+		ContentLength: aws.Int64(stat.Size()),
+		LastModified:  aws.Time(stat.ModTime()),
+	}, nil
+}
+
+func (l *localStorage) DeleteFile(ctx context.Context, opts *s3.DeleteObjectInput) error {
+	pth, err := l.path(aws.StringValue(opts.Bucket), aws.StringValue(opts.Key))
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(pth); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+func (l *localStorage) Ping(ctx context.Context) error {
+	stat, err := os.Stat(l.root)
+	if err != nil {
+		return err
+	}
+
+	if !stat.IsDir() {
+		return fmt.Errorf("%s is not a directory", l.root)
+	}
+
+	return nil
+}
+
+// contextReader stops reading once the context is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return r.r.Read(p)
+}
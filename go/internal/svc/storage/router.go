@@ -0,0 +1,168 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"go.uber.org/multierr"
+)
+
+type router struct {
+	fallback Instance
+	buckets  map[string]Instance
+	profiles map[string]Instance
+}
+
+// NewRouter sends the calls for a bucket to its backend in buckets, or to fallback when it has none.
+func NewRouter(fallback Instance, buckets map[string]Instance) Instance {
+	return &router{fallback: fallback, buckets: buckets, profiles: map[string]Instance{}}
+}
+
+// Profile returns the storage of a profile, the empty name is the router itself.
+func (r *router) Profile(name string) (Instance, bool) {
+	if name == "" {
+		return r, true
+	}
+
+	inst, ok := r.profiles[name]
+
+	return inst, ok
+}
+
+func (r *router) Profiles() []string {
+	names := make([]string, 0, len(r.profiles))
+	for name := range r.profiles {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+func (r *router) backend(bucket *string) Instance {
+	if inst, ok := r.buckets[aws.StringValue(bucket)]; ok {
+		return inst
+	}
+
+	return r.fallback
+}
+
+func (r *router) UploadFile(ctx context.Context, opts *s3.PutObjectInput) error {
+	return r.backend(opts.Bucket).UploadFile(ctx, opts)
+}
+
+func (r *router) DownloadFile(ctx context.Context, output io.Writer, opts *s3.GetObjectInput) error {
+	return r.backend(opts.Bucket).DownloadFile(ctx, output, opts)
+}
+
+// CopyFile copies within the backend when both buckets are in the same one, otherwise the file is downloaded
+// from the backend of the source into a temporary file and uploaded from it to the backend of the destination.
+func (r *router) CopyFile(ctx context.Context, opts *s3.CopyObjectInput) error {
+	bucket, key, err := copySource(opts)
+	if err != nil {
+		return err
+	}
+
+	source := r.backend(aws.String(bucket))
+	destination := r.backend(opts.Bucket)
+
+	if source == destination {
+		return destination.CopyFile(ctx, opts)
+	}
+
+	// uploads need to seek the body so the file is spooled to disk instead of held in memory
+	file, err := os.CreateTemp("", "storage-copy-*")
+	if err != nil {
+		return multierr.Append(fmt.Errorf("failed at create temp file"), err)
+	}
+
+	defer func() {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+	}()
+
+	if err := source.DownloadFile(ctx, file, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}); err != nil {
+		return err
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return multierr.Append(fmt.Errorf("failed at seek temp file"), err)
+	}
+
+	return destination.UploadFile(ctx, &s3.PutObjectInput{
+		ACL:                opts.ACL,
+		Body:               file,
+		Bucket:             opts.Bucket,
+		CacheControl:       opts.CacheControl,
+		ContentDisposition: opts.ContentDisposition,
+		ContentType:        opts.ContentType,
+		Key:                opts.Key,
+		Metadata:           opts.Metadata,
+		Tagging:            opts.Tagging,
+	})
+}
+
+func (r *router) HeadFile(ctx context.Context, opts *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	return r.backend(opts.Bucket).HeadFile(ctx, opts)
+}
+
+func (r *router) DeleteFile(ctx context.Context, opts *s3.DeleteObjectInput) error {
+	return r.backend(opts.Bucket).DeleteFile(ctx, opts)
+}
+
+// PutFile uploads without a response when the backend of the bucket does not return one.
+func (r *router) PutFile(ctx context.Context, opts *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	inst := r.backend(opts.Bucket)
+	if p, ok := inst.(Putter); ok {
+		return p.PutFile(ctx, opts)
+	}
+
+	return &s3.PutObjectOutput{}, inst.UploadFile(ctx, opts)
+}
+
+// UploadFileMultipart uploads in one request when the backend of the bucket can not upload in parts.
+func (r *router) UploadFileMultipart(ctx context.Context, opts *s3.PutObjectInput, partSize int64) error {
+	inst := r.backend(opts.Bucket)
+	if m, ok := inst.(MultipartUploader); ok {
+		return m.UploadFileMultipart(ctx, opts, partSize)
+	}
+
+	return inst.UploadFile(ctx, opts)
+}
+
+// Ping pings every backend once, the profiles are only replica destinations and are pinged on their own
+// so one being down does not take the worker down.
+func (r *router) Ping(ctx context.Context) error {
+	pinged := map[Instance]bool{}
+
+	var err error
+
+	for _, inst := range append([]Instance{r.fallback}, values(r.buckets)...) {
+		if pinged[inst] {
+			continue
+		}
+
+		pinged[inst] = true
+		err = multierr.Append(err, inst.Ping(ctx))
+	}
+
+	return err
+}
+
+func values(m map[string]Instance) []Instance {
+	v := make([]Instance, 0, len(m))
+	for _, inst := range m {
+		v = append(v, inst)
+	}
+
+	return v
+}
@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	commons3 "github.com/seventv/common/svc/s3"
+)
+
+type headFiler interface {
+	HeadFile(ctx context.Context, opts *s3.HeadObjectInput) (*s3.HeadObjectOutput, error)
+}
+
+type fileDeleter interface {
+	DeleteFile(ctx context.Context, opts *s3.DeleteObjectInput) error
+}
+
+var (
+	// errDeleteUnsupported means the s3 instance can not delete files, the mock of the common package can not.
+	errDeleteUnsupported = errors.New("s3 instance can not delete files")
+	// errHeadUnsupported means the s3 instance can not head files, the common package has no call for it.
+	errHeadUnsupported = errors.New("s3 instance can not head files")
+)
+
+type s3Storage struct {
+	inst commons3.Instance
+}
+
+// NewS3 stores the buckets in s3, the calls the instance does not have fall back to the ones every instance has.
+func NewS3(inst commons3.Instance) Instance {
+	return &s3Storage{inst: inst}
+}
+
+func (s *s3Storage) UploadFile(ctx context.Context, opts *s3.PutObjectInput) error {
+	return s.inst.UploadFile(ctx, opts)
+}
+
+func (s *s3Storage) DownloadFile(ctx context.Context, output io.Writer, opts *s3.GetObjectInput) error {
+	return s.inst.DownloadFile(ctx, output, opts)
+}
+
+func (s *s3Storage) CopyFile(ctx context.Context, opts *s3.CopyObjectInput) error {
+	return s.inst.CopyFile(ctx, opts)
+}
+
+func (s *s3Storage) HeadFile(ctx context.Context, opts *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	if h, ok := s.inst.(headFiler); ok {
+		return h.HeadFile(ctx, opts)
+	}
+
+	return nil, errHeadUnsupported
+}
+
+func (s *s3Storage) DeleteFile(ctx context.Context, opts *s3.DeleteObjectInput) error {
+	if d, ok := s.inst.(fileDeleter); ok {
+		return d.DeleteFile(ctx, opts)
+	}
+
+	return errDeleteUnsupported
+}
+
+func (s *s3Storage) PutFile(ctx context.Context, opts *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	if p, ok := s.inst.(Putter); ok {
+		return p.PutFile(ctx, opts)
+	}
+
+	return &s3.PutObjectOutput{}, s.inst.UploadFile(ctx, opts)
+}
+
+func (s *s3Storage) UploadFileMultipart(ctx context.Context, opts *s3.PutObjectInput, partSize int64) error {
+	if m, ok := s.inst.(MultipartUploader); ok {
+		return m.UploadFileMultipart(ctx, opts, partSize)
+	}
+
+	return s.inst.UploadFile(ctx, opts)
+}
+
+func (s *s3Storage) Ping(ctx context.Context) error {
+	_, err := s.inst.ListBuckets(ctx)
+
+	return err
+}
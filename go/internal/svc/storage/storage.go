@@ -0,0 +1,148 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	commons3 "github.com/seventv/common/svc/s3"
+	"go.uber.org/multierr"
+
+	internals3 "github.com/seventv/image-processor/go/internal/svc/s3"
+)
+
+const (
+	BackendS3    = "s3"
+	BackendLocal = "local"
+)
+
+// Instance stores the inputs and outputs of tasks in buckets. The calls take the s3 request types so every backend
+// is given the same options, a backend ignores the options it can not keep. Missing files fail with s3.ErrCodeNoSuchKey.
+type Instance interface {
+	UploadFile(ctx context.Context, opts *s3.PutObjectInput) error
+	DownloadFile(ctx context.Context, output io.Writer, opts *s3.GetObjectInput) error
+	CopyFile(ctx context.Context, opts *s3.CopyObjectInput) error
+	HeadFile(ctx context.Context, opts *s3.HeadObjectInput) (*s3.HeadObjectOutput, error)
+	// DeleteFile removes a file, files which do not exist are not an error
+	DeleteFile(ctx context.Context, opts *s3.DeleteObjectInput) error
+	Ping(ctx context.Context) error
+}
+
+// Putter is implemented by backends that return the response of an upload, which has the ETag of the file.
+type Putter interface {
+	PutFile(ctx context.Context, opts *s3.PutObjectInput) (*s3.PutObjectOutput, error)
+}
+
+// Profiler is implemented by instances with named profiles, every profile is a storage of its own,
+// e.g. the buckets of another region.
+type Profiler interface {
+	Profile(name string) (Instance, bool)
+	// Profiles returns the names of the profiles
+	Profiles() []string
+}
+
+// MultipartUploader is implemented by backends that can upload a file in parts.
+type MultipartUploader interface {
+	UploadFileMultipart(ctx context.Context, opts *s3.PutObjectInput, partSize int64) error
+}
+
+type Options struct {
+	// Backend stores the buckets without a mapping in Buckets, s3 when it is empty
+	Backend string
+	// Buckets maps bucket names to the backend they are stored in
+	Buckets map[string]string
+	// LocalRoot is the directory of the local backend, every bucket is a directory in it
+	LocalRoot string
+	S3        commons3.Options
+	// Profiles are other storages a destination can pick by name, the profiles of a profile are not set up
+	Profiles map[string]Options
+}
+
+// New sets up the backends the options use and routes every bucket to its backend.
+func New(ctx context.Context, o Options) (Instance, error) {
+	if o.Backend == "" {
+		o.Backend = BackendS3
+	}
+
+	backends := map[string]Instance{}
+
+	setup := func(name string) (Instance, error) {
+		if inst, ok := backends[name]; ok {
+			return inst, nil
+		}
+
+		var inst Instance
+
+		switch name {
+		case BackendS3:
+			s3Inst, err := internals3.New(ctx, o.S3)
+			if err != nil {
+				return nil, err
+			}
+
+			inst = NewS3(s3Inst)
+		case BackendLocal:
+			if o.LocalRoot == "" {
+				return nil, fmt.Errorf("local storage has no root")
+			}
+
+			inst = NewLocal(o.LocalRoot)
+		default:
+			return nil, fmt.Errorf("unknown storage backend %s", name)
+		}
+
+		backends[name] = inst
+
+		return inst, nil
+	}
+
+	fallback, err := setup(o.Backend)
+	if err != nil {
+		return nil, err
+	}
+
+	buckets := map[string]Instance{}
+
+	for bucket, name := range o.Buckets {
+		inst, err := setup(name)
+		if err != nil {
+			return nil, err
+		}
+
+		buckets[bucket] = inst
+	}
+
+	r := &router{fallback: fallback, buckets: buckets, profiles: map[string]Instance{}}
+
+	for name, profile := range o.Profiles {
+		profile.Profiles = nil
+
+		inst, err := New(ctx, profile)
+		if err != nil {
+			return nil, multierr.Append(fmt.Errorf("failed at setup storage profile %s", name), err)
+		}
+
+		r.profiles[name] = inst
+	}
+
+	return r, nil
+}
+
+// copySource splits the escaped bucket/key source of a copy.
+func copySource(opts *s3.CopyObjectInput) (bucket string, key string, err error) {
+	source, err := url.PathUnescape(aws.StringValue(opts.CopySource))
+	if err != nil {
+		return "", "", err
+	}
+
+	splits := strings.SplitN(strings.TrimPrefix(source, "/"), "/", 2)
+	if len(splits) != 2 {
+		return "", "", fmt.Errorf("invalid copy source %s", source)
+	}
+
+	return splits[0], splits[1], nil
+}
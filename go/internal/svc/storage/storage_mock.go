@@ -0,0 +1,47 @@
+package storage
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	commons3 "github.com/seventv/common/svc/s3"
+)
+
+// NewMock stores the files in memory behind the s3 backend, files maps bucket names to the files in them by key.
+func NewMock(ctx context.Context, files map[string]map[string][]byte) (Instance, error) {
+	mock, err := commons3.NewMock(ctx, files)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewS3(mockS3{mock}), nil
+}
+
+// mockS3 heads the files of the mock of the common package, which has no call for it.
+type mockS3 struct {
+	commons3.Instance
+}
+
+// HeadFile counts the bytes of the file, the mock has it in memory.
+func (m mockS3) HeadFile(ctx context.Context, opts *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	counter := &countWriter{}
+	if err := m.DownloadFile(ctx, counter, &s3.GetObjectInput{
+		Bucket: opts.Bucket,
+		Key:    opts.Key,
+	}); err != nil {
+		return nil, err
+	}
+
+	return &s3.HeadObjectOutput{ContentLength: aws.Int64(counter.n)}, nil
+}
+
+type countWriter struct {
+	n int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+
+	return len(p), nil
+}
@@ -0,0 +1,221 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	commons3 "github.com/seventv/common/svc/s3"
+
+	"github.com/seventv/image-processor/go/internal/testutil"
+)
+
+func isNoSuchKey(err error) bool {
+	var awsErr awserr.Error
+
+	return errors.As(err, &awsErr) && awsErr.Code() == s3.ErrCodeNoSuchKey
+}
+
+func download(inst Instance, bucket string, key string) (string, error) {
+	buf := &bytes.Buffer{}
+	err := inst.DownloadFile(context.Background(), buf, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+
+	return buf.String(), err
+}
+
+func TestLocal(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	root := t.TempDir()
+	local := NewLocal(root)
+
+	testutil.IsNil(t, local.Ping(ctx), "root is a directory")
+	testutil.IsNotNil(t, NewLocal(filepath.Join(root, "missing")).Ping(ctx), "missing root")
+
+	testutil.IsNil(t, local.UploadFile(ctx, &s3.PutObjectInput{
+		Body:   strings.NewReader("file"),
+		Bucket: aws.String("bucket"),
+		Key:    aws.String("a/b/file.txt"),
+	}), "upload")
+
+	data, err := os.ReadFile(filepath.Join(root, "bucket", "a", "b", "file.txt"))
+	testutil.IsNil(t, err, "the key is a file in the bucket directory")
+	testutil.Assert(t, "file", string(data), "file contents")
+
+	data2, err := download(local, "bucket", "a/b/file.txt")
+	testutil.IsNil(t, err, "download")
+	testutil.Assert(t, "file", data2, "downloaded contents")
+
+	head, err := local.HeadFile(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String("bucket"),
+		Key:    aws.String("a/b/file.txt"),
+	})
+	testutil.IsNil(t, err, "head")
+	testutil.Assert(t, int64(4), aws.Int64Value(head.ContentLength), "head size")
+
+	err = local.CopyFile(ctx, &s3.CopyObjectInput{
+		Bucket:     aws.String("other"),
+		CopySource: aws.String("bucket/a/b/file%20copy.txt"),
+		Key:        aws.String("copy.txt"),
+	})
+	testutil.Assert(t, true, isNoSuchKey(err), "copy of a missing file fails")
+
+	testutil.IsNil(t, local.CopyFile(ctx, &s3.CopyObjectInput{
+		Bucket:     aws.String("other"),
+		CopySource: aws.String("bucket/a/b/file.txt"),
+		Key:        aws.String("copy.txt"),
+	}), "copy")
+
+	data2, err = download(local, "other", "copy.txt")
+	testutil.IsNil(t, err, "download copy")
+	testutil.Assert(t, "file", data2, "copied contents")
+
+	_, err = download(local, "bucket", "missing.txt")
+	testutil.Assert(t, true, isNoSuchKey(err), "missing files are NoSuchKey")
+
+	_, err = local.HeadFile(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String("bucket"),
+		Key:    aws.String("missing.txt"),
+	})
+	testutil.Assert(t, true, isNoSuchKey(err), "missing heads are NoSuchKey")
+
+	for _, key := range []string{"", "../escape.txt", "a/../../escape.txt", "a/./b", `a\b`, "dir/"} {
+		err := local.UploadFile(ctx, &s3.PutObjectInput{
+			Body:   strings.NewReader("escape"),
+			Bucket: aws.String("bucket"),
+			Key:    aws.String(key),
+		})
+		testutil.IsNotNil(t, err, "invalid key "+key)
+	}
+
+	for _, bucket := range []string{"", ".", "..", "a/b"} {
+		_, err := download(local, bucket, "file.txt")
+		testutil.IsNotNil(t, err, "invalid bucket "+bucket)
+	}
+
+	_, err = os.Stat(filepath.Join(filepath.Dir(root), "escape.txt"))
+	testutil.Assert(t, true, os.IsNotExist(err), "nothing is written outside of the root")
+}
+
+func TestRouter(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	mock, err := NewMock(ctx, map[string]map[string][]byte{
+		"remote": {"file.txt": []byte("remote")},
+	})
+	testutil.IsNil(t, err, "mock init successful")
+
+	root := t.TempDir()
+	router := NewRouter(mock, map[string]Instance{"local": NewLocal(root)})
+
+	testutil.IsNil(t, router.UploadFile(ctx, &s3.PutObjectInput{
+		Body:   strings.NewReader("local"),
+		Bucket: aws.String("local"),
+		Key:    aws.String("file.txt"),
+	}), "upload to the local bucket")
+
+	_, err = os.Stat(filepath.Join(root, "local", "file.txt"))
+	testutil.IsNil(t, err, "mapped buckets are stored in their backend")
+
+	_, err = download(mock, "local", "file.txt")
+	testutil.IsNotNil(t, err, "mapped buckets are not stored in the fallback")
+
+	data, err := download(router, "remote", "file.txt")
+	testutil.IsNil(t, err, "download from the fallback")
+	testutil.Assert(t, "remote", data, "fallback contents")
+
+	testutil.IsNil(t, router.CopyFile(ctx, &s3.CopyObjectInput{
+		Bucket:     aws.String("local"),
+		CopySource: aws.String("remote/file.txt"),
+		Key:        aws.String("copy.txt"),
+	}), "copy across backends")
+
+	data, err = download(router, "local", "copy.txt")
+	testutil.IsNil(t, err, "download copy")
+	testutil.Assert(t, "remote", data, "copied across backends")
+
+	testutil.IsNil(t, router.Ping(ctx), "every backend is up")
+
+	testutil.IsNil(t, os.RemoveAll(root), "remove local root")
+	testutil.IsNotNil(t, router.Ping(ctx), "a backend is down")
+}
+
+func TestNew(t *testing.T) {
+	t.Parallel()
+
+	_, err := New(context.Background(), Options{Backend: BackendLocal})
+	testutil.IsNotNil(t, err, "local storage needs a root")
+
+	_, err = New(context.Background(), Options{Backend: "ftp"})
+	testutil.IsNotNil(t, err, "unknown backends are rejected")
+
+	inst, err := New(context.Background(), Options{Backend: BackendLocal, LocalRoot: t.TempDir()})
+	testutil.IsNil(t, err, "local storage")
+	testutil.IsNil(t, inst.Ping(context.Background()), "local storage is up")
+
+	eu := t.TempDir()
+
+	inst, err = New(context.Background(), Options{
+		Backend:   BackendLocal,
+		LocalRoot: t.TempDir(),
+		Profiles: map[string]Options{
+			"eu": {Backend: BackendLocal, LocalRoot: eu},
+		},
+	})
+	testutil.IsNil(t, err, "storage with a profile")
+
+	profile, ok := inst.(Profiler).Profile("eu")
+	testutil.Assert(t, true, ok, "profile exists")
+	testutil.Assert(t, true, profile != inst, "profile is a storage of its own")
+
+	_, ok = inst.(Profiler).Profile("us")
+	testutil.Assert(t, false, ok, "unknown profile")
+
+	names := inst.(Profiler).Profiles()
+	testutil.Assert(t, 1, len(names), "profile names")
+	testutil.Assert(t, "eu", names[0], "profile name")
+
+	testutil.IsNil(t, os.RemoveAll(eu), "remove profile root")
+	testutil.IsNotNil(t, profile.Ping(context.Background()), "profile is down")
+	testutil.IsNil(t, inst.Ping(context.Background()), "a profile being down does not take the storage down")
+
+	_, err = New(context.Background(), Options{
+		Backend:   BackendLocal,
+		LocalRoot: t.TempDir(),
+		Profiles:  map[string]Options{"eu": {Backend: BackendLocal}},
+	})
+	testutil.IsNotNil(t, err, "profiles are set up with the storage")
+}
+
+func TestHeadFile(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	files := map[string]map[string][]byte{"bucket": {"file.txt": []byte("contents")}}
+
+	mock, err := NewMock(ctx, files)
+	testutil.IsNil(t, err, "mock init successful")
+
+	head, err := mock.HeadFile(ctx, &s3.HeadObjectInput{Bucket: aws.String("bucket"), Key: aws.String("file.txt")})
+	testutil.IsNil(t, err, "head file of the mock")
+	testutil.Assert(t, int64(8), aws.Int64Value(head.ContentLength), "size of the file")
+
+	common, err := commons3.NewMock(ctx, files)
+	testutil.IsNil(t, err, "common mock init successful")
+
+	_, err = NewS3(common).HeadFile(ctx, &s3.HeadObjectInput{Bucket: aws.String("bucket"), Key: aws.String("file.txt")})
+	testutil.Assert(t, true, errors.Is(err, errHeadUnsupported), "files are not downloaded to head them")
+}
@@ -0,0 +1,420 @@
+package probe
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+)
+
+// maxAvifHeaderBox limits how much of a meta or moov box is read into memory, real files keep these to a few kilobytes.
+const maxAvifHeaderBox = 16 << 20
+
+// box is an ISOBMFF box with its payload.
+type box struct {
+	typ  string
+	data []byte
+}
+
+// probeAvif reads the top level boxes, the primary item in meta gives the dimensions of still images
+// and the tracks in moov give the frames of image sequences.
+func probeAvif(r *bufio.Reader) (Info, error) {
+	var meta, moov []byte
+
+	header := make([]byte, 8)
+
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+
+			return Info{}, fmt.Errorf("%w: avif box: %v", ErrMalformed, err)
+		}
+
+		size := int64(be.Uint32(header))
+		typ := string(header[4:])
+		headerSize := int64(8)
+
+		switch size {
+		case 0:
+			// the box extends to the end of the file, this is only allowed for the last box which is mdat
+			if typ == "meta" || typ == "moov" {
+				return Info{}, fmt.Errorf("%w: avif %s has no size", ErrMalformed, typ)
+			}
+
+			size = -1
+		case 1:
+			large := make([]byte, 8)
+			if _, err := io.ReadFull(r, large); err != nil {
+				return Info{}, fmt.Errorf("%w: avif box size: %v", ErrMalformed, err)
+			}
+
+			size = int64(be.Uint64(large))
+			headerSize += 8
+		}
+
+		if size == -1 {
+			break
+		}
+
+		if size < headerSize {
+			return Info{}, fmt.Errorf("%w: avif %s is %d bytes", ErrMalformed, typ, size)
+		}
+
+		switch typ {
+		case "meta", "moov":
+			if size-headerSize > maxAvifHeaderBox {
+				return Info{}, fmt.Errorf("%w: avif %s is %d bytes", ErrMalformed, typ, size)
+			}
+
+			data := make([]byte, size-headerSize)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return Info{}, fmt.Errorf("%w: avif %s: %v", ErrMalformed, typ, err)
+			}
+
+			if typ == "meta" {
+				meta = data
+			} else {
+				moov = data
+			}
+		default:
+			if err := skip(r, size-headerSize); err != nil {
+				return Info{}, fmt.Errorf("%w: avif %s: %v", ErrMalformed, typ, err)
+			}
+		}
+	}
+
+	info := Info{FrameCount: 1}
+
+	if meta != nil {
+		width, height, alpha, err := avifPrimaryItem(meta)
+		if err != nil {
+			return Info{}, err
+		}
+
+		info.Width = width
+		info.Height = height
+		info.Alpha = alpha
+	}
+
+	if moov != nil {
+		track, err := avifTracks(moov)
+		if err != nil {
+			return Info{}, err
+		}
+
+		if info.Width == 0 || info.Height == 0 {
+			info.Width = track.Width
+			info.Height = track.Height
+		}
+
+		if track.FrameCount > 1 {
+			info.FrameCount = track.FrameCount
+			info.Delays = track.Delays
+			info.LoopCount = track.LoopCount
+		}
+
+		info.Alpha = info.Alpha || track.Alpha
+	}
+
+	if info.Width == 0 || info.Height == 0 {
+		return Info{}, fmt.Errorf("%w: avif has no dimensions", ErrMalformed)
+	}
+
+	return info, nil
+}
+
+// parseBoxes splits a payload into its child boxes.
+func parseBoxes(data []byte) ([]box, error) {
+	boxes := []box{}
+
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, fmt.Errorf("%w: avif box is truncated", ErrMalformed)
+		}
+
+		size := uint64(be.Uint32(data))
+		typ := string(data[4:8])
+		headerSize := uint64(8)
+
+		switch size {
+		case 0:
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return nil, fmt.Errorf("%w: avif box is truncated", ErrMalformed)
+			}
+
+			size = be.Uint64(data[8:])
+			headerSize = 16
+		}
+
+		if size < headerSize || size > uint64(len(data)) {
+			return nil, fmt.Errorf("%w: avif %s is %d bytes", ErrMalformed, typ, size)
+		}
+
+		boxes = append(boxes, box{typ: typ, data: data[headerSize:size]})
+		data = data[size:]
+	}
+
+	return boxes, nil
+}
+
+// findBox returns the first child box of the type.
+func findBox(boxes []box, typ string) (box, bool) {
+	for _, b := range boxes {
+		if b.typ == typ {
+			return b, true
+		}
+	}
+
+	return box{}, false
+}
+
+// avifPrimaryItem returns the ispe of the primary item, if the associations cannot be resolved the largest ispe is used.
+// The image has alpha when there is an auxiliary alpha property.
+func avifPrimaryItem(meta []byte) (int, int, bool, error) {
+	// meta is a full box, the first 4 bytes are the version and flags
+	if len(meta) < 4 {
+		return 0, 0, false, fmt.Errorf("%w: avif meta is truncated", ErrMalformed)
+	}
+
+	boxes, err := parseBoxes(meta[4:])
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	iprp, ok := findBox(boxes, "iprp")
+	if !ok {
+		return 0, 0, false, fmt.Errorf("%w: avif is missing iprp", ErrMalformed)
+	}
+
+	iprpBoxes, err := parseBoxes(iprp.data)
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	ipco, ok := findBox(iprpBoxes, "ipco")
+	if !ok {
+		return 0, 0, false, fmt.Errorf("%w: avif is missing ipco", ErrMalformed)
+	}
+
+	properties, err := parseBoxes(ipco.data)
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	alpha := false
+
+	for _, p := range properties {
+		if p.typ == "auxC" && strings.Contains(string(p.data), "auxiliary:alpha") {
+			alpha = true
+		}
+	}
+
+	primary := uint32(0)
+	if pitm, ok := findBox(boxes, "pitm"); ok && len(pitm.data) >= 6 {
+		if pitm.data[0] == 0 {
+			primary = uint32(be.Uint16(pitm.data[4:]))
+		} else if len(pitm.data) >= 8 {
+			primary = be.Uint32(pitm.data[4:])
+		}
+	}
+
+	if ipma, ok := findBox(iprpBoxes, "ipma"); ok && primary != 0 {
+		for _, index := range ipmaProperties(ipma.data, primary) {
+			if index == 0 || index > len(properties) {
+				continue
+			}
+
+			if p := properties[index-1]; p.typ == "ispe" && len(p.data) >= 12 {
+				return int(be.Uint32(p.data[4:])), int(be.Uint32(p.data[8:])), alpha, nil
+			}
+		}
+	}
+
+	width, height := 0, 0
+
+	for _, p := range properties {
+		if p.typ != "ispe" || len(p.data) < 12 {
+			continue
+		}
+
+		w, h := int(be.Uint32(p.data[4:])), int(be.Uint32(p.data[8:]))
+		if w*h > width*height {
+			width, height = w, h
+		}
+	}
+
+	return width, height, alpha, nil
+}
+
+// ipmaProperties returns the 1-based property indices associated with the item.
+func ipmaProperties(data []byte, item uint32) []int {
+	if len(data) < 8 {
+		return nil
+	}
+
+	version := data[0]
+	largeIndex := data[3]&1 != 0
+	count := be.Uint32(data[4:])
+	data = data[8:]
+
+	for i := uint32(0); i < count; i++ {
+		var id uint32
+
+		if version < 1 {
+			if len(data) < 3 {
+				return nil
+			}
+
+			id = uint32(be.Uint16(data))
+			data = data[2:]
+		} else {
+			if len(data) < 5 {
+				return nil
+			}
+
+			id = be.Uint32(data)
+			data = data[4:]
+		}
+
+		associations := int(data[0])
+		data = data[1:]
+
+		indices := make([]int, 0, associations)
+
+		for j := 0; j < associations; j++ {
+			if largeIndex {
+				if len(data) < 2 {
+					return nil
+				}
+
+				indices = append(indices, int(be.Uint16(data)&0x7fff))
+				data = data[2:]
+			} else {
+				if len(data) < 1 {
+					return nil
+				}
+
+				indices = append(indices, int(data[0]&0x7f))
+				data = data[1:]
+			}
+		}
+
+		if id == item {
+			return indices
+		}
+	}
+
+	return nil
+}
+
+// avifTracks reads the image sequence tracks in moov. The first track has the colour frames, its tkhd has the
+// dimensions, stsz the frame count and stts the frame durations in the timescale of mdhd. An auxv track holds alpha.
+func avifTracks(moov []byte) (Info, error) {
+	boxes, err := parseBoxes(moov)
+	if err != nil {
+		return Info{}, err
+	}
+
+	info := Info{}
+	first := true
+
+	for _, trak := range boxes {
+		if trak.typ != "trak" {
+			continue
+		}
+
+		trakBoxes, err := parseBoxes(trak.data)
+		if err != nil {
+			return Info{}, err
+		}
+
+		mdia, err := childBoxes(trakBoxes, "mdia")
+		if err != nil {
+			return Info{}, err
+		}
+
+		// hdlr is a full box with a pre defined field before the handler type
+		if hdlr, ok := findBox(mdia, "hdlr"); ok && len(hdlr.data) >= 12 && string(hdlr.data[8:12]) == "auxv" {
+			info.Alpha = true
+			continue
+		}
+
+		if !first {
+			continue
+		}
+
+		first = false
+
+		// the width and height are 16.16 fixed point numbers at the end of tkhd
+		if tkhd, ok := findBox(trakBoxes, "tkhd"); ok && len(tkhd.data) >= 8 {
+			info.Width = int(be.Uint32(tkhd.data[len(tkhd.data)-8:]) >> 16)
+			info.Height = int(be.Uint32(tkhd.data[len(tkhd.data)-4:]) >> 16)
+		}
+
+		// an edit list with the repeat flag loops forever, any other edit list plays once
+		if edts, err := childBoxes(trakBoxes, "edts"); err == nil {
+			if elst, ok := findBox(edts, "elst"); ok && len(elst.data) >= 4 && elst.data[3]&0x01 == 0 {
+				info.LoopCount = 1
+			}
+		}
+
+		timescale := uint32(0)
+		if mdhd, ok := findBox(mdia, "mdhd"); ok && len(mdhd.data) >= 16 {
+			if mdhd.data[0] != 1 {
+				timescale = be.Uint32(mdhd.data[12:])
+			} else if len(mdhd.data) >= 24 {
+				timescale = be.Uint32(mdhd.data[20:])
+			}
+		}
+
+		minf, err := childBoxes(mdia, "minf")
+		if err != nil {
+			return Info{}, err
+		}
+
+		stbl, err := childBoxes(minf, "stbl")
+		if err != nil {
+			return Info{}, err
+		}
+
+		// stsz is a full box with a sample size followed by the sample count
+		if stsz, ok := findBox(stbl, "stsz"); ok && len(stsz.data) >= 12 {
+			info.FrameCount = int(be.Uint32(stsz.data[8:]))
+		}
+
+		// stts is a full box with runs of samples that share a duration
+		if stts, ok := findBox(stbl, "stts"); ok && len(stts.data) >= 8 && timescale != 0 {
+			entries := be.Uint32(stts.data[4:])
+			data := stts.data[8:]
+
+			for i := uint32(0); i < entries && len(data) >= 8 && len(info.Delays) < info.FrameCount; i++ {
+				count := be.Uint32(data)
+				delay := int(math.Round(float64(be.Uint32(data[4:])) * 100 / float64(timescale)))
+
+				for j := uint32(0); j < count && len(info.Delays) < info.FrameCount; j++ {
+					info.Delays = append(info.Delays, delay)
+				}
+
+				data = data[8:]
+			}
+		}
+	}
+
+	return info, nil
+}
+
+// childBoxes returns the children of the first box of the type, a missing box has no children.
+func childBoxes(boxes []box, typ string) ([]box, error) {
+	b, ok := findBox(boxes, typ)
+	if !ok {
+		return nil, nil
+	}
+
+	return parseBoxes(b.data)
+}
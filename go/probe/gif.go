@@ -0,0 +1,159 @@
+package probe
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	gifExtension       = 0x21
+	gifImageDescriptor = 0x2C
+	gifTrailer         = 0x3B
+
+	gifGraphicControlLabel = 0xF9
+	gifApplicationLabel    = 0xFF
+)
+
+// probeGif walks the gif blocks counting image descriptors, the image data itself is skipped without being decompressed.
+func probeGif(r *bufio.Reader) (Info, error) {
+	header := make([]byte, 13)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return Info{}, fmt.Errorf("%w: gif header: %v", ErrMalformed, err)
+	}
+
+	info := Info{
+		Width:  int(le.Uint16(header[6:])),
+		Height: int(le.Uint16(header[8:])),
+		// without a NETSCAPE2.0 extension a gif plays once
+		LoopCount: 1,
+	}
+
+	// the delay of a graphic control extension applies to the next image
+	delay := 0
+
+	if flags := header[10]; flags&0x80 != 0 {
+		if err := skip(r, 3*(1<<((flags&0x07)+1))); err != nil {
+			return Info{}, fmt.Errorf("%w: gif global color table: %v", ErrMalformed, err)
+		}
+	}
+
+	for {
+		block, err := r.ReadByte()
+		if err != nil {
+			// plenty of gifs in the wild are missing the trailer, they decode fine as long as there was a frame
+			if errors.Is(err, io.EOF) && info.FrameCount > 0 {
+				return gifInfo(info), nil
+			}
+
+			return Info{}, fmt.Errorf("%w: gif block: %v", ErrMalformed, err)
+		}
+
+		switch block {
+		case gifExtension:
+			label, err := r.ReadByte()
+			if err != nil {
+				return Info{}, fmt.Errorf("%w: gif extension label: %v", ErrMalformed, err)
+			}
+
+			blocks, err := readGifSubBlocks(r)
+			if err != nil {
+				return Info{}, fmt.Errorf("%w: gif extension: %v", ErrMalformed, err)
+			}
+
+			switch label {
+			case gifGraphicControlLabel:
+				if len(blocks) > 0 && len(blocks[0]) >= 4 {
+					delay = int(le.Uint16(blocks[0][1:]))
+					info.Alpha = info.Alpha || blocks[0][0]&0x01 != 0
+				}
+			case gifApplicationLabel:
+				if len(blocks) > 1 && string(blocks[0]) == "NETSCAPE2.0" && len(blocks[1]) >= 3 && blocks[1][0] == 0x01 {
+					info.LoopCount = int(le.Uint16(blocks[1][1:]))
+				}
+			}
+		case gifImageDescriptor:
+			descriptor := make([]byte, 9)
+			if _, err := io.ReadFull(r, descriptor); err != nil {
+				return Info{}, fmt.Errorf("%w: gif image descriptor: %v", ErrMalformed, err)
+			}
+
+			if flags := descriptor[8]; flags&0x80 != 0 {
+				if err := skip(r, 3*(1<<((flags&0x07)+1))); err != nil {
+					return Info{}, fmt.Errorf("%w: gif local color table: %v", ErrMalformed, err)
+				}
+			}
+
+			// lzw minimum code size
+			if _, err := r.ReadByte(); err != nil {
+				return Info{}, fmt.Errorf("%w: gif image data: %v", ErrMalformed, err)
+			}
+
+			if err := skipGifSubBlocks(r); err != nil {
+				return Info{}, fmt.Errorf("%w: gif image data: %v", ErrMalformed, err)
+			}
+
+			info.FrameCount++
+			info.Delays = append(info.Delays, delay)
+			delay = 0
+		case gifTrailer:
+			return gifInfo(info), nil
+		default:
+			if info.FrameCount > 0 {
+				return gifInfo(info), nil
+			}
+
+			return Info{}, fmt.Errorf("%w: unknown gif block 0x%02x", ErrMalformed, block)
+		}
+	}
+}
+
+// gifInfo drops the delays of still images.
+func gifInfo(info Info) Info {
+	if info.FrameCount == 1 {
+		info.Delays = nil
+	}
+
+	return info
+}
+
+// readGifSubBlocks reads the data sub-blocks of an extension, extensions are small so they are kept in memory.
+func readGifSubBlocks(r *bufio.Reader) ([][]byte, error) {
+	blocks := [][]byte{}
+
+	for {
+		size, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		if size == 0 {
+			return blocks, nil
+		}
+
+		block := make([]byte, size)
+		if _, err := io.ReadFull(r, block); err != nil {
+			return nil, err
+		}
+
+		blocks = append(blocks, block)
+	}
+}
+
+func skipGifSubBlocks(r *bufio.Reader) error {
+	for {
+		size, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+
+		if size == 0 {
+			return nil
+		}
+
+		if err := skip(r, int64(size)); err != nil {
+			return err
+		}
+	}
+}
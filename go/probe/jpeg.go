@@ -0,0 +1,21 @@
+package probe
+
+import (
+	"bufio"
+	"fmt"
+	"image/jpeg"
+)
+
+// probeJpeg uses the standard library which only reads the markers up to the start of frame.
+func probeJpeg(r *bufio.Reader) (Info, error) {
+	cfg, err := jpeg.DecodeConfig(r)
+	if err != nil {
+		return Info{}, fmt.Errorf("%w: jpeg: %v", ErrMalformed, err)
+	}
+
+	return Info{
+		Width:      cfg.Width,
+		Height:     cfg.Height,
+		FrameCount: 1,
+	}, nil
+}
@@ -0,0 +1,108 @@
+package probe
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// probePng walks the chunks, IHDR has the dimensions, acTL the frame and play count of animated pngs
+// and every fcTL the delay of a frame. The image data chunks are skipped without being decompressed.
+func probePng(r *bufio.Reader) (Info, error) {
+	if err := skip(r, 8); err != nil {
+		return Info{}, fmt.Errorf("%w: png signature: %v", ErrMalformed, err)
+	}
+
+	info := Info{FrameCount: 1}
+	chunk := make([]byte, 8)
+	animated := false
+
+	for {
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			// a missing IEND is tolerated by most decoders
+			if errors.Is(err, io.EOF) && info.Width != 0 {
+				break
+			}
+
+			return Info{}, fmt.Errorf("%w: png chunk: %v", ErrMalformed, err)
+		}
+
+		length := int64(be.Uint32(chunk))
+		typ := string(chunk[4:])
+
+		var data []byte
+
+		switch typ {
+		case "IHDR", "acTL", "fcTL":
+			if length > 64 {
+				return Info{}, fmt.Errorf("%w: png %s is %d bytes", ErrMalformed, typ, length)
+			}
+
+			data = make([]byte, length)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return Info{}, fmt.Errorf("%w: png %s: %v", ErrMalformed, typ, err)
+			}
+
+			length = 0
+		}
+
+		switch typ {
+		case "IHDR":
+			if len(data) < 10 {
+				return Info{}, fmt.Errorf("%w: png IHDR is %d bytes", ErrMalformed, len(data))
+			}
+
+			info.Width = int(be.Uint32(data))
+			info.Height = int(be.Uint32(data[4:]))
+			// greyscale with alpha and truecolor with alpha
+			info.Alpha = data[9] == 4 || data[9] == 6
+		case "tRNS":
+			info.Alpha = true
+		case "acTL":
+			if len(data) < 8 {
+				return Info{}, fmt.Errorf("%w: png acTL is %d bytes", ErrMalformed, len(data))
+			}
+
+			animated = true
+			info.FrameCount = int(be.Uint32(data))
+			info.LoopCount = int(be.Uint32(data[4:]))
+		case "fcTL":
+			if len(data) < 26 {
+				return Info{}, fmt.Errorf("%w: png fcTL is %d bytes", ErrMalformed, len(data))
+			}
+
+			numerator := float64(be.Uint16(data[20:]))
+			denominator := float64(be.Uint16(data[22:]))
+
+			// a denominator of 0 means 100ths of a second
+			if denominator == 0 {
+				denominator = 100
+			}
+
+			info.Delays = append(info.Delays, int(math.Round(numerator*100/denominator)))
+		}
+
+		if typ == "IEND" {
+			break
+		}
+
+		// the rest of the chunk and its crc
+		if err := skip(r, length+4); err != nil {
+			return Info{}, fmt.Errorf("%w: png %s: %v", ErrMalformed, typ, err)
+		}
+	}
+
+	if info.Width == 0 || info.Height == 0 {
+		return Info{}, fmt.Errorf("%w: png is missing IHDR", ErrMalformed)
+	}
+
+	if !animated || info.FrameCount <= 1 {
+		info.FrameCount = 1
+		info.Delays = nil
+		info.LoopCount = 0
+	}
+
+	return info, nil
+}
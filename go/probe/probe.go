@@ -0,0 +1,71 @@
+// Package probe reads image metadata from container headers without decoding any frames,
+// so that limits can be checked before a file is handed to a decoder.
+package probe
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/h2non/filetype/matchers"
+	"github.com/seventv/image-processor/go/container"
+)
+
+var (
+	ErrUnsupported = errors.New("unsupported format")
+	ErrMalformed   = errors.New("malformed file")
+)
+
+type Info struct {
+	Width      int
+	Height     int
+	FrameCount int
+	// Delays has the duration of each frame in 100ths of a second, it is nil for still images.
+	Delays []int
+	// LoopCount is the number of times an animation loops as stored in the file, 0 means it loops forever.
+	LoopCount int
+	Alpha     bool
+}
+
+// Probe reads the headers of a gif, png, webp, avif or jpeg file.
+func Probe(r io.Reader) (Info, error) {
+	br := bufio.NewReader(r)
+
+	// filetype needs at most 262 bytes to match a type, a shorter file returns fewer bytes which is fine
+	head, _ := br.Peek(262)
+
+	switch container.Match(head) {
+	case matchers.TypeGif:
+		return probeGif(br)
+	case matchers.TypePng:
+		return probePng(br)
+	case matchers.TypeWebp:
+		return probeWebp(br)
+	case container.TypeAvif:
+		return probeAvif(br)
+	case matchers.TypeJpeg:
+		return probeJpeg(br)
+	}
+
+	return Info{}, ErrUnsupported
+}
+
+// skip discards n bytes from the reader.
+func skip(r io.Reader, n int64) error {
+	if n <= 0 {
+		return nil
+	}
+
+	copied, err := io.CopyN(io.Discard, r, n)
+	if err == io.EOF || copied != n {
+		return io.ErrUnexpectedEOF
+	}
+
+	return err
+}
+
+var (
+	be = binary.BigEndian
+	le = binary.LittleEndian
+)
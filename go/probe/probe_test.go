@@ -0,0 +1,112 @@
+package probe
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path"
+	"runtime"
+	"testing"
+
+	"github.com/seventv/image-processor/go/internal/testutil"
+)
+
+type testCase struct {
+	Filename string
+	Data     []byte
+	Expected Info
+}
+
+func makeCase(t *testing.T, filename string, expected Info) testCase {
+	_, cwd, _, _ := runtime.Caller(0)
+	file := path.Join(path.Dir(cwd), "..", "..", "assets", filename)
+
+	return testCase{
+		Filename: filename,
+		Data:     testutil.ReadFile(t, file),
+		Expected: expected,
+	}
+}
+
+func TestProbe(t *testing.T) {
+	t.Parallel()
+
+	cases := []testCase{
+		makeCase(t, "animated-1.avif", Info{Width: 110, Height: 128, FrameCount: 2, Delays: []int{4, 4}, Alpha: true}),
+		makeCase(t, "animated-1.gif", Info{Width: 112, Height: 112, FrameCount: 5, Delays: []int{6, 6, 6, 6, 6}, Alpha: true}),
+		makeCase(t, "animated-1.png", Info{Width: 228, Height: 128, FrameCount: 23, Delays: repeat(6, 23), Alpha: true}),
+		makeCase(t, "animated-1.webp", Info{Width: 96, Height: 96, FrameCount: 11, Delays: []int{16, 12, 8, 4, 8, 8, 12, 12, 8, 8, 4}, Alpha: true}),
+		makeCase(t, "animated-2.gif", Info{Width: 112, Height: 112, FrameCount: 41, Delays: repeat(8, 41), Alpha: true}),
+		makeCase(t, "animated-2.webp", Info{Width: 128, Height: 128, FrameCount: 157, Alpha: true}),
+		makeCase(t, "animated-3.gif", Info{Width: 112, Height: 112, FrameCount: 158, Delays: repeat(4, 158), Alpha: true}),
+		makeCase(t, "animated-3.webp", Info{Width: 134, Height: 127, FrameCount: 8, Delays: repeat(75, 8), Alpha: true}),
+		makeCase(t, "animated-4.gif", Info{Width: 500, Height: 500, FrameCount: 17, Delays: repeat(50, 17), Alpha: true}),
+		makeCase(t, "animated-5.gif", Info{Width: 112, Height: 112, FrameCount: 8, Delays: []int{20, 0, 0, 0, 20, 0, 0, 0}, Alpha: true}),
+		makeCase(t, "static-1.avif", Info{Width: 768, Height: 512, FrameCount: 1}),
+		makeCase(t, "static-1.jpeg", Info{Width: 640, Height: 492, FrameCount: 1}),
+		makeCase(t, "static-1.png", Info{Width: 128, Height: 128, FrameCount: 1, Alpha: true}),
+		makeCase(t, "static-1.webp", Info{Width: 128, Height: 127, FrameCount: 1, Alpha: true}),
+		makeCase(t, "static-2.avif", Info{Width: 154, Height: 128, FrameCount: 1, Alpha: true}),
+		makeCase(t, "static-2.png", Info{Width: 2000, Height: 100, FrameCount: 1}),
+		makeCase(t, "static-2.webp", Info{Width: 640, Height: 492, FrameCount: 1}),
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.Filename, func(t *testing.T) {
+			t.Parallel()
+
+			info, err := Probe(bytes.NewReader(c.Data))
+			testutil.IsNil(t, err, "probe successful")
+			testutil.Assert(t, c.Expected.Width, info.Width, "width")
+			testutil.Assert(t, c.Expected.Height, info.Height, "height")
+			testutil.Assert(t, c.Expected.FrameCount, info.FrameCount, "frame count")
+			testutil.Assert(t, c.Expected.LoopCount, info.LoopCount, "loop count")
+			testutil.Assert(t, c.Expected.Alpha, info.Alpha, "alpha")
+
+			if c.Expected.FrameCount > 1 {
+				testutil.Assert(t, c.Expected.FrameCount, len(info.Delays), "delay count")
+			} else {
+				testutil.Assert(t, 0, len(info.Delays), "still images have no delays")
+			}
+
+			for i, delay := range c.Expected.Delays {
+				testutil.Assert(t, delay, info.Delays[i], fmt.Sprintf("delay %d", i))
+			}
+		})
+	}
+}
+
+func repeat(delay int, count int) []int {
+	delays := make([]int, count)
+	for i := range delays {
+		delays[i] = delay
+	}
+
+	return delays
+}
+
+func TestProbeUnsupported(t *testing.T) {
+	t.Parallel()
+
+	for _, c := range []testCase{
+		makeCase(t, "animated.mp4", Info{}),
+		makeCase(t, "static-1.tiff", Info{}),
+	} {
+		_, err := Probe(bytes.NewReader(c.Data))
+		testutil.Assert(t, true, errors.Is(err, ErrUnsupported), c.Filename)
+	}
+}
+
+func TestProbeTruncated(t *testing.T) {
+	t.Parallel()
+
+	for _, c := range []testCase{
+		makeCase(t, "animated-1.avif", Info{}),
+		makeCase(t, "static-1.png", Info{}),
+		makeCase(t, "animated-1.webp", Info{}),
+	} {
+		_, err := Probe(bytes.NewReader(c.Data[:40]))
+		testutil.Assert(t, true, errors.Is(err, ErrMalformed), c.Filename)
+	}
+}
@@ -0,0 +1,140 @@
+package probe
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// probeWebp walks the RIFF chunks, the canvas size comes from VP8X for extended files or from the bitstream header
+// for simple files, ANIM has the loop count and every ANMF chunk is a frame with its duration.
+func probeWebp(r *bufio.Reader) (Info, error) {
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return Info{}, fmt.Errorf("%w: webp header: %v", ErrMalformed, err)
+	}
+
+	info := Info{}
+	extended := false
+	bitstream := false
+	chunk := make([]byte, 8)
+
+	for {
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			if errors.Is(err, io.EOF) && info.Width != 0 {
+				break
+			}
+
+			return Info{}, fmt.Errorf("%w: webp chunk: %v", ErrMalformed, err)
+		}
+
+		length := int64(le.Uint32(chunk[4:]))
+		padded := length + length&1
+
+		switch string(chunk[:4]) {
+		case "VP8X":
+			data := make([]byte, 10)
+			if length < 10 {
+				return Info{}, fmt.Errorf("%w: webp VP8X is %d bytes", ErrMalformed, length)
+			}
+
+			if _, err := io.ReadFull(r, data); err != nil {
+				return Info{}, fmt.Errorf("%w: webp VP8X: %v", ErrMalformed, err)
+			}
+
+			extended = true
+			info.Alpha = data[0]&0x10 != 0
+			info.Width = int(uint24(data[4:])) + 1
+			info.Height = int(uint24(data[7:])) + 1
+			padded -= 10
+		case "VP8 ":
+			data := make([]byte, 10)
+			if length < 10 {
+				return Info{}, fmt.Errorf("%w: webp VP8 is %d bytes", ErrMalformed, length)
+			}
+
+			if _, err := io.ReadFull(r, data); err != nil {
+				return Info{}, fmt.Errorf("%w: webp VP8: %v", ErrMalformed, err)
+			}
+
+			if !extended {
+				info.Width = int(le.Uint16(data[6:]) & 0x3fff)
+				info.Height = int(le.Uint16(data[8:]) & 0x3fff)
+			}
+
+			bitstream = true
+
+			padded -= 10
+		case "VP8L":
+			data := make([]byte, 5)
+			if length < 5 {
+				return Info{}, fmt.Errorf("%w: webp VP8L is %d bytes", ErrMalformed, length)
+			}
+
+			if _, err := io.ReadFull(r, data); err != nil {
+				return Info{}, fmt.Errorf("%w: webp VP8L: %v", ErrMalformed, err)
+			}
+
+			if !extended {
+				bits := le.Uint32(data[1:])
+				info.Width = int(bits&0x3fff) + 1
+				info.Height = int((bits>>14)&0x3fff) + 1
+				info.Alpha = bits&(1<<28) != 0
+			}
+
+			bitstream = true
+
+			padded -= 5
+		case "ANIM":
+			data := make([]byte, 6)
+			if length < 6 {
+				return Info{}, fmt.Errorf("%w: webp ANIM is %d bytes", ErrMalformed, length)
+			}
+
+			if _, err := io.ReadFull(r, data); err != nil {
+				return Info{}, fmt.Errorf("%w: webp ANIM: %v", ErrMalformed, err)
+			}
+
+			info.LoopCount = int(le.Uint16(data[4:]))
+			padded -= 6
+		case "ANMF":
+			data := make([]byte, 16)
+			if length < 16 {
+				return Info{}, fmt.Errorf("%w: webp ANMF is %d bytes", ErrMalformed, length)
+			}
+
+			if _, err := io.ReadFull(r, data); err != nil {
+				return Info{}, fmt.Errorf("%w: webp ANMF: %v", ErrMalformed, err)
+			}
+
+			// the duration is in milliseconds
+			info.FrameCount++
+			info.Delays = append(info.Delays, int(uint24(data[12:]))/10)
+			padded -= 16
+		}
+
+		if err := skip(r, padded); err != nil {
+			return Info{}, fmt.Errorf("%w: webp chunk: %v", ErrMalformed, err)
+		}
+	}
+
+	// a still image has a single bitstream chunk and no ANMF chunks
+	if info.FrameCount == 0 && bitstream {
+		info.FrameCount = 1
+	}
+
+	if info.FrameCount == 0 {
+		return Info{}, fmt.Errorf("%w: webp has no frames", ErrMalformed)
+	}
+
+	if info.FrameCount == 1 {
+		info.Delays = nil
+	}
+
+	return info, nil
+}
+
+func uint24(b []byte) uint32 {
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+}
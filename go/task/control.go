@@ -0,0 +1,14 @@
+package task
+
+type ControlType string
+
+const (
+	// ControlTypeCancel stops the task with the id, or skips it when it was not started yet
+	ControlTypeCancel ControlType = "cancel"
+)
+
+// Control is a message of the control queue of the workers.
+type Control struct {
+	Type ControlType `json:"type"`
+	ID   string      `json:"id"`
+}
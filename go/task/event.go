@@ -0,0 +1,44 @@
+package task
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// EventType tells the messages published for a task apart from its Result, which has no type.
+type EventType string
+
+const (
+	EventTypeProgress EventType = "progress"
+)
+
+// EventStage is a step of processing a task, streamed tasks decode and resize their frames in the stream stage
+// instead of the export and resize stages.
+type EventStage string
+
+const (
+	EventStageDownload    EventStage = "download"
+	EventStageStream      EventStage = "stream"
+	EventStageExport      EventStage = "export"
+	EventStageResize      EventStage = "resize"
+	EventStageMakeResults EventStage = "make_results"
+	EventStageUpload      EventStage = "upload"
+)
+
+type EventState string
+
+const (
+	EventStateStarted  EventState = "started"
+	EventStateFinished EventState = "finished"
+)
+
+// Event is the progress of a task, published while it is processed and before its Result.
+type Event struct {
+	Type       EventType       `json:"type"`
+	ID         string          `json:"id"`
+	Stage      EventStage      `json:"stage"`
+	State      EventState      `json:"state"`
+	FrameCount int             `json:"frame_count,omitempty"`
+	Timestamp  time.Time       `json:"timestamp"`
+	Metadata   json.RawMessage `json:"metadata"`
+}
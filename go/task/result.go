@@ -12,6 +12,7 @@ const (
 	_ ResultState = iota
 	ResultStateSuccess
 	ResultStateFailed
+	ResultStateCancelled
 )
 
 func (r ResultState) String() string {
@@ -20,26 +21,88 @@ func (r ResultState) String() string {
 		return "SUCCESS"
 	case ResultStateFailed:
 		return "FAILED"
+	case ResultStateCancelled:
+		return "CANCELLED"
 	default:
 		return fmt.Sprintf("UNKNOWN TYPE %d", r)
 	}
 }
 
+// ResultError is a machine readable reason for a failed task, callers can act on it without parsing Message.
+type ResultError string
+
+const (
+	ResultErrorNone               ResultError = ""
+	ResultErrorInputTooLarge      ResultError = "INPUT_TOO_LARGE"
+	ResultErrorTooManyFrames      ResultError = "TOO_MANY_FRAMES"
+	ResultErrorTooManyPixels      ResultError = "TOO_MANY_PIXELS"
+	ResultErrorDimensionsTooLarge ResultError = "DIMENSIONS_TOO_LARGE"
+	ResultErrorDimensionsTooSmall ResultError = "DIMENSIONS_TOO_SMALL"
+	ResultErrorAspectRatio        ResultError = "ASPECT_RATIO"
+	ResultErrorInputBlocked       ResultError = "INPUT_BLOCKED"
+	ResultErrorReplicaQuorum      ResultError = "REPLICA_QUORUM"
+)
+
+// ResultReuse is where the outputs of a reused result came from.
+type ResultReuse string
+
+const (
+	ResultReuseNone ResultReuse = ""
+	// ResultReuseManifest outputs are the ones an earlier run of an idempotent task wrote to the same keys
+	ResultReuseManifest ResultReuse = "MANIFEST"
+	// ResultReuseCache outputs are copies of the ones of an earlier task with the same input and options
+	ResultReuseCache ResultReuse = "CACHE"
+)
+
 type Result struct {
 	ID            string          `json:"id"`
 	StartedAt     time.Time       `json:"started_at"`
 	FinishedAt    time.Time       `json:"finished_at"`
 	State         ResultState     `json:"state"`
 	Message       string          `json:"message"`
+	Error         ResultError     `json:"error,omitempty"`
 	ImageInput    ResultFile      `json:"image_input"`
 	ImageOutputs  []ResultFile    `json:"image_outputs"`
 	ArchiveOutput ResultFile      `json:"archive_output"`
 	Metadata      json.RawMessage `json:"metadata"`
+
+	SkippedOutputs []ResultSkippedFile `json:"skipped_outputs,omitempty"`
+
+	// Replicas are the statuses of the replicas of the outputs in the order of the task
+	Replicas []ResultReplica `json:"replicas,omitempty"`
+
+	// Reused is set when the outputs of an earlier task with the same input and parameters were returned instead
+	Reused     bool        `json:"reused,omitempty"`
+	ReusedFrom ResultReuse `json:"reused_from,omitempty"`
+}
+
+// ResultSkippedFile is an output which was not uploaded and the reason why.
+type ResultSkippedFile struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+// ResultReplica is where a replica of the outputs was written, Error is set when any of them was not.
+type ResultReplica struct {
+	Bucket  string       `json:"bucket"`
+	Prefix  string       `json:"prefix"`
+	Profile string       `json:"profile,omitempty"`
+	Success bool         `json:"success"`
+	Error   string       `json:"error,omitempty"`
+	Outputs []ResultFile `json:"outputs"`
+}
+
+// ResultEncoding describes the encoder settings an output was produced with.
+type ResultEncoding struct {
+	Quality   int `json:"quality"`
+	Colors    int `json:"colors,omitempty"`
+	FrameStep int `json:"frame_step,omitempty"`
 }
 
 type ResultFile struct {
 	Name         string `json:"name"`
 	SHA3         string `json:"sha3"`
+	SHA256       string `json:"sha256"`
 	ContentType  string `json:"content_type"`
 	Size         int    `json:"size"`
 	Key          string `json:"key"`
@@ -50,4 +113,7 @@ type ResultFile struct {
 	FrameCount int `json:"frame_count,omitempty"`
 	Width      int `json:"width,omitempty"`
 	Height     int `json:"height,omitempty"`
+
+	Encoding     *ResultEncoding `json:"encoding,omitempty"`
+	NonPreferred bool            `json:"non_preferred,omitempty"`
 }
@@ -41,18 +41,59 @@ type Task struct {
 	Scales            []int           `json:"scales"` // 1, 2, 3, 4 for 1x, 2x, 3x, 4x
 	Limits            TaskLimits      `json:"limits"`
 	Metadata          json.RawMessage `json:"metadata"`
+	// CallbackURL receives the result as a json POST, alongside the reply queue of the message when it has one
+	CallbackURL string `json:"callback_url"`
+	// ProgressEvents publishes the progress of the task to the reply queue of the message before the result,
+	// the events queue of the worker receives them either way
+	ProgressEvents bool `json:"progress_events"`
 }
 
 type TaskLimits struct {
-	MaxProcessingTime time.Duration `json:"max_processing_time"`
-	MaxFrameCount     int           `json:"max_frame_count"`
-	MaxWidth          int           `json:"max_width"`
-	MaxHeight         int           `json:"max_height"`
+	MaxProcessingTime time.Duration         `json:"max_processing_time"`
+	MaxFrameCount     int                   `json:"max_frame_count"`
+	MaxWidth          int                   `json:"max_width"`
+	MaxHeight         int                   `json:"max_height"`
+	MinWidth          int                   `json:"min_width"`
+	MinHeight         int                   `json:"min_height"`
+	MinAspectRatio    float64               `json:"min_aspect_ratio"` // width / height
+	MaxAspectRatio    float64               `json:"max_aspect_ratio"` // width / height
+	MaxInputBytes     int64                 `json:"max_input_bytes"`
+	MaxTotalPixels    int64                 `json:"max_total_pixels"` // width * height * frames
+	MaxOutputSizes    []TaskOutputSizeLimit `json:"max_output_sizes"`
+}
+
+// TaskOutputSizeLimit is a byte budget for outputs, an empty Format or a zero Scale matches every format or scale.
+type TaskOutputSizeLimit struct {
+	Format   string `json:"format"` // avif, webp, gif or png
+	Scale    int    `json:"scale"`
+	MaxBytes int    `json:"max_bytes"`
+}
+
+// MaxOutputBytes returns the smallest byte budget that applies to the output, 0 means there is no budget.
+func (l TaskLimits) MaxOutputBytes(format string, scale int) int {
+	max := 0
+
+	for _, limit := range l.MaxOutputSizes {
+		if limit.MaxBytes <= 0 || (limit.Format != "" && limit.Format != format) || (limit.Scale != 0 && limit.Scale != scale) {
+			continue
+		}
+
+		if max == 0 || limit.MaxBytes < max {
+			max = limit.MaxBytes
+		}
+	}
+
+	return max
 }
 
 type TaskInput struct {
-	Bucket   string            `json:"bucket"`
-	Key      string            `json:"key"`
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	// URL is downloaded over http or https instead of Bucket and Key when it is set
+	URL string `json:"url"`
+	// Data is the input itself, base64 in json, for small images which do not need a round trip through s3.
+	// It is used before URL, Bucket and Key when it is set.
+	Data     []byte            `json:"data,omitempty"`
 	Reupload TaskInputReupload `json:"reupload"`
 }
 
@@ -65,8 +106,144 @@ type TaskInputReupload struct {
 }
 
 type TaskOutput struct {
+	Prefix       string           `json:"prefix"`
+	ACL          string           `json:"acl"`
+	Bucket       string           `json:"bucket"`
+	CacheControl string           `json:"cache_control"`
+	SizePolicy   OutputSizePolicy `json:"size_policy"`
+	// Idempotent stores a manifest of the result under Prefix, a later task for the same input and parameters returns it instead of processing again
+	Idempotent bool `json:"idempotent"`
+	// KeyTemplate lays out the keys of the outputs, e.g. "emote/{id}/{scale}x.{ext}" or "{sha3}.{ext}".
+	// The placeholders are {id}, {prefix}, {name} (2x_static), {scale}, {ext} or {format}, {static} ("_static" or empty),
+	// {kind} (static, animated or archive), {input_sha3} and {sha3}. An empty template stores the outputs under Prefix by their name.
+	KeyTemplate string `json:"key_template"`
+	// ContentDisposition, Metadata and Tags are set on every output object
+	ContentDisposition string            `json:"content_disposition"`
+	Metadata           map[string]string `json:"metadata"`
+	Tags               map[string]string `json:"tags"`
+	// Overrides change where and how the outputs of a format or scale are stored, later overrides win
+	Overrides []TaskOutputOverride `json:"overrides"`
+	Archive   TaskOutputArchive    `json:"archive"`
+	// Replicas are other destinations the outputs are written to in the same pass
+	Replicas []TaskOutputReplica `json:"replicas"`
+	// Quorum is how many destinations, the outputs themselves included, have to be written for the task to succeed.
+	// The outputs themselves always have to be written, 0 means every destination.
+	Quorum int `json:"quorum"`
+}
+
+// TaskOutputReplica is another destination of the outputs, empty fields keep the options of the output.
+// Profile is the name of the storage profile of the worker the replica is written to, empty is the default storage.
+type TaskOutputReplica struct {
+	Bucket       string `json:"bucket"`
 	Prefix       string `json:"prefix"`
 	ACL          string `json:"acl"`
-	Bucket       string `json:"bucket"`
 	CacheControl string `json:"cache_control"`
+	Profile      string `json:"profile"`
 }
+
+// TaskOutputArchive decides what is stored in the archive of the outputs and how it is packed.
+type TaskOutputArchive struct {
+	Contents ArchiveContents `json:"contents"`
+	Format   ArchiveFormat   `json:"format"`
+}
+
+// ArchiveContents decides which files are put in the archive, a manifest.json describing the entries is always added.
+type ArchiveContents int32
+
+const (
+	ArchiveContentsAll     ArchiveContents = iota // the outputs and the resized frames
+	ArchiveContentsNone                           // no archive is made
+	ArchiveContentsResults                        // only the outputs
+	ArchiveContentsFrames                         // only the resized frames
+)
+
+type ArchiveFormat int32
+
+const (
+	ArchiveFormatZip     ArchiveFormat = iota // archive.zip
+	ArchiveFormatTarZstd                      // archive.tar.zst
+)
+
+// TaskOutputOverride replaces the storage options of matching outputs, an empty Format or a zero Scale matches every format or scale.
+// Empty fields keep the options of the output, metadata and tags are merged.
+type TaskOutputOverride struct {
+	Format             string            `json:"format"` // avif, webp, gif, png or zip or tar.zst for the archive
+	Scale              int               `json:"scale"`
+	Bucket             string            `json:"bucket"`
+	ACL                string            `json:"acl"`
+	CacheControl       string            `json:"cache_control"`
+	ContentDisposition string            `json:"content_disposition"`
+	Metadata           map[string]string `json:"metadata"`
+	Tags               map[string]string `json:"tags"`
+}
+
+// TaskOutputStorage is where and how an output is stored.
+type TaskOutputStorage struct {
+	Bucket             string
+	ACL                string
+	CacheControl       string
+	ContentDisposition string
+	Metadata           map[string]string
+	Tags               map[string]string
+}
+
+// Storage returns the storage options of an output after applying the overrides that match it, the archive has the format zip and scale 0.
+func (o TaskOutput) Storage(format string, scale int) TaskOutputStorage {
+	s := TaskOutputStorage{
+		Bucket:             o.Bucket,
+		ACL:                o.ACL,
+		CacheControl:       o.CacheControl,
+		ContentDisposition: o.ContentDisposition,
+		Metadata:           map[string]string{},
+		Tags:               map[string]string{},
+	}
+
+	for k, v := range o.Metadata {
+		s.Metadata[k] = v
+	}
+
+	for k, v := range o.Tags {
+		s.Tags[k] = v
+	}
+
+	for _, override := range o.Overrides {
+		if (override.Format != "" && override.Format != format) || (override.Scale != 0 && override.Scale != scale) {
+			continue
+		}
+
+		if override.Bucket != "" {
+			s.Bucket = override.Bucket
+		}
+
+		if override.ACL != "" {
+			s.ACL = override.ACL
+		}
+
+		if override.CacheControl != "" {
+			s.CacheControl = override.CacheControl
+		}
+
+		if override.ContentDisposition != "" {
+			s.ContentDisposition = override.ContentDisposition
+		}
+
+		for k, v := range override.Metadata {
+			s.Metadata[k] = v
+		}
+
+		for k, v := range override.Tags {
+			s.Tags[k] = v
+		}
+	}
+
+	return s
+}
+
+// OutputSizePolicy decides what happens to an output which is larger than a more widely supported output of the same scale.
+type OutputSizePolicy int32
+
+const (
+	OutputSizePolicyKeep OutputSizePolicy = iota
+	OutputSizePolicyMark
+	OutputSizePolicyDrop
+)